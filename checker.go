@@ -0,0 +1,250 @@
+package hostpool
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// HealthChecker probes a host outside of real traffic. Check returns nil if
+// the host is healthy; the context bounds how long it may take.
+type HealthChecker interface {
+	Check(ctx context.Context, host string) error
+}
+
+// HealthCheckerFunc lets an ordinary function be used as a HealthChecker
+type HealthCheckerFunc func(ctx context.Context, host string) error
+
+func (f HealthCheckerFunc) Check(ctx context.Context, host string) error {
+	return f(ctx, host)
+}
+
+// Warmup checks every host in p probes times with checker before it takes
+// real traffic, and marks the pool with the results and how long they took,
+// as MarkBatch does. An epsilon greedy pool warmed up this way starts out
+// scoring hosts on their probe latencies, rather than exploring at random
+// against production requests; hosts that fail their probes start out dead.
+//
+// Hosts are probed concurrently, each host's probes one after another. Warmup
+// returns when all the probes are done, or with ctx.Err() if ctx is done
+// first; probes cut short by ctx are marked with its error, which by default
+// says nothing about the host.
+func Warmup(ctx context.Context, p HostPool, checker HealthChecker, probes int) error {
+	var wg sync.WaitGroup
+	for _, host := range p.Hosts() {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			outcomes := make([]Outcome, 0, probes)
+			for i := 0; i < probes && ctx.Err() == nil; i++ {
+				start := time.Now()
+				err := checker.Check(ctx, host)
+				outcomes = append(outcomes, Outcome{Err: err, Duration: time.Since(start)})
+			}
+			p.MarkBatch(host, outcomes)
+		}(host)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// ScheduleConfig configures a Scheduler
+type ScheduleConfig struct {
+	// Interval is how often each host is checked (0 uses a default of 10
+	// seconds). First checks are spread evenly over it, so that starting up
+	// doesn't check every host at once.
+	Interval time.Duration
+	// Jitter moves each check by up to this fraction of its interval either
+	// way, at random, so checks from many clients don't line up
+	Jitter float64
+	// Concurrency is how many checks may run at once (0 uses a default of
+	// 10). Checks that come due while it's reached wait their turn.
+	Concurrency int
+	// MaxInterval caps how far checks of a failing host back off: the
+	// interval doubles with each failed check in a row, up to MaxInterval
+	// (0 uses 8 times Interval), and goes back to Interval once it passes
+	MaxInterval time.Duration
+}
+
+const (
+	defaultCheckInterval    = 10 * time.Second
+	defaultCheckConcurrency = 10
+)
+
+// Scheduler checks the hosts of a pool in the background, marking them with
+// MarkHostSuccess and MarkHostFailure. Hosts added to the pool are picked up
+// and removed ones dropped as they come due.
+type Scheduler struct {
+	pool    HostPool
+	checker HealthChecker
+	config  ScheduleConfig
+
+	added     chan string
+	results   chan checkResult
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+type checkEntry struct {
+	host     string
+	next     time.Time
+	failures uint
+}
+
+type checkResult struct {
+	entry *checkEntry
+	err   error
+}
+
+// NewScheduler starts checking the hosts in pool with checker
+func NewScheduler(pool HostPool, checker HealthChecker, c ScheduleConfig) *Scheduler {
+	if c.Interval <= 0 {
+		c.Interval = defaultCheckInterval
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = defaultCheckConcurrency
+	}
+	if c.MaxInterval < c.Interval {
+		c.MaxInterval = 8 * c.Interval
+	}
+	if c.Jitter < 0 {
+		c.Jitter = 0
+	} else if c.Jitter > 1 {
+		c.Jitter = 1
+	}
+	s := &Scheduler{
+		pool:    pool,
+		checker: checker,
+		config:  c,
+		added:   make(chan string, 16),
+		results: make(chan checkResult, c.Concurrency),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	pool.AddHooks(HostHooks{OnHostAdded: s.hostAdded})
+	go s.run(pool.Hosts())
+	return s
+}
+
+func (s *Scheduler) hostAdded(host string) {
+	select {
+	case s.added <- host:
+	case <-s.done:
+	}
+}
+
+// Close stops the checks, and waits for any that are running to finish
+func (s *Scheduler) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	<-s.stopped
+}
+
+func (s *Scheduler) run(hosts []string) {
+	defer close(s.stopped)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var due checkHeap
+	scheduled := make(map[string]bool, len(hosts))
+	now := time.Now()
+	for i, host := range hosts {
+		scheduled[host] = true
+		offset := s.config.Interval * time.Duration(i) / time.Duration(len(hosts))
+		heap.Push(&due, &checkEntry{host: host, next: now.Add(offset)})
+	}
+
+	running := 0
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now = time.Now()
+		for running < s.config.Concurrency && len(due) > 0 && !due[0].next.After(now) {
+			e := heap.Pop(&due).(*checkEntry)
+			if _, ok := s.pool.HostStatistics(e.host); !ok {
+				delete(scheduled, e.host)
+				continue
+			}
+			running++
+			go func() {
+				s.results <- checkResult{entry: e, err: s.checker.Check(ctx, e.host)}
+			}()
+		}
+
+		var wakeup <-chan time.Time
+		if running < s.config.Concurrency && len(due) > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(due[0].next.Sub(now))
+			wakeup = timer.C
+		}
+		select {
+		case <-wakeup:
+		case host := <-s.added:
+			if !scheduled[host] {
+				scheduled[host] = true
+				offset := time.Duration(rand.Int63n(int64(s.config.Interval)))
+				heap.Push(&due, &checkEntry{host: host, next: time.Now().Add(offset)})
+			}
+		case r := <-s.results:
+			running--
+			s.finished(r)
+			heap.Push(&due, r.entry)
+		case <-s.done:
+			cancel()
+			for ; running > 0; running-- {
+				<-s.results
+			}
+			return
+		}
+	}
+}
+
+// finished marks the pool with the result of a check, and works out when the
+// host is next due
+func (s *Scheduler) finished(r checkResult) {
+	e := r.entry
+	interval := s.config.Interval
+	if r.err == nil {
+		e.failures = 0
+		s.pool.MarkHostSuccess(e.host)
+	} else {
+		e.failures++
+		s.pool.MarkHostFailure(e.host, r.err)
+		for i := uint(0); i < e.failures && interval < s.config.MaxInterval; i++ {
+			interval *= 2
+		}
+		if interval > s.config.MaxInterval {
+			interval = s.config.MaxInterval
+		}
+	}
+	if s.config.Jitter > 0 {
+		interval += time.Duration(s.config.Jitter * (2*rand.Float64() - 1) * float64(interval))
+	}
+	e.next = time.Now().Add(interval)
+}
+
+// checkHeap orders entries by when they're next due
+type checkHeap []*checkEntry
+
+func (h checkHeap) Len() int           { return len(h) }
+func (h checkHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h checkHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *checkHeap) Push(x interface{}) {
+	*h = append(*h, x.(*checkEntry))
+}
+
+func (h *checkHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
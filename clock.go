@@ -0,0 +1,91 @@
+package hostpool
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// coarseClock holds the time as of its last tick. Pools asking for the same
+// resolution share one clock, which stops once no pool uses it.
+type coarseClock struct {
+	nanos      int64 // accessed atomically
+	resolution time.Duration
+	refs       int
+	quit       chan struct{}
+}
+
+var coarseClocks = struct {
+	sync.Mutex
+	byResolution map[time.Duration]*coarseClock
+}{byResolution: make(map[time.Duration]*coarseClock)}
+
+func acquireCoarseClock(resolution time.Duration) *coarseClock {
+	coarseClocks.Lock()
+	defer coarseClocks.Unlock()
+	c, ok := coarseClocks.byResolution[resolution]
+	if !ok {
+		c = &coarseClock{
+			nanos:      time.Now().UnixNano(),
+			resolution: resolution,
+			quit:       make(chan struct{}),
+		}
+		coarseClocks.byResolution[resolution] = c
+		go c.run()
+	}
+	c.refs++
+	return c
+}
+
+func (c *coarseClock) release() {
+	coarseClocks.Lock()
+	defer coarseClocks.Unlock()
+	c.refs--
+	if c.refs == 0 {
+		delete(coarseClocks.byResolution, c.resolution)
+		close(c.quit)
+	}
+}
+
+func (c *coarseClock) run() {
+	ticker := time.NewTicker(c.resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case t := <-ticker.C:
+			atomic.StoreInt64(&c.nanos, t.UnixNano())
+		}
+	}
+}
+
+func (c *coarseClock) now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.nanos))
+}
+
+func (p *standardHostPool) UseCoarseClock(resolution time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.releaseClock()
+	if resolution > 0 {
+		p.clock = acquireCoarseClock(resolution)
+	}
+}
+
+// releaseClock should only be called when the lock has already been acquired
+func (p *standardHostPool) releaseClock() {
+	if p.clock != nil {
+		p.clock.release()
+		p.clock = nil
+	}
+}
+
+// now is the time used to decide which hosts can be tried, and should only be
+// called when the lock has already been acquired
+func (p *standardHostPool) now() time.Time {
+	if p.clock != nil {
+		return p.clock.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,198 @@
+package hostpool
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnectionBalancer is a HostPool for long lived connections (WebSockets,
+// gRPC streams, server sent events), where each response handed out is a
+// connection held open until it's marked. Response times say little about
+// such hosts, so each Get picks the live host with the fewest connections
+// for its Weight instead. Connections stay where they are as hosts come and
+// go, so Rebalance suggests which to move to even the load out again, eg.
+// after hosts are added.
+type ConnectionBalancer interface {
+	HostPool
+	// Connections returns how many connections each host has open
+	Connections() map[string]int
+	// Rebalance returns the connections to close and open again, so that
+	// each live host ends up with its share of them. Connections to dead
+	// hosts are all included. Mark each once it's closed, and Get its
+	// replacement.
+	Rebalance() []HostPoolResponse
+}
+
+type connectionPool struct {
+	*standardHostPool
+
+	connsLock sync.Mutex
+	conns     map[string][]HostPoolResponse // open connections by host, oldest first
+}
+
+// NewConnectionBalancer builds a ConnectionBalancer over hosts
+func NewConnectionBalancer(hosts []string) ConnectionBalancer {
+	return &connectionPool{
+		standardHostPool: New(hosts).(*standardHostPool),
+		conns:            make(map[string][]HostPoolResponse),
+	}
+}
+
+func (p *connectionPool) Get() HostPoolResponse {
+	return p.GetWithFeatures(RequestFeatures{})
+}
+
+func (p *connectionPool) GetWithFeatures(f RequestFeatures) HostPoolResponse {
+	r, err := p.GetContext(forGet, f)
+	return orNoHost(p, r, err)
+}
+
+func (p *connectionPool) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	r, err := p.getRefreshed(ctx, f, func() (HostPoolResponse, error) { return p.getContext(ctx, f) })
+	if err == nil {
+		p.connsLock.Lock()
+		p.conns[r.Host()] = append(p.conns[r.Host()], r)
+		p.connsLock.Unlock()
+	}
+	return r, err
+}
+
+func (p *connectionPool) getContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	if err := p.waitForHosts(ctx); err != nil {
+		return nil, err
+	}
+	if err := p.waitForCapacity(ctx); err != nil {
+		return nil, err
+	}
+	if f.Filter != nil {
+		if !p.useFilter(f.Filter) {
+			return nil, ErrNoHosts
+		}
+		defer func() { p.filter = nil }()
+	}
+	if p.usePriority(f) {
+		defer func() { p.avoid = nil }()
+	}
+	host := p.getLeastLoaded(func(h *hostEntry) float64 {
+		return float64(atomic.LoadInt64(&h.inFlight))
+	})
+	atomic.AddInt64(&p.hosts[host].inFlight, 1)
+	t := requestTrace(ctx, f)
+	p.emit(Event{Kind: EventSelected, Host: host, Trace: t})
+	return &standardHostPoolResponse{host: host, pool: p, inFlight: true, trace: t}, nil
+}
+
+// getLeastLoaded picks the host with the least load for its weight, starting
+// from where round robin would so that ties are spread out. It should only be
+// called when the lock has already been acquired
+func (p *standardHostPool) getLeastLoaded(load func(h *hostEntry) float64) string {
+	now := p.now()
+	var best *hostEntry
+	var bestLoad float64
+	for i := range p.hostList {
+		h := p.hostList[(i+p.nextHostIndex)%len(p.hostList)]
+		if !h.canTryHost(now) || p.excluded(h) {
+			continue
+		}
+		load := load(h) / p.weight(h)
+		if best == nil || load < bestLoad {
+			best, bestLoad = h, load
+		}
+	}
+	if best == nil {
+		return p.getRoundRobin()
+	}
+	p.nextHostIndex++
+	if best.dead {
+		p.retryHost(best)
+	}
+	return best.host
+}
+
+func (p *connectionPool) markSuccess(r HostPoolResponse) {
+	p.closed(r)
+	p.standardHostPool.markSuccess(r)
+}
+
+func (p *connectionPool) markFailed(r HostPoolResponse) {
+	p.closed(r)
+	p.standardHostPool.markFailed(r)
+}
+
+func (p *connectionPool) markNeutral(r HostPoolResponse) {
+	p.closed(r)
+	p.standardHostPool.markNeutral(r)
+}
+
+// closed stops tracking a connection once it's marked
+func (p *connectionPool) closed(r HostPoolResponse) {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	conns := p.conns[r.Host()]
+	for i, c := range conns {
+		if c == r {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.conns, r.Host())
+	} else {
+		p.conns[r.Host()] = conns
+	}
+}
+
+func (p *connectionPool) Connections() map[string]int {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	counts := make(map[string]int, len(p.conns))
+	for host, conns := range p.conns {
+		counts[host] = len(conns)
+	}
+	return counts
+}
+
+// Rebalance works out each live host's share of the connections by weight,
+// rounded up, and suggests moving the newest connections of hosts over
+// theirs, which have the least invested in them
+func (p *connectionPool) Rebalance() []HostPoolResponse {
+	p.RLock()
+	weights := make(map[string]float64, len(p.hostList))
+	var sum float64
+	for _, h := range p.hostList {
+		if !h.dead {
+			weights[h.host] = p.weight(h)
+			sum += weights[h.host]
+		}
+	}
+	p.RUnlock()
+
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	total := 0
+	for _, conns := range p.conns {
+		total += len(conns)
+	}
+	hosts := make([]string, 0, len(p.conns))
+	for host := range p.conns {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var move []HostPoolResponse
+	for _, host := range hosts {
+		conns := p.conns[host]
+		share := 0
+		if w, ok := weights[host]; ok {
+			share = int(math.Ceil(float64(total) * w / sum))
+		}
+		if len(conns) > share {
+			move = append(move, conns[share:]...)
+		}
+	}
+	return move
+}
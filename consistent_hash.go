@@ -0,0 +1,292 @@
+package hostpool
+
+import (
+	"context"
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// KeyedHostPool is a HostPool that can also pick hosts by key, so that every
+// request for a key goes to the same host while it's up.
+type KeyedHostPool interface {
+	HostPool
+	// GetForKey returns the host owning key. If the owner is down the next
+	// live host round the ring is used, so a failed host's keys move to the
+	// same place on every client, and move back once it recovers.
+	GetForKey(key string) HostPoolResponse
+	// GetForKeyContext is GetForKey following the pool's EmptyPoolPolicy,
+	// as with GetContext
+	GetForKeyContext(ctx context.Context, key string) (HostPoolResponse, error)
+	// HostForKey is GetForKey without handing out a response, for clients
+	// that only need an address (and report failures with MarkBatch). Dead
+	// hosts are skipped, but do not get retried through HostForKey.
+	HostForKey(key string) string
+	// KeysMoved is the share of keys that would move to another host if the
+	// pool's hosts were set to hosts, eg. to judge when a change's cache
+	// misses can be afforded. It goes by ownership on the ring, whether or
+	// not the owners are up; ApplyHostsDryRun reports it too.
+	KeysMoved(hosts []string) float64
+	// SetHash replaces the hash placing hosts and keys on the ring, CRC32 by
+	// default, eg. to share a ring with clients in other languages. Replica
+	// i of a host is placed at the hash of "host-i". Changing it moves keys
+	// between hosts, as if they had all been replaced.
+	SetHash(HashFunc)
+	// SetKeyFunc has Get, GetWithFeatures and GetContext pick the host owning
+	// the key that key returns for the request, as GetForKey does, so that
+	// callers going through a plain HostPool are routed by key too. Requests
+	// it returns "" for, and all of them while it's nil (the default), are
+	// picked round robin. Filters are ignored for requests picked by key.
+	SetKeyFunc(key func(ctx context.Context, f RequestFeatures) string)
+}
+
+// HashFunc hashes data onto a ring, see KeyedHostPool.SetHash. Wider hashes
+// (xxhash, murmur3) can be used by keeping 32 bits of them.
+type HashFunc func(data []byte) uint32
+
+// CRC32 is the IEEE CRC32 of data, the default HashFunc
+func CRC32(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// FNV1a32 is the 32 bit FNV-1a hash of data
+func FNV1a32(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
+
+const defaultRingReplicas = 100
+
+type consistentHashPool struct {
+	*standardHostPool
+	replicas int
+	ring     []ringPoint // sorted by hash
+	hash     HashFunc
+	keyFunc  func(ctx context.Context, f RequestFeatures) string
+	ketama   bool // see NewKetama
+}
+
+type ringPoint struct {
+	hash uint32
+	host *hostEntry
+}
+
+// NewConsistentHash builds a KeyedHostPool that places each host on a hash
+// ring replicas times (0 uses a default of 100). Get without a key (see
+// SetKeyFunc) works round robin, like New.
+func NewConsistentHash(hosts []string, replicas int) KeyedHostPool {
+	if replicas <= 0 {
+		replicas = defaultRingReplicas
+	}
+	p := &consistentHashPool{
+		standardHostPool: New(hosts).(*standardHostPool),
+		replicas:         replicas,
+		hash:             CRC32,
+	}
+	p.buildRing()
+	// changing hosts only moves the keys of the hosts added or removed
+	p.onHostsChange = p.buildRing
+	return p
+}
+
+// buildRing should only be called when the lock has already been acquired
+func (p *consistentHashPool) buildRing() {
+	hosts := make([]string, len(p.hostList))
+	weights := make([]float64, len(p.hostList))
+	for i, h := range p.hostList {
+		hosts[i], weights[i] = h.host, h.endpoint.weight()
+	}
+	named := p.namedRing(hosts, weights)
+	p.ring = make([]ringPoint, len(named))
+	for i, point := range named {
+		p.ring[i] = ringPoint{hash: point.hash, host: p.hosts[point.host]}
+	}
+}
+
+type namedPoint struct {
+	hash uint32
+	host string
+}
+
+// namedRing is the ring of hosts with the given weights (nil for all 1), by
+// host name
+func (p *consistentHashPool) namedRing(hosts []string, weights []float64) []namedPoint {
+	seen := make(map[string]bool, len(hosts))
+	var total float64
+	for i, host := range hosts {
+		if !seen[host] {
+			seen[host] = true
+			total += ringWeight(weights, i)
+		}
+	}
+	n := len(seen)
+	ring := make([]namedPoint, 0, n*p.replicas)
+	for i, host := range hosts {
+		if !seen[host] {
+			continue
+		}
+		delete(seen, host)
+		// relative to the mean weight, for ketama
+		share := ringWeight(weights, i) / total * float64(n)
+		for _, hash := range p.points(host, share) {
+			ring = append(ring, namedPoint{hash: hash, host: host})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func ringWeight(weights []float64, i int) float64 {
+	if weights == nil {
+		return 1
+	}
+	return weights[i]
+}
+
+// currentRing is the pool's ring by host name, and should only be called
+// when the lock (or read lock) has already been acquired
+func (p *consistentHashPool) currentRing() []namedPoint {
+	ring := make([]namedPoint, len(p.ring))
+	for i, point := range p.ring {
+		ring[i] = namedPoint{hash: point.hash, host: point.host.host}
+	}
+	return ring
+}
+
+// points is where host goes on the ring, replica i at the hash of "host-i".
+// share is ignored; only ketama rings are weighted.
+func (p *consistentHashPool) points(host string, share float64) []uint32 {
+	if p.ketama {
+		return ketamaPoints(host, share)
+	}
+	points := make([]uint32, p.replicas)
+	for i := range points {
+		points[i] = p.hash([]byte(host + "-" + strconv.Itoa(i)))
+	}
+	return points
+}
+
+func (p *consistentHashPool) SetHash(hash HashFunc) {
+	if hash == nil {
+		hash = CRC32
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.hash = hash
+	p.buildRing()
+}
+
+func (p *consistentHashPool) SetKeyFunc(key func(ctx context.Context, f RequestFeatures) string) {
+	p.Lock()
+	defer p.Unlock()
+	p.keyFunc = key
+}
+
+func (p *consistentHashPool) Get() HostPoolResponse {
+	return p.GetWithFeatures(RequestFeatures{})
+}
+
+func (p *consistentHashPool) GetWithFeatures(f RequestFeatures) HostPoolResponse {
+	r, err := p.GetContext(forGet, f)
+	return orNoHost(p, r, err)
+}
+
+func (p *consistentHashPool) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	p.RLock()
+	keyFunc := p.keyFunc
+	p.RUnlock()
+	if keyFunc != nil {
+		if key := keyFunc(ctx, f); key != "" {
+			return p.getRefreshed(ctx, f, func() (HostPoolResponse, error) { return p.getForKey(ctx, key) })
+		}
+	}
+	return p.standardHostPool.GetContext(ctx, f)
+}
+
+func (p *consistentHashPool) GetForKey(key string) HostPoolResponse {
+	r, err := p.GetForKeyContext(forGet, key)
+	return orNoHost(p, r, err)
+}
+
+func (p *consistentHashPool) GetForKeyContext(ctx context.Context, key string) (HostPoolResponse, error) {
+	return p.getRefreshed(ctx, RequestFeatures{}, func() (HostPoolResponse, error) { return p.getForKey(ctx, key) })
+}
+
+func (p *consistentHashPool) getForKey(ctx context.Context, key string) (HostPoolResponse, error) {
+	p.Lock()
+	defer p.Unlock()
+	if err := p.waitForHosts(ctx); err != nil {
+		return nil, err
+	}
+	h := p.lookupKey(key, true)
+	if h == nil {
+		// all hosts are down. re-add them
+		p.doResetAll()
+		h = p.lookupKey(key, false)
+	}
+	if h == nil {
+		if len(p.ring) == 0 {
+			return nil, ErrNoHosts
+		}
+		// every host is draining, the owner is as good as any
+		h = p.ring[p.ringIndex(key)].host
+	}
+	atomic.AddInt64(&h.inFlight, 1)
+	t, _ := TraceFromContext(ctx)
+	p.emit(Event{Kind: EventSelected, Host: h.host, Trace: t})
+	r := &standardHostPoolResponse{host: h.host, pool: p, inFlight: true, trace: t}
+	p.watchLeaks(r)
+	return r, nil
+}
+
+func (p *consistentHashPool) HostForKey(key string) string {
+	p.RLock()
+	defer p.RUnlock()
+	if h := p.lookupKey(key, false); h != nil {
+		return h.host
+	}
+	if len(p.ring) == 0 {
+		return ""
+	}
+	// with every host down, the owner is as good as any
+	return p.ring[p.ringIndex(key)].host.host
+}
+
+// lookupKey walks the ring clockwise from key to the first host that can take
+// it, retrying a dead host if retry is set and it's due one. It returns nil if
+// there are none, and should only be called when the lock (or, without retry,
+// the read lock) has already been acquired
+func (p *consistentHashPool) lookupKey(key string, retry bool) *hostEntry {
+	if len(p.ring) == 0 {
+		return nil
+	}
+	now := p.now()
+	start := p.ringIndex(key)
+	for i := 0; i < len(p.ring); i++ {
+		h := p.ring[(start+i)%len(p.ring)].host
+		if h.endpoint.Draining {
+			continue
+		}
+		if !h.dead {
+			return h
+		}
+		if retry && h.nextRetry.Before(now) {
+			p.retryHost(h)
+			return h
+		}
+	}
+	return nil
+}
+
+// ringIndex is the first ring point at or after the key's hash
+func (p *consistentHashPool) ringIndex(key string) int {
+	hash := p.hash([]byte(key))
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return i
+}
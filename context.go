@@ -0,0 +1,59 @@
+package hostpool
+
+import (
+	"context"
+)
+
+// WrapContext returns a context derived from ctx that marks r with the
+// context's error when it's done, if r hasn't been marked by then, so that a
+// caller bailing out early doesn't leave the request counted as in flight.
+// With the default ErrorClassifier context errors say nothing about the host
+// and only end the request. Call the returned CancelFunc once finished with
+// the context, as with context.WithCancel.
+func WrapContext(ctx context.Context, r HostPoolResponse) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-ctx.Done()
+		r.Mark(ctx.Err())
+	}()
+	return ctx, cancel
+}
+
+// Trace identifies the request a host was picked for, eg. the trace and span
+// IDs of the tracing system in use. A response carries the Trace it was picked
+// with, and so do the events about it and the decision log lines, so they
+// can be joined with the request's trace.
+type Trace struct {
+	TraceID string
+	SpanID  string
+}
+
+func (t Trace) String() string {
+	if t.SpanID == "" {
+		return t.TraceID
+	}
+	return t.TraceID + "/" + t.SpanID
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context carrying t, for GetContext (and the context
+// taking Gets of other pools) to pick up when RequestFeatures.Trace isn't set
+func WithTrace(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// TraceFromContext returns the Trace set with WithTrace, if any
+func TraceFromContext(ctx context.Context) (Trace, bool) {
+	t, ok := ctx.Value(traceKey{}).(Trace)
+	return t, ok
+}
+
+// requestTrace is the trace of a request, from its features or its context
+func requestTrace(ctx context.Context, f RequestFeatures) Trace {
+	if f.Trace != (Trace{}) {
+		return f.Trace
+	}
+	t, _ := TraceFromContext(ctx)
+	return t
+}
@@ -0,0 +1,70 @@
+package hostpool
+
+import (
+	"time"
+)
+
+// Cooldown cuts the share of traffic a host gets for a while after a burst
+// of errors, as a softer step before it fails badly enough to be put in the
+// dead pool. Hosts are checked on every decay tick.
+type Cooldown struct {
+	// Window is how far back to look at a host's error rate. It is rounded
+	// up to whole decay ticks.
+	Window time.Duration
+	// ErrorRate is the fraction of failed requests over Window that starts a
+	// cooldown, and MinRequests the number of requests needed to judge it
+	ErrorRate   float64
+	MinRequests int64
+	// Weight multiplies the value a cooling host gets from the calculator,
+	// eg. 0.25 for a quarter of its usual share
+	Weight float64
+	// Duration is how long a cooldown lasts. Hosts still over ErrorRate when
+	// it ends start another.
+	Duration time.Duration
+}
+
+// SetCooldown sets the cooldown policy for the pool. A zero Cooldown turns it
+// off.
+func (p *epsilonGreedyHostPool) SetCooldown(c Cooldown) {
+	p.Lock()
+	defer p.Unlock()
+	if c.ErrorRate <= 0 || c.Weight <= 0 || c.Duration <= 0 {
+		p.cooldown = nil
+		for _, h := range p.hostList {
+			h.cooldownUntil = time.Time{}
+		}
+		return
+	}
+	if c.Weight > 1 {
+		c.Weight = 1
+	}
+	p.cooldown = &c
+}
+
+// checkCooldowns starts the cooldown of any host over the error rate, and
+// should only be called when the lock has already been acquired
+func (p *epsilonGreedyHostPool) checkCooldowns(now time.Time) {
+	if p.cooldown == nil {
+		return
+	}
+	tick := p.decayDuration / epsilonBuckets
+	buckets := int((p.cooldown.Window + tick - 1) / tick)
+	for _, h := range p.hostList {
+		if now.Before(h.cooldownUntil) {
+			continue
+		}
+		rate, requests := h.getRecentErrorRate(buckets)
+		if requests >= p.cooldown.MinRequests && requests > 0 && rate > p.cooldown.ErrorRate {
+			h.cooldownUntil = now.Add(p.cooldown.Duration)
+		}
+	}
+}
+
+// cooldownWeight is what to multiply a host's value by, and should only be
+// called when the lock (or read lock) has already been acquired
+func (p *epsilonGreedyHostPool) cooldownWeight(h *hostEntry) float64 {
+	if p.cooldown == nil || h.cooldownUntil.IsZero() || !time.Now().Before(h.cooldownUntil) {
+		return 1
+	}
+	return p.cooldown.Weight
+}
@@ -0,0 +1,134 @@
+package hostpool
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Credential rotation
+//
+// Integrations that keep credentials per host (mTLS certificates, API tokens)
+// need to refresh them when they rotate, and shouldn't send a request to a
+// host until they have. RotateCredentials flags hosts as rotated; the next
+// Get to pick each of them first calls the pool's CredentialRefresher with
+// the host (and its Meta, see Host), and any other Gets picking it meanwhile
+// wait for that. A host whose refresh fails goes in the dead pool and stays
+// flagged, so it is refreshed again when it comes up for a retry, and Get
+// moves on to another host.
+
+// CredentialRefresher refreshes the credentials for a host, see
+// RotateCredentials
+type CredentialRefresher func(ctx context.Context, host Host) error
+
+func (p *standardHostPool) SetCredentialRefresher(refresh CredentialRefresher) {
+	p.Lock()
+	defer p.Unlock()
+	p.refresher = refresh
+}
+
+func (p *standardHostPool) RotateCredentials(hosts ...string) {
+	p.Lock()
+	defer p.Unlock()
+	if len(hosts) == 0 {
+		hosts = p.hostNames()
+	}
+	for _, host := range hosts {
+		if h := p.lookupHost(host); h != nil && !h.rotated {
+			h.rotated = true
+			atomic.AddInt32(&p.rotated, 1)
+		}
+	}
+}
+
+// getRefreshed runs get, a pool's Get for f, unless it's shed (see shed), once
+// pacing lets it (see pace) and the weight schedule is up to date, until it
+// picks a host whose credentials don't need refreshing or are refreshed. It
+// gives up with the last refresh error once every host has failed one.
+func (p *standardHostPool) getRefreshed(ctx context.Context, f RequestFeatures, get func() (HostPoolResponse, error)) (HostPoolResponse, error) {
+	if err := p.shed(ctx, f); err != nil {
+		return nil, err
+	}
+	if err := p.pace(ctx); err != nil {
+		return nil, err
+	}
+	p.checkSchedule()
+	for attempt := 0; ; attempt++ {
+		r, err := get()
+		if err != nil || atomic.LoadInt32(&p.rotated) == 0 {
+			return r, err
+		}
+		if err = p.refreshIfRotated(ctx, r); err == nil {
+			return r, nil
+		}
+		if attempt+1 >= len(p.Hosts()) {
+			return nil, err
+		}
+	}
+}
+
+// refreshIfRotated refreshes the credentials of a host picked by Get, if it
+// has rotated. When the refresh fails, the response is let go without being
+// marked and the host put in the dead pool.
+func (p *standardHostPool) refreshIfRotated(ctx context.Context, r HostPoolResponse) error {
+	p.Lock()
+	h := p.hosts[r.Host()]
+	waited := false
+	for h != nil && h.refreshing != nil {
+		done := h.refreshing
+		p.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			p.Lock()
+			p.abandon(h, r)
+			p.Unlock()
+			return ctx.Err()
+		}
+		waited = true
+		p.Lock()
+		h = p.hosts[r.Host()]
+	}
+	if h == nil || !h.rotated || p.refresher == nil {
+		p.Unlock()
+		return nil
+	}
+	if waited {
+		// the refresh this Get waited for failed
+		err := h.refreshErr
+		p.abandon(h, r)
+		p.Unlock()
+		return err
+	}
+	done := make(chan struct{})
+	h.refreshing = done
+	refresh, endpoint := p.refresher, h.endpoint
+	p.Unlock()
+
+	err := refresh(ctx, endpoint)
+
+	p.Lock()
+	defer p.unlockAndNotify()
+	h.refreshing = nil
+	close(done)
+	if err == nil {
+		if h.rotated {
+			h.rotated = false
+			atomic.AddInt32(&p.rotated, -1)
+		}
+		return nil
+	}
+	h.refreshErr = fmt.Errorf("hostpool: refreshing credentials for %s: %w", h.host, err)
+	p.noteMark(h, "refresh", err, 0)
+	p.doMarkFailed(h)
+	p.abandon(h, r)
+	return h.refreshErr
+}
+
+// abandon lets go of a response that won't be handed out, and should only be
+// called when the lock has already been acquired
+func (p *standardHostPool) abandon(h *hostEntry, r HostPoolResponse) {
+	if o, ok := r.(interface{ Do(func()) }); ok {
+		o.Do(func() { p.release(h, r) })
+	}
+}
@@ -0,0 +1,126 @@
+package hostpool
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// decayer runs the decay ticks of every epsilon greedy pool in the process
+// from a single goroutine, which only runs while some pool needs it.
+var decayer = &decayScheduler{wake: make(chan struct{}, 1)}
+
+type decayScheduler struct {
+	sync.Mutex
+	entries decayHeap
+	running bool
+	wake    chan struct{}
+}
+
+type decayEntry struct {
+	pool     *epsilonGreedyHostPool
+	interval time.Duration
+	next     time.Time
+	index    int
+}
+
+func (s *decayScheduler) add(p *epsilonGreedyHostPool, interval time.Duration) *decayEntry {
+	e := &decayEntry{pool: p, interval: interval, next: time.Now().Add(interval)}
+	s.Lock()
+	heap.Push(&s.entries, e)
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	s.Unlock()
+	s.poke()
+	return e
+}
+
+func (s *decayScheduler) remove(e *decayEntry) {
+	s.Lock()
+	if e.index >= 0 {
+		heap.Remove(&s.entries, e.index)
+	}
+	s.Unlock()
+	s.poke()
+}
+
+// poke wakes the scheduler up to look at the next entry again
+func (s *decayScheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *decayScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.Lock()
+		if len(s.entries) == 0 {
+			s.running = false
+			s.Unlock()
+			return
+		}
+		now := time.Now()
+		var due []*epsilonGreedyHostPool
+		for len(s.entries) > 0 && !s.entries[0].next.After(now) {
+			e := s.entries[0]
+			e.next = e.next.Add(e.interval)
+			if e.next.Before(now) {
+				// we fell behind, don't try to catch up with a burst of ticks
+				e.next = now.Add(e.interval)
+			}
+			heap.Fix(&s.entries, 0)
+			due = append(due, e.pool)
+		}
+		wait := s.entries[0].next.Sub(now)
+		s.Unlock()
+
+		// decay outside our own lock, since pools call add and remove with
+		// theirs held
+		for _, p := range due {
+			p.performEpsilonGreedyDecay()
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// decayHeap orders entries by their next tick
+type decayHeap []*decayEntry
+
+func (h decayHeap) Len() int           { return len(h) }
+func (h decayHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h decayHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *decayHeap) Push(x interface{}) {
+	e := x.(*decayEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *decayHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
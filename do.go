@@ -0,0 +1,324 @@
+package hostpool
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Do gets a host from p, calls f with it and marks the host with what f
+// returns
+func Do(ctx context.Context, p HostPool, f func(ctx context.Context, host string) error) error {
+	r, err := p.GetContext(ctx, RequestFeatures{})
+	if err != nil {
+		return err
+	}
+	err = f(ctx, r.Host())
+	r.Mark(err)
+	return err
+}
+
+// DoHedged is Do that sends a second, hedge, request to another host if the
+// first hasn't finished after delay. The first request to succeed wins and
+// the other one's context is canceled; if both fail the last error is
+// returned. The loser is marked with context.Canceled, which by default says
+// nothing about its host, unless it finished (and was marked) first.
+//
+// The hedge always goes to a different host from the first request: if the
+// pool picks the same host again no hedge is sent. How hedges play out is
+// kept in the pool's HedgeStatistics, to help tune delay.
+func DoHedged(ctx context.Context, p HostPool, delay time.Duration, f func(ctx context.Context, host string) error) error {
+	return doHedged(ctx, p, RequestFeatures{}, delay, f)
+}
+
+// DoPriority is Do for a request of the given priority, see PriorityPolicy.
+// It's hedged, as DoHedged does, if the pool's policy for the priority has a
+// HedgeDelay.
+func DoPriority(ctx context.Context, p HostPool, priority int, f func(ctx context.Context, host string) error) error {
+	features := RequestFeatures{Priority: priority}
+	if delay := p.priorityPolicy(priority).HedgeDelay; delay > 0 {
+		return doHedged(ctx, p, features, delay, f)
+	}
+	r, err := p.GetContext(ctx, features)
+	if err != nil {
+		return err
+	}
+	err = f(ctx, r.Host())
+	r.Mark(err)
+	return err
+}
+
+func doHedged(ctx context.Context, p HostPool, features RequestFeatures, delay time.Duration, f func(ctx context.Context, host string) error) error {
+	first, err := p.GetContext(ctx, features)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		r        HostPoolResponse
+		err      error
+		started  time.Time
+		finished time.Time
+	}
+	results := make(chan result, 2)
+	var cancels []context.CancelFunc
+	start := func(r HostPoolResponse) {
+		rctx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			started := time.Now()
+			err := f(rctx, r.Host())
+			results <- result{r: r, err: err, started: started, finished: time.Now()}
+		}()
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	start(first)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var hedge HostPoolResponse
+	select {
+	case res := <-results:
+		res.r.Mark(res.err)
+		return res.err
+	case <-timer.C:
+		hedge = getOther(ctx, p, features, first.Host())
+		if hedge == nil {
+			res := <-results
+			res.r.Mark(res.err)
+			return res.err
+		}
+		start(hedge)
+	}
+
+	a := <-results
+	if a.err == nil {
+		a.r.Mark(nil)
+		cancelled := time.Now()
+		for _, cancel := range cancels {
+			cancel()
+		}
+		b := <-results
+		if b.finished.Before(cancelled) {
+			b.r.Mark(b.err)
+		} else {
+			b.r.Mark(context.Canceled)
+		}
+		p.recordHedge(hedgeOutcome{
+			first:         first.Host(),
+			winner:        a.r.Host(),
+			loser:         b.r.Host(),
+			cancelLatency: b.finished.Sub(cancelled),
+			wasted:        b.finished.Sub(b.started),
+			useful:        a.finished.Sub(a.started),
+		})
+		return nil
+	}
+
+	// the other request is still the best chance
+	a.r.Mark(a.err)
+	b := <-results
+	b.r.Mark(b.err)
+	if b.err != nil {
+		p.recordHedge(hedgeOutcome{first: first.Host()})
+		return b.err
+	}
+	p.recordHedge(hedgeOutcome{
+		first:  first.Host(),
+		winner: b.r.Host(),
+		loser:  a.r.Host(),
+		wasted: a.finished.Sub(a.started),
+		useful: b.finished.Sub(b.started),
+	})
+	return nil
+}
+
+// DoShared is Do for idempotent calls that callers may make at the same time,
+// like fetching an item on a cache miss. Calls with the same key while one is
+// in flight wait for it and share its result, rather than sending more
+// requests upstream, so there is only the one request and the one Mark for
+// them all.
+//
+// The shared call keeps going for as long as any of its callers is still
+// waiting for it, and is only canceled once they have all given up; it has
+// the values of the first caller's context but not its deadline, so f
+// should apply a timeout of its own if it needs one.
+func DoShared(ctx context.Context, p HostPool, key string, f func(ctx context.Context, host string) (interface{}, error)) (interface{}, error) {
+	g := p.sharedCalls()
+	g.Lock()
+	c, ok := g.calls[key]
+	if !ok {
+		if g.calls == nil {
+			g.calls = make(map[string]*sharedCall)
+		}
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = &sharedCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			defer cancel()
+			err := Do(valuesFrom{callCtx, ctx}, p, func(ctx context.Context, host string) error {
+				var err error
+				c.value, err = f(ctx, host)
+				return err
+			})
+			c.err = err
+			g.Lock()
+			g.forget(key, c)
+			g.Unlock()
+			close(c.done)
+		}()
+	}
+	c.waiting++
+	g.Unlock()
+
+	select {
+	case <-c.done:
+		return c.value, c.err
+	case <-ctx.Done():
+		g.Lock()
+		c.waiting--
+		if c.waiting == 0 {
+			// later calls start afresh rather than join a canceled one
+			g.forget(key, c)
+			c.cancel()
+		}
+		g.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// flightGroup is the calls in flight for DoShared, by key
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*sharedCall
+}
+
+type sharedCall struct {
+	done    chan struct{} // closed once value and err are set
+	value   interface{}
+	err     error
+	waiting int // callers still waiting
+	cancel  context.CancelFunc
+}
+
+// forget should only be called when the lock has already been acquired
+func (g *flightGroup) forget(key string, c *sharedCall) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+func (p *standardHostPool) sharedCalls() *flightGroup {
+	return &p.flights
+}
+
+// valuesFrom is a context that's canceled as its Context is, with the values
+// of another
+type valuesFrom struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesFrom) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// getOther gets a host other than host, or returns nil if the pool doesn't
+// come up with one
+func getOther(ctx context.Context, p HostPool, f RequestFeatures, host string) HostPoolResponse {
+	r, err := p.GetContext(ctx, f)
+	if err != nil {
+		return nil
+	}
+	if r.Host() == host {
+		r.Mark(context.Canceled)
+		return nil
+	}
+	return r
+}
+
+// HedgeStats sums up the hedged requests made with DoHedged
+type HedgeStats struct {
+	// Hedged is the number of requests that sent a hedge
+	Hedged int64
+	// FirstWins and HedgeWins count which request won, and Failed the hedged
+	// requests where both failed
+	FirstWins int64
+	HedgeWins int64
+	Failed    int64
+	// CancelLatency is the average time losers took to return after being
+	// canceled (0 for losers that had already failed)
+	CancelLatency time.Duration
+	// WastedWork is the fraction of the time spent on hedged requests that
+	// went on losers
+	WastedWork float64
+	// Wins and Losses count by host
+	Wins   map[string]int64
+	Losses map[string]int64
+}
+
+type hedgeOutcome struct {
+	first, winner, loser string // winner is empty if both failed
+	cancelLatency        time.Duration
+	wasted, useful       time.Duration
+}
+
+type hedgeTracker struct {
+	sync.Mutex
+	stats         HedgeStats
+	cancelLatency time.Duration // total
+	wasted        time.Duration
+	total         time.Duration
+}
+
+func (p *standardHostPool) recordHedge(o hedgeOutcome) {
+	t := &p.hedges
+	t.Lock()
+	defer t.Unlock()
+	s := &t.stats
+	s.Hedged++
+	if o.winner == "" {
+		s.Failed++
+		return
+	}
+	if o.winner == o.first {
+		s.FirstWins++
+	} else {
+		s.HedgeWins++
+	}
+	if s.Wins == nil {
+		s.Wins = make(map[string]int64)
+		s.Losses = make(map[string]int64)
+	}
+	s.Wins[o.winner]++
+	s.Losses[o.loser]++
+	t.cancelLatency += o.cancelLatency
+	t.wasted += o.wasted
+	t.total += o.wasted + o.useful
+}
+
+func (p *standardHostPool) HedgeStatistics() HedgeStats {
+	t := &p.hedges
+	t.Lock()
+	defer t.Unlock()
+	s := t.stats
+	s.Wins = make(map[string]int64, len(t.stats.Wins))
+	s.Losses = make(map[string]int64, len(t.stats.Losses))
+	for host, n := range t.stats.Wins {
+		s.Wins[host] = n
+	}
+	for host, n := range t.stats.Losses {
+		s.Losses[host] = n
+	}
+	if decided := s.FirstWins + s.HedgeWins; decided > 0 {
+		s.CancelLatency = t.cancelLatency / time.Duration(decided)
+	}
+	if t.total > 0 {
+		s.WastedWork = float64(t.wasted) / float64(t.total)
+	}
+	return s
+}
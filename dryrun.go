@@ -0,0 +1,185 @@
+package hostpool
+
+import (
+	"sort"
+)
+
+// HostChanges is what setting a pool's hosts would change, as reported by
+// ApplyHostsDryRun and ApplyEndpointsDryRun, eg. for deploy tooling to show
+// before a topology change goes out
+type HostChanges struct {
+	// Added and Removed are the hosts that would join and leave the pool
+	Added   []string
+	Removed []string
+	// Reweighted are the hosts staying in the pool whose Weight would change
+	Reweighted []WeightChange
+	// Shares are the share of keys each host owns, before and after, for
+	// consistent hash pools (nil for others). Shares go by ownership on the
+	// ring, whether or not the owner is up.
+	Shares map[string]ShareChange
+	// KeysMoved is the share of keys whose owner would change, for
+	// consistent hash pools; every one of them is a cache miss waiting to
+	// happen
+	KeysMoved float64
+}
+
+// WeightChange is a host's Weight before and after a change
+type WeightChange struct {
+	Host     string
+	From, To float64
+}
+
+// ShareChange is a host's share of keys before and after a change, 0 while
+// it isn't in the pool
+type ShareChange struct {
+	Before, After float64
+}
+
+func (p *standardHostPool) ApplyHostsDryRun(hosts []string) HostChanges {
+	p.RLock()
+	defer p.RUnlock()
+	return p.dryRun(hosts, nil)
+}
+
+func (p *standardHostPool) ApplyEndpointsDryRun(hosts []Host) HostChanges {
+	names := make([]string, len(hosts))
+	for i, h := range hosts {
+		names[i] = h.String()
+	}
+	p.RLock()
+	defer p.RUnlock()
+	return p.dryRun(names, hosts)
+}
+
+// dryRun works out what setEndpoints would change, and should only be called
+// when the lock (or read lock) has already been acquired
+func (p *standardHostPool) dryRun(hosts []string, endpoints []Host) HostChanges {
+	var c HostChanges
+	staying := make(map[string]bool, len(hosts))
+	for i, host := range hosts {
+		if staying[host] {
+			continue
+		}
+		staying[host] = true
+		h, ok := p.hosts[host]
+		if !ok {
+			c.Added = append(c.Added, host)
+			continue
+		}
+		if endpoints != nil {
+			from, to := h.endpoint.weight(), endpoints[i].weight()
+			if from != to {
+				c.Reweighted = append(c.Reweighted, WeightChange{Host: host, From: from, To: to})
+			}
+		}
+	}
+	for _, h := range p.hostList {
+		if !staying[h.host] {
+			c.Removed = append(c.Removed, h.host)
+		}
+	}
+	return c
+}
+
+func (p *consistentHashPool) ApplyHostsDryRun(hosts []string) HostChanges {
+	p.RLock()
+	defer p.RUnlock()
+	return p.withShares(p.dryRun(hosts, nil), hosts, nil)
+}
+
+func (p *consistentHashPool) ApplyEndpointsDryRun(hosts []Host) HostChanges {
+	names := make([]string, len(hosts))
+	weights := make([]float64, len(hosts))
+	for i, h := range hosts {
+		names[i] = h.String()
+		weights[i] = h.weight()
+	}
+	p.RLock()
+	defer p.RUnlock()
+	return p.withShares(p.dryRun(names, hosts), names, weights)
+}
+
+// withShares adds the shares of keys before and after to c, and should only
+// be called when the lock (or read lock) has already been acquired
+func (p *consistentHashPool) withShares(c HostChanges, hosts []string, weights []float64) HostChanges {
+	before, after := p.currentRing(), p.namedRing(hosts, weights)
+	c.Shares = make(map[string]ShareChange)
+	for host, share := range ringShares(before) {
+		c.Shares[host] = ShareChange{Before: share}
+	}
+	for host, share := range ringShares(after) {
+		s := c.Shares[host]
+		s.After = share
+		c.Shares[host] = s
+	}
+	c.KeysMoved = keysMoved(before, after)
+	return c
+}
+
+func (p *consistentHashPool) KeysMoved(hosts []string) float64 {
+	p.RLock()
+	defer p.RUnlock()
+	return keysMoved(p.currentRing(), p.namedRing(hosts, nil))
+}
+
+// keysMoved is the share of keys owned by different hosts on the two rings.
+// Between neighbouring points of either ring neither owner changes, so it
+// adds up the stretches between them where the owners differ.
+func keysMoved(from, to []namedPoint) float64 {
+	switch {
+	case len(from) == 0 && len(to) == 0:
+		return 0
+	case len(from) == 0 || len(to) == 0:
+		return 1
+	}
+	bounds := make([]uint32, 0, len(from)+len(to))
+	for _, point := range from {
+		bounds = append(bounds, point.hash)
+	}
+	for _, point := range to {
+		bounds = append(bounds, point.hash)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	unique := bounds[:1]
+	for _, b := range bounds[1:] {
+		if b != unique[len(unique)-1] {
+			unique = append(unique, b)
+		}
+	}
+	var moved float64
+	for i, b := range unique {
+		if ringOwner(from, b) == ringOwner(to, b) {
+			continue
+		}
+		if len(unique) == 1 {
+			return 1
+		}
+		// the stretch up to b from the point before it, wrapping round
+		prev := unique[(i+len(unique)-1)%len(unique)]
+		moved += float64(b-prev) / (1 << 32)
+	}
+	return moved
+}
+
+// ringOwner is the host owning hash on ring
+func ringOwner(ring []namedPoint, hash uint32) string {
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].host
+}
+
+// ringShares is the share of keys each host owns on ring
+func ringShares(ring []namedPoint) map[string]float64 {
+	shares := make(map[string]float64)
+	for i, point := range ring {
+		// a point owns the hashes after the one before it, up to its own
+		prev := ring[(i+len(ring)-1)%len(ring)].hash
+		shares[point.host] += float64(point.hash-prev) / (1 << 32)
+	}
+	if len(ring) == 1 {
+		shares[ring[0].host] = 1
+	}
+	return shares
+}
@@ -0,0 +1,280 @@
+// Package dualstack dials hosts that resolve to both IPv4 and IPv6 addresses,
+// either preferring one family or racing the two Happy Eyeballs style (RFC
+// 8305). It keeps track of how fast each family connects for each host, so a
+// host whose IPv6 path is broken or slow is soon dialed over IPv4 first.
+//
+// A Dialer's DialContext fits net/http's Transport.DialContext, eg. as the
+// Base of an httppool.Transport.
+package dualstack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Family is an IP address family
+type Family int
+
+const (
+	IPv6 Family = iota
+	IPv4
+)
+
+func (f Family) String() string {
+	if f == IPv4 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// Policy decides how the families of a host are dialed
+type Policy int
+
+const (
+	// Race dials the family that has connected faster for the host (IPv6 to
+	// begin with), and the other family too if that hasn't connected after
+	// FallbackDelay or fails. The first connection made wins. A family that
+	// lost its place only gets it back once the other one slows down.
+	Race Policy = iota
+	// PreferIPv4 and PreferIPv6 only dial the other family if every address
+	// of the preferred one fails
+	PreferIPv4
+	PreferIPv6
+)
+
+// Dialer dials hosts over both address families. The zero value races them.
+type Dialer struct {
+	Policy Policy
+	// FallbackDelay is how long Race waits before dialing the second family
+	// (0 uses the 250ms RFC 8305 recommends)
+	FallbackDelay time.Duration
+	// Dial dials a single address, nil uses a net.Dialer
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// LookupIPAddr resolves host names, nil uses net.DefaultResolver
+	LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	mu    sync.Mutex
+	hosts map[string]*familyTimes
+}
+
+const (
+	defaultFallbackDelay = 250 * time.Millisecond
+	// a failed dial counts as one this slow
+	failurePenalty = 5 * time.Second
+	// how much of the average each new connect time makes up
+	connectWeight = 0.2
+)
+
+type familyTimes [2]time.Duration // moving averages by Family, 0 if unknown
+
+// Stats is how fast each family has connected for a host
+type Stats struct {
+	// IPv4 and IPv6 are moving averages of connect times, with failures
+	// counted as slow connects. They are 0 for families not dialed yet.
+	IPv4 time.Duration
+	IPv6 time.Duration
+	// Preferred is the family Race dials first
+	Preferred Family
+}
+
+// Stats returns how fast each family has connected for host (a host name,
+// without a port)
+func (d *Dialer) Stats(host string) Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t := d.hosts[host]
+	if t == nil {
+		return Stats{}
+	}
+	return Stats{IPv4: t[IPv4], IPv6: t[IPv6], Preferred: t.preferred()}
+}
+
+// preferred is the faster family, IPv6 until both have been dialed
+func (t *familyTimes) preferred() Family {
+	if t != nil && t[IPv4] > 0 && t[IPv6] > 0 && t[IPv4] < t[IPv6] {
+		return IPv4
+	}
+	return IPv6
+}
+
+func (d *Dialer) record(host string, f Family, took time.Duration, err error) {
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			// lost a race, or the caller gave up
+			return
+		}
+		took = failurePenalty
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hosts == nil {
+		d.hosts = make(map[string]*familyTimes)
+	}
+	t := d.hosts[host]
+	if t == nil {
+		t = &familyTimes{}
+		d.hosts[host] = t
+	}
+	if t[f] == 0 {
+		t[f] = took
+	} else {
+		t[f] = time.Duration((1-connectWeight)*float64(t[f]) + connectWeight*float64(took))
+	}
+}
+
+// DialContext connects to address (host:port). Networks that pin a family,
+// like tcp4, and addresses that are already IPs are dialed as they are.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(network, "4") || strings.HasSuffix(network, "6") || net.ParseIP(host) != nil {
+		return d.dial(ctx, network, address)
+	}
+
+	lookup := d.LookupIPAddr
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIPAddr
+	}
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var byFamily [2][]string
+	for _, a := range addrs {
+		f, ip := IPv6, a.IP.String()
+		if a.IP.To4() != nil {
+			f = IPv4
+		} else if a.Zone != "" {
+			ip += "%" + a.Zone
+		}
+		byFamily[f] = append(byFamily[f], net.JoinHostPort(ip, port))
+	}
+
+	first := IPv6
+	switch d.Policy {
+	case PreferIPv4:
+		first = IPv4
+	case Race:
+		d.mu.Lock()
+		first = d.hosts[host].preferred()
+		d.mu.Unlock()
+	}
+	second := 1 - first
+	switch {
+	case len(byFamily[first]) == 0 && len(byFamily[second]) == 0:
+		return nil, &net.DNSError{Err: "no addresses", Name: host}
+	case len(byFamily[first]) == 0:
+		return d.dialFamily(ctx, ctx, network, host, second, byFamily[second])
+	case len(byFamily[second]) == 0:
+		return d.dialFamily(ctx, ctx, network, host, first, byFamily[first])
+	case d.Policy != Race:
+		conn, err := d.dialFamily(ctx, ctx, network, host, first, byFamily[first])
+		if err == nil {
+			return conn, nil
+		}
+		return d.dialFamily(ctx, ctx, network, host, second, byFamily[second])
+	}
+	return d.race(ctx, network, host, first, byFamily)
+}
+
+func (d *Dialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Dial != nil {
+		return d.Dial(ctx, network, address)
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+// dialFamily tries the addresses of a family in order, and records how long
+// it took to get a connection, or to fail to. ctx may be a race's own
+// context, which is canceled once the race has been won: a family that loses
+// is recorded as taking as long as it had been dialing, since it was at least
+// that slow. The caller's context is parent.
+func (d *Dialer) dialFamily(ctx, parent context.Context, network, host string, f Family, addrs []string) (net.Conn, error) {
+	start := time.Now()
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = d.dial(ctx, network, addr); err == nil {
+			d.record(host, f, time.Since(start), nil)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+	}
+	if parent.Err() == nil && ctx.Err() != nil {
+		d.record(host, f, time.Since(start), nil)
+	} else {
+		d.record(host, f, time.Since(start), err)
+	}
+	return nil, err
+}
+
+func (d *Dialer) race(parent context.Context, network, host string, first Family, byFamily [2][]string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	results := make(chan dialResult, 2)
+	start := func(f Family) {
+		go func() {
+			conn, err := d.dialFamily(ctx, parent, network, host, f, byFamily[f])
+			results <- dialResult{conn, err}
+		}()
+	}
+	start(first)
+
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = defaultFallbackDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	running := 1
+	select {
+	case <-timer.C:
+		start(1 - first)
+		running++
+	case r := <-results:
+		if r.err == nil {
+			return r.conn, nil
+		}
+		start(1 - first)
+	}
+	return wait(results, running)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// wait returns the first connection among running dials, closing any that
+// connect after it, or the last error if none do
+func wait(results chan dialResult, running int) (net.Conn, error) {
+	var err error
+	for ; running > 0; running-- {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		if running > 1 {
+			go func(n int) {
+				for ; n > 0; n-- {
+					if late := <-results; late.conn != nil {
+						late.conn.Close()
+					}
+				}
+			}(running - 1)
+		}
+		return r.conn, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,118 @@
+package dualstack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testNet resolves every name to one IPv4 and one IPv6 address, and dials
+// each family after a delay, or fails it
+type testNet struct {
+	sync.Mutex
+	delay  map[Family]time.Duration
+	down   map[Family]bool
+	dialed []string
+}
+
+func (n *testNet) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func (n *testNet) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	f := IPv4
+	if strings.HasPrefix(address, "[") {
+		f = IPv6
+	}
+	n.Lock()
+	n.dialed = append(n.dialed, address)
+	delay, down := n.delay[f], n.down[f]
+	n.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if down {
+		return nil, errors.New("connection refused")
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func (n *testNet) dialer(p Policy) *Dialer {
+	return &Dialer{Policy: p, FallbackDelay: 5 * time.Millisecond, Dial: n.dial, LookupIPAddr: n.lookup}
+}
+
+func (n *testNet) lastDialed() []string {
+	n.Lock()
+	defer n.Unlock()
+	dialed := n.dialed
+	n.dialed = nil
+	return dialed
+}
+
+func TestRace(t *testing.T) {
+	n := &testNet{delay: map[Family]time.Duration{IPv6: 50 * time.Millisecond}}
+	d := n.dialer(Race)
+	ctx := context.Background()
+
+	// IPv6 goes first, but is slow enough that IPv4 is raced and wins
+	conn, err := d.DialContext(ctx, "tcp", "svc.local:80")
+	assert.Equal(t, err, nil)
+	conn.Close()
+	assert.Equal(t, n.lastDialed(), []string{"[::1]:80", "127.0.0.1:80"})
+	// the loser is recorded as it gives up
+	s := d.Stats("svc.local")
+	for deadline := time.Now().Add(time.Second); s.IPv6 == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s = d.Stats("svc.local")
+	}
+	assert.Equal(t, s.IPv4 > 0 && s.IPv4 < s.IPv6, true)
+	assert.Equal(t, s.Preferred, IPv4)
+
+	// so IPv4 goes first from now on, and doesn't need racing
+	conn, err = d.DialContext(ctx, "tcp", "svc.local:80")
+	assert.Equal(t, err, nil)
+	conn.Close()
+	assert.Equal(t, n.lastDialed(), []string{"127.0.0.1:80"})
+
+	// unless it fails
+	n.Lock()
+	n.down = map[Family]bool{IPv4: true}
+	n.Unlock()
+	conn, err = d.DialContext(ctx, "tcp", "svc.local:80")
+	assert.Equal(t, err, nil)
+	conn.Close()
+	assert.Equal(t, n.lastDialed(), []string{"127.0.0.1:80", "[::1]:80"})
+
+	// pinned families and IPs are dialed as they are
+	n.Lock()
+	n.down = nil
+	n.Unlock()
+	conn, err = d.DialContext(ctx, "tcp6", "svc.local:80")
+	assert.Equal(t, err, nil)
+	conn.Close()
+	assert.Equal(t, n.lastDialed(), []string{"svc.local:80"})
+}
+
+func TestPrefer(t *testing.T) {
+	n := &testNet{delay: map[Family]time.Duration{IPv4: 20 * time.Millisecond}}
+	d := n.dialer(PreferIPv4)
+	conn, err := d.DialContext(context.Background(), "tcp", "svc.local:80")
+	assert.Equal(t, err, nil)
+	conn.Close()
+	// no racing however slow
+	assert.Equal(t, n.lastDialed(), []string{"127.0.0.1:80"})
+
+	n.down = map[Family]bool{IPv4: true, IPv6: true}
+	_, err = d.DialContext(context.Background(), "tcp", "svc.local:80")
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, n.lastDialed(), []string{"127.0.0.1:80", "[::1]:80"})
+	assert.Equal(t, d.Stats("svc.local").IPv6, failurePenalty)
+}
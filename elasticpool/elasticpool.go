@@ -0,0 +1,171 @@
+// Package elasticpool balances requests over the nodes of an Elasticsearch or
+// OpenSearch cluster with a hostpool. Nodes can be discovered by sniffing the
+// cluster, and are tracked by URL with their node names kept alongside for
+// statistics.
+package elasticpool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// Node is a cluster node requests can be sent to
+type Node struct {
+	// URL is the base URL of the node's HTTP interface, eg. http://10.0.0.1:9200
+	URL  string
+	Name string
+}
+
+// Pool hands out cluster nodes
+type Pool struct {
+	pool hostpool.HostPool
+
+	sync.RWMutex
+	names map[string]string // node name by URL
+}
+
+// Conn is a node handed out by Get. Mark it with the result of the request
+// sent to it.
+type Conn struct {
+	URL  string
+	Name string
+	resp hostpool.HostPoolResponse
+}
+
+// NodeStats is the statistics for a node, with its node name
+type NodeStats struct {
+	Name string
+	hostpool.HostStats
+}
+
+// New builds a Pool over the seed URLs. newPool builds the underlying
+// hostpool, nil uses hostpool.New.
+func New(urls []string, newPool func(hosts []string) hostpool.HostPool) *Pool {
+	if newPool == nil {
+		newPool = hostpool.New
+	}
+	return &Pool{pool: newPool(urls), names: make(map[string]string)}
+}
+
+// HostPool returns the pool nodes are picked from
+func (p *Pool) HostPool() hostpool.HostPool {
+	return p.pool
+}
+
+// SetNodes replaces the nodes in the pool, eg. with the result of Sniff.
+// Nodes that were already in the pool keep their health.
+func (p *Pool) SetNodes(nodes []Node) {
+	urls := make([]string, len(nodes))
+	names := make(map[string]string, len(nodes))
+	for i, n := range nodes {
+		urls[i] = n.URL
+		names[n.URL] = n.Name
+	}
+	sort.Strings(urls) // keep round robin order stable between sniffs
+	p.Lock()
+	p.names = names
+	p.Unlock()
+	p.pool.SetHosts(urls)
+}
+
+// Get returns a node to send a request to
+func (p *Pool) Get() *Conn {
+	resp := p.pool.Get()
+	p.RLock()
+	defer p.RUnlock()
+	return &Conn{URL: resp.Host(), Name: p.names[resp.Host()], resp: resp}
+}
+
+// Mark reports the result of the request. Only connection level errors
+// should be passed here: an error response from a node that is up is not a
+// reason to stop using it.
+func (c *Conn) Mark(err error) {
+	c.resp.Mark(err)
+}
+
+// Stats returns the statistics of every node in the pool
+func (p *Pool) Stats() []NodeStats {
+	hosts := p.pool.Statistics()
+	p.RLock()
+	defer p.RUnlock()
+	stats := make([]NodeStats, len(hosts))
+	for i, s := range hosts {
+		stats[i] = NodeStats{Name: p.names[s.Host], HostStats: s}
+	}
+	return stats
+}
+
+// Close closes the underlying hostpool
+func (p *Pool) Close() {
+	p.pool.Close()
+}
+
+// Sniff asks a node in the pool for the nodes in the cluster with an HTTP
+// interface, and replaces the pool's nodes with them. The node asked is marked
+// with the result. New URLs use the scheme of the node asked.
+func (p *Pool) Sniff(ctx context.Context, client *http.Client) error {
+	c := p.Get()
+	nodes, err := sniff(ctx, client, c.URL)
+	c.Mark(err)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return fmt.Errorf("elasticpool: %s returned no nodes with http enabled", c.URL)
+	}
+	p.SetNodes(nodes)
+	return nil
+}
+
+type nodesInfo struct {
+	Nodes map[string]struct {
+		Name string `json:"name"`
+		HTTP struct {
+			PublishAddress string `json:"publish_address"`
+		} `json:"http"`
+	} `json:"nodes"`
+}
+
+func sniff(ctx context.Context, client *http.Client, base string) ([]Node, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(base, "/")+"/_nodes/http", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("elasticpool: sniffing %s returned %s", base, resp.Status)
+	}
+	var info nodesInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	for _, n := range info.Nodes {
+		addr := n.HTTP.PublishAddress
+		if addr == "" {
+			continue
+		}
+		// publish addresses can look like hostname/10.0.0.1:9200
+		if i := strings.LastIndexByte(addr, '/'); i >= 0 {
+			addr = addr[i+1:]
+		}
+		nodes = append(nodes, Node{URL: u.Scheme + "://" + addr, Name: n.Name})
+	}
+	return nodes, nil
+}
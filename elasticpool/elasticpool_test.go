@@ -0,0 +1,53 @@
+package elasticpool
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/_nodes/http")
+		fmt.Fprintf(w, `{"nodes": {
+			"n1": {"name": "es-1", "http": {"publish_address": "es-1.local/10.0.0.1:9200"}},
+			"n2": {"name": "es-2", "http": {"publish_address": "10.0.0.2:9200"}},
+			"n3": {"name": "es-master"}
+		}}`)
+	}))
+	defer ts.Close()
+
+	p := New([]string{ts.URL}, nil)
+	defer p.Close()
+	assert.Equal(t, p.Sniff(context.Background(), http.DefaultClient), nil)
+
+	names := map[string]string{}
+	for _, s := range p.Stats() {
+		names[s.Host] = s.Name
+	}
+	assert.Equal(t, names, map[string]string{
+		"http://10.0.0.1:9200": "es-1",
+		"http://10.0.0.2:9200": "es-2",
+	})
+
+	c := p.Get()
+	assert.Equal(t, strings.HasPrefix(c.Name, "es-"), true)
+	c.Mark(nil)
+}
+
+func TestSetNodesKeepsHealth(t *testing.T) {
+	p := New([]string{"http://a:9200", "http://b:9200"}, nil)
+	defer p.Close()
+
+	c := p.Get()
+	c.Mark(fmt.Errorf("connection refused"))
+	p.SetNodes([]Node{{URL: "http://a:9200", Name: "a"}, {URL: "http://b:9200", Name: "b"}, {URL: "http://c:9200", Name: "c"}})
+	for _, s := range p.Stats() {
+		assert.Equal(t, s.Dead, s.Host == c.URL)
+	}
+}
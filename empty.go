@@ -0,0 +1,95 @@
+package hostpool
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoHosts is returned by GetContext when the pool has no hosts
+var ErrNoHosts = errors.New("no hosts in HostPool")
+
+// EmptyPoolPolicy decides what Get does when the pool has no hosts, either
+// because it was built without any or because they have all been removed
+type EmptyPoolPolicy int
+
+const (
+	// EmptyPoolFail makes GetContext return ErrNoHosts, and Get return a
+	// response with an empty Host that ignores marks
+	EmptyPoolFail EmptyPoolPolicy = iota
+	// EmptyPoolWait makes Get wait for a host to be added, and GetContext
+	// wait until then or the context is done
+	EmptyPoolWait
+)
+
+// noHostResponse is what Get returns from an empty pool
+type noHostResponse struct {
+	pool HostPool
+}
+
+func (r *noHostResponse) Host() string                       { return "" }
+func (r *noHostResponse) Endpoint() Host                     { return Host{} }
+func (r *noHostResponse) Trace() Trace                       { return Trace{} }
+func (r *noHostResponse) Mark(err error)                     {}
+func (r *noHostResponse) MarkScore(err error, score float64) {}
+func (r *noHostResponse) MarkBytes(err error, bytes int64)   {}
+func (r *noHostResponse) hostPool() HostPool                 { return r.pool }
+
+func (p *standardHostPool) SetEmptyPoolPolicy(policy EmptyPoolPolicy) {
+	p.Lock()
+	defer p.Unlock()
+	p.emptyPolicy = policy
+}
+
+// waitForHosts returns once the pool has hosts, following the empty pool
+// policy while it has none. It should only be called when the lock has
+// already been acquired, and may unlock while it waits
+func (p *standardHostPool) waitForHosts(ctx context.Context) error {
+	for len(p.hostList) == 0 {
+		if p.emptyPolicy != EmptyPoolWait {
+			return ErrNoHosts
+		}
+		if p.hostsAdded == nil {
+			p.hostsAdded = make(chan struct{})
+		}
+		added := p.hostsAdded
+		p.Unlock()
+		select {
+		case <-added:
+		case <-ctx.Done():
+			p.Lock()
+			return ctx.Err()
+		}
+		p.Lock()
+	}
+	return nil
+}
+
+// wakeWaiters lets Gets waiting on an empty pool go on, and should only be
+// called when the lock has already been acquired
+func (p *standardHostPool) wakeWaiters() {
+	if p.hostsAdded != nil && len(p.hostList) > 0 {
+		close(p.hostsAdded)
+		p.hostsAdded = nil
+	}
+}
+
+type getKey struct{}
+
+// forGet is the context Get and GetWithFeatures pick with. They have no way
+// to return an error, so Gets with it are never shed (see SetLoadShedding) or
+// failed by pacing (see SetPacing), only held up by it.
+var forGet = context.WithValue(context.Background(), getKey{}, true)
+
+// fromGet reports whether a Get was made with forGet
+func fromGet(ctx context.Context) bool {
+	return ctx.Value(getKey{}) != nil
+}
+
+// orNoHost turns the error from a GetContext without a deadline into the
+// response for Get
+func orNoHost(p HostPool, r HostPoolResponse, err error) HostPoolResponse {
+	if err != nil {
+		return &noHostResponse{pool: p}
+	}
+	return r
+}
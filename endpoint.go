@@ -0,0 +1,141 @@
+package hostpool
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Host is a host with its address broken out, for pools set up with
+// SetEndpoints rather than plain strings. The pool knows it by its String,
+// which is what Get hands out as the response's Host.
+type Host struct {
+	// Name is the host name or IP address
+	Name string
+	// IP is the host's address, if known
+	IP net.IP
+	// Port is 0 if not given
+	Port int
+	// Scheme is eg. "https", or empty
+	Scheme string
+	// Zone is the IPv6 zone of a link local address
+	Zone string
+	// Weight scales the share of traffic an epsilon greedy pool gives the
+	// host, eg. 2 for a host with twice the capacity of the others. 0 counts
+	// as 1. Round robin pools ignore it.
+	Weight float64
+	// Cost is what a request to the host costs relative to the others, eg.
+	// 1.5 for a host in another zone that egress is charged for. 0 counts
+	// as 1. Epsilon greedy pools divide the host's value by it, so that of
+	// hosts that perform alike the cheaper ones get more traffic; see
+	// SetCostSensitivity.
+	Cost float64
+	// Meta is anything else callers want kept with the host
+	Meta map[string]string
+	// Draining keeps the host in the pool, with everything learned about it,
+	// so that requests already sent to it are marked as usual, but it isn't
+	// picked for new requests unless every host is draining or down
+	Draining bool
+}
+
+// ParseHost breaks a host string (name, name:port, or scheme://name:port) up
+// into a Host. Any path is dropped.
+func ParseHost(s string) Host {
+	var h Host
+	rest := s
+	if i := strings.Index(rest, "://"); i >= 0 {
+		h.Scheme, rest = rest[:i], rest[i+3:]
+	}
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest = rest[:i]
+	}
+	name := rest
+	if host, port, err := net.SplitHostPort(rest); err == nil {
+		if n, err := strconv.Atoi(port); err == nil {
+			name, h.Port = host, n
+		}
+	} else {
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")
+	}
+	if i := strings.IndexByte(name, '%'); i >= 0 {
+		name, h.Zone = name[:i], name[i+1:]
+	}
+	h.Name = name
+	h.IP = net.ParseIP(name)
+	return h
+}
+
+// String puts the host back together as scheme://name:port, leaving out
+// whatever isn't set
+func (h Host) String() string {
+	if h.Scheme != "" {
+		return h.Scheme + "://" + h.address()
+	}
+	return h.address()
+}
+
+// URL returns the host as a URL with no path, eg. to build requests with. An
+// empty Scheme is left empty.
+func (h Host) URL() *url.URL {
+	return &url.URL{Scheme: h.Scheme, Host: h.address()}
+}
+
+// address is the name:port part of String
+func (h Host) address() string {
+	addr := h.Name
+	if addr == "" && h.IP != nil {
+		addr = h.IP.String()
+	}
+	if h.Zone != "" {
+		addr += "%" + h.Zone
+	}
+	if h.Port > 0 {
+		addr = net.JoinHostPort(addr, strconv.Itoa(h.Port))
+	}
+	return addr
+}
+
+// weight is Weight with 0 (or anything silly) as 1
+func (h *Host) weight() float64 {
+	if !validScore(h.Weight) {
+		return 1
+	}
+	return h.Weight
+}
+
+// cost is Cost with 0 (or anything silly) as 1
+func (h *Host) cost() float64 {
+	if !validScore(h.Cost) {
+		return 1
+	}
+	return h.Cost
+}
+
+func (r *standardHostPoolResponse) Endpoint() Host {
+	if h, ok := r.pool.Endpoint(r.host); ok {
+		return h
+	}
+	// removed from the pool since
+	return ParseHost(r.host)
+}
+
+func (p *standardHostPool) SetEndpoints(hosts []Host) {
+	names := make([]string, len(hosts))
+	for i, h := range hosts {
+		names[i] = h.String()
+	}
+	p.Lock()
+	defer p.unlockAndNotify()
+	p.setEndpoints(names, hosts)
+}
+
+func (p *standardHostPool) Endpoint(host string) (Host, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	h, ok := p.hosts[host]
+	if !ok {
+		return Host{}, false
+	}
+	return h.endpoint, true
+}
@@ -1,31 +1,139 @@
 package hostpool
 
 import (
-	"log"
+	"context"
+	"math"
 	"math/rand"
+	"sync/atomic"
 	"time"
 )
 
 type epsilonHostPoolResponse struct {
 	standardHostPoolResponse
-	started time.Time
-	ended   time.Time
+	started  time.Time
+	ended    time.Time
+	score    float64
+	hasScore bool
+	class    string
+	bytes    int64 // as marked with MarkBytes
 }
 
 func (r *epsilonHostPoolResponse) Mark(err error) {
 	r.Do(func() {
 		r.ended = time.Now()
+		r.err = err
 		doMark(err, r)
 	})
 }
 
+func (r *epsilonHostPoolResponse) elapsed() (time.Duration, bool) {
+	p, ok := r.pool.(*epsilonGreedyHostPool)
+	if !ok || r.hasScore {
+		return 0, false
+	}
+	return p.between(r.started, r.ended), true
+}
+
+func (r *epsilonHostPoolResponse) MarkScore(err error, score float64) {
+	if !validScore(score) {
+		// a score of zero or below can't be turned into a weight, so fall back
+		// to the measured response time
+		r.Mark(err)
+		return
+	}
+	r.Do(func() {
+		r.ended = time.Now()
+		r.score = score
+		r.hasScore = true
+		r.err = err
+		doMark(err, r)
+	})
+}
+
+// EpsilonGreedyHostPool is implemented by the HostPool returned from
+// NewEpsilonGreedy, for tuning how it explores.
+type EpsilonGreedyHostPool interface {
+	HostPool
+	// SetEpsilon restarts the default exploration schedule at newEpsilon
+	SetEpsilon(newEpsilon float32)
+	SetExplorationStrategy(ExplorationStrategy)
+	// SetMinExploration makes sure every live host is explored at least n
+	// times per decay duration, however badly it scores, so that a host that
+	// recovers gets the chance to show it. 0 turns this off.
+	SetMinExploration(n int)
+	// SetPerformanceMode switches Get to a lock free path built for very high
+	// request rates, see performance.go
+	SetPerformanceMode(enabled bool)
+	// SetSelectionCache reuses the traffic shares worked out for a Get for a
+	// short time, see selection_cache.go
+	SetSelectionCache(window time.Duration, picks int)
+	// SetTimingSampleRate makes marks record timings for only a fraction of
+	// requests, picked at random, which cuts the cost of Mark for very busy
+	// clients. Successes and failures are sampled alike, so averages and error
+	// rates stay unbiased; health tracking still sees every mark. A rate of 0
+	// or 1 and above records every request.
+	SetTimingSampleRate(rate float64)
+	// SetMaxTiming sets the longest response time the pool believes, eg. to
+	// leave out responses marked hours after they finished. Longer ones, and
+	// any that come out negative after the clock is set back, are counted in
+	// HostStats.TimingAnomalies rather than recorded; their marks still count
+	// for health. 0, the default, only leaves out negative ones.
+	SetMaxTiming(max time.Duration)
+	// SetErrorPenalty scores every failed request of the given class as if
+	// it had taken penalty, see penalty.go. 0 removes the penalty.
+	SetErrorPenalty(class ErrorClass, penalty time.Duration)
+	// SetCooldown cuts the traffic of hosts with bursts of errors, see
+	// Cooldown
+	SetCooldown(Cooldown)
+	// Priors returns the score the pool has learned for each host, to be
+	// saved and handed to SetPriors when the process restarts
+	Priors() []HostPrior
+	// SetPriors starts hosts off with saved scores rather than nothing, so
+	// the pool doesn't have to learn them all over again. Each prior counts
+	// as weight requests (0 uses a default of 10) mixed in with the host's
+	// own response times, and its weight halves every decay tick, so fresh
+	// data soon takes over. Hosts not in the pool are skipped.
+	SetPriors(priors []HostPrior, weight float64)
+	// SeedScore starts a single host off with avgLatency as its prior, see
+	// SetPriors
+	SeedScore(host string, avgLatency time.Duration, weight float64) bool
+	// SetCostSensitivity sets how much host costs count against them, see
+	// Host.Cost
+	SetCostSensitivity(s float64)
+	// SetDecisionLogging logs a sampled fraction of host picks, with the
+	// shares and skip reasons behind them, see logger.go
+	SetDecisionLogging(rate float64)
+}
+
 type epsilonGreedyHostPool struct {
-	*standardHostPool              // TODO - would be nifty if we could embed HostPool and Locker interfaces
-	epsilon                float32 // this is our exploration factor
+	*standardHostPool                          // TODO - would be nifty if we could embed HostPool and Locker interfaces
+	exploration            ExplorationStrategy // decides our exploration factor
+	minExploration         int64
 	decayDuration          time.Duration
 	EpsilonValueCalculator // embed the epsilonValueCalculator
 	timer
-	quit chan bool
+	decay  *decayEntry // nil until the pool sees its first traffic
+	closed bool
+
+	// performance mode state, see SetPerformanceMode
+	performance  int32        // accessed atomically
+	snapshot     atomic.Value // *hostSnapshot
+	fastNext     uint64       // accessed atomically
+	fastExplored int64        // accessed atomically
+
+	// selection cache state, see SetSelectionCache
+	cacheWindow time.Duration
+	cachePicks  int
+	selections  map[string]*selectionCache
+
+	sampleRate   uint64 // float64 bits, accessed atomically. 0 records everything
+	maxTiming    int64  // time.Duration, accessed atomically, see SetMaxTiming
+	decisionRate uint64 // float64 bits, accessed atomically, see SetDecisionLogging
+
+	penalties map[ErrorClass]float64 // in milliseconds
+	cooldown  *Cooldown
+
+	costSensitivity float64 // see SetCostSensitivity
 }
 
 // Construct an Epsilon Greedy HostPool
@@ -48,91 +156,282 @@ func NewEpsilonGreedy(hosts []string, decayDuration time.Duration, calc EpsilonV
 		decayDuration = defaultDecayDuration
 	}
 	stdHP := New(hosts).(*standardHostPool)
+	// timing structures are allocated as hosts get traffic, see hostTimings
 	p := &epsilonGreedyHostPool{
 		standardHostPool:       stdHP,
-		epsilon:                float32(initialEpsilon),
+		exploration:            NewDecayingExploration(initialEpsilon, epsilonDecay, minEpsilon),
 		decayDuration:          decayDuration,
 		EpsilonValueCalculator: calc,
-		timer: &realTimer{},
-		quit:  make(chan bool),
+		timer:                  &realTimer{},
+		costSensitivity:        1,
 	}
+	stdHP.onHealthChange = p.hostsChanged
+	stdHP.hostScore = (*hostEntry).getWeightedAverageResponseTime
+	stdHP.hostLatency = (*hostEntry).getLatency
+	return p
+}
 
-	// allocate structures
-	for _, h := range p.hostList {
-		h.epsilonCounts = make([]int64, epsilonBuckets)
-		h.epsilonValues = make([]int64, epsilonBuckets)
+func (p *epsilonGreedyHostPool) SetTimingSampleRate(rate float64) {
+	if !(rate > 0 && rate < 1) {
+		rate = 0
 	}
-	go p.epsilonGreedyDecay()
-	return p
+	atomic.StoreUint64(&p.sampleRate, math.Float64bits(rate))
+}
+
+func (p *epsilonGreedyHostPool) SetMaxTiming(max time.Duration) {
+	if max < 0 {
+		max = 0
+	}
+	atomic.StoreInt64(&p.maxTiming, int64(max))
+}
+
+// plausible reports whether a response time can be believed, counting it as
+// an anomaly if not. It should only be called between lockTimings and
+// unlockTimings
+func (p *epsilonGreedyHostPool) plausible(h *hostEntry, d time.Duration) bool {
+	if max := time.Duration(atomic.LoadInt64(&p.maxTiming)); d < 0 || (max > 0 && d > max) {
+		h.timingAnomalies++
+		return false
+	}
+	return true
+}
+
+// sampled decides whether to record the timing of a request
+func (p *epsilonGreedyHostPool) sampled() bool {
+	rate := math.Float64frombits(atomic.LoadUint64(&p.sampleRate))
+	if rate == 0 {
+		return true
+	}
+	r := fastRands.Get().(*rand.Rand)
+	v := r.Float64()
+	fastRands.Put(r)
+	return v < rate
+}
+
+// hostsChanged drops everything worked out from the old set of live hosts,
+// and should only be called when the lock has already been acquired
+func (p *epsilonGreedyHostPool) hostsChanged() {
+	p.invalidateSelections()
+	p.rebuildSnapshot()
 }
 
 func (p *epsilonGreedyHostPool) Close() {
-	// No need to do p.quit <- true as close(p.quit) does the trick.
-	close(p.quit)
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	p.releaseClock()
+	p.replaceSink(nil)
+	if p.decay != nil {
+		decayer.remove(p.decay)
+		p.decay = nil
+	}
+}
+
+// startDecay schedules the pool's decay ticks the first time it's used, so idle
+// pools cost nothing. It should only be called when the lock has already been
+// acquired
+func (p *epsilonGreedyHostPool) startDecay() {
+	if p.decay == nil && !p.closed {
+		p.decay = decayer.add(p, p.decayDuration/epsilonBuckets)
+	}
 }
 
 func (p *epsilonGreedyHostPool) SetEpsilon(newEpsilon float32) {
 	p.Lock()
 	defer p.Unlock()
-	p.epsilon = newEpsilon
+	p.exploration = NewDecayingExploration(newEpsilon, epsilonDecay, minEpsilon)
 }
 
-func (p *epsilonGreedyHostPool) epsilonGreedyDecay() {
-	durationPerBucket := p.decayDuration / epsilonBuckets
-	ticker := time.NewTicker(durationPerBucket)
-	for {
-		select {
-		case <-p.quit:
-			ticker.Stop()
-			return
-		case <-ticker.C:
-			p.performEpsilonGreedyDecay()
-		}
-	}
+func (p *epsilonGreedyHostPool) SetMinExploration(n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.minExploration = int64(n)
+}
+
+func (p *epsilonGreedyHostPool) SetExplorationStrategy(s ExplorationStrategy) {
+	p.Lock()
+	defer p.Unlock()
+	p.exploration = s
 }
+
 func (p *epsilonGreedyHostPool) performEpsilonGreedyDecay() {
 	p.Lock()
+	// before the oldest bucket is cleared for reuse
+	p.checkCooldowns(time.Now())
 	for _, h := range p.hostList {
 		h.epsilonIndex += 1
 		h.epsilonIndex = h.epsilonIndex % epsilonBuckets
-		h.epsilonCounts[h.epsilonIndex] = 0
-		h.epsilonValues[h.epsilonIndex] = 0
+		h.decayPrior()
+		if h.hostTimings != nil {
+			h.clearBucket(h.epsilonIndex)
+		}
+		if h.epsilonIndex == 0 {
+			// a full decay duration has gone by
+			h.explorationPicks = 0
+			if h.hostTimings != nil && h.empty() {
+				// and the host hasn't had any traffic in it
+				h.hostTimings = nil
+			}
+		}
+	}
+	shares, averages := p.scoreHosts()
+	if o, ok := p.exploration.(ScoreObserver); ok {
+		o.ObserveScores(shares, averages)
 	}
+	if atomic.SwapInt64(&p.fastExplored, 0) > 0 {
+		p.exploration.Explored()
+	}
+	p.invalidateSelections()
+	p.rebuildSnapshot()
 	p.Unlock()
 }
 
+// scoreHosts works out the value each live host with response times gets from
+// the calculator, and its share of traffic for a request without features,
+// caching them on the hosts for Statistics. It returns the shares along with
+// the response times they were calculated from, and should only be called when
+// the lock has already been acquired
+func (p *epsilonGreedyHostPool) scoreHosts() (shares []float64, averages []float64) {
+	now := time.Now()
+	var scored []*hostEntry
+	var sum float64
+	for _, h := range p.hostList {
+		h.tickValue, h.tickPercentage = 0, 0
+		if !h.canTryHost(now) {
+			continue
+		}
+		v := h.getWeightedAverageResponseTime()
+		if v > 0 {
+			h.tickValue = p.calcValue(h, v, RequestFeatures{})
+			scored = append(scored, h)
+			averages = append(averages, v)
+			sum += h.tickValue
+		}
+	}
+	for _, h := range scored {
+		h.tickPercentage = h.tickValue / sum
+		shares = append(shares, h.tickPercentage)
+	}
+	return shares, averages
+}
+
 func (p *epsilonGreedyHostPool) Get() HostPoolResponse {
+	return p.GetWithFeatures(RequestFeatures{})
+}
+
+func (p *epsilonGreedyHostPool) GetWithFeatures(f RequestFeatures) HostPoolResponse {
+	r, err := p.GetContext(forGet, f)
+	return orNoHost(p, r, err)
+}
+
+func (p *epsilonGreedyHostPool) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	return p.getRefreshed(ctx, f, func() (HostPoolResponse, error) { return p.getContext(ctx, f) })
+}
+
+func (p *epsilonGreedyHostPool) getContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	if atomic.LoadInt32(&p.performance) == 1 && atomic.LoadInt32(&p.limitsSet) == 0 && atomic.LoadInt32(&p.prioritiesSet) == 0 && f.Filter == nil {
+		if r := p.getFast(); r != nil {
+			r.trace = requestTrace(ctx, f)
+			p.emit(Event{Kind: EventSelected, Host: r.host, Trace: r.trace})
+			p.watchLeaks(r)
+			return r, nil
+		}
+	}
 	p.Lock()
-	defer p.Unlock()
-	host := p.getEpsilonGreedy()
+	defer p.unlockAndNotify()
+	if err := p.waitForHosts(ctx); err != nil {
+		return nil, err
+	}
+	if err := p.waitForCapacity(ctx); err != nil {
+		return nil, err
+	}
+	if f.Filter != nil {
+		if !p.useFilter(f.Filter) {
+			return nil, ErrNoHosts
+		}
+		defer func() { p.filter = nil }()
+	}
+	if p.usePriority(f) {
+		defer func() { p.avoid = nil }()
+	}
+	p.startDecay()
+	host, how := p.getEpsilonGreedy(f)
 	started := time.Now()
-	return &epsilonHostPoolResponse{
-		standardHostPoolResponse: standardHostPoolResponse{host: host, pool: p},
+	t := requestTrace(ctx, f)
+	p.logDecision(host, how, f, t, started)
+	atomic.AddInt64(&p.hosts[host].inFlight, 1)
+	p.hosts[host].lastSelected = started
+	p.emit(Event{Kind: EventSelected, Host: host, Trace: t})
+	r := &epsilonHostPoolResponse{
+		standardHostPoolResponse: standardHostPoolResponse{host: host, pool: p, inFlight: true, trace: t},
 		started:                  started,
+		class:                    f.Class,
 	}
+	p.watchLeaks(r)
+	return r, nil
 }
 
-func (p *epsilonGreedyHostPool) getEpsilonGreedy() string {
-	var hostToUse *hostEntry
+func (p *epsilonGreedyHostPool) getEpsilonGreedy(f RequestFeatures) (string, pickReason) {
+	now := p.now()
+	// hosts that haven't had their minimum exploration yet go first
+	if p.minExploration > 0 {
+		for _, h := range p.hostList {
+			if h.explorationPicks < p.minExploration && h.canTryHost(now) && !p.excluded(h) {
+				if h.dead {
+					p.retryHost(h)
+				}
+				h.explorationPicks++
+				return h.host, pickedMinExploration
+			}
+		}
+	}
 
 	// this is our exploration phase
-	if rand.Float32() < p.epsilon {
-		p.epsilon = p.epsilon * epsilonDecay
-		if p.epsilon < minEpsilon {
-			p.epsilon = minEpsilon
-		}
-		return p.getRoundRobin()
+	if rand.Float32() < p.exploration.Epsilon() {
+		p.exploration.Explored()
+		host := p.getLeastRecentlyTried(now)
+		p.hosts[host].explorationPicks++
+		return host, pickedExploring
 	}
 
+	how := pickedCached
+	hostToUse := p.cachedPick(f, now)
+	if hostToUse != nil && p.excluded(hostToUse) {
+		hostToUse = nil
+	}
+	if hostToUse == nil {
+		how = pickedWeighted
+		hostToUse = p.getWeighted(f, now)
+	}
+
+	if hostToUse == nil {
+		return p.getRoundRobin(), pickedRoundRobin
+	}
+
+	if hostToUse.dead {
+		p.retryHost(hostToUse)
+	}
+	return hostToUse.host, how
+}
+
+// getWeighted does a weighted random choice among the hosts that have a score,
+// and returns nil if there are none
+func (p *epsilonGreedyHostPool) getWeighted(f RequestFeatures, now time.Time) *hostEntry {
+	var hostToUse *hostEntry
+
 	// calculate values for each host in the 0..1 range (but not ormalized)
 	var possibleHosts []*hostEntry
-	now := time.Now()
 	var sumValues float64
 	for _, h := range p.hostList {
-		if h.canTryHost(now) {
-			v := h.getWeightedAverageResponseTime()
+		if h.canTryHost(now) && !p.excluded(h) {
+			var v float64
+			if f.Class != "" {
+				v = h.getWeightedAverageClassResponseTime(f.Class)
+			} else {
+				v = h.getWeightedAverageResponseTime()
+			}
 			if v > 0 {
-				ev := p.CalcValueFromAvgResponseTime(v)
+				ev := p.calcValue(h, v, f)
 				h.epsilonValue = ev
 				sumValues += ev
 				possibleHosts = append(possibleHosts, h)
@@ -158,17 +457,80 @@ func (p *epsilonGreedyHostPool) getEpsilonGreedy() string {
 		}
 	}
 
-	if hostToUse == nil {
-		if len(possibleHosts) != 0 {
-			log.Println("Failed to randomly choose a host, Dan loses")
+	if hostToUse == nil && len(possibleHosts) != 0 {
+		p.logf("Failed to randomly choose a host, Dan loses")
+	}
+	if hostToUse != nil {
+		p.cacheSelection(f, now, possibleHosts)
+	}
+	return hostToUse
+}
+
+// getLeastRecentlyTried explores the live host that was selected the longest
+// time ago, since that's where we know the least about current response times
+func (p *epsilonGreedyHostPool) getLeastRecentlyTried(now time.Time) string {
+	var oldest *hostEntry
+	for _, h := range p.hostList {
+		if h.canTryHost(now) && !p.excluded(h) && (oldest == nil || h.lastSelected.Before(oldest.lastSelected)) {
+			oldest = h
 		}
+	}
+	if oldest == nil {
+		// all hosts are down, let round robin re-add them
 		return p.getRoundRobin()
 	}
+	if oldest.dead {
+		p.retryHost(oldest)
+	}
+	return oldest.host
+}
+
+// calcValue scores a host using the calculator, handing it the full set of
+// metrics and the request features if it asks for them
+func (p *epsilonGreedyHostPool) calcValue(h *hostEntry, avgResponseTime float64, f RequestFeatures) float64 {
+	var v float64
+	switch c := p.EpsilonValueCalculator.(type) {
+	case ContextualEpsilonValueCalculator:
+		v = c.CalcValueForRequest(p.hostMetrics(h, avgResponseTime), f)
+	case MetricsEpsilonValueCalculator:
+		v = c.CalcValueFromMetrics(p.hostMetrics(h, avgResponseTime))
+	default:
+		v = p.CalcValueFromAvgResponseTime(avgResponseTime)
+	}
+	return clampEpsilonValue(v * p.cooldownWeight(h) * p.weight(h) / p.costFactor(h))
+}
 
-	if hostToUse.dead {
-		hostToUse.willRetryHost(p.maxRetryInterval)
+// SetCostSensitivity sets how strongly host costs (see Host.Cost) count
+// against them: a host's value is divided by its cost to the power of s. The
+// default of 1 gives a host that costs twice as much half the value; 0
+// ignores costs.
+func (p *epsilonGreedyHostPool) SetCostSensitivity(s float64) {
+	p.Lock()
+	defer p.Unlock()
+	if !(s > 0) {
+		s = 0
+	}
+	p.costSensitivity = s
+}
+
+func (p *epsilonGreedyHostPool) costFactor(h *hostEntry) float64 {
+	c := h.endpoint.cost()
+	if c == 1 || p.costSensitivity == 0 {
+		return 1
+	}
+	return math.Pow(c, p.costSensitivity)
+}
+
+func (p *epsilonGreedyHostPool) hostMetrics(h *hostEntry, avgResponseTime float64) HostMetrics {
+	_, confidence := h.getConfidentScore()
+	return HostMetrics{
+		Host:            h.host,
+		AvgResponseTime: avgResponseTime,
+		ErrorRate:       h.getErrorRate(),
+		InFlight:        atomic.LoadInt64(&h.inFlight),
+		Throughput:      h.getThroughput(),
+		Confidence:      confidence,
 	}
-	return hostToUse.host
 }
 
 func (p *epsilonGreedyHostPool) markSuccess(hostR HostPoolResponse) {
@@ -176,20 +538,232 @@ func (p *epsilonGreedyHostPool) markSuccess(hostR HostPoolResponse) {
 	p.standardHostPool.markSuccess(hostR)
 	eHostR, ok := hostR.(*epsilonHostPoolResponse)
 	if !ok {
-		log.Printf("Incorrect type in eps markSuccess!") // TODO reflection to print out offending type
+		p.logf("Incorrect type in eps markSuccess!") // TODO reflection to print out offending type
+		return
+	}
+	if !p.sampled() {
 		return
 	}
 	host := eHostR.host
 	duration := p.between(eHostR.started, eHostR.ended)
 
-	p.Lock()
-	defer p.Unlock()
+	h := p.lockTimings(host)
+	if h == nil {
+		return
+	}
+	defer p.unlockTimings(h)
+	// a score stands in for the response time, which is still needed for
+	// throughput
+	timed := true
+	if !eHostR.hasScore || eHostR.bytes > 0 {
+		timed = p.plausible(h, duration)
+	}
+	score := duration.Seconds() * 1000
+	if eHostR.hasScore {
+		score = eHostR.score
+		p.recordScore(h, score)
+	} else if timed {
+		p.recordTiming(h, duration)
+	}
+	if eHostR.bytes > 0 && timed {
+		p.recordThroughput(h, eHostR.bytes, duration)
+	}
+	if eHostR.class != "" && (eHostR.hasScore || timed) {
+		p.recordClassScore(h, eHostR.class, score)
+	}
+	if eHostR.err != nil && p.errorClass(eHostR.err) == PartialSuccess {
+		p.recordPenalty(h, PartialSuccess, eHostR.class)
+	}
+}
+
+func (p *epsilonGreedyHostPool) markFailed(hostR HostPoolResponse) {
+	p.standardHostPool.markFailed(hostR)
+	eHostR, ok := hostR.(*epsilonHostPoolResponse)
+	if !ok {
+		p.logf("Incorrect type in eps markFailed!")
+		return
+	}
+	if !p.sampled() {
+		return
+	}
+	duration := p.between(eHostR.started, eHostR.ended)
+
+	h := p.lockTimings(eHostR.host)
+	if h == nil {
+		return
+	}
+	defer p.unlockTimings(h)
+	p.recordError(h)
+	if !eHostR.hasScore && p.plausible(h, duration) {
+		// a score is not a response time, so there's no latency to track
+		p.recordFailureTiming(h, duration)
+	}
+	p.recordPenalty(h, p.errorClass(eHostR.err), eHostR.class)
+}
+
+func (p *epsilonGreedyHostPool) MarkBatch(host string, results []Outcome) {
+	p.standardHostPool.MarkBatch(host, results)
+
+	p.RLock()
+	started := p.decay != nil || p.closed
+	p.RUnlock()
+	if !started {
+		p.Lock()
+		p.startDecay()
+		p.Unlock()
+	}
+
+	h := p.lockTimings(host)
+	if h == nil {
+		return
+	}
+	defer p.unlockTimings(h)
+	for _, o := range results {
+		if !p.sampled() {
+			continue
+		}
+		switch c := p.errorClass(o.Err); {
+		case c.succeeded():
+			if p.plausible(h, o.Duration) {
+				p.recordTiming(h, o.Duration)
+			}
+			if c == PartialSuccess {
+				p.recordPenalty(h, c, "")
+			}
+		case c.hostFailed():
+			p.recordError(h)
+			if p.plausible(h, o.Duration) {
+				p.recordFailureTiming(h, o.Duration)
+			}
+			p.recordPenalty(h, c, "")
+		case c == Throttled:
+			p.recordPenalty(h, c, "")
+		}
+	}
+}
+
+// lockTimings gets ready to record timings for a host. Recording only takes
+// the pool's read lock plus the host's own timing lock, so marks on different
+// hosts never wait on each other; anything that takes the pool's full lock
+// (selection, decay) sees the buckets without needing the host locks. It
+// returns nil, with nothing locked, if the host isn't in the pool.
+func (p *epsilonGreedyHostPool) lockTimings(host string) *hostEntry {
+	p.RLock()
+	h := p.lookupHost(host)
+	if h == nil {
+		p.RUnlock()
+		return nil
+	}
+	h.timingLock.Lock()
+	return h
+}
+
+func (p *epsilonGreedyHostPool) unlockTimings(h *hostEntry) {
+	h.timingLock.Unlock()
+	p.RUnlock()
+}
+
+func (p *epsilonGreedyHostPool) Statistics() []HostStats {
+	p.RLock()
+	defer p.RUnlock()
+	stats := make([]HostStats, len(p.hostList))
+	now := time.Now()
+	for i, h := range p.hostList {
+		stats[i] = p.epsilonHostStats(h, now)
+	}
+	return stats
+}
+
+func (p *epsilonGreedyHostPool) HostStatistics(host string) (HostStats, bool) {
+	p.RLock()
+	defer p.RUnlock()
 	h, ok := p.hosts[host]
 	if !ok {
-		log.Fatalf("host %s not in HostPool %v", host, p.Hosts())
+		return HostStats{}, false
+	}
+	return p.epsilonHostStats(h, time.Now()), true
+}
+
+// epsilonHostStats adds what the pool has learned to a host's stats, and
+// should only be called when the lock (or read lock) has already been acquired
+func (p *epsilonGreedyHostPool) epsilonHostStats(h *hostEntry, now time.Time) HostStats {
+	s := p.hostStats(h, now)
+	h.timingLock.Lock()
+	defer h.timingLock.Unlock()
+	s.Score = h.getWeightedAverageResponseTime()
+	s.SampledScore, s.Confidence = h.getConfidentScore()
+	s.Throughput = h.getThroughput()
+	s.ExplorationPicks = h.explorationPicks
+	s.EpsilonValue = h.tickValue
+	s.EpsilonPercentage = h.tickPercentage
+	if p.cooldownWeight(h) < 1 {
+		s.CooldownUntil = h.cooldownUntil
 	}
-	h.epsilonCounts[h.epsilonIndex]++
-	h.epsilonValues[h.epsilonIndex] += int64(duration.Seconds() * 1000)
+	s.SuccessLatency = msToDuration(h.getWeightedAverageLatency())
+	s.FailureLatency = msToDuration(h.getWeightedAverageFailureTime())
+	s.TimingAnomalies = h.timingAnomalies
+	return s
+}
+
+// recordTiming adds a response time to the current bucket for a host, and
+// should only be called between lockTimings and unlockTimings
+func (p *epsilonGreedyHostPool) recordTiming(h *hostEntry, duration time.Duration) {
+	ms := duration.Seconds() * 1000
+	t := h.timings()
+	t.latencyCounts[h.epsilonIndex]++
+	t.latencyValues[h.epsilonIndex] += ms
+	p.recordScore(h, ms)
+}
+
+// recordClassScore should only be called between lockTimings and
+// unlockTimings
+func (p *epsilonGreedyHostPool) recordClassScore(h *hostEntry, class string, score float64) {
+	t := h.timings()
+	c, ok := t.classes[class]
+	if !ok {
+		if len(t.classes) >= maxClassesPerHost {
+			return
+		}
+		if t.classes == nil {
+			t.classes = make(map[string]*classTimings)
+		}
+		c = &classTimings{
+			counts: make([]int64, epsilonBuckets),
+			values: make([]float64, epsilonBuckets),
+		}
+		t.classes[class] = c
+	}
+	c.counts[h.epsilonIndex]++
+	c.values[h.epsilonIndex] += score
+}
+
+// recordFailureTiming tracks the response time of a failed request for a host.
+// These are kept apart from successful response times and do not affect the
+// host's score; it should only be called between lockTimings and
+// unlockTimings
+func (p *epsilonGreedyHostPool) recordFailureTiming(h *hostEntry, duration time.Duration) {
+	t := h.timings()
+	t.failureCounts[h.epsilonIndex]++
+	t.failureValues[h.epsilonIndex] += duration.Seconds() * 1000
+}
+
+// recordError counts a failed request against a host's error rate, and should
+// only be called between lockTimings and unlockTimings
+func (p *epsilonGreedyHostPool) recordError(h *hostEntry) {
+	h.timings().errorCounts[h.epsilonIndex]++
+}
+
+// recordScore adds a score (in the same units as a response time in
+// milliseconds) to the current bucket for a host, and should only be called
+// between lockTimings and unlockTimings
+func (p *epsilonGreedyHostPool) recordScore(h *hostEntry, score float64) {
+	t := h.timings()
+	t.epsilonCounts[h.epsilonIndex]++
+	t.epsilonValues[h.epsilonIndex] += score
+}
+
+func validScore(score float64) bool {
+	return score > 0 && !math.IsInf(score, 1)
 }
 
 // --- timer: this just exists for testing
@@ -13,10 +13,60 @@ import (
 // times should yield higher scores (we want to select the faster hosts more often) The default
 // LinearEpsilonValueCalculator just uses the reciprocal of the response time. In practice, any
 // decreasing function from the positive reals to the positive reals should work.
+//
+// Values must be positive and finite, since they're normalized into the share of traffic each
+// host gets. The pool clamps anything else into [minEpsilonValue, maxEpsilonValue], so a zero,
+// negative or NaN value gives a host a negligible share rather than corrupting the others.
 type EpsilonValueCalculator interface {
 	CalcValueFromAvgResponseTime(float64) float64
 }
 
+const minEpsilonValue = 1e-12
+const maxEpsilonValue = 1e12
+
+func clampEpsilonValue(v float64) float64 {
+	if math.IsNaN(v) || v < minEpsilonValue {
+		return minEpsilonValue
+	}
+	if v > maxEpsilonValue {
+		return maxEpsilonValue
+	}
+	return v
+}
+
+// HostMetrics is what an epsilon greedy pool knows about a host when scoring it
+type HostMetrics struct {
+	Host string
+	// weighted average response time in milliseconds over the decay duration
+	AvgResponseTime float64
+	// fraction of requests marked as failed over the decay duration
+	ErrorRate float64
+	// requests handed out by Get and not marked yet
+	InFlight int64
+	// bytes per second over the decay duration, for requests marked with
+	// MarkBytes, and 0 if there were none
+	Throughput float64
+	// how far AvgResponseTime can be trusted, from 0 with no recent samples
+	// towards 1 with many, see HostStats.Confidence
+	Confidence float64
+}
+
+// Calculators that need more than the average response time to score a host
+// can implement this interface, and the pool will call CalcValueFromMetrics
+// instead of CalcValueFromAvgResponseTime.
+type MetricsEpsilonValueCalculator interface {
+	EpsilonValueCalculator
+	CalcValueFromMetrics(HostMetrics) float64
+}
+
+// Calculators that score hosts differently depending on the request being made
+// can implement this interface, and the pool will call CalcValueForRequest with
+// the features passed to GetWithFeatures (or the zero RequestFeatures for Get).
+type ContextualEpsilonValueCalculator interface {
+	EpsilonValueCalculator
+	CalcValueForRequest(HostMetrics, RequestFeatures) float64
+}
+
 type LinearEpsilonValueCalculator struct{}
 type LogEpsilonValueCalculator struct{ LinearEpsilonValueCalculator }
 type PolynomialEpsilonValueCalculator struct {
@@ -24,6 +74,42 @@ type PolynomialEpsilonValueCalculator struct {
 	Exp float64 // the exponent to which we will raise the value to reweight
 }
 
+// SigmoidEpsilonValueCalculator scores hosts with a logistic curve that is
+// close to 1 for response times well under Midpoint and falls towards 0 past
+// it, over a range set by Steepness (both in milliseconds). Unlike the
+// reciprocal based calculators it is bounded, so very fast hosts don't take
+// nearly all the traffic, and very slow ones are all equally bad.
+type SigmoidEpsilonValueCalculator struct {
+	Midpoint  float64
+	Steepness float64
+}
+
+// CappedLinearEpsilonValueCalculator is the LinearEpsilonValueCalculator with
+// response times clamped to [Min, Max] milliseconds first, so a host can get
+// at most Max/Min times the traffic of another.
+type CappedLinearEpsilonValueCalculator struct {
+	Min float64
+	Max float64
+}
+
+// CompositeEpsilonValueCalculator scores hosts on a weighted sum of their
+// latency, error rate and in flight requests, scaled by a static per host cost:
+//
+//	1 / ((LatencyWeight*avg + ErrorWeight*errorRate + LoadWeight*inFlight) * cost)
+//
+// The weights are in units of milliseconds, so an ErrorWeight of 1000 makes a
+// host failing every request look as bad as one a second slower. Hosts missing
+// from Costs have a cost of 1.
+type CompositeEpsilonValueCalculator struct {
+	LatencyWeight float64
+	ErrorWeight   float64
+	LoadWeight    float64
+	Costs         map[string]float64
+}
+
+// keeps a host with no penalty at all from getting an infinite score
+const minCompositePenalty = 0.001
+
 // -------- Methods -----------------------
 
 func (c *LinearEpsilonValueCalculator) CalcValueFromAvgResponseTime(v float64) float64 {
@@ -31,10 +117,47 @@ func (c *LinearEpsilonValueCalculator) CalcValueFromAvgResponseTime(v float64) f
 }
 
 func (c *LogEpsilonValueCalculator) CalcValueFromAvgResponseTime(v float64) float64 {
-	// we need to add 1 to v so that this will be defined on all positive floats
-	return c.LinearEpsilonValueCalculator.CalcValueFromAvgResponseTime(math.Log(v + 1.0))
+	// we need to add 1 to v so that this will be defined on all positive floats,
+	// and keep it there so the log stays positive
+	if v < 0 {
+		v = 0
+	}
+	return c.LinearEpsilonValueCalculator.CalcValueFromAvgResponseTime(math.Log1p(v))
 }
 
 func (c *PolynomialEpsilonValueCalculator) CalcValueFromAvgResponseTime(v float64) float64 {
 	return c.LinearEpsilonValueCalculator.CalcValueFromAvgResponseTime(math.Pow(v, c.Exp))
 }
+
+func (c *SigmoidEpsilonValueCalculator) CalcValueFromAvgResponseTime(v float64) float64 {
+	steepness := c.Steepness
+	if steepness <= 0 {
+		steepness = 1
+	}
+	return 1.0 / (1.0 + math.Exp((v-c.Midpoint)/steepness))
+}
+
+func (c *CappedLinearEpsilonValueCalculator) CalcValueFromAvgResponseTime(v float64) float64 {
+	if v > c.Max && c.Max > 0 {
+		v = c.Max
+	}
+	if v < c.Min {
+		v = c.Min
+	}
+	return 1.0 / v
+}
+
+func (c *CompositeEpsilonValueCalculator) CalcValueFromAvgResponseTime(v float64) float64 {
+	return c.CalcValueFromMetrics(HostMetrics{AvgResponseTime: v})
+}
+
+func (c *CompositeEpsilonValueCalculator) CalcValueFromMetrics(m HostMetrics) float64 {
+	penalty := c.LatencyWeight*m.AvgResponseTime + c.ErrorWeight*m.ErrorRate + c.LoadWeight*float64(m.InFlight)
+	if cost, ok := c.Costs[m.Host]; ok && cost > 0 {
+		penalty *= cost
+	}
+	if penalty < minCompositePenalty {
+		penalty = minCompositePenalty
+	}
+	return 1.0 / penalty
+}
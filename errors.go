@@ -0,0 +1,155 @@
+package hostpool
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrorClass says what an error means for the host that returned it
+type ErrorClass int
+
+const (
+	// HostError is an error from a host that is down or broken, which puts
+	// the host in the dead pool. It is the class of every unclassified error.
+	HostError ErrorClass = iota
+	// Timeout is a host taking too long to answer. It is a HostError, kept
+	// apart so it can be told apart from a host refusing connections.
+	Timeout
+	// Throttled is a host turning requests away to shed load (eg. HTTP 429).
+	// The host stays in the pool, and the request counts for nothing either
+	// way.
+	Throttled
+	// RequestError is an error about the request itself (a bad query, a
+	// missing key) from a host that is working fine, and counts as a success.
+	RequestError
+	// Canceled is the caller giving up on a request, through its context
+	// being canceled or running out of time, which says nothing about the
+	// host. Like Throttled the request counts for nothing either way.
+	Canceled
+	// PartialSuccess is a request that succeeded, but not fully: a host
+	// serving stale data or partial results. It counts as a success for the
+	// host's health, while an epsilon greedy pool scores it with any penalty
+	// set for the class (see SetErrorPenalty) on top of its response time, so
+	// hosts failing in gray ways lose traffic without being taken out. Mark
+	// with eg. WithErrorClass(errStale, PartialSuccess).
+	PartialSuccess
+)
+
+// ClassifiedError is an error that knows its ErrorClass. Marking a response
+// with a ClassifiedError, or an error wrapping one, uses its class instead of
+// treating it as a HostError.
+type ClassifiedError interface {
+	error
+	ErrorClass() ErrorClass
+}
+
+// hostFailed reports whether errors of the class put a host in the dead pool
+func (c ErrorClass) hostFailed() bool {
+	return c == HostError || c == Timeout
+}
+
+// succeeded reports whether errors of the class still count as a success
+func (c ErrorClass) succeeded() bool {
+	return c == RequestError || c == PartialSuccess
+}
+
+// neutral reports whether requests ending with errors of the class are left
+// out of everything the pool learns about hosts
+func (c ErrorClass) neutral() bool {
+	return c == Throttled || c == Canceled
+}
+
+// ErrorClassifier decides the class of the errors responses are marked with.
+// It is never called with a nil error.
+type ErrorClassifier func(error) ErrorClass
+
+// DefaultErrorClassifier uses the class of a ClassifiedError, treats context
+// cancellation and deadlines as Canceled, and tells network timeouts apart
+// from other errors. Every other error is a HostError.
+//
+// To count context errors against hosts, wrap the classifier:
+//
+//	pool.SetErrorClassifier(func(err error) hostpool.ErrorClass {
+//		if errors.Is(err, context.DeadlineExceeded) {
+//			return hostpool.Timeout
+//		}
+//		return hostpool.DefaultErrorClassifier(err)
+//	})
+func DefaultErrorClassifier(err error) ErrorClass {
+	var c ClassifiedError
+	if errors.As(err, &c) {
+		return c.ErrorClass()
+	}
+	if isContextError(err) {
+		return Canceled
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return Timeout
+	}
+	return HostError
+}
+
+// NetworkErrorClassifier only blames hosts for network errors (timeouts,
+// refused or reset connections, DNS failures), treating any other error as a
+// RequestError, eg. so a response body that doesn't decode doesn't take a host
+// out of the pool. ClassifiedErrors keep their own class, and context errors
+// are Canceled as with DefaultErrorClassifier.
+func NetworkErrorClassifier(err error) ErrorClass {
+	var c ClassifiedError
+	if errors.As(err, &c) {
+		return c.ErrorClass()
+	}
+	if isContextError(err) {
+		return Canceled
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		if ne.Timeout() {
+			return Timeout
+		}
+		return HostError
+	}
+	return RequestError
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (p *standardHostPool) SetErrorClassifier(c ErrorClassifier) {
+	if c == nil {
+		c = DefaultErrorClassifier
+	}
+	p.classifier.Store(c)
+}
+
+// errorClass classifies err, with a nil error counting as a RequestError (a
+// success)
+func (p *standardHostPool) errorClass(err error) ErrorClass {
+	if err == nil {
+		return RequestError
+	}
+	if c, ok := p.classifier.Load().(ErrorClassifier); ok {
+		return c(err)
+	}
+	return DefaultErrorClassifier(err)
+}
+
+type classifiedError struct {
+	error
+	class ErrorClass
+}
+
+func (e *classifiedError) ErrorClass() ErrorClass { return e.class }
+
+func (e *classifiedError) Unwrap() error { return e.error }
+
+// WithErrorClass wraps err so that marking a response with it uses class
+func WithErrorClass(err error, class ErrorClass) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{error: err, class: class}
+}
@@ -0,0 +1,169 @@
+package hostpool
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventKind says what an Event is about
+type EventKind int
+
+const (
+	// EventSelected is a host handed out by Get
+	EventSelected EventKind = iota
+	// EventMarked is a response or MarkBatch outcome marked for a host
+	EventMarked
+	// EventHostDead and EventHostAlive are a host going in and out of the
+	// dead pool
+	EventHostDead
+	EventHostAlive
+	// EventHostAdded and EventHostRemoved are changes to the hosts in the
+	// pool
+	EventHostAdded
+	EventHostRemoved
+	// EventProfileStarted and EventProfileEnded are a weight profile
+	// switching in and out, which have no host (see SetWeightSchedule)
+	EventProfileStarted
+	EventProfileEnded
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventSelected:
+		return "selected"
+	case EventMarked:
+		return "marked"
+	case EventHostDead:
+		return "dead"
+	case EventHostAlive:
+		return "alive"
+	case EventHostAdded:
+		return "added"
+	case EventHostRemoved:
+		return "removed"
+	case EventProfileStarted:
+		return "profile started"
+	case EventProfileEnded:
+		return "profile ended"
+	}
+	return "unknown"
+}
+
+// Event is something that happened to a host in a pool, as handed to an
+// EventSink
+type Event struct {
+	Kind EventKind
+	Host string
+	Time time.Time
+	// Trace is the Trace of the request, for EventSelected and EventMarked
+	Trace Trace
+	// Err and Class are what a response was marked with, for EventMarked
+	Err   error
+	Class ErrorClass
+	// Duration is how long a marked request took, for EventMarked from
+	// epsilon greedy pools (unless marked with MarkScore) and MarkBatch, and
+	// 0 otherwise
+	Duration time.Duration
+	// Profile is the name of the weight profile, for EventProfileStarted and
+	// EventProfileEnded
+	Profile string
+}
+
+// EventSink receives a pool's events, eg. to feed an audit log or telemetry
+// pipeline. Events are queued, and handed to HandleEvent one at a time in the
+// order they happened, by a goroutine of the pool's, so a slow sink doesn't
+// hold up requests; when the queue is full new events are dropped and
+// counted instead.
+type EventSink interface {
+	HandleEvent(Event)
+}
+
+// EventSinkFunc lets an ordinary function be used as an EventSink
+type EventSinkFunc func(Event)
+
+func (f EventSinkFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// EventSinkStats counts the events for the current sink, see SetEventSink
+type EventSinkStats struct {
+	Delivered int64
+	Dropped   int64
+}
+
+const defaultEventQueue = 1024
+
+// eventSink delivers events to an EventSink from its own goroutine
+type eventSink struct {
+	// counters first for 64 bit alignment on 32 bit systems
+	delivered int64
+	dropped   int64
+	sink      EventSink
+	queue     chan Event
+	done      chan struct{}
+}
+
+// SetEventSink sends the pool's events to sink, through a queue of up to
+// queue events (0 uses a default of 1024). nil stops sending events. Events
+// still queued for a sink that is replaced, or when the pool is closed, are
+// dropped.
+func (p *standardHostPool) SetEventSink(sink EventSink, queue int) {
+	if queue <= 0 {
+		queue = defaultEventQueue
+	}
+	var s *eventSink
+	if sink != nil {
+		s = &eventSink{sink: sink, queue: make(chan Event, queue), done: make(chan struct{})}
+		go s.run()
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.replaceSink(s)
+}
+
+// replaceSink stops the current sink's goroutine and starts using s (which may
+// be nil). It should only be called when the lock has already been acquired
+func (p *standardHostPool) replaceSink(s *eventSink) {
+	if old, _ := p.sink.Load().(*eventSink); old != nil {
+		close(old.done)
+	}
+	p.sink.Store(s)
+}
+
+func (p *standardHostPool) EventSinkStatistics() EventSinkStats {
+	s, _ := p.sink.Load().(*eventSink)
+	if s == nil {
+		return EventSinkStats{}
+	}
+	return EventSinkStats{
+		Delivered: atomic.LoadInt64(&s.delivered),
+		Dropped:   atomic.LoadInt64(&s.dropped),
+	}
+}
+
+// emit queues an event for the sink, if there is one. It never blocks, and
+// may be called with or without the lock.
+func (p *standardHostPool) emit(e Event) {
+	s, _ := p.sink.Load().(*eventSink)
+	if s == nil {
+		return
+	}
+	e.Time = time.Now()
+	select {
+	case s.queue <- e:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+func (s *eventSink) run() {
+	for {
+		select {
+		case e := <-s.queue:
+			s.sink.HandleEvent(e)
+			atomic.AddInt64(&s.delivered, 1)
+		case <-s.done:
+			return
+		}
+	}
+}
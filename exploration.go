@@ -0,0 +1,174 @@
+package hostpool
+
+import (
+	"math"
+	"time"
+)
+
+// ExplorationStrategy decides how often an epsilon greedy pool explores, that
+// is picks the least recently tried host instead of choosing by score. The pool
+// calls its methods with its lock held, so implementations don't need to be
+// safe for concurrent use, but shouldn't be shared between pools.
+type ExplorationStrategy interface {
+	// Epsilon is called for every selection and returns the probability that
+	// it explores
+	Epsilon() float32
+	// Explored is called each time a selection explores
+	Explored()
+}
+
+// ScoreObserver can be implemented by an ExplorationStrategy that adapts to how
+// hosts are scoring. After every decay tick the pool calls ObserveScores with
+// the share of traffic each live host would get from a weighted choice, and the
+// weighted average response time it was scored on, in the same order.
+type ScoreObserver interface {
+	ObserveScores(shares []float64, avgResponseTimes []float64)
+}
+
+// NewDecayingExploration starts exploring with probability epsilon, and
+// multiplies that by decay each time the pool explores, down to min. This is
+// the default schedule, starting at 0.3 and decaying by 0.9 to 0.01.
+func NewDecayingExploration(epsilon, decay, min float32) ExplorationStrategy {
+	return &decayingExploration{epsilon: epsilon, decay: decay, min: min}
+}
+
+type decayingExploration struct {
+	epsilon, decay, min float32
+}
+
+func (e *decayingExploration) Epsilon() float32 {
+	return e.epsilon
+}
+
+func (e *decayingExploration) Explored() {
+	e.epsilon = e.epsilon * e.decay
+	if e.epsilon < e.min {
+		e.epsilon = e.min
+	}
+}
+
+// ConstantExploration always explores with probability epsilon
+type ConstantExploration float32
+
+func (e ConstantExploration) Epsilon() float32 {
+	return float32(e)
+}
+
+func (e ConstantExploration) Explored() {}
+
+// NewTimeAnnealedExploration moves epsilon linearly from start to end over the
+// given duration after it is created, and holds it at end afterwards.
+func NewTimeAnnealedExploration(start, end float32, over time.Duration) ExplorationStrategy {
+	return &timeAnnealedExploration{start: start, end: end, over: over, begin: time.Now()}
+}
+
+type timeAnnealedExploration struct {
+	start, end float32
+	over       time.Duration
+	begin      time.Time
+}
+
+func (e *timeAnnealedExploration) Epsilon() float32 {
+	elapsed := time.Since(e.begin)
+	if elapsed >= e.over {
+		return e.end
+	}
+	return anneal(e.start, e.end, float32(elapsed)/float32(e.over))
+}
+
+func (e *timeAnnealedExploration) Explored() {}
+
+// NewRequestAnnealedExploration moves epsilon linearly from start to end over
+// the given number of selections, and holds it at end afterwards.
+func NewRequestAnnealedExploration(start, end float32, requests int64) ExplorationStrategy {
+	return &requestAnnealedExploration{start: start, end: end, requests: requests}
+}
+
+type requestAnnealedExploration struct {
+	start, end float32
+	requests   int64
+	seen       int64
+}
+
+func (e *requestAnnealedExploration) Epsilon() float32 {
+	if e.seen >= e.requests {
+		return e.end
+	}
+	e.seen++
+	return anneal(e.start, e.end, float32(e.seen-1)/float32(e.requests))
+}
+
+func (e *requestAnnealedExploration) Explored() {}
+
+// thresholds used by the adaptive exploration strategy
+const (
+	adaptiveDominantShare  = 0.8  // one host getting this much traffic is clearly best
+	adaptiveConvergedRatio = 1.25 // best and worst hosts within this ratio have converged
+	adaptiveChangeRatio    = 0.25 // response times moving this much between ticks is a change
+	adaptiveRaise          = 1.5
+	adaptiveLower          = 0.9
+)
+
+// NewAdaptiveExploration explores more when conditions look uncertain and less
+// when one host is clearly best, keeping epsilon between min and max. Epsilon
+// goes up after a decay tick where the hosts' scores have converged (so it's
+// worth checking which one is really best) or where their response times moved
+// noticeably since the last tick (suggesting conditions changed), and goes down
+// when a single host would take most of the traffic.
+func NewAdaptiveExploration(min, max float32) ExplorationStrategy {
+	return &adaptiveExploration{epsilon: max, min: min, max: max}
+}
+
+type adaptiveExploration struct {
+	epsilon, min, max float32
+	last              []float64
+}
+
+func (e *adaptiveExploration) Epsilon() float32 {
+	return e.epsilon
+}
+
+func (e *adaptiveExploration) Explored() {}
+
+func (e *adaptiveExploration) ObserveScores(shares []float64, avgResponseTimes []float64) {
+	last := e.last
+	e.last = append([]float64(nil), avgResponseTimes...)
+	if len(shares) < 2 {
+		return
+	}
+
+	lowest, highest := shares[0], shares[0]
+	for _, s := range shares {
+		if s < lowest {
+			lowest = s
+		}
+		if s > highest {
+			highest = s
+		}
+	}
+	changed := false
+	if len(last) == len(avgResponseTimes) {
+		var change float64
+		for i, v := range avgResponseTimes {
+			change += math.Abs(v-last[i]) / last[i]
+		}
+		changed = change/float64(len(avgResponseTimes)) > adaptiveChangeRatio
+	}
+
+	switch {
+	case changed || highest <= lowest*adaptiveConvergedRatio:
+		e.epsilon = e.epsilon * adaptiveRaise
+	case highest >= adaptiveDominantShare:
+		e.epsilon = e.epsilon * adaptiveLower
+	}
+	if e.epsilon > e.max {
+		e.epsilon = e.max
+	}
+	if e.epsilon < e.min {
+		e.epsilon = e.min
+	}
+}
+
+func anneal(start, end, progress float32) float32 {
+	return start + (end-start)*progress
+}
@@ -0,0 +1,25 @@
+package hostpool
+
+import (
+	"expvar"
+)
+
+// PublishExpvar publishes the state of p through expvar, as prefix.pool (the
+// pool's gauges: host counts, health, requests in flight) and prefix.hosts
+// (each host's counters and scores, keyed by host), in the same shape as
+// WriteStatsJSON. They are read from p whenever /debug/vars is served.
+//
+// expvar variables can't be removed, so publish each pool once for the life
+// of the program; like expvar.Publish this panics if prefix is already in use.
+func PublishExpvar(p HostPool, prefix string) {
+	expvar.Publish(prefix+".pool", expvar.Func(func() interface{} {
+		return statsJSON(p).Data.poolGauges
+	}))
+	expvar.Publish(prefix+".hosts", expvar.Func(func() interface{} {
+		hosts := make(map[string]hostStatsJSON)
+		for _, h := range statsJSON(p).Data.Hosts {
+			hosts[h.Host] = h
+		}
+		return hosts
+	}))
+}
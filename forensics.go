@@ -0,0 +1,150 @@
+package hostpool
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Transition log
+//
+// After an outage the statistics show which hosts are dead, but not how they
+// got there. With a transition log the pool keeps the last few times hosts
+// went in and out of the dead pool, along with the mark that did it, for
+// post-incident analysis: which error ejected a host, how slow the request
+// was, when the pool gave up on every host at once.
+
+// Transition is a host going into or coming out of the dead pool, as kept by
+// SetTransitionLog
+type Transition struct {
+	Host string    `json:"host"`
+	Time time.Time `json:"time"`
+	// Dead is whether the host went into the dead pool, rather than out of it
+	Dead bool `json:"dead"`
+	// Cause is what made the change: "request" and "batch" for marks through
+	// responses and MarkBatch, "external" for MarkHostSuccess and
+	// MarkHostFailure, "refresh" for failed credential refreshes, "registry"
+	// for hosts a HostRegistry made suspect, and "reset" for every host being
+	// brought back because all of them were dead (or with ResetAll)
+	Cause string `json:"cause"`
+	// Err and Latency are the error and response time of the mark that made
+	// the change, at MarkedAt. A change made when an SLO's burn rate was
+	// exceeded is put down to the mark that exceeded it.
+	Err      string        `json:"error,omitempty"`
+	Latency  time.Duration `json:"latency_ns,omitempty"`
+	MarkedAt time.Time     `json:"marked_at"`
+}
+
+// lastMark is the latest mark of a host that could have changed whether it's
+// dead, kept while the transition log is on
+type lastMark struct {
+	source  string
+	err     string
+	latency time.Duration
+	at      time.Time
+}
+
+// transitionLog is a ring buffer of the latest transitions
+type transitionLog struct {
+	entries []Transition
+	next    int
+	full    bool
+}
+
+// SetTransitionLog keeps the last n host transitions for Transitions. 0 turns
+// the log off and drops what it holds.
+func (p *standardHostPool) SetTransitionLog(n int) {
+	p.Lock()
+	defer p.Unlock()
+	if n <= 0 {
+		p.transitions = nil
+		return
+	}
+	l := &transitionLog{entries: make([]Transition, n)}
+	for _, t := range p.transitions.all() {
+		l.add(t)
+	}
+	p.transitions = l
+}
+
+// Transitions returns the host transitions kept by SetTransitionLog, oldest
+// first
+func (p *standardHostPool) Transitions() []Transition {
+	p.RLock()
+	defer p.RUnlock()
+	return p.transitions.all()
+}
+
+// TransitionsHandler serves the pool's Transitions as JSON, eg. next to
+// StatsHandler on an admin port
+func TransitionsHandler(p HostPool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transitions := p.Transitions()
+		if transitions == nil {
+			transitions = []Transition{}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(transitions)
+	})
+}
+
+// noteMark remembers a mark that may change whether h is dead, and should only
+// be called when the lock has already been acquired
+func (p *standardHostPool) noteMark(h *hostEntry, source string, err error, latency time.Duration) {
+	if p.transitions == nil {
+		return
+	}
+	m := &lastMark{source: source, latency: latency, at: time.Now()}
+	if err != nil {
+		m.err = err.Error()
+	}
+	h.lastMark = m
+}
+
+// noteResponse is noteMark for a marked response
+func (p *standardHostPool) noteResponse(h *hostEntry, hostR HostPoolResponse) {
+	if p.transitions == nil {
+		return
+	}
+	var err error
+	if r, ok := hostR.(interface{ markedErr() error }); ok {
+		err = r.markedErr()
+	}
+	var latency time.Duration
+	if r, ok := hostR.(interface{ elapsed() (time.Duration, bool) }); ok {
+		latency, _ = r.elapsed()
+	}
+	p.noteMark(h, "request", err, latency)
+}
+
+// logTransition should only be called when the lock has already been acquired
+func (p *standardHostPool) logTransition(h *hostEntry, dead bool, reset bool) {
+	if p.transitions == nil {
+		return
+	}
+	t := Transition{Host: h.host, Time: time.Now(), Dead: dead, Cause: "reset"}
+	if m := h.lastMark; m != nil && !reset {
+		t.Cause, t.Err, t.Latency, t.MarkedAt = m.source, m.err, m.latency, m.at
+	}
+	h.lastMark = nil
+	p.transitions.add(t)
+}
+
+func (l *transitionLog) add(t Transition) {
+	l.entries[l.next] = t
+	l.next++
+	if l.next == len(l.entries) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+func (l *transitionLog) all() []Transition {
+	if l == nil {
+		return nil
+	}
+	if !l.full {
+		return append([]Transition(nil), l.entries[:l.next]...)
+	}
+	return append(append([]Transition(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+}
@@ -0,0 +1,126 @@
+package hostpool
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPeerReportedDead is what hosts are marked failed with when peers report
+// them dead through a Gossip
+var ErrPeerReportedDead = WithErrorClass(errors.New("host reported dead by peers"), HostError)
+
+// Observation is one client's report that a host has gone dead, shared with
+// the other clients of the same hosts through a Broadcaster. It encodes to
+// JSON for sending.
+type Observation struct {
+	Host string `json:"host"`
+	// Source identifies the client that made the observation, so it can
+	// ignore its own reports coming back
+	Source string `json:"source"`
+}
+
+// Broadcaster sends observations to the other clients, eg. over UDP multicast
+// or a pub/sub channel. Broadcast is called from pool hooks, so it shouldn't
+// block for long. Observations from peers are handed to Gossip.Receive.
+type Broadcaster interface {
+	Broadcast(Observation)
+}
+
+// GossipConfig configures a Gossip
+type GossipConfig struct {
+	// Source identifies this client to its peers, and must be unique among
+	// them
+	Source string
+	// Trust is how much a report from a peer counts for, against the 1 it
+	// takes to mark a host failed here: 1 acts on every report, 0.5 waits
+	// for two peers to agree, and 0 only broadcasts.
+	Trust float64
+	// Window is how long reports are added up for (0 uses a default of a
+	// minute)
+	Window time.Duration
+}
+
+const defaultGossipWindow = time.Minute
+
+// Gossip shares the hosts a pool finds dead with other clients through a
+// Broadcaster, and marks hosts its peers find dead as failed, so that each
+// client doesn't have to find a dead host out for itself. Hosts marked failed
+// this way are retried as usual, and peer reports of hosts that are already
+// dead here are ignored.
+type Gossip struct {
+	pool        HostPool
+	broadcaster Broadcaster
+	config      GossipConfig
+
+	sync.Mutex
+	reports  map[string][]gossipReport // by host, oldest first
+	applying map[string]bool           // hosts being marked from peer reports
+}
+
+type gossipReport struct {
+	source string
+	at     time.Time
+}
+
+// NewGossip starts sharing the health of pool's hosts
+func NewGossip(pool HostPool, b Broadcaster, c GossipConfig) *Gossip {
+	if c.Window <= 0 {
+		c.Window = defaultGossipWindow
+	}
+	g := &Gossip{
+		pool:        pool,
+		broadcaster: b,
+		config:      c,
+		reports:     make(map[string][]gossipReport),
+		applying:    make(map[string]bool),
+	}
+	pool.AddHooks(HostHooks{OnHostDead: g.hostDead})
+	return g
+}
+
+func (g *Gossip) hostDead(host string) {
+	g.Lock()
+	fromPeers := g.applying[host]
+	g.Unlock()
+	// don't echo what peers told us
+	if !fromPeers {
+		g.broadcaster.Broadcast(Observation{Host: host, Source: g.config.Source})
+	}
+}
+
+// Receive takes an observation from a peer. Each peer counts once per host
+// within the window, however often it reports it.
+func (g *Gossip) Receive(o Observation) {
+	if o.Source == g.config.Source || g.config.Trust <= 0 {
+		return
+	}
+	if s, ok := g.pool.HostStatistics(o.Host); !ok || s.Dead {
+		return
+	}
+
+	now := time.Now()
+	g.Lock()
+	reports := g.reports[o.Host][:0]
+	for _, r := range g.reports[o.Host] {
+		if now.Sub(r.at) < g.config.Window && r.source != o.Source {
+			reports = append(reports, r)
+		}
+	}
+	reports = append(reports, gossipReport{source: o.Source, at: now})
+	// allowing for rounding, so that three reports at a trust of 1/3 do
+	if float64(len(reports))*g.config.Trust < 1-1e-9 {
+		g.reports[o.Host] = reports
+		g.Unlock()
+		return
+	}
+	delete(g.reports, o.Host)
+	g.applying[o.Host] = true
+	g.Unlock()
+
+	g.pool.MarkHostFailure(o.Host, ErrPeerReportedDead)
+
+	g.Lock()
+	delete(g.applying, o.Host)
+	g.Unlock()
+}
@@ -0,0 +1,42 @@
+package hostpool
+
+// Minimum healthy hosts
+//
+// When something goes wrong on the client side (its network, a bad deploy,
+// an overloaded process) every request fails, whatever host it goes to, and
+// the pool ends up marking the whole fleet dead. With a minimum set, request
+// failures stop putting hosts in the dead pool once that would leave fewer
+// than the minimum alive: the pool keeps using the hosts it has, logs the
+// ejection it skipped and tells the OnEjectionBlocked hooks. Failures from
+// MarkHostFailure, which come from outside the client's requests, still eject
+// hosts.
+
+// SetMinHealthyHosts sets the number of live hosts that request failures
+// can't take the pool below. 0 turns the guardrail off.
+func (p *standardHostPool) SetMinHealthyHosts(n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.minHealthyHosts = n
+}
+
+// ejectHost puts a host in the dead pool after failed requests, unless that
+// would break the minimum healthy hosts. It should only be called when the
+// lock has already been acquired
+func (p *standardHostPool) ejectHost(h *hostEntry) {
+	if h.dead || p.minHealthyHosts <= 0 {
+		p.doMarkFailed(h)
+		return
+	}
+	live := 0
+	for _, e := range p.hostList {
+		if !e.dead {
+			live++
+		}
+	}
+	if live-1 < p.minHealthyHosts {
+		p.logf("not marking %s dead, only %d of %d hosts are alive (minimum %d)", h.host, live, len(p.hostList), p.minHealthyHosts)
+		p.queueEvent(hostEjectionBlocked, h.host)
+		return
+	}
+	p.doMarkFailed(h)
+}
@@ -0,0 +1,81 @@
+package hostpool
+
+// HealthStatus is an overall view of a pool's health, from the fraction of
+// its hosts that are alive
+type HealthStatus int
+
+const (
+	Healthy HealthStatus = iota
+	Degraded
+	Unhealthy
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Unhealthy:
+		return "unhealthy"
+	}
+	return "unknown"
+}
+
+// HealthThresholds are the fractions of live hosts below which a pool counts
+// as Degraded or Unhealthy
+type HealthThresholds struct {
+	Degraded  float64
+	Unhealthy float64
+}
+
+var defaultHealthThresholds = HealthThresholds{Degraded: 0.8, Unhealthy: 0.5}
+
+// PoolHealth is returned by Health
+type PoolHealth struct {
+	Status HealthStatus
+	Live   int
+	Total  int
+}
+
+// Ready reports whether the pool is fit to serve from, for readiness probes:
+// it is as long as the pool isn't Unhealthy
+func (h PoolHealth) Ready() bool {
+	return h.Status != Unhealthy
+}
+
+// SetHealthThresholds changes the thresholds used by Health. The default is
+// Degraded below 80% of hosts alive and Unhealthy below 50%.
+func (p *standardHostPool) SetHealthThresholds(t HealthThresholds) {
+	p.Lock()
+	defer p.Unlock()
+	p.healthThresholds = &t
+}
+
+// Health sums up how many of the pool's hosts are alive. A pool with no hosts
+// is Unhealthy.
+func (p *standardHostPool) Health() PoolHealth {
+	p.RLock()
+	defer p.RUnlock()
+	t := defaultHealthThresholds
+	if p.healthThresholds != nil {
+		t = *p.healthThresholds
+	}
+	h := PoolHealth{Total: len(p.hostList)}
+	for _, e := range p.hostList {
+		if !e.dead {
+			h.Live++
+		}
+	}
+	live := 0.0
+	if h.Total > 0 {
+		live = float64(h.Live) / float64(h.Total)
+	}
+	switch {
+	case h.Total == 0 || live < t.Unhealthy:
+		h.Status = Unhealthy
+	case live < t.Degraded:
+		h.Status = Degraded
+	}
+	return h
+}
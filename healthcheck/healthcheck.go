@@ -0,0 +1,27 @@
+// Package healthcheck provides hostpool.HealthCheckers for probing hosts
+// outside of real traffic, eg. for hostpool.Warmup.
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// withTimeout runs check with timeout (if any) on top of ctx. The host
+// running out of it is a hostpool.Timeout, rather than the context error a
+// pool would take to say nothing about the host.
+func withTimeout(ctx context.Context, timeout time.Duration, host string, check func(context.Context, string) error) error {
+	if timeout <= 0 {
+		return check(ctx, host)
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := check(tctx, host)
+	if err != nil && tctx.Err() != nil && ctx.Err() == nil {
+		return hostpool.WithErrorClass(fmt.Errorf("healthcheck: %s timed out after %v: %w", host, timeout, err), hostpool.Timeout)
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package healthcheck
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ hostpool.HealthChecker = &HTTP{}
+var _ hostpool.HealthChecker = &TLS{}
+
+func TestHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(20 * time.Millisecond)
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/status":
+			assert.Equal(t, r.Method, http.MethodHead)
+			assert.Equal(t, r.Host, "svc.local")
+			assert.Equal(t, r.Header.Get("X-Check"), "1")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte("status: ok"))
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+	ctx := context.Background()
+
+	assert.Equal(t, (&HTTP{}).Check(ctx, host), nil)
+	assert.NotEqual(t, (&HTTP{Path: "/down"}).Check(ctx, host), nil)
+	assert.Equal(t, (&HTTP{Path: "/down", Statuses: []int{503}}).Check(ctx, host), nil)
+	assert.Equal(t, (&HTTP{
+		Path:     "/status",
+		Method:   http.MethodHead,
+		Header:   http.Header{"Host": {"svc.local"}, "X-Check": {"1"}},
+		Statuses: []int{204},
+	}).Check(ctx, host), nil)
+
+	assert.Equal(t, (&HTTP{BodyContains: "ok"}).Check(ctx, host), nil)
+	assert.NotEqual(t, (&HTTP{BodyContains: "degraded"}).Check(ctx, host), nil)
+
+	err := (&HTTP{Path: "/slow", MaxLatency: 5 * time.Millisecond}).Check(ctx, host)
+	assert.Equal(t, hostpool.DefaultErrorClassifier(err), hostpool.Timeout)
+	assert.Equal(t, (&HTTP{Path: "/slow", MaxLatency: time.Second}).Check(ctx, host), nil)
+	err = (&HTTP{Path: "/slow", Timeout: 5 * time.Millisecond}).Check(ctx, host)
+	assert.Equal(t, hostpool.DefaultErrorClassifier(err), hostpool.Timeout)
+
+	// the caller giving up isn't the host's fault
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = (&HTTP{Timeout: time.Second}).Check(canceled, host)
+	assert.Equal(t, hostpool.DefaultErrorClassifier(err), hostpool.Canceled)
+}
+
+func TestTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "https://")
+	ctx := context.Background()
+
+	p := hostpool.New([]string{host})
+	defer p.Close()
+	var expiring []time.Time
+	p.AddHooks(hostpool.HostHooks{OnCertExpiring: func(host string, notAfter time.Time) {
+		expiring = append(expiring, notAfter)
+	}})
+
+	c := &TLS{Config: ts.Client().Transport.(*http.Transport).TLSClientConfig, Warn: time.Hour, OnExpiring: p.ReportCertExpiry}
+	assert.Equal(t, c.Check(ctx, host), nil)
+	assert.Equal(t, len(expiring), 0)
+	c.Warn = 200 * 365 * 24 * time.Hour
+	assert.Equal(t, c.Check(ctx, host), nil)
+	assert.Equal(t, expiring, []time.Time{ts.Certificate().NotAfter})
+	s, _ := p.HostStatistics(host)
+	assert.Equal(t, s.CertNotAfter, ts.Certificate().NotAfter)
+
+	// an unknown authority fails
+	assert.NotEqual(t, (&TLS{}).Check(ctx, host), nil)
+
+	// a host that never answers the handshake times out
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	err = (&TLS{Timeout: 10 * time.Millisecond}).Check(ctx, l.Addr().String())
+	assert.Equal(t, hostpool.DefaultErrorClassifier(err), hostpool.Timeout)
+}
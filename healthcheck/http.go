@@ -0,0 +1,115 @@
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// HTTP checks hosts (a host or host:port) by sending them a request and
+// looking at the response. The zero value sends GET / over plain HTTP and
+// wants a 2xx status.
+//
+// Hosts that run out of Timeout or go over MaxLatency fail with a
+// hostpool.Timeout error, rather than the context error a pool would take to
+// say nothing about the host.
+type HTTP struct {
+	// Scheme is http or https, empty means http
+	Scheme string
+	// Path is the path and query requested, empty means /
+	Path string
+	// Method is the request method, empty means GET
+	Method string
+	// Header is added to each request. A Host header sets the request's Host.
+	Header http.Header
+	// Statuses are the status codes of a healthy host, nil means any 2xx
+	Statuses []int
+	// BodyContains, if set, must be found in the first MaxBodyBytes of the
+	// response body
+	BodyContains string
+	// MaxLatency, if set, fails hosts that take longer than it to answer,
+	// even if they answer correctly
+	MaxLatency time.Duration
+	// Timeout bounds each check, on top of the context it is given. 0 means
+	// no timeout beyond the context's.
+	Timeout time.Duration
+
+	// Client sends the requests, nil uses http.DefaultClient. Redirects are
+	// followed as the client does.
+	Client *http.Client
+}
+
+// MaxBodyBytes is how much of a response body is searched for BodyContains
+const MaxBodyBytes = 64 << 10
+
+func (c *HTTP) Check(ctx context.Context, host string) error {
+	return withTimeout(ctx, c.Timeout, host, c.check)
+}
+
+func (c *HTTP) check(ctx context.Context, host string) error {
+	scheme, path, method := c.Scheme, c.Path, c.Method
+	if scheme == "" {
+		scheme = "http"
+	}
+	if path == "" {
+		path = "/"
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, scheme+"://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if h := c.Header.Get("Host"); h != "" {
+		req.Host = h
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !c.healthyStatus(resp.StatusCode) {
+		return fmt.Errorf("healthcheck: %s%s returned %s", host, path, resp.Status)
+	}
+	if c.BodyContains != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxBodyBytes))
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(body, []byte(c.BodyContains)) {
+			return fmt.Errorf("healthcheck: %s%s response doesn't contain %q", host, path, c.BodyContains)
+		}
+	}
+	if took := time.Since(start); c.MaxLatency > 0 && took > c.MaxLatency {
+		return hostpool.WithErrorClass(fmt.Errorf("healthcheck: %s%s took %v, over %v", host, path, took, c.MaxLatency), hostpool.Timeout)
+	}
+	return nil
+}
+
+func (c *HTTP) healthyStatus(code int) bool {
+	if c.Statuses == nil {
+		return code >= 200 && code < 300
+	}
+	for _, s := range c.Statuses {
+		if code == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+// Package pingcheck provides hostpool.HealthCheckers that only check a host
+// is reachable, for hosts that have no L7 endpoint to check: ICMP echo, which
+// needs permission to open raw sockets (root, or CAP_NET_RAW on Linux), and a
+// UDP probe, which doesn't.
+package pingcheck
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// ICMP checks hosts (host or host:port, the port is ignored) by sending them
+// an ICMP echo request and waiting for the reply. IPv4 and IPv6 are both
+// supported.
+type ICMP struct {
+	// Timeout bounds each check on top of the context it is given (0 uses a
+	// default of a second). A host that doesn't reply in time fails with a
+	// hostpool.Timeout error.
+	Timeout time.Duration
+}
+
+// UDP checks hosts (host:port) by sending them a datagram. A host that sends
+// anything back is up, and one that answers with an ICMP port unreachable is
+// down. Since UDP services often don't answer at all, silence counts as up
+// unless RequireReply is set.
+type UDP struct {
+	// Payload is sent to each host, eg. a request the service answers
+	Payload []byte
+	// RequireReply fails hosts that don't reply within Timeout
+	RequireReply bool
+	// Timeout is how long to wait for a reply (0 uses a default of a second)
+	Timeout time.Duration
+}
+
+const defaultTimeout = time.Second
+
+// ICMP message types, see RFC 792 and RFC 4443
+const (
+	echoRequest   = 8
+	echoReply     = 0
+	echoRequestV6 = 128
+	echoReplyV6   = 129
+)
+
+var (
+	echoID  = uint16(os.Getpid())
+	echoSeq uint32 // accessed atomically
+)
+
+func checkContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timedOut turns the check running out of its own time into a
+// hostpool.Timeout, rather than the context error a pool would take to say
+// nothing about the host
+func timedOut(parent context.Context, host string, timeout time.Duration) error {
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return hostpool.WithErrorClass(fmt.Errorf("pingcheck: no reply from %s after %v", host, timeout), hostpool.Timeout)
+}
+
+// closeOnDone sets conn's deadline from ctx, and closes conn if ctx is
+// canceled first, so reads don't wait out the deadline. Call the func it
+// returns once done with conn.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// expired reports whether err is from the check running out of time, which
+// may show as a deadline error before the context itself is done
+func expired(ctx context.Context, err error) bool {
+	var ne net.Error
+	return ctx.Err() != nil || errors.As(err, &ne) && ne.Timeout()
+}
+
+func (c *ICMP) Check(ctx context.Context, host string) error {
+	cctx, cancel := checkContext(ctx, c.Timeout)
+	defer cancel()
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(cctx, name)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("pingcheck: no addresses for %s", name)
+	}
+	addr := &addrs[0]
+
+	network, request, reply := "ip4:icmp", byte(echoRequest), byte(echoReply)
+	if addr.IP.To4() == nil {
+		network, request, reply = "ip6:ipv6-icmp", echoRequestV6, echoReplyV6
+	}
+	conn, err := net.DialIP(network, nil, &net.IPAddr{IP: addr.IP, Zone: addr.Zone})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(cctx, conn)()
+
+	seq := uint16(atomic.AddUint32(&echoSeq, 1))
+	msg := make([]byte, 8)
+	msg[0] = request
+	binary.BigEndian.PutUint16(msg[4:], echoID)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	if request == echoRequest {
+		// the kernel fills in ICMPv6 checksums
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		// unlike Read, ReadFrom strips the IPv4 header
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if expired(cctx, err) {
+				return timedOut(ctx, host, c.Timeout)
+			}
+			return err
+		}
+		// the socket sees every ICMP message from the host, including other
+		// checks' replies
+		if n >= 8 && buf[0] == reply && binary.BigEndian.Uint16(buf[4:]) == echoID && binary.BigEndian.Uint16(buf[6:]) == seq {
+			return nil
+		}
+	}
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func (c *UDP) Check(ctx context.Context, host string) error {
+	cctx, cancel := checkContext(ctx, c.Timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(cctx, "udp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(cctx, conn)()
+
+	if _, err := conn.Write(c.Payload); err != nil {
+		return err
+	}
+	// a port unreachable comes back as an error reading the connected socket
+	if _, err := conn.Read(make([]byte, 1500)); err != nil {
+		if expired(cctx, err) {
+			if c.RequireReply || ctx.Err() != nil {
+				return timedOut(ctx, host, c.Timeout)
+			}
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package pingcheck
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ hostpool.HealthChecker = &ICMP{}
+var _ hostpool.HealthChecker = &UDP{}
+
+func TestChecksum(t *testing.T) {
+	// an echo request with id 1 and sequence 1
+	msg := []byte{8, 0, 0, 0, 0, 1, 0, 1}
+	assert.Equal(t, checksum(msg), uint16(0xf7fd))
+}
+
+func TestICMP(t *testing.T) {
+	if c, err := net.ListenPacket("ip4:icmp", "127.0.0.1"); err != nil {
+		t.Skipf("no raw sockets: %v", err)
+	} else {
+		c.Close()
+	}
+	assert.Equal(t, (&ICMP{}).Check(context.Background(), "127.0.0.1:80"), nil)
+}
+
+func TestUDP(t *testing.T) {
+	ctx := context.Background()
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				echo.WriteTo([]byte("pong"), addr)
+			}
+		}
+	}()
+	host := echo.LocalAddr().String()
+
+	assert.Equal(t, (&UDP{Payload: []byte("ping"), RequireReply: true}).Check(ctx, host), nil)
+	// silence is fine, unless a reply is required
+	c := &UDP{Payload: []byte("hello"), Timeout: 10 * time.Millisecond}
+	assert.Equal(t, c.Check(ctx, host), nil)
+	c.RequireReply = true
+	assert.Equal(t, hostpool.DefaultErrorClassifier(c.Check(ctx, host)), hostpool.Timeout)
+
+	// nothing listening
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	closed.Close()
+	err = (&UDP{Payload: []byte("ping")}).Check(ctx, closed.LocalAddr().String())
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, hostpool.DefaultErrorClassifier(err), hostpool.HostError)
+}
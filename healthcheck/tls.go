@@ -0,0 +1,91 @@
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TLS checks hosts (host:port) by completing a TLS handshake with them, which
+// fails for hosts serving a certificate that doesn't verify, including one
+// that has expired. Certificates that are about to expire still pass, but are
+// reported, so they can be renewed before they take the host down.
+type TLS struct {
+	// Config is used for the handshakes, nil means the defaults. An empty
+	// ServerName is taken from each host.
+	Config *tls.Config
+	// Timeout bounds each check, dial and handshake, on top of the context
+	// it is given. Running out of it is a hostpool.Timeout.
+	Timeout time.Duration
+	// Warn is how long before its certificate expires a host is reported,
+	// 0 reports every host
+	Warn time.Duration
+	// OnExpiring is called with a host and when the certificate chain it
+	// served expires (the earliest NotAfter in it), for hosts within Warn of
+	// it. To see them in the pool's statistics and hooks, use the pool's
+	// ReportCertExpiry.
+	OnExpiring func(host string, notAfter time.Time)
+}
+
+func (c *TLS) Check(ctx context.Context, host string) error {
+	return withTimeout(ctx, c.Timeout, host, c.check)
+}
+
+func (c *TLS) check(ctx context.Context, host string) error {
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+
+	config := &tls.Config{}
+	if c.Config != nil {
+		config = c.Config.Clone()
+	}
+	if config.ServerName == "" {
+		name, _, err := net.SplitHostPort(host)
+		if err != nil {
+			name = host
+		}
+		config.ServerName = name
+	}
+	conn := tls.Client(raw, config)
+	// the handshake only knows about deadlines, so close the connection to
+	// stop it if the context is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			raw.Close()
+		case <-done:
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := conn.Handshake(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("healthcheck: tls handshake with %s: %w", host, ctx.Err())
+		}
+		return err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 || c.OnExpiring == nil {
+		return nil
+	}
+	notAfter := certs[0].NotAfter
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	if time.Until(notAfter) < c.Warn || c.Warn == 0 {
+		c.OnExpiring(host, notAfter)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package hostpool
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// HostHooks are called as hosts join, leave and fail, eg. to manage a
+// connection per host (see ConnPool). Any of them may be nil. Hooks run after
+// the pool has been unlocked, in the order the changes happened, on the
+// goroutine that made the change, so they may call back into the pool.
+type HostHooks struct {
+	// OnHostAdded is called for each host added by SetHosts or AddHost
+	OnHostAdded func(host string)
+	// OnHostRemoved is called for each host removed by SetHosts or RemoveHost
+	OnHostRemoved func(host string)
+	// OnHostDead is called when a host is marked failed and put in the dead
+	// pool (not again for further failures while it's dead)
+	OnHostDead func(host string)
+	// OnEjectionBlocked is called when failed requests would have put a host
+	// in the dead pool, but didn't because of SetMinHealthyHosts
+	OnEjectionBlocked func(host string)
+	// OnCertExpiring is called for each ReportCertExpiry, with when the
+	// host's certificate expires
+	OnCertExpiring func(host string, notAfter time.Time)
+	// OnSaturation is called when the pool becomes saturated, with every
+	// host at its concurrency limit, and again when it stops being (see
+	// Limits)
+	OnSaturation func(saturated bool)
+}
+
+type hostEventKind int
+
+const (
+	hostAdded hostEventKind = iota
+	hostRemoved
+	hostDead
+	hostEjectionBlocked
+	hostCertExpiring
+	hostSaturation
+)
+
+type hostEvent struct {
+	kind      hostEventKind
+	host      string
+	at        time.Time // for hostCertExpiring
+	saturated bool      // for hostSaturation, which has no host
+}
+
+func (p *standardHostPool) AddHooks(hooks HostHooks) {
+	p.Lock()
+	defer p.Unlock()
+	p.hooks = append(p.hooks, hooks)
+}
+
+// queueEvent saves a change for the hooks to hear about once the pool is
+// unlocked, and sends it to any EventSink. It should only be called when the
+// lock has already been acquired
+func (p *standardHostPool) queueEvent(kind hostEventKind, host string) {
+	switch kind {
+	case hostAdded:
+		p.emit(Event{Kind: EventHostAdded, Host: host})
+	case hostRemoved:
+		p.emit(Event{Kind: EventHostRemoved, Host: host})
+	case hostDead:
+		p.emit(Event{Kind: EventHostDead, Host: host})
+	}
+	if len(p.hooks) > 0 {
+		p.events = append(p.events, hostEvent{kind: kind, host: host})
+	}
+}
+
+// unlockAndNotify unlocks the pool, then runs the hooks for any changes made
+// while it was locked. Anything that can add, remove or kill hosts unlocks
+// with this rather than Unlock.
+func (p *standardHostPool) unlockAndNotify() {
+	events, hooks := p.events, p.hooks
+	p.events = nil
+	p.Unlock()
+	for _, e := range events {
+		for _, h := range hooks {
+			switch {
+			case e.kind == hostAdded && h.OnHostAdded != nil:
+				h.OnHostAdded(e.host)
+			case e.kind == hostRemoved && h.OnHostRemoved != nil:
+				h.OnHostRemoved(e.host)
+			case e.kind == hostDead && h.OnHostDead != nil:
+				h.OnHostDead(e.host)
+			case e.kind == hostEjectionBlocked && h.OnEjectionBlocked != nil:
+				h.OnEjectionBlocked(e.host)
+			case e.kind == hostCertExpiring && h.OnCertExpiring != nil:
+				h.OnCertExpiring(e.host, e.at)
+			case e.kind == hostSaturation && h.OnSaturation != nil:
+				h.OnSaturation(e.saturated)
+			}
+		}
+	}
+}
+
+// ConnFactory builds a connection to host
+type ConnFactory func(host string) (io.Closer, error)
+
+// ConnPool keeps a connection per host in a HostPool, built by a ConnFactory
+// on the first Get of each host. Connections are closed when their host is
+// removed from the pool or marked dead, and built again when it's next used.
+type ConnPool struct {
+	pool    HostPool
+	factory ConnFactory
+
+	sync.Mutex
+	conns map[string]io.Closer
+}
+
+// NewConnPool manages connections for the hosts in pool
+func NewConnPool(pool HostPool, factory ConnFactory) *ConnPool {
+	c := &ConnPool{pool: pool, factory: factory, conns: make(map[string]io.Closer)}
+	pool.AddHooks(HostHooks{OnHostRemoved: c.closeConn, OnHostDead: c.closeConn})
+	return c
+}
+
+// Get returns a host along with its connection. Hosts the factory fails for
+// are marked as failed and another host is tried; the last factory error is
+// returned if every host fails, and ErrNoHosts if there are none.
+func (c *ConnPool) Get() (HostPoolResponse, io.Closer, error) {
+	var err error
+	for i := 0; i == 0 || i < len(c.pool.Hosts()); i++ {
+		r, getErr := c.pool.GetContext(context.Background(), RequestFeatures{})
+		if getErr != nil {
+			return nil, nil, getErr
+		}
+		var conn io.Closer
+		if conn, err = c.conn(r.Host()); err != nil {
+			r.Mark(err)
+			continue
+		}
+		return r, conn, nil
+	}
+	return nil, nil, err
+}
+
+func (c *ConnPool) conn(host string) (io.Closer, error) {
+	c.Lock()
+	defer c.Unlock()
+	if conn, ok := c.conns[host]; ok {
+		return conn, nil
+	}
+	conn, err := c.factory(host)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[host] = conn
+	return conn, nil
+}
+
+func (c *ConnPool) closeConn(host string) {
+	c.Lock()
+	conn, ok := c.conns[host]
+	delete(c.conns, host)
+	c.Unlock()
+	if ok {
+		conn.Close()
+	}
+}
+
+// Close closes the HostPool and every connection
+func (c *ConnPool) Close() {
+	c.pool.Close()
+	c.Lock()
+	defer c.Unlock()
+	for host, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, host)
+	}
+}
@@ -1,22 +1,151 @@
 package hostpool
 
 import (
+	"sync"
 	"time"
 )
 
-// --- hostEntry - this is due to get upgraded
+// --- hostEntry
 
+// hostEntry is the state a pool keeps for one host. It is a plain struct with
+// no goroutine or channels of its own: every field is guarded by the owning
+// pool's lock (apart from inFlight), so checks like canTryHost cost a
+// comparison, not a round trip. The timing buckets can also be written with
+// only the pool's read lock, as long as timingLock is held.
+//
+// The timing buckets are only needed by epsilon greedy pools, and only for
+// hosts that get traffic, so they live in a hostTimings that is allocated on
+// the first recorded timing and dropped again once a host has gone a full
+// decay duration without any.
 type hostEntry struct {
+	// inFlight is accessed atomically, so that marks on a healthy host only
+	// need the read lock; keep it first for 64 bit alignment on 32 bit systems
+	inFlight int64
+	// marks counts the marked responses by outcome (see HostStats), and is
+	// accessed atomically like inFlight
+	marks             [3]int64
+	dropped           int64 // responses found dropped, see leaks.go
+	outstanding       int64 // bytes, see ByteBalancer
+	throttled         int64 // when it last throttled a request, in Unix nanoseconds, see PriorityPolicy
+	timingLock        sync.Mutex
 	host              string
+	given             int       // position in the hosts as given, see SetHostOrder
+	added             time.Time // while ramping up, see SetNewHostRamp
 	nextRetry         time.Time
 	retryCount        int16
 	retryDelay        time.Duration
 	dead              bool
-	epsilonCounts     []int64
-	epsilonValues     []int64
+	*hostTimings      // nil until the host has a timing recorded
 	epsilonIndex      int
 	epsilonValue      float64
 	epsilonPercentage float64
+	tickValue         float64 // epsilonValue as of the last decay tick
+	tickPercentage    float64 // epsilonPercentage as of the last decay tick
+	burn              *burnTracker
+	explorationPicks  int64 // exploring selections over this decay duration
+	timingAnomalies   int64 // response times left out, see SetMaxTiming
+	lastSelected      time.Time
+	cooldownUntil     time.Time // see Cooldown
+	priorScore        float64   // see SetPriors
+	priorWeight       float64
+	certNotAfter      time.Time // see ReportCertExpiry
+	endpoint          Host
+	lastMark          *lastMark      // see SetTransitionLog
+	limiter           LimitAlgorithm // see Limits.AdaptiveLimit
+	rotated           bool           // see RotateCredentials
+	refreshing        chan struct{}  // closed when a refresh is done
+	refreshErr        error          // from the last failed refresh
+}
+
+const (
+	markSucceeded = iota
+	markFailed
+	markIgnored
+)
+
+// hostTimings holds the bucketed response times of a host, one bucket per
+// decay tick
+type hostTimings struct {
+	epsilonCounts []int64
+	epsilonValues []float64
+	penaltyCounts []int64 // epsilon samples that are error penalties
+	latencyCounts []int64
+	latencyValues []float64
+	errorCounts   []int64 // every failed request, timed or not
+	failureCounts []int64 // failed requests with a response time
+	failureValues []float64
+	classes       map[string]*classTimings
+	throughput    *throughputTimings // see MarkBytes
+}
+
+func newHostTimings() *hostTimings {
+	return &hostTimings{
+		epsilonCounts: make([]int64, epsilonBuckets),
+		epsilonValues: make([]float64, epsilonBuckets),
+		penaltyCounts: make([]int64, epsilonBuckets),
+		latencyCounts: make([]int64, epsilonBuckets),
+		latencyValues: make([]float64, epsilonBuckets),
+		errorCounts:   make([]int64, epsilonBuckets),
+		failureCounts: make([]int64, epsilonBuckets),
+		failureValues: make([]float64, epsilonBuckets),
+	}
+}
+
+// clearBucket empties bucket i ready for reuse
+func (t *hostTimings) clearBucket(i int) {
+	t.epsilonCounts[i] = 0
+	t.epsilonValues[i] = 0
+	t.penaltyCounts[i] = 0
+	t.latencyCounts[i] = 0
+	t.latencyValues[i] = 0
+	t.errorCounts[i] = 0
+	t.failureCounts[i] = 0
+	t.failureValues[i] = 0
+	for _, c := range t.classes {
+		c.counts[i] = 0
+		c.values[i] = 0
+	}
+	if t.throughput != nil {
+		t.throughput.bytes[i] = 0
+		t.throughput.ms[i] = 0
+	}
+}
+
+// empty reports whether every bucket has been cleared
+func (t *hostTimings) empty() bool {
+	for i := 0; i < epsilonBuckets; i++ {
+		if t.epsilonCounts[i] != 0 || t.latencyCounts[i] != 0 || t.errorCounts[i] != 0 || t.failureCounts[i] != 0 {
+			return false
+		}
+	}
+	for _, c := range t.classes {
+		for _, n := range c.counts {
+			if n != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// timings returns the host's timing buckets, allocating them if this is the
+// first timing recorded for it
+func (h *hostEntry) timings() *hostTimings {
+	if h.hostTimings == nil {
+		h.hostTimings = newHostTimings()
+	}
+	return h.hostTimings
+}
+
+// each class costs two bucket slices per host, so stop tracking new classes
+// past this many rather than growing without bound
+const maxClassesPerHost = 32
+
+// classTimings holds the response times of a single request class on a host,
+// bucketed the same way as the host's overall response times
+type classTimings struct {
+	counts []int64
+	values []float64
 }
 
 func (h *hostEntry) canTryHost(now time.Time) bool {
@@ -41,17 +170,131 @@ func (h *hostEntry) willRetryHost(maxRetryInterval time.Duration) {
 }
 
 func (h *hostEntry) getWeightedAverageResponseTime() float64 {
+	if h.hostTimings == nil {
+		return h.withPrior(0, 0)
+	}
+	var count int64
+	for _, n := range h.epsilonCounts {
+		count += n
+	}
+	return h.withPrior(weightedAverage(h.epsilonCounts, h.epsilonValues, h.epsilonIndex), count)
+}
+
+// getWeightedAverageClassResponseTime returns the weighted average response
+// time for requests in class, falling back to all requests if the class has
+// not been seen on this host
+func (h *hostEntry) getWeightedAverageClassResponseTime(class string) float64 {
+	if h.hostTimings == nil {
+		return 0
+	}
+	if c, ok := h.classes[class]; ok {
+		if v := weightedAverage(c.counts, c.values, h.epsilonIndex); v > 0 {
+			return v
+		}
+	}
+	return h.getWeightedAverageResponseTime()
+}
+
+// getWeightedAverageLatency is the same as getWeightedAverageResponseTime but
+// leaves out scores reported with MarkScore
+func (h *hostEntry) getWeightedAverageLatency() float64 {
+	if h.hostTimings == nil {
+		return 0
+	}
+	return weightedAverage(h.latencyCounts, h.latencyValues, h.epsilonIndex)
+}
+
+// getWeightedAverageFailureTime is the same as getWeightedAverageResponseTime
+// but only over requests that were marked as failed
+func (h *hostEntry) getWeightedAverageFailureTime() float64 {
+	if h.hostTimings == nil {
+		return 0
+	}
+	return weightedAverage(h.failureCounts, h.failureValues, h.epsilonIndex)
+}
+
+// getErrorRate returns the fraction of requests over the decay duration that
+// were marked as failed
+func (h *hostEntry) getErrorRate() float64 {
+	if h.hostTimings == nil {
+		return 0
+	}
+	var successes, failures int64
+	for i := 0; i < epsilonBuckets; i++ {
+		successes += h.epsilonCounts[i] - h.penaltyCounts[i]
+		failures += h.errorCounts[i]
+	}
+	if successes+failures == 0 {
+		return 0
+	}
+	return float64(failures) / float64(successes+failures)
+}
+
+// getRecentErrorRate is getErrorRate over the latest buckets buckets only,
+// returned along with the number of requests it was worked out from
+func (h *hostEntry) getRecentErrorRate(buckets int) (float64, int64) {
+	if h.hostTimings == nil {
+		return 0, 0
+	}
+	if buckets > epsilonBuckets {
+		buckets = epsilonBuckets
+	}
+	var successes, failures int64
+	for i := 0; i < buckets; i++ {
+		pos := (h.epsilonIndex - i + epsilonBuckets) % epsilonBuckets
+		successes += h.epsilonCounts[pos] - h.penaltyCounts[pos]
+		failures += h.errorCounts[pos]
+	}
+	if successes+failures == 0 {
+		return 0, 0
+	}
+	return float64(failures) / float64(successes+failures), successes + failures
+}
+
+// getConfidentScore is the host's score worked out with confidentAverage, and
+// how far it can be trusted. It leaves out priors.
+func (h *hostEntry) getConfidentScore() (score, confidence float64) {
+	if h.hostTimings == nil {
+		return 0, 0
+	}
+	return confidentAverage(h.epsilonCounts, h.epsilonValues, h.epsilonIndex)
+}
+
+// confidenceSamples is how many recent samples give a confidence of a half
+const confidenceSamples = 10
+
+// confidentAverage is the other way of averaging the buckets to
+// weightedAverage: rather than fill empty buckets in with the value before
+// them, each bucket counts by its samples as well as its age, so a host that
+// stops getting traffic isn't scored as if its last sample kept coming in.
+// Instead the confidence in the average falls, from near 1 with many recent
+// samples to 0 with none, as its samples age.
+func confidentAverage(counts []int64, values []float64, index int) (value, confidence float64) {
+	var samples, sum float64
+	for i := 1; i <= epsilonBuckets; i++ {
+		pos := (index + i) % epsilonBuckets
+		weight := float64(i) / float64(epsilonBuckets)
+		samples += float64(counts[pos]) * weight
+		sum += values[pos] * weight
+	}
+	if samples == 0 {
+		return 0, 0
+	}
+	return sum / samples, samples / (samples + confidenceSamples)
+}
+
+func weightedAverage(counts []int64, values []float64, index int) float64 {
 	var value float64
 	var lastValue float64
 
 	// start at 1 so we start with the oldest entry
 	for i := 1; i <= epsilonBuckets; i += 1 {
-		pos := (h.epsilonIndex + i) % epsilonBuckets
-		bucketCount := h.epsilonCounts[pos]
+		pos := (index + i) % epsilonBuckets
+		bucketCount := counts[pos]
 		// Changing the line below to what I think it should be to get the weights right
 		weight := float64(i) / float64(epsilonBuckets)
 		if bucketCount > 0 {
-			currentValue := float64(h.epsilonValues[pos]) / float64(bucketCount)
+			currentValue := values[pos] / float64(bucketCount)
 			value += currentValue * weight
 			lastValue = currentValue
 		} else {
@@ -4,8 +4,10 @@
 package hostpool
 
 import (
-	"log"
+	"context"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,16 +22,70 @@ func Version() string {
 // hostname by calling Host(), and after making a request to the host you should
 // call Mark with any error encountered, which will inform the HostPool issuing
 // the HostPoolResponse of what happened to the request and allow it to update.
+// What an error means for the host is decided by the pool's ErrorClassifier;
+// by default any error marks the host as failed, unless it is a
+// ClassifiedError saying otherwise.
+//
+// MarkScore can be called instead of Mark to report an arbitrary quality
+// signal for the request (queue length, cost, inverse throughput...) in place
+// of the measured response time. Like response times, lower scores are better,
+// and the EpsilonValueCalculator turns them into weights. Scores must be finite
+// and greater than zero; any other score is ignored and the request's response
+// time is used instead. Pools that don't learn from response times treat
+// MarkScore the same as Mark.
 type HostPoolResponse interface {
 	Host() string
+	// Endpoint is the host broken out, with anything it was given to
+	// SetEndpoints with
+	Endpoint() Host
+	// Trace is the Trace the host was picked with
+	Trace() Trace
+	// MarkBytes is Mark for a request that transferred bytes, for scoring
+	// hosts on throughput (see ThroughputEpsilonValueCalculator)
+	MarkBytes(err error, bytes int64)
 	Mark(error)
+	MarkScore(err error, score float64)
 	hostPool() HostPool
 }
 
+// RequestFeatures describe the request a host is being picked for, so that
+// hosts can be chosen differently for different kinds of requests (eg. large
+// uploads to high bandwidth hosts, small reads to low latency ones).
+type RequestFeatures struct {
+	Method      string
+	PayloadSize int64
+	Priority    int
+	// Class, if set, makes epsilon greedy pools score hosts on the response
+	// times of requests in the same class only (eg. one class per endpoint),
+	// since a host that's slow for one kind of request may be fast for another.
+	// Classes should come from a small fixed set (endpoint names, not raw
+	// paths); each host tracks at most maxClassesPerHost of them and requests
+	// in any further class are scored on all requests.
+	Class string
+	// Trace is carried by the response and the events about it, see Trace.
+	// GetContext takes it from the context if it isn't set.
+	Trace Trace
+	// Filter, if set, limits the pick to the hosts it returns true for, see
+	// View. GetContext returns ErrNoHosts if it allows none.
+	Filter func(Host) bool
+}
+
+// Outcome is the result of a single operation against a host. It is used to
+// report many results at once with MarkBatch.
+type Outcome struct {
+	Err      error
+	Duration time.Duration
+}
+
 type standardHostPoolResponse struct {
 	host string
 	sync.Once
 	pool HostPool
+	// inFlight is set for responses handed out by Get, which are counted as
+	// in flight against their host until marked
+	inFlight bool
+	trace    Trace
+	err      error // as marked
 }
 
 // --- HostPool structs and interfaces ----
@@ -39,12 +95,170 @@ type standardHostPoolResponse struct {
 // get the list of all Hosts, and use ResetAll to reset state.
 type HostPool interface {
 	Get() HostPoolResponse
+	// GetWithFeatures is Get for a request with the given features, which
+	// selectors and calculators may take into account when picking a host.
+	GetWithFeatures(RequestFeatures) HostPoolResponse
+	// GetContext is GetWithFeatures that returns ErrNoHosts from an empty
+	// pool, or waits on the context for hosts, depending on the pool's
+	// EmptyPoolPolicy
+	GetContext(context.Context, RequestFeatures) (HostPoolResponse, error)
+	SetEmptyPoolPolicy(EmptyPoolPolicy)
 	// keep the marks separate so we can override independently
 	markSuccess(HostPoolResponse)
 	markFailed(HostPoolResponse)
+	// markNeutral ends a request that says nothing about its host
+	markNeutral(HostPoolResponse)
+	errorClass(error) ErrorClass
+	emit(Event)
+
+	// SetErrorClassifier changes how errors passed to Mark are classified,
+	// nil goes back to DefaultErrorClassifier
+	SetErrorClassifier(ErrorClassifier)
+	// SetLogger sends the pool's log messages to l, nil goes back to the
+	// standard logger
+	SetLogger(l Logger)
+
+	// MarkBatch reports the outcomes of several operations against a host in
+	// one call. This is meant for clients that pipeline many requests over a
+	// single connection (redis pipelines, multiplexed HTTP/2) and would
+	// otherwise need a Get per operation. A batch containing any error marks
+	// the host as failed.
+	MarkBatch(host string, results []Outcome)
+
+	// MarkHostSuccess and MarkHostFailure report a host's health from
+	// outside of any request, eg. from an external health check or a sidecar.
+	// They change whether the host is in the dead pool, but nothing that is
+	// learned from requests (response times, error rates, SLOs). A failure
+	// that err's class doesn't blame on the host is ignored.
+	MarkHostSuccess(host string)
+	MarkHostFailure(host string, err error)
+	// ReportCertExpiry records when the certificate a host serves expires,
+	// eg. as found by a TLS health check, for HostStats and the
+	// OnCertExpiring hook. It changes nothing about the host's health.
+	ReportCertExpiry(host string, notAfter time.Time)
 
 	ResetAll()
 	Hosts() []string
+	// SetHosts changes the hosts in the pool. Hosts already in the pool keep
+	// their state; marks for hosts that have been removed are ignored.
+	SetHosts([]string)
+	// AddHost and RemoveHost change a single host, as with SetHosts
+	AddHost(host string)
+	RemoveHost(host string)
+	// SetEndpoints is SetHosts with each host's address broken out, see Host
+	SetEndpoints([]Host)
+	// ApplyHostsDryRun and ApplyEndpointsDryRun report what SetHosts and
+	// SetEndpoints would change, without changing anything
+	ApplyHostsDryRun(hosts []string) HostChanges
+	ApplyEndpointsDryRun(hosts []Host) HostChanges
+	// Endpoint returns the Host for a host in the pool, as given to
+	// SetEndpoints or parsed from the host string
+	Endpoint(host string) (Host, bool)
+	// AddHooks registers hooks to call as hosts join, leave and fail
+	AddHooks(HostHooks)
+	// SetEventSink sends the pool's events to sink, see EventSink, and
+	// EventSinkStatistics counts how many were delivered and dropped
+	SetEventSink(sink EventSink, queue int)
+	EventSinkStatistics() EventSinkStats
+	// SetTransitionLog keeps the last n times hosts went in or out of the
+	// dead pool, with the marks that did it, for Transitions (and
+	// TransitionsHandler) to dump after an outage
+	SetTransitionLog(n int)
+	Transitions() []Transition
+
+	// Statistics returns a point in time view of every host in the pool, and
+	// HostStatistics of a single host. These copies are the only view of a
+	// host's state outside of the pool.
+	Statistics() []HostStats
+	HostStatistics(host string) (HostStats, bool)
+	// Range calls f with each host and its stats from a snapshot, without
+	// holding the pool's lock while f runs, until f returns false
+	Range(f func(host Host, stats HostStats) bool)
+	// HedgeStatistics sums up the hedged requests made with DoHedged
+	HedgeStatistics() HedgeStats
+	recordHedge(hedgeOutcome)
+	sharedCalls() *flightGroup
+	countHosts(keep func(Host) bool) (live, total int)
+	suspect(host string)
+
+	// NextRetryAt returns when a dead host will next be retried, or the zero
+	// time if it's alive. ok is false if the host isn't in the pool.
+	NextRetryAt(host string) (at time.Time, ok bool)
+	// ForceRetryNow makes a dead host due a retry straight away and starts
+	// its backoff over, eg. once it's known to be fixed. It reports whether
+	// the host was dead.
+	ForceRetryNow(host string) bool
+
+	// Health sums up the state of the pool from how many hosts are alive,
+	// eg. for a readiness probe
+	Health() PoolHealth
+	SetHealthThresholds(HealthThresholds)
+
+	// SetMinHealthyHosts stops request failures from taking the pool below n
+	// live hosts, see guardrail.go
+	SetMinHealthyHosts(n int)
+
+	// SetLimits caps the requests in flight to each host, see Limits, and
+	// SaturationStatistics reports whether the pool is saturated by them
+	SetLimits(Limits)
+	SaturationStatistics() SaturationStats
+
+	// SetPacing limits the rate of Gets across the pool, see Pacing, and
+	// PacingStatistics sums up how they were held up by it
+	SetPacing(Pacing)
+	PacingStatistics() PacingStats
+
+	// SetWeightSchedule replaces the pool's weight profiles, which scale
+	// host weights at set times of day, and ActiveWeightProfiles names those
+	// in effect, see schedule.go
+	SetWeightSchedule(profiles ...WeightProfile)
+	ActiveWeightProfiles() []string
+
+	// StaggerRoundRobin starts round robin at an offset for this instance of
+	// the client, see stagger.go
+	StaggerRoundRobin(instance string)
+	// SetRetryStagger spreads out the retries of hosts that go down
+	// together, see retry_stagger.go
+	SetRetryStagger(stagger time.Duration)
+	// SetNewHostRamp ramps up the traffic to hosts added to the pool, see
+	// ramp.go
+	SetNewHostRamp(ramp time.Duration)
+	// SetHostOrder sets the order the pool keeps its hosts in, see HostOrder
+	SetHostOrder(HostOrder)
+
+	// RotateCredentials flags hosts (all of them, given none) as having had
+	// their credentials rotated, so that the pool's CredentialRefresher is
+	// called for each before it's next handed out, see credentials.go
+	RotateCredentials(hosts ...string)
+	SetCredentialRefresher(CredentialRefresher)
+
+	// SetLeakDetection makes the pool find responses that are dropped
+	// without being marked, and mark them, see leaks.go
+	SetLeakDetection(on bool)
+
+	// SetIdentity makes hosts on the same server, as identity maps them,
+	// share their health, see identity.go
+	SetIdentity(identity func(host string) string)
+
+	// UseCoarseClock makes host selection read the time from a clock updated
+	// every resolution by a single goroutine, instead of calling time.Now for
+	// every Get. Retry times are only compared to the millisecond or so, so at
+	// very high request rates this is a cheap win. 0 goes back to time.Now.
+	UseCoarseClock(resolution time.Duration)
+
+	// SetPriorityPolicy sets how Gets of a priority are treated, see
+	// priority.go
+	SetPriorityPolicy(priority int, policy PriorityPolicy)
+	priorityPolicy(priority int) PriorityPolicy
+	// SetLoadShedding turns away low priority Gets while the pool is
+	// unhealthy or slow, and LoadSheddingStatistics reports on it, see
+	// shedding.go
+	SetLoadShedding(LoadShedding)
+	LoadSheddingStatistics() SheddingStats
+
+	// SetSLO sets the objective used to compute per host burn rates, which are
+	// reported through Statistics. A zero SLO disables tracking.
+	SetSLO(SLO)
 
 	// Close the hostpool and release all resources.
 	Close()
@@ -57,6 +271,61 @@ type standardHostPool struct {
 	initialRetryDelay time.Duration
 	maxRetryInterval  time.Duration
 	nextHostIndex     int
+	startOffset       int       // see StaggerRoundRobin
+	standInIndex      int       // next to stand in for a ramping host, see SetNewHostRamp
+	hostOrder         HostOrder // see SetHostOrder
+	retryStagger      time.Duration
+	newHostRamp       time.Duration // see SetNewHostRamp
+	staggerRand       *rand.Rand    // only used under the lock, see SetRetryStagger
+	slo               *SLO
+	clock             *coarseClock // nil to use time.Now
+	onHealthChange    func()
+	onHostsChange     func()
+	hooks             []HostHooks
+	events            []hostEvent  // waiting for the hooks, see unlockAndNotify
+	classifier        atomic.Value // ErrorClassifier
+	logger            atomic.Value // loggerBox
+	sink              atomic.Value // *eventSink, see SetEventSink
+	healthThresholds  *HealthThresholds
+	minHealthyHosts   int
+	emptyPolicy       EmptyPoolPolicy
+	hostsAdded        chan struct{} // closed when hosts are added to an empty pool
+	hedges            hedgeTracker
+	flights           flightGroup    // calls in flight for DoShared
+	transitions       *transitionLog // nil unless SetTransitionLog is on
+
+	// concurrency limits, see limits.go
+	limits          Limits
+	limitsSet       int32 // 1 while any limit is set, accessed atomically
+	saturation      saturationState
+	capacityWaiting int64 // Gets waiting for capacity, accessed atomically
+	capacityLock    sync.Mutex
+	capacityFreed   chan struct{} // closed when capacity may have been freed
+
+	pacer pacer // see SetPacing
+	paced int32 // 1 while paced, accessed atomically
+
+	schedule  weightSchedule // see SetWeightSchedule
+	scheduled int32          // 1 while any profile is set, accessed atomically
+
+	refresher CredentialRefresher // see RotateCredentials
+	rotated   int32               // hosts flagged as rotated, accessed atomically
+
+	filter func(Host) bool // of the Get being picked, see useFilter
+
+	priorities    map[int]PriorityPolicy
+	prioritiesSet int32                    // 1 while any policy is set, accessed atomically
+	avoid         map[*hostEntry]bool      // by the Get being picked, see usePriority
+	hostScore     func(*hostEntry) float64 // lower is faster, nil for pools that don't score hosts
+
+	shedder     shedder                        // see SetLoadShedding
+	shedding    int32                          // 1 while shedding is set, accessed atomically
+	hostLatency func(*hostEntry) time.Duration // nil for pools that don't time requests
+
+	leakDetection int32 // 1 while on, accessed atomically, see leaks.go
+
+	identity   func(host string) string // see SetIdentity
+	byIdentity map[string][]*hostEntry  // nil without an identity
 }
 
 // ------ constants -------------------
@@ -70,77 +339,245 @@ const defaultDecayDuration = time.Duration(5) * time.Minute
 // Construct a basic HostPool using the hostnames provided
 func New(hosts []string) HostPool {
 	p := &standardHostPool{
-		hosts:             make(map[string]*hostEntry, len(hosts)),
-		hostList:          make([]*hostEntry, len(hosts)),
 		initialRetryDelay: time.Duration(30) * time.Second,
 		maxRetryInterval:  time.Duration(900) * time.Second,
 	}
+	p.setHosts(hosts)
+	return p
+}
 
-	for i, h := range hosts {
-		e := &hostEntry{
-			host:       h,
-			retryDelay: p.initialRetryDelay,
+func (p *standardHostPool) SetHosts(hosts []string) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	p.setHosts(hosts)
+}
+
+func (p *standardHostPool) AddHost(host string) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	if _, ok := p.hosts[host]; !ok {
+		p.setHosts(append(p.hostNamesInOrder(), host))
+	}
+}
+
+func (p *standardHostPool) RemoveHost(host string) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	if _, ok := p.hosts[host]; ok {
+		hosts := p.hostNamesInOrder()
+		for i, h := range hosts {
+			if h == host {
+				hosts = append(hosts[:i], hosts[i+1:]...)
+				break
+			}
 		}
-		p.hosts[h] = e
-		p.hostList[i] = e
+		p.setHosts(hosts)
 	}
+}
 
-	return p
+// hostNamesInOrder should only be called when the lock (or read lock) has
+// already been acquired
+func (p *standardHostPool) hostNamesInOrder() []string {
+	hosts := make([]string, len(p.hostList))
+	for _, h := range p.hostList {
+		hosts[h.given] = h.host
+	}
+	return hosts
+}
+
+// setHosts should only be called when the lock has already been acquired
+func (p *standardHostPool) setHosts(hosts []string) {
+	p.setEndpoints(hosts, nil)
+}
+
+// setEndpoints is setHosts with endpoints[i] as the Host of hosts[i]. With
+// nil endpoints, hosts already in the pool keep theirs and new ones are
+// parsed with ParseHost. It should only be called when the lock has already
+// been acquired
+func (p *standardHostPool) setEndpoints(hosts []string, endpoints []Host) {
+	byName := make(map[string]*hostEntry, len(hosts))
+	list := make([]*hostEntry, 0, len(hosts))
+	for i, host := range hosts {
+		if _, ok := byName[host]; ok {
+			continue
+		}
+		e, ok := p.hosts[host]
+		if !ok {
+			e = &hostEntry{
+				host:       host,
+				retryDelay: p.initialRetryDelay,
+				endpoint:   ParseHost(host),
+			}
+			if p.limits.AdaptiveLimit != nil {
+				e.limiter = p.limits.AdaptiveLimit()
+			}
+			if p.newHostRamp > 0 && len(p.hostList) > 0 {
+				e.added = time.Now()
+			}
+			p.queueEvent(hostAdded, host)
+		}
+		if endpoints != nil {
+			e.endpoint = endpoints[i]
+		}
+		e.given = len(list)
+		byName[host] = e
+		list = append(list, e)
+	}
+	for _, e := range p.hostList {
+		if _, ok := byName[e.host]; !ok {
+			if e.rotated {
+				atomic.AddInt32(&p.rotated, -1)
+			}
+			p.queueEvent(hostRemoved, e.host)
+		}
+	}
+	p.orderHosts(list)
+	p.hosts = byName
+	p.hostList = list
+	p.groupIdentities()
+	p.wakeWaiters()
+	if p.onHostsChange != nil {
+		p.onHostsChange()
+	}
+	p.healthChanged()
 }
 
 func (r *standardHostPoolResponse) Host() string {
 	return r.host
 }
 
+func (r *standardHostPoolResponse) Trace() Trace {
+	return r.trace
+}
+
 func (r *standardHostPoolResponse) hostPool() HostPool {
 	return r.pool
 }
 
 func (r *standardHostPoolResponse) Mark(err error) {
 	r.Do(func() {
+		r.err = err
 		doMark(err, r)
 	})
 }
 
+func (r *standardHostPoolResponse) markedErr() error {
+	return r.err
+}
+
+func (r *standardHostPoolResponse) isInFlight() bool {
+	return r.inFlight
+}
+
+func (r *standardHostPoolResponse) MarkScore(err error, score float64) {
+	r.Mark(err)
+}
+
 func doMark(err error, r HostPoolResponse) {
-	if err == nil {
+	c := r.hostPool().errorClass(err)
+	e := Event{Kind: EventMarked, Host: r.Host(), Trace: r.Trace(), Err: err, Class: c}
+	if t, ok := r.(interface{ elapsed() (time.Duration, bool) }); ok {
+		e.Duration, _ = t.elapsed()
+	}
+	r.hostPool().emit(e)
+	switch {
+	case c.succeeded():
 		r.hostPool().markSuccess(r)
-	} else {
+	case c.neutral():
+		r.hostPool().markNeutral(r)
+	default:
 		r.hostPool().markFailed(r)
 	}
 }
 
 // Get returns an entry from the HostPool
 func (p *standardHostPool) Get() HostPoolResponse {
+	return p.GetWithFeatures(RequestFeatures{})
+}
+
+// the round robin pool doesn't make use of request features
+func (p *standardHostPool) GetWithFeatures(f RequestFeatures) HostPoolResponse {
+	r, err := p.GetContext(forGet, f)
+	return orNoHost(p, r, err)
+}
+
+func (p *standardHostPool) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	return p.getRefreshed(ctx, f, func() (HostPoolResponse, error) { return p.getContext(ctx, f) })
+}
+
+func (p *standardHostPool) getContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
 	p.Lock()
-	defer p.Unlock()
+	defer p.unlockAndNotify()
+	if err := p.waitForHosts(ctx); err != nil {
+		return nil, err
+	}
+	if err := p.waitForCapacity(ctx); err != nil {
+		return nil, err
+	}
+	if f.Filter != nil {
+		if !p.useFilter(f.Filter) {
+			return nil, ErrNoHosts
+		}
+		defer func() { p.filter = nil }()
+	}
+	if p.usePriority(f) {
+		defer func() { p.avoid = nil }()
+	}
 	host := p.getRoundRobin()
-	return &standardHostPoolResponse{host: host, pool: p}
+	atomic.AddInt64(&p.hosts[host].inFlight, 1)
+	t := requestTrace(ctx, f)
+	p.emit(Event{Kind: EventSelected, Host: host, Trace: t})
+	r := &standardHostPoolResponse{host: host, pool: p, inFlight: true, trace: t}
+	p.watchLeaks(r)
+	return r, nil
 }
 
 func (p *standardHostPool) getRoundRobin() string {
-	now := time.Now()
+	now := p.now()
 	hostCount := len(p.hostList)
+	ramping := -1 // a live host passed over while it ramps up
 	for i := range p.hostList {
 		// iterate via sequenece from where we last iterated
 		currentIndex := (i + p.nextHostIndex) % hostCount
 
 		h := p.hostList[currentIndex]
+		if p.excluded(h) {
+			continue
+		}
 		if !h.dead {
+			if p.rampedOut(h, now) {
+				// its whole turn goes to a stand in, so that it isn't up
+				// again until the others have all had theirs
+				if standIn := p.standIn(now); standIn != nil {
+					p.nextHostIndex = currentIndex + 1
+					return standIn.host
+				}
+				if ramping < 0 {
+					ramping = currentIndex
+				}
+				continue
+			}
 			p.nextHostIndex = currentIndex + 1
 			return h.host
 		}
 		if h.nextRetry.Before(now) {
-			h.willRetryHost(p.maxRetryInterval)
+			p.retryHost(h)
 			p.nextHostIndex = currentIndex + 1
 			return h.host
 		}
 	}
+	if ramping >= 0 {
+		p.nextHostIndex = ramping + 1
+		return p.hostList[ramping].host
+	}
 
 	// all hosts are down. re-add them
+	if p.filter != nil {
+		return p.resetFiltered()
+	}
 	p.doResetAll()
-	p.nextHostIndex = 0
-	return p.hostList[0].host
+	p.nextHostIndex = p.startIndex()
+	return p.hostList[p.nextHostIndex].host
 }
 
 func (p *standardHostPool) ResetAll() {
@@ -154,48 +591,302 @@ func (p *standardHostPool) ResetAll() {
 // already been acquired
 func (p *standardHostPool) doResetAll() {
 	for _, h := range p.hosts {
+		if h.dead {
+			h.dead = false
+			p.emit(Event{Kind: EventHostAlive, Host: h.host})
+			p.logTransition(h, false, true)
+		}
+	}
+	p.orderHosts(p.hostList)
+	p.healthChanged()
+}
+
+// setAlive takes a host out of the dead pool, and should only be called when
+// the lock has already been acquired
+func (p *standardHostPool) setAlive(h *hostEntry) {
+	if h.dead {
 		h.dead = false
+		p.healthChanged()
+		p.emit(Event{Kind: EventHostAlive, Host: h.host})
+		p.logTransition(h, false, false)
+		for _, s := range p.siblings(h) {
+			p.setAlive(s)
+		}
+	}
+}
+
+// retryHost lets a dead host have another request, backing off its next retry.
+// It should only be called when the lock has already been acquired
+func (p *standardHostPool) retryHost(h *hostEntry) {
+	h.willRetryHost(p.maxRetryInterval)
+	// one host at a time is retried for a server
+	for _, s := range p.siblings(h) {
+		if s.dead {
+			s.retryCount, s.retryDelay, s.nextRetry = h.retryCount, h.retryDelay, h.nextRetry
+		}
 	}
+	p.healthChanged()
+}
+
+// healthChanged is called whenever a host goes in or out of the dead pool or
+// has its retry time moved, and should only be called when the lock has
+// already been acquired
+func (p *standardHostPool) healthChanged() {
+	if p.onHealthChange != nil {
+		p.onHealthChange()
+	}
+	p.wakeCapacityWaiters()
 }
 
 func (p *standardHostPool) Close() {
+	p.Lock()
+	defer p.Unlock()
 	for _, h := range p.hosts {
 		h.dead = true
 	}
+	p.healthChanged()
+	p.releaseClock()
+	p.replaceSink(nil)
 }
 
 func (p *standardHostPool) markSuccess(hostR HostPoolResponse) {
 	host := hostR.Host()
+
+	// most marks are successes on hosts that are already alive, which only
+	// need to read the pool
+	p.RLock()
+	h := p.lookupHost(host)
+	if h == nil {
+		p.RUnlock()
+		return
+	}
+	atomic.AddInt64(&h.marks[markSucceeded], 1)
+	if !h.dead && p.slo == nil {
+		p.release(h, hostR)
+		p.RUnlock()
+		return
+	}
+	p.RUnlock()
+
+	// a host can be ejected for burning its error budget
 	p.Lock()
-	defer p.Unlock()
+	defer p.unlockAndNotify()
 
-	h, ok := p.hosts[host]
-	if !ok {
-		log.Fatalf("host %s not in HostPool %v", host, p.Hosts())
+	h = p.lookupHost(host)
+	if h == nil {
+		return
+	}
+	p.noteResponse(h, hostR)
+	p.setAlive(h)
+	p.release(h, hostR)
+	p.observeResponse(h, false, hostR)
+}
+
+func (p *standardHostPool) markNeutral(hostR HostPoolResponse) {
+	p.RLock()
+	defer p.RUnlock()
+	if h := p.lookupHost(hostR.Host()); h != nil {
+		atomic.AddInt64(&h.marks[markIgnored], 1)
+		p.noteThrottled(h, hostR)
+		p.release(h, hostR)
 	}
-	h.dead = false
 }
 
 func (p *standardHostPool) markFailed(hostR HostPoolResponse) {
 	host := hostR.Host()
 	p.Lock()
-	defer p.Unlock()
-	h, ok := p.hosts[host]
-	if !ok {
-		log.Fatalf("host %s not in HostPool %v", host, p.Hosts())
+	defer p.unlockAndNotify()
+	h := p.lookupHost(host)
+	if h == nil {
+		return
 	}
+	atomic.AddInt64(&h.marks[markFailed], 1)
+	p.noteResponse(h, hostR)
+	p.ejectHost(h)
+	p.release(h, hostR)
+	p.observeResponse(h, true, hostR)
+}
+
+// release stops counting a marked response as in flight, and should only be
+// called when the lock (or read lock) has already been acquired
+func (p *standardHostPool) release(h *hostEntry, hostR HostPoolResponse) {
+	if r, ok := hostR.(interface{ isInFlight() bool }); ok && r.isInFlight() {
+		inFlight := atomic.AddInt64(&h.inFlight, -1)
+		if h.limiter != nil {
+			p.observeLimit(h, hostR, inFlight+1)
+		}
+		p.wakeCapacityWaiters()
+	}
+}
+
+// doMarkFailed puts a host in the dead pool and should only be called when the
+// lock has already been acquired
+func (p *standardHostPool) doMarkFailed(h *hostEntry) {
 	if !h.dead {
 		h.dead = true
 		h.retryCount = 0
 		h.retryDelay = p.initialRetryDelay
-		h.nextRetry = time.Now().Add(h.retryDelay)
+		h.nextRetry = time.Now().Add(h.retryDelay + p.retryJitter())
+		p.healthChanged()
+		p.queueEvent(hostDead, h.host)
+		p.logTransition(h, true, false)
+		for _, s := range p.siblings(h) {
+			p.doMarkFailed(s)
+		}
 	}
+}
+
+func (p *standardHostPool) MarkBatch(host string, results []Outcome) {
+	if len(results) == 0 {
+		return
+	}
+	p.Lock()
+	defer p.unlockAndNotify()
+	h := p.lookupHost(host)
+	if h == nil {
+		return
+	}
+	failed, succeeded := false, false
+	for _, o := range results {
+		c := p.errorClass(o.Err)
+		p.emit(Event{Kind: EventMarked, Host: host, Err: o.Err, Class: c, Duration: o.Duration})
+		switch {
+		case c.hostFailed():
+			if !failed {
+				p.noteMark(h, "batch", o.Err, o.Duration)
+			}
+			failed = true
+			atomic.AddInt64(&h.marks[markFailed], 1)
+		case c.succeeded():
+			if !failed && !succeeded {
+				p.noteMark(h, "batch", nil, o.Duration)
+			}
+			succeeded = true
+			atomic.AddInt64(&h.marks[markSucceeded], 1)
+		default:
+			atomic.AddInt64(&h.marks[markIgnored], 1)
+		}
+	}
+	if failed {
+		p.ejectHost(h)
+	} else if succeeded {
+		p.setAlive(h)
+	}
+	for _, o := range results {
+		if c := p.errorClass(o.Err); !c.neutral() {
+			p.observeSLO(h, c.hostFailed(), o.Duration, true)
+		}
+	}
+}
 
+// lookupHost returns the entry for host, or nil if it isn't in the pool (any
+// more), and should only be called when the lock (or read lock) has already
+// been acquired
+func (p *standardHostPool) lookupHost(host string) *hostEntry {
+	h, ok := p.hosts[host]
+	if !ok {
+		p.logf("host %s not in HostPool %v", host, p.hostNames())
+	}
+	return h
 }
+
 func (p *standardHostPool) Hosts() []string {
+	p.RLock()
+	defer p.RUnlock()
+	return p.hostNames()
+}
+
+// hostNames should only be called when the lock (or read lock) has already
+// been acquired
+func (p *standardHostPool) hostNames() []string {
 	hosts := make([]string, 0, len(p.hosts))
 	for host := range p.hosts {
 		hosts = append(hosts, host)
 	}
 	return hosts
 }
+
+func (p *standardHostPool) HostStatistics(host string) (HostStats, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	h, ok := p.hosts[host]
+	if !ok {
+		return HostStats{}, false
+	}
+	return p.hostStats(h, time.Now()), true
+}
+
+func (p *standardHostPool) Statistics() []HostStats {
+	p.RLock()
+	defer p.RUnlock()
+	stats := make([]HostStats, len(p.hostList))
+	now := time.Now()
+	for i, h := range p.hostList {
+		stats[i] = p.hostStats(h, now)
+	}
+	return stats
+}
+
+func (p *standardHostPool) NextRetryAt(host string) (time.Time, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	h, ok := p.hosts[host]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !h.dead {
+		return time.Time{}, true
+	}
+	return h.nextRetry, true
+}
+
+func (p *standardHostPool) ForceRetryNow(host string) bool {
+	p.Lock()
+	defer p.Unlock()
+	h, ok := p.hosts[host]
+	if !ok || !h.dead {
+		return false
+	}
+	h.retryCount = 0
+	h.retryDelay = p.initialRetryDelay
+	// just behind the clock, which may be coarse
+	h.nextRetry = p.now().Add(-time.Nanosecond)
+	p.healthChanged()
+	return true
+}
+
+func (p *standardHostPool) MarkHostSuccess(host string) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	if h := p.lookupHost(host); h != nil {
+		p.noteMark(h, "external", nil, 0)
+		p.setAlive(h)
+	}
+}
+
+func (p *standardHostPool) ReportCertExpiry(host string, notAfter time.Time) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	if h := p.lookupHost(host); h != nil {
+		h.certNotAfter = notAfter
+		if len(p.hooks) > 0 {
+			p.events = append(p.events, hostEvent{kind: hostCertExpiring, host: host, at: notAfter})
+		}
+	}
+}
+
+func (p *standardHostPool) MarkHostFailure(host string, err error) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	h := p.lookupHost(host)
+	if h == nil {
+		return
+	}
+	p.noteMark(h, "external", err, 0)
+	switch c := p.errorClass(err); {
+	case c.hostFailed():
+		p.doMarkFailed(h)
+	case c.succeeded():
+		p.setAlive(h)
+	}
+}
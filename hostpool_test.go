@@ -1,11 +1,22 @@
 package hostpool
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"net"
+	"net/http/httptest"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -144,3 +155,2843 @@ func BenchmarkEpsilonGreedy(b *testing.B) {
 		hostR.Mark(nil)
 	}
 }
+
+func TestMarkBatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+
+	p.MarkBatch("a", []Outcome{
+		{Duration: 10 * time.Millisecond},
+		{Duration: 30 * time.Millisecond},
+	})
+	assert.Equal(t, p.hosts["a"].epsilonCounts[p.hosts["a"].epsilonIndex], int64(2))
+	assert.Equal(t, p.hosts["a"].epsilonValues[p.hosts["a"].epsilonIndex], float64(40))
+
+	p.MarkBatch("b", []Outcome{{}, {Err: errors.New("Dummy Error")}})
+	assert.Equal(t, p.hosts["b"].dead, true)
+	assert.Equal(t, p.hosts["b"].epsilonCounts[p.hosts["b"].epsilonIndex], int64(1))
+}
+
+func TestMarkScore(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+
+	p.Get().MarkScore(nil, 2.5)
+	p.Get().MarkScore(nil, 0.5)
+	h := p.hosts["a"]
+	assert.Equal(t, h.epsilonCounts[h.epsilonIndex], int64(2))
+	assert.Equal(t, h.epsilonValues[h.epsilonIndex], 3.0)
+
+	// invalid scores fall back to the response time
+	p.timer = &mockTimer{t: 7}
+	p.Get().MarkScore(nil, 0)
+	p.Get().MarkScore(nil, -1)
+	assert.Equal(t, h.epsilonCounts[h.epsilonIndex], int64(4))
+	assert.Equal(t, h.epsilonValues[h.epsilonIndex], 17.0)
+
+	p.Get().MarkScore(errors.New("Dummy Error"), 1)
+	assert.Equal(t, h.dead, true)
+	assert.Equal(t, h.epsilonCounts[h.epsilonIndex], int64(4))
+}
+
+func TestSuccessAndFailureLatency(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+
+	p.timer = &mockTimer{t: 100}
+	p.Get().Mark(nil)
+	p.timer = &mockTimer{t: 900}
+	p.Get().Mark(errors.New("Dummy Error"))
+
+	stats := p.Statistics()
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].Host, "a")
+	assert.Equal(t, stats[0].Dead, true)
+	assert.Equal(t, stats[0].SuccessLatency > 0, true)
+	assert.Equal(t, stats[0].FailureLatency, 9*stats[0].SuccessLatency)
+	successLatency, score := stats[0].SuccessLatency, stats[0].Score
+
+	// scores change what the host is weighted on, but not its latency
+	p.Get().MarkScore(nil, 50000)
+	stats = p.Statistics()
+	assert.Equal(t, stats[0].SuccessLatency, successLatency)
+	assert.Equal(t, stats[0].Score > score, true)
+}
+
+func TestSLOBurnRate(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{})
+	defer p.Close()
+	p.SetSLO(SLO{Objective: 0.9, Latency: 100 * time.Millisecond, EjectBurnRate: 4, EjectMinRequests: 10})
+
+	// a is slow 20% of the time: twice the budget, but not enough to be
+	// ejected. b is always slow.
+	for i := 0; i < 10; i++ {
+		d := 10 * time.Millisecond
+		if i%5 == 0 {
+			d = time.Second
+		}
+		p.MarkBatch("a", []Outcome{{Duration: d}})
+		p.MarkBatch("b", []Outcome{{Duration: time.Second}})
+	}
+
+	stats := p.Statistics()
+	assert.Equal(t, len(stats[0].BurnRates), 2)
+	assert.InDelta(t, stats[0].BurnRates[0], 2.0, 0.0001)
+	assert.InDelta(t, stats[1].BurnRates[1], 10.0, 0.0001)
+	assert.Equal(t, stats[0].Dead, false)
+	assert.Equal(t, stats[1].Dead, true)
+}
+
+func TestSLOWindows(t *testing.T) {
+	p := New([]string{"a"}).(*standardHostPool)
+	windows := []time.Duration{time.Hour, -time.Minute, 0, 5 * time.Minute}
+	p.SetSLO(SLO{Objective: 0.99, Windows: windows})
+	assert.Equal(t, p.slo.Windows, []time.Duration{5 * time.Minute, time.Hour})
+	assert.Equal(t, windows[0], time.Hour)
+
+	p.SetSLO(SLO{Objective: 0.99, Windows: []time.Duration{-time.Minute}})
+	assert.Equal(t, p.slo.Windows, defaultSLOWindows)
+	p.slo.Windows[0] = time.Second
+	assert.Equal(t, defaultSLOWindows[0], 5*time.Minute)
+}
+
+func TestCompositeEpsilonValueCalculator(t *testing.T) {
+	c := &CompositeEpsilonValueCalculator{
+		LatencyWeight: 1,
+		ErrorWeight:   1000,
+		LoadWeight:    10,
+		Costs:         map[string]float64{"b": 2},
+	}
+	a := c.CalcValueFromMetrics(HostMetrics{Host: "a", AvgResponseTime: 100, ErrorRate: 0.1, InFlight: 5})
+	b := c.CalcValueFromMetrics(HostMetrics{Host: "b", AvgResponseTime: 100})
+	assert.InDelta(t, a, 1.0/250, 1e-9)
+	assert.InDelta(t, b, 1.0/200, 1e-9)
+}
+
+func TestErrorRate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	h := p.hosts["a"]
+
+	p.Get().MarkScore(nil, 10)
+	p.Get().MarkScore(errors.New("Dummy Error"), 10)
+	assert.InDelta(t, h.getErrorRate(), 0.5, 1e-9)
+	assert.Equal(t, p.Statistics()[0].FailureLatency, time.Duration(0))
+
+	p.MarkBatch("a", []Outcome{{}, {Err: errors.New("Dummy Error")}})
+	assert.InDelta(t, h.getErrorRate(), 0.5, 1e-9)
+}
+
+func TestInFlight(t *testing.T) {
+	inFlight := func(p HostPool) int64 {
+		return p.Statistics()[0].InFlight
+	}
+
+	p := New([]string{"a"})
+	r := p.Get()
+	assert.Equal(t, inFlight(p), int64(1))
+	r.Mark(nil)
+	r.Mark(nil)
+	assert.Equal(t, inFlight(p), int64(0))
+	// responses not handed out by Get were never in flight
+	(&standardHostPoolResponse{host: "a", pool: p}).Mark(nil)
+	assert.Equal(t, inFlight(p), int64(0))
+
+	ep := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{})
+	defer ep.Close()
+	r1 := ep.Get()
+	r2 := ep.GetWithFeatures(RequestFeatures{Class: "search"})
+	assert.Equal(t, inFlight(ep), int64(2))
+	ep.MarkBatch("a", []Outcome{{}, {}})
+	assert.Equal(t, inFlight(ep), int64(2))
+	r1.Mark(nil)
+	r2.MarkScore(errors.New("Dummy Error"), 1)
+	assert.Equal(t, inFlight(ep), int64(0))
+}
+
+// prefers "big" for large payloads and "small" for everything else
+type payloadCalculator struct{ LinearEpsilonValueCalculator }
+
+func (c *payloadCalculator) CalcValueForRequest(m HostMetrics, f RequestFeatures) float64 {
+	if (f.PayloadSize > 1024) == (m.Host == "big") {
+		return 1
+	}
+	return 0
+}
+
+func TestGetWithFeatures(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"big", "small"}, 0, &payloadCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetEpsilon(0)
+	p.MarkBatch("big", []Outcome{{Duration: time.Millisecond}})
+	p.MarkBatch("small", []Outcome{{Duration: time.Millisecond}})
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, p.GetWithFeatures(RequestFeatures{PayloadSize: 1 << 20}).Host(), "big")
+		assert.Equal(t, p.GetWithFeatures(RequestFeatures{PayloadSize: 10}).Host(), "small")
+	}
+}
+
+func TestRequestClassScores(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetEpsilon(0)
+
+	// a is fast for search and slow for health, b the reverse
+	p.Lock()
+	for host, ms := range map[string][2]float64{"a": {1, 1000}, "b": {1000, 1}} {
+		h := p.hosts[host]
+		p.recordScore(h, 500)
+		p.recordClassScore(h, "search", ms[0])
+		p.recordClassScore(h, "health", ms[1])
+	}
+	p.Unlock()
+
+	hits := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		hits[p.GetWithFeatures(RequestFeatures{Class: "search"}).Host()]++
+	}
+	assert.Equal(t, hits["a"] > 900, true)
+
+	hits = map[string]int{}
+	for i := 0; i < 1000; i++ {
+		hits[p.GetWithFeatures(RequestFeatures{Class: "health"}).Host()]++
+	}
+	assert.Equal(t, hits["b"] > 900, true)
+
+	// past the cap new classes aren't tracked
+	p.Lock()
+	h := p.hosts["a"]
+	for i := 0; i < 2*maxClassesPerHost; i++ {
+		p.recordClassScore(h, fmt.Sprintf("class%d", i), 1)
+	}
+	assert.Equal(t, len(h.classes), maxClassesPerHost)
+	p.Unlock()
+}
+
+func TestExplorationStrategies(t *testing.T) {
+	d := NewDecayingExploration(0.3, 0.5, 0.1)
+	assert.Equal(t, d.Epsilon(), float32(0.3))
+	d.Explored()
+	assert.InDelta(t, d.Epsilon(), 0.15, 1e-6)
+	d.Explored()
+	assert.InDelta(t, d.Epsilon(), 0.1, 1e-6)
+
+	r := NewRequestAnnealedExploration(0.5, 0.1, 4)
+	var seen []float32
+	for i := 0; i < 6; i++ {
+		seen = append(seen, r.Epsilon())
+	}
+	assert.InDeltaSlice(t, seen, []float32{0.5, 0.4, 0.3, 0.2, 0.1, 0.1}, 1e-6)
+
+	tm := NewTimeAnnealedExploration(0.5, 0.1, time.Hour)
+	assert.InDelta(t, tm.Epsilon(), 0.5, 0.01)
+	tm = NewTimeAnnealedExploration(0.5, 0.1, 0)
+	assert.Equal(t, tm.Epsilon(), float32(0.1))
+
+	// a pool that always explores is plain round robin
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(EpsilonGreedyHostPool)
+	defer p.Close()
+	p.SetExplorationStrategy(ConstantExploration(1))
+	p.MarkBatch("a", []Outcome{{Duration: time.Millisecond}})
+	p.MarkBatch("b", []Outcome{{Duration: time.Second}})
+	assert.Equal(t, p.Get().Host(), "a")
+	assert.Equal(t, p.Get().Host(), "b")
+	assert.Equal(t, p.Get().Host(), "a")
+}
+
+func TestAdaptiveExploration(t *testing.T) {
+	e := NewAdaptiveExploration(0.01, 0.2).(*adaptiveExploration)
+	assert.Equal(t, e.Epsilon(), float32(0.2))
+
+	// a dominant host lowers epsilon, down to the minimum
+	for i := 0; i < 100; i++ {
+		e.ObserveScores([]float64{0.9, 0.1}, []float64{10, 90})
+	}
+	assert.Equal(t, e.Epsilon(), float32(0.01))
+
+	// a shift in response times raises it
+	e.ObserveScores([]float64{0.9, 0.1}, []float64{10, 300})
+	assert.InDelta(t, e.Epsilon(), 0.015, 1e-6)
+
+	// and so do converging scores
+	for i := 0; i < 100; i++ {
+		e.ObserveScores([]float64{0.5, 0.5}, []float64{50, 50})
+	}
+	assert.Equal(t, e.Epsilon(), float32(0.2))
+}
+
+func TestMinExploration(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetEpsilon(0)
+	p.SetMinExploration(3)
+	p.MarkBatch("a", []Outcome{{Duration: time.Millisecond}})
+	p.MarkBatch("b", []Outcome{{Duration: time.Hour}})
+
+	hits := map[string]int{}
+	for i := 0; i < 100; i++ {
+		hits[p.Get().Host()]++
+	}
+	assert.Equal(t, hits["b"] >= 3, true)
+	stats := p.Statistics()
+	assert.Equal(t, stats[0].ExplorationPicks, int64(3))
+	assert.Equal(t, stats[1].ExplorationPicks, int64(3))
+
+	// a new decay duration starts the count again
+	for i := 0; i < epsilonBuckets; i++ {
+		p.performEpsilonGreedyDecay()
+	}
+	assert.Equal(t, p.Statistics()[1].ExplorationPicks, int64(0))
+}
+
+func TestExploreLeastRecentlyTried(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b", "c"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.MarkBatch("a", []Outcome{{Duration: time.Millisecond}})
+	p.MarkBatch("b", []Outcome{{Duration: time.Millisecond}})
+	p.MarkBatch("c", []Outcome{{Duration: time.Millisecond}})
+
+	now := time.Now()
+	p.hosts["a"].lastSelected = now
+	p.hosts["b"].lastSelected = now.Add(-time.Minute)
+	p.hosts["c"].lastSelected = now.Add(-time.Second)
+
+	p.SetExplorationStrategy(ConstantExploration(1))
+	assert.Equal(t, p.Get().Host(), "b")
+	assert.Equal(t, p.Get().Host(), "c")
+	assert.Equal(t, p.Get().Host(), "a")
+}
+
+func TestBoundedCalculators(t *testing.T) {
+	assert.Equal(t, clampEpsilonValue(-1), minEpsilonValue)
+	assert.Equal(t, clampEpsilonValue(math.NaN()), minEpsilonValue)
+	assert.Equal(t, clampEpsilonValue(math.Inf(1)), maxEpsilonValue)
+
+	l := &LogEpsilonValueCalculator{}
+	for _, v := range []float64{0.001, 0.5, 1, 1000} {
+		assert.Equal(t, l.CalcValueFromAvgResponseTime(v) > 0, true)
+	}
+
+	s := &SigmoidEpsilonValueCalculator{Midpoint: 100, Steepness: 10}
+	assert.InDelta(t, s.CalcValueFromAvgResponseTime(100), 0.5, 1e-9)
+	assert.Equal(t, s.CalcValueFromAvgResponseTime(1) > 0.99, true)
+	assert.Equal(t, s.CalcValueFromAvgResponseTime(1000) < 0.01, true)
+
+	c := &CappedLinearEpsilonValueCalculator{Min: 10, Max: 1000}
+	assert.Equal(t, c.CalcValueFromAvgResponseTime(1), 0.1)
+	assert.Equal(t, c.CalcValueFromAvgResponseTime(100), 0.01)
+	assert.Equal(t, c.CalcValueFromAvgResponseTime(1e6), 0.001)
+}
+
+func TestEpsilonValueStats(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b", "c"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.MarkBatch("a", []Outcome{{Duration: 100 * time.Millisecond}})
+	p.MarkBatch("b", []Outcome{{Duration: 300 * time.Millisecond}})
+	p.performEpsilonGreedyDecay()
+
+	stats := p.Statistics()
+	assert.Equal(t, stats[0].EpsilonValue > stats[1].EpsilonValue, true)
+	assert.InDelta(t, stats[0].EpsilonPercentage, 0.75, 1e-9)
+	assert.InDelta(t, stats[1].EpsilonPercentage, 0.25, 1e-9)
+	assert.Equal(t, stats[2].EpsilonPercentage, 0.0)
+}
+
+func TestSharedDecay(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a"}, epsilonBuckets*time.Millisecond, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	q := NewEpsilonGreedy([]string{"a"}, epsilonBuckets*2*time.Millisecond, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	index := func(p *epsilonGreedyHostPool) int {
+		p.RLock()
+		defer p.RUnlock()
+		return p.hosts["a"].epsilonIndex
+	}
+
+	// nothing ticks until the pools are used
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, index(p), 0)
+	assert.Equal(t, p.decay == nil, true)
+
+	p.Get().Mark(nil)
+	q.Get().Mark(nil)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, index(p) > 0, true)
+	assert.Equal(t, index(q) > 0, true)
+
+	p.Close()
+	q.Close()
+	p.Close()
+	stopped := index(p)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, index(p), stopped)
+}
+
+func TestCoarseClock(t *testing.T) {
+	p := New([]string{"a"}).(*standardHostPool)
+	q := New([]string{"a"}).(*standardHostPool)
+	p.UseCoarseClock(time.Millisecond)
+	q.UseCoarseClock(time.Millisecond)
+	assert.Equal(t, p.clock == q.clock, true)
+
+	before := p.now()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, p.now().After(before), true)
+	assert.WithinDuration(t, p.now(), time.Now(), 5*time.Millisecond)
+
+	c := p.clock
+	p.Close()
+	q.UseCoarseClock(0)
+	assert.Equal(t, q.clock == nil, true)
+	coarseClocks.Lock()
+	assert.Equal(t, c.refs, 0)
+	assert.Equal(t, len(coarseClocks.byResolution), 0)
+	coarseClocks.Unlock()
+}
+
+func TestConcurrentMarks(t *testing.T) {
+	hosts := []string{"a", "b", "c", "d"}
+	p := NewEpsilonGreedy(hosts, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				p.MarkBatch(host, []Outcome{{Duration: time.Millisecond}})
+				p.Get().Mark(nil)
+			}
+		}(host)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			p.Statistics()
+		}
+	}()
+	wg.Wait()
+
+	var total int64
+	for _, h := range p.hostList {
+		for _, c := range h.epsilonCounts {
+			total += c
+		}
+	}
+	assert.Equal(t, total, int64(800))
+}
+
+func TestLazyTimings(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+
+	assert.Nil(t, p.hosts["a"].hostTimings)
+	p.MarkBatch("a", []Outcome{{Duration: time.Millisecond}})
+	assert.NotNil(t, p.hosts["a"].hostTimings)
+	assert.Nil(t, p.hosts["b"].hostTimings)
+
+	// a full decay duration without traffic frees them again
+	for i := 0; i < epsilonBuckets-1; i++ {
+		p.performEpsilonGreedyDecay()
+	}
+	assert.NotNil(t, p.hosts["a"].hostTimings)
+	p.performEpsilonGreedyDecay()
+	assert.Nil(t, p.hosts["a"].hostTimings)
+	assert.Equal(t, p.Statistics()[0].Score, 0.0)
+}
+
+func TestSelectionCache(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetEpsilon(0)
+	p.SetSelectionCache(time.Hour, 3)
+
+	p.Lock()
+	p.recordScore(p.hosts["a"], 1)
+	p.recordScore(p.hosts["b"], 1000)
+	p.Unlock()
+
+	p.Get()
+	assert.Equal(t, p.selections[""].uses, 1)
+	p.Get()
+	p.Get()
+	assert.Equal(t, p.selections[""].uses, 3)
+	// the fourth pick works the shares out again
+	p.Get()
+	assert.Equal(t, p.selections[""].uses, 1)
+
+	p.GetWithFeatures(RequestFeatures{Class: "search"})
+	assert.Equal(t, len(p.selections), 2)
+
+	// a host going down throws the cache away
+	p.MarkBatch("b", []Outcome{{Err: errors.New("Dummy Error")}})
+	assert.Equal(t, len(p.selections), 0)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, p.Get().Host(), "a")
+	}
+
+	p.SetSelectionCache(0, 0)
+	p.Get()
+	assert.Equal(t, len(p.selections), 0)
+}
+
+func TestTimingSampleRate(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetTimingSampleRate(0.1)
+
+	results := make([]Outcome, 10000)
+	for i := range results {
+		results[i].Duration = time.Duration(10+i%2*20) * time.Millisecond
+		if i%4 == 0 {
+			results[i].Err = errors.New("Dummy Error")
+		}
+	}
+	p.MarkBatch("a", results)
+
+	h := p.hosts["a"]
+	recorded := h.epsilonCounts[h.epsilonIndex] + h.errorCounts[h.epsilonIndex]
+	assert.InDelta(t, float64(recorded), 1000, 150)
+	assert.InDelta(t, h.getErrorRate(), 0.25, 0.05)
+	// two successes at 30ms for every one at 10ms
+	assert.InDelta(t, h.epsilonValues[h.epsilonIndex]/float64(h.epsilonCounts[h.epsilonIndex]), 23.3, 2)
+
+	// health doesn't depend on sampling
+	assert.Equal(t, h.dead, true)
+
+	p.SetTimingSampleRate(1)
+	p.MarkBatch("a", []Outcome{{}, {}})
+	assert.Equal(t, h.epsilonCounts[h.epsilonIndex]+h.errorCounts[h.epsilonIndex], recorded+2)
+}
+
+func TestConsistentHash(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewConsistentHash([]string{"a", "b", "c"}, 0)
+	defer p.Close()
+
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		r := p.GetForKey(key)
+		owners[key] = r.Host()
+		counts[r.Host()]++
+		r.Mark(nil)
+		assert.Equal(t, p.HostForKey(key), owners[key])
+	}
+	for _, host := range []string{"a", "b", "c"} {
+		assert.InDelta(t, counts[host], 1000, 300)
+	}
+
+	// only a's keys move while it's down, and they move back after
+	var downKey string
+	for key, owner := range owners {
+		if owner == "a" {
+			downKey = key
+			break
+		}
+	}
+	p.GetForKey(downKey).Mark(errors.New("Dummy Error"))
+	moved := p.HostForKey(downKey)
+	assert.NotEqual(t, moved, "a")
+	for key, owner := range owners {
+		if owner != "a" {
+			assert.Equal(t, p.HostForKey(key), owner)
+		}
+	}
+	assert.Equal(t, p.GetForKey(downKey).Host(), moved)
+
+	p.ResetAll()
+	assert.Equal(t, p.HostForKey(downKey), "a")
+}
+
+func TestSetHosts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+
+	p.MarkBatch("a", []Outcome{{Err: errors.New("Dummy Error")}})
+	r := p.Get()
+	assert.Equal(t, r.Host(), "b")
+
+	p.SetHosts([]string{"a", "c", "c"})
+	assert.Equal(t, len(p.Hosts()), 2)
+	assert.Equal(t, p.hosts["a"].dead, true)
+	assert.Equal(t, p.Get().Host(), "c")
+
+	// marks for b are dropped now that it's gone
+	r.Mark(nil)
+	p.MarkBatch("b", []Outcome{{}})
+	assert.Equal(t, len(p.Hosts()), 2)
+
+	ch := NewConsistentHash([]string{"a", "b"}, 0)
+	defer ch.Close()
+	ch.SetHosts([]string{"c"})
+	assert.Equal(t, ch.HostForKey("key"), "c")
+}
+
+type testConn struct {
+	host   string
+	closed bool
+}
+
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestHostHooks(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := New([]string{"a", "b"})
+	defer p.Close()
+	var events []string
+	p.AddHooks(HostHooks{
+		OnHostAdded:   func(host string) { events = append(events, "added "+host) },
+		OnHostRemoved: func(host string) { events = append(events, "removed "+host) },
+		OnHostDead: func(host string) {
+			// hooks can call back into the pool
+			events = append(events, fmt.Sprintf("dead %s of %d", host, len(p.Hosts())))
+		},
+	})
+
+	p.AddHost("c")
+	p.AddHost("c")
+	p.MarkBatch("a", []Outcome{{Err: errors.New("Dummy Error")}})
+	p.MarkBatch("a", []Outcome{{Err: errors.New("Dummy Error")}})
+	p.RemoveHost("b")
+	p.SetHosts([]string{"a", "d"})
+	assert.Equal(t, events, []string{"added c", "dead a of 3", "removed b", "added d", "removed c"})
+	assert.ElementsMatch(t, p.Hosts(), []string{"a", "d"})
+}
+
+func TestConnPool(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := New([]string{"a", "b"})
+	built := map[string]*testConn{}
+	c := NewConnPool(p, func(host string) (io.Closer, error) {
+		if host == "b" {
+			return nil, errors.New("connection refused")
+		}
+		built[host] = &testConn{host: host}
+		return built[host], nil
+	})
+
+	for i := 0; i < 3; i++ {
+		r, conn, err := c.Get()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, r.Host(), "a")
+		assert.Equal(t, conn.(*testConn).host, "a")
+		r.Mark(nil)
+	}
+
+	// dead and removed hosts have their connections closed
+	first := built["a"]
+	r, _, _ := c.Get()
+	r.Mark(errors.New("Dummy Error"))
+	assert.Equal(t, first.closed, true)
+	_, conn, _ := c.Get()
+	assert.NotEqual(t, conn, first)
+	p.RemoveHost("a")
+	assert.Equal(t, conn.(*testConn).closed, true)
+
+	c.Close()
+}
+
+func TestWrapContext(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	inFlight := func() int64 { return p.Statistics()[0].InFlight }
+
+	// cancelling only ends the request
+	r := p.Get()
+	_, cancel := WrapContext(context.Background(), r)
+	assert.Equal(t, inFlight(), int64(1))
+	cancel()
+	waitUntil(t, func() bool { return inFlight() == 0 })
+	assert.Equal(t, p.hosts["a"].dead, false)
+
+	// so does a deadline passing, unless the classifier counts it as a failure
+	deadline, stop := context.WithTimeout(context.Background(), time.Millisecond)
+	defer stop()
+	ctx, cancel := WrapContext(deadline, p.Get())
+	<-ctx.Done()
+	waitUntil(t, func() bool { return inFlight() == 0 })
+	assert.Equal(t, p.Statistics()[0].Dead, false)
+	cancel()
+
+	p.SetErrorClassifier(func(err error) ErrorClass {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return Timeout
+		}
+		return DefaultErrorClassifier(err)
+	})
+	ctx, cancel = WrapContext(deadline, p.Get())
+	defer cancel()
+	<-ctx.Done()
+	waitUntil(t, func() bool { return p.Statistics()[0].Dead })
+	assert.Equal(t, inFlight(), int64(0))
+
+	// marks made first win, and the request isn't ended twice
+	r = p.Get()
+	_, cancel = WrapContext(context.Background(), r)
+	r.Mark(nil)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, inFlight(), int64(0))
+	assert.Equal(t, p.Statistics()[0].Dead, false)
+}
+
+func TestErrorClasses(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+
+	p.MarkBatch("a", []Outcome{
+		{Err: WithErrorClass(errors.New("no such key"), RequestError), Duration: time.Millisecond},
+		{Err: WithErrorClass(errors.New("slow down"), Throttled)},
+	})
+	h := p.hosts["a"]
+	assert.Equal(t, h.dead, false)
+	assert.Equal(t, h.epsilonCounts[h.epsilonIndex], int64(1))
+	assert.Equal(t, h.errorCounts[h.epsilonIndex], int64(0))
+
+	// classes survive wrapping
+	err := fmt.Errorf("get: %w", WithErrorClass(errors.New("slow down"), Throttled))
+	assert.Equal(t, p.errorClass(err), Throttled)
+	assert.Equal(t, p.errorClass(errors.New("connection refused")), HostError)
+
+	r := p.Get()
+	r.Mark(err)
+	assert.Equal(t, p.hosts[r.Host()].dead, false)
+	assert.Equal(t, p.hosts[r.Host()].inFlight, int64(0))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClassifiers(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	decode := errors.New("invalid character '<' looking for beginning of value")
+
+	assert.Equal(t, DefaultErrorClassifier(timeout), Timeout)
+	assert.Equal(t, DefaultErrorClassifier(refused), HostError)
+	assert.Equal(t, DefaultErrorClassifier(decode), HostError)
+
+	assert.Equal(t, NetworkErrorClassifier(fmt.Errorf("get: %w", timeout)), Timeout)
+	assert.Equal(t, NetworkErrorClassifier(refused), HostError)
+	assert.Equal(t, NetworkErrorClassifier(decode), RequestError)
+	assert.Equal(t, NetworkErrorClassifier(WithErrorClass(decode, HostError)), HostError)
+
+	// the caller giving up isn't the host's fault
+	assert.Equal(t, DefaultErrorClassifier(context.Canceled), Canceled)
+	assert.Equal(t, DefaultErrorClassifier(&net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}), Canceled)
+	assert.Equal(t, NetworkErrorClassifier(fmt.Errorf("query: %w", context.Canceled)), Canceled)
+
+	p := New([]string{"a", "b"})
+	defer p.Close()
+	p.SetErrorClassifier(NetworkErrorClassifier)
+	r := p.Get()
+	r.Mark(decode)
+	assert.Equal(t, p.Statistics()[0].Dead || p.Statistics()[1].Dead, false)
+	p.Get().Mark(timeout)
+	assert.Equal(t, p.Statistics()[0].Dead || p.Statistics()[1].Dead, true)
+}
+
+func TestErrorPenalties(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetErrorPenalty(Timeout, 2*time.Second)
+	p.SetErrorPenalty(Throttled, 100*time.Millisecond)
+
+	timeout := WithErrorClass(errors.New("i/o timeout"), Timeout)
+	throttled := WithErrorClass(errors.New("slow down"), Throttled)
+	p.MarkBatch("a", []Outcome{{Duration: 10 * time.Millisecond}, {Duration: 10 * time.Millisecond, Err: timeout}})
+	p.MarkBatch("b", []Outcome{{Duration: 10 * time.Millisecond}, {Err: throttled}})
+
+	a, b := p.hosts["a"], p.hosts["b"]
+	assert.Equal(t, a.epsilonValues[a.epsilonIndex], 2010.0)
+	assert.Equal(t, b.epsilonValues[b.epsilonIndex], 110.0)
+	// penalties don't count towards the error rate
+	assert.Equal(t, a.getErrorRate(), 0.5)
+	assert.Equal(t, b.getErrorRate(), 0.0)
+	assert.Equal(t, b.dead, false)
+
+	// and throttled responses pick up their penalty too
+	penalties := func() int64 { return a.penaltyCounts[a.epsilonIndex] + b.penaltyCounts[b.epsilonIndex] }
+	p.timer = &mockTimer{t: 1}
+	p.Get().Mark(throttled)
+	assert.Equal(t, penalties(), int64(3))
+
+	p.SetErrorPenalty(Throttled, 0)
+	p.MarkBatch("b", []Outcome{{Err: throttled}})
+	assert.Equal(t, penalties(), int64(3))
+}
+
+func TestCooldown(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetCooldown(Cooldown{Window: time.Second, ErrorRate: 0.2, MinRequests: 10, Weight: 0.25, Duration: time.Minute})
+
+	a, b := p.hosts["a"], p.hosts["b"]
+	p.Lock()
+	for i := 0; i < 10; i++ {
+		p.recordScore(a, 10)
+		p.recordScore(b, 10)
+	}
+	for i := 0; i < 5; i++ {
+		p.recordError(a)
+	}
+	p.recordError(b)
+	p.Unlock()
+
+	p.performEpsilonGreedyDecay()
+	stats := p.Statistics()
+	assert.Equal(t, stats[0].CooldownUntil.IsZero(), false)
+	assert.Equal(t, stats[1].CooldownUntil.IsZero(), true)
+	// a gets a quarter of b's value rather than none
+	assert.InDelta(t, stats[0].EpsilonPercentage, 0.2, 0.001)
+	assert.Equal(t, stats[0].Dead, false)
+
+	p.SetCooldown(Cooldown{})
+	assert.Equal(t, p.Statistics()[0].CooldownUntil.IsZero(), true)
+
+	s, ok := p.HostStatistics("b")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, s, p.Statistics()[1])
+	_, ok = p.HostStatistics("c")
+	assert.Equal(t, ok, false)
+}
+
+func TestForceRetryNow(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+
+	p.MarkBatch("a", []Outcome{{Err: errors.New("Dummy Error")}})
+	at, ok := p.NextRetryAt("a")
+	assert.Equal(t, ok, true)
+	assert.InDelta(t, time.Until(at).Seconds(), 30, 1)
+	at, ok = p.NextRetryAt("b")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, at.IsZero(), true)
+	_, ok = p.NextRetryAt("c")
+	assert.Equal(t, ok, false)
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, p.Get().Host(), "b")
+	}
+	assert.Equal(t, p.ForceRetryNow("b"), false)
+	assert.Equal(t, p.ForceRetryNow("a"), true)
+	assert.Equal(t, p.Get().Host(), "a")
+}
+
+func TestMarkHost(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+
+	p.MarkHostFailure("a", errors.New("health check failed"))
+	assert.Equal(t, p.hosts["a"].dead, true)
+	p.MarkHostFailure("b", context.Canceled)
+	assert.Equal(t, p.hosts["b"].dead, false)
+	p.MarkHostSuccess("a")
+	assert.Equal(t, p.hosts["a"].dead, false)
+	// nothing is learned about response times
+	assert.Nil(t, p.hosts["a"].hostTimings)
+}
+
+func TestHealth(t *testing.T) {
+	p := New([]string{"a", "b", "c", "d"})
+	defer p.Close()
+
+	assert.Equal(t, p.Health(), PoolHealth{Status: Healthy, Live: 4, Total: 4})
+	p.MarkHostFailure("a", errors.New("down"))
+	assert.Equal(t, p.Health().Status, Degraded)
+	p.MarkHostFailure("b", errors.New("down"))
+	assert.Equal(t, p.Health().Status, Degraded)
+	p.MarkHostFailure("c", errors.New("down"))
+	assert.Equal(t, p.Health().Status, Unhealthy)
+	assert.Equal(t, p.Health().Ready(), false)
+
+	p.SetHealthThresholds(HealthThresholds{Degraded: 0.5, Unhealthy: 0.25})
+	assert.Equal(t, p.Health().Status, Degraded)
+	assert.Equal(t, p.Health().Status.String(), "degraded")
+
+	p.SetHosts(nil)
+	assert.Equal(t, p.Health().Status, Unhealthy)
+}
+
+func TestMinHealthyHosts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := New([]string{"a", "b", "c"})
+	defer p.Close()
+	p.SetMinHealthyHosts(2)
+	var blocked []string
+	p.AddHooks(HostHooks{OnEjectionBlocked: func(host string) { blocked = append(blocked, host) }})
+
+	fail := []Outcome{{Err: errors.New("Dummy Error")}}
+	p.MarkBatch("a", fail)
+	p.MarkBatch("b", fail)
+	p.MarkBatch("c", fail)
+	assert.Equal(t, p.Health().Live, 2)
+	assert.Equal(t, blocked, []string{"b", "c"})
+
+	// external health signals aren't held back
+	p.MarkHostFailure("b", errors.New("down"))
+	assert.Equal(t, p.Health().Live, 1)
+}
+
+func TestEmptyPool(t *testing.T) {
+	for _, p := range []HostPool{
+		New(nil),
+		NewEpsilonGreedy(nil, 0, &LinearEpsilonValueCalculator{}),
+		NewConsistentHash(nil, 0),
+	} {
+		r := p.Get()
+		assert.Equal(t, r.Host(), "")
+		r.Mark(errors.New("Dummy Error"))
+		_, err := p.GetContext(context.Background(), RequestFeatures{})
+		assert.Equal(t, err, ErrNoHosts)
+
+		// waiting callers are woken when a host is added
+		p.SetEmptyPoolPolicy(EmptyPoolWait)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		_, err = p.GetContext(ctx, RequestFeatures{})
+		cancel()
+		assert.Equal(t, err, context.DeadlineExceeded)
+
+		got := make(chan string)
+		go func() { got <- p.Get().Host() }()
+		time.Sleep(time.Millisecond)
+		p.AddHost("a")
+		assert.Equal(t, <-got, "a")
+
+		p.RemoveHost("a")
+		go func() { got <- p.Get().Host() }()
+		time.Sleep(time.Millisecond)
+		p.SetHosts([]string{"b"})
+		assert.Equal(t, <-got, "b")
+		p.Close()
+	}
+
+	ch := NewConsistentHash(nil, 0)
+	defer ch.Close()
+	assert.Equal(t, ch.GetForKey("key").Host(), "")
+	assert.Equal(t, ch.HostForKey("key"), "")
+}
+
+func TestDoHedged(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+
+	var first string
+	var mu sync.Mutex
+	err := DoHedged(context.Background(), p, 10*time.Millisecond, func(ctx context.Context, host string) error {
+		mu.Lock()
+		slow := first == ""
+		if slow {
+			first = host
+		}
+		mu.Unlock()
+		if slow {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	assert.Equal(t, err, nil)
+
+	stats := p.HedgeStatistics()
+	assert.Equal(t, stats.Hedged, int64(1))
+	assert.Equal(t, stats.HedgeWins, int64(1))
+	assert.Equal(t, stats.Losses, map[string]int64{first: 1})
+	assert.Equal(t, stats.WastedWork > 0.5, true)
+	// the canceled loser isn't held against its host
+	s, _ := p.HostStatistics(first)
+	assert.Equal(t, s.Dead, false)
+
+	// a pool that can only offer the same host doesn't hedge
+	single := New([]string{"a"})
+	defer single.Close()
+	calls := 0
+	err = DoHedged(context.Background(), single, time.Millisecond, func(ctx context.Context, host string) error {
+		calls++
+		time.Sleep(5 * time.Millisecond)
+		return errors.New("Dummy Error")
+	})
+	assert.Equal(t, err, errors.New("Dummy Error"))
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, single.HedgeStatistics().Hedged, int64(0))
+
+	err = Do(context.Background(), p, func(ctx context.Context, host string) error {
+		return errors.New("Dummy Error")
+	})
+	assert.Equal(t, err, errors.New("Dummy Error"))
+	assert.Equal(t, p.Health().Live, 1)
+}
+
+func TestDoShared(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+	waiting := func() int {
+		g := p.sharedCalls()
+		g.Lock()
+		defer g.Unlock()
+		if c, ok := g.calls["item"]; ok {
+			return c.waiting
+		}
+		return 0
+	}
+
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	values := make([]interface{}, 5)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], _ = DoShared(context.Background(), p, "item", func(ctx context.Context, host string) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", nil
+			})
+		}(i)
+	}
+	for waiting() < len(values) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+	for _, v := range values {
+		assert.Equal(t, v, "value")
+	}
+	var marks int64
+	for _, s := range p.Statistics() {
+		marks += s.Successes
+	}
+	assert.Equal(t, marks, int64(1))
+
+	// a call all its callers give up on is canceled, and the next starts afresh
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := DoShared(ctx, p, "item", func(ctx context.Context, host string) (interface{}, error) {
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return nil, ctx.Err()
+		})
+		assert.Equal(t, err, context.Canceled)
+	}()
+	for waiting() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, <-canceled, context.Canceled)
+	v, err := DoShared(context.Background(), p, "item", func(ctx context.Context, host string) (interface{}, error) {
+		return "fresh", nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, v, "fresh")
+}
+
+func TestWarmup(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewEpsilonGreedy([]string{"a", "b", "c"}, 0, &LinearEpsilonValueCalculator{})
+	defer p.Close()
+	checker := HealthCheckerFunc(func(ctx context.Context, host string) error {
+		switch host {
+		case "a":
+			time.Sleep(time.Millisecond)
+		case "b":
+			time.Sleep(10 * time.Millisecond)
+		case "c":
+			return errors.New("Dummy Error")
+		}
+		return nil
+	})
+	assert.Equal(t, Warmup(context.Background(), p, checker, 3), nil)
+
+	a, _ := p.HostStatistics("a")
+	b, _ := p.HostStatistics("b")
+	c, _ := p.HostStatistics("c")
+	assert.Equal(t, a.SuccessLatency > 0, true)
+	assert.Equal(t, a.SuccessLatency < b.SuccessLatency, true)
+	assert.Equal(t, c.Dead, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, Warmup(ctx, p, checker, 3), context.Canceled)
+}
+
+func TestPriors(t *testing.T) {
+	old := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer old.Close()
+	old.MarkBatch("a", []Outcome{{Duration: 10 * time.Millisecond}})
+	old.MarkBatch("b", []Outcome{{Duration: 100 * time.Millisecond}})
+	saved, err := json.Marshal(old.Priors())
+	assert.Equal(t, err, nil)
+
+	var priors []HostPrior
+	assert.Equal(t, json.Unmarshal(saved, &priors), nil)
+	p := NewEpsilonGreedy([]string{"a", "b", "c"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetEpsilon(0)
+	p.SetPriors(append(priors, HostPrior{Host: "gone", Score: 1}), 0)
+
+	// real response times are mixed in with the prior
+	p.MarkBatch("b", []Outcome{{Duration: time.Millisecond}, {Duration: time.Millisecond}})
+	b, _ := p.HostStatistics("b")
+	assert.InDelta(t, b.Score, (2*1+10*100)/12.0, 1)
+
+	hits := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		r := p.Get()
+		hits[r.Host()]++
+		r.Mark(nil)
+	}
+	assert.Equal(t, hits["a"] > hits["b"], true)
+
+	// and the prior fades
+	for i := 0; i < 20; i++ {
+		p.performEpsilonGreedyDecay()
+	}
+	p.RLock()
+	assert.Equal(t, p.hosts["b"].priorWeight, 0.0)
+	p.RUnlock()
+}
+
+func TestSeedScore(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.MarkBatch("a", []Outcome{{Duration: 20 * time.Millisecond}})
+
+	// a host added next to a starts out as a does
+	p.AddHost("c")
+	a, _ := p.HostStatistics("a")
+	assert.Equal(t, p.SeedScore("c", msToDuration(a.Score), 0), true)
+	c, _ := p.HostStatistics("c")
+	assert.InDelta(t, c.Score, 20, 0.001)
+	assert.Equal(t, p.SeedScore("gone", time.Millisecond, 0), false)
+}
+
+type testBroadcaster struct {
+	sync.Mutex
+	sent []Observation
+}
+
+func (b *testBroadcaster) Broadcast(o Observation) {
+	b.Lock()
+	defer b.Unlock()
+	b.sent = append(b.sent, o)
+}
+
+func TestGossip(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := New([]string{"a", "b", "c"})
+	defer p.Close()
+	b := &testBroadcaster{}
+	g := NewGossip(p, b, GossipConfig{Source: "me", Trust: 0.5})
+
+	p.MarkHostFailure("a", errors.New("Dummy Error"))
+	assert.Equal(t, b.sent, []Observation{{Host: "a", Source: "me"}})
+
+	// our own reports and repeats from one peer don't count
+	g.Receive(Observation{Host: "b", Source: "me"})
+	g.Receive(Observation{Host: "b", Source: "peer1"})
+	g.Receive(Observation{Host: "b", Source: "peer1"})
+	s, _ := p.HostStatistics("b")
+	assert.Equal(t, s.Dead, false)
+
+	// a second peer does, and what peers said isn't broadcast again
+	g.Receive(Observation{Host: "b", Source: "peer2"})
+	s, _ = p.HostStatistics("b")
+	assert.Equal(t, s.Dead, true)
+	assert.Equal(t, len(b.sent), 1)
+
+	untrusting := NewGossip(p, b, GossipConfig{Source: "me"})
+	untrusting.Receive(Observation{Host: "c", Source: "peer1"})
+	s, _ = p.HostStatistics("c")
+	assert.Equal(t, s.Dead, false)
+}
+
+// waitUntil polls cond for up to a second. assert.Eventually can panic
+// sending on a closed channel when cond is slow.
+func waitUntil(t *testing.T, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met after 1s")
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := New([]string{"a", "b", "c", "d"})
+	defer p.Close()
+	var mu sync.Mutex
+	checks := map[string]int{}
+	var running, maxRunning int
+	up := map[string]bool{"a": true, "b": true, "c": true}
+	checker := HealthCheckerFunc(func(ctx context.Context, host string) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		checks[host]++
+		ok := up[host]
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if !ok {
+			return errors.New("Dummy Error")
+		}
+		return nil
+	})
+	s := NewScheduler(p, checker, ScheduleConfig{Interval: 5 * time.Millisecond, Jitter: 0.2, Concurrency: 2})
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, maxRunning <= 2, true)
+	assert.Equal(t, checks["a"] > 5, true)
+	// d backs off
+	assert.Equal(t, checks["d"] < checks["a"]/2, true)
+	up["d"] = true
+	mu.Unlock()
+	d, _ := p.HostStatistics("d")
+	assert.Equal(t, d.Dead, true)
+
+	p.AddHost("e")
+	waitUntil(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return checks["e"] > 0
+	})
+	waitUntil(t, func() bool {
+		d, _ := p.HostStatistics("d")
+		return !d.Dead
+	})
+
+	s.Close()
+	mu.Lock()
+	total := checks["a"]
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, checks["a"], total)
+	mu.Unlock()
+}
+
+func TestParseHost(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		host Host
+		out  string
+	}{
+		{"a", Host{Name: "a"}, "a"},
+		{"a:80", Host{Name: "a", Port: 80}, "a:80"},
+		{"https://a:443/path", Host{Name: "a", Port: 443, Scheme: "https"}, "https://a:443"},
+		{"10.0.0.1:80", Host{Name: "10.0.0.1", IP: net.ParseIP("10.0.0.1"), Port: 80}, "10.0.0.1:80"},
+		{"[fe80::1%eth0]:80", Host{Name: "fe80::1", IP: net.ParseIP("fe80::1"), Port: 80, Zone: "eth0"}, "[fe80::1%eth0]:80"},
+		{"::1", Host{Name: "::1", IP: net.ParseIP("::1")}, "::1"},
+	} {
+		h := ParseHost(c.in)
+		assert.Equal(t, h, c.host, c.in)
+		assert.Equal(t, h.String(), c.out, c.in)
+	}
+}
+
+func TestSetEndpoints(t *testing.T) {
+	p := NewEpsilonGreedy(nil, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetEpsilon(0)
+	p.SetEndpoints([]Host{
+		{Name: "a", Port: 80, Weight: 3, Meta: map[string]string{"zone": "us-east-1a"}},
+		{Name: "b", Port: 80},
+	})
+	assert.ElementsMatch(t, p.Hosts(), []string{"a:80", "b:80"})
+	p.MarkBatch("a:80", []Outcome{{Duration: 10 * time.Millisecond}})
+	p.MarkBatch("b:80", []Outcome{{Duration: 10 * time.Millisecond}})
+
+	hits := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		r := p.Get()
+		hits[r.Host()]++
+		r.MarkScore(nil, 10)
+	}
+	assert.InDelta(t, float64(hits["a:80"])/4000, 0.75, 0.05)
+
+	// string changes keep the endpoints of hosts that stay
+	p.AddHost("c:80")
+	a, ok := p.Endpoint("a:80")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, a.Meta["zone"], "us-east-1a")
+	c, _ := p.Endpoint("c:80")
+	assert.Equal(t, c, Host{Name: "c", Port: 80})
+	_, ok = p.Endpoint("d:80")
+	assert.Equal(t, ok, false)
+
+	r := p.Get()
+	assert.Equal(t, r.Endpoint().Port, 80)
+	p.SetEndpoints([]Host{{Scheme: "https", Name: "e", Port: 8443, Meta: map[string]string{"zone": "eu-west-1b"}}})
+	r = p.Get()
+	assert.Equal(t, r.Endpoint().Meta["zone"], "eu-west-1b")
+	assert.Equal(t, r.Endpoint().URL().String(), "https://e:8443")
+	// hosts removed since still break out
+	p.SetHosts([]string{"f"})
+	assert.Equal(t, r.Endpoint(), Host{Scheme: "https", Name: "e", Port: 8443})
+}
+
+func TestStatsJSON(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+	p.SetErrorClassifier(nil)
+	r := p.Get()
+	r.Mark(nil)
+	p.Get().Mark(errors.New("down"))
+	p.Get().Mark(context.Canceled)
+	p.MarkBatch("b", []Outcome{{}, {}})
+	p.Get()
+
+	s, _ := p.HostStatistics("a")
+	assert.Equal(t, s.Successes, int64(1))
+	assert.Equal(t, s.Ignored, int64(1))
+
+	w := httptest.NewRecorder()
+	StatsHandler(p).ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	var got struct {
+		StatusCode int `json:"status_code"`
+		Data       struct {
+			Health    string `json:"health"`
+			Status    string `json:"status"`
+			DeadCount int    `json:"dead_count"`
+			InFlight  int64  `json:"in_flight"`
+			Hosts     []struct {
+				Host         string `json:"host"`
+				Dead         bool   `json:"dead"`
+				NextRetry    int64  `json:"next_retry"`
+				RequestCount int64  `json:"request_count"`
+				FailureCount int64  `json:"failure_count"`
+			} `json:"hosts"`
+		} `json:"data"`
+	}
+	assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &got), nil)
+	assert.Equal(t, got.StatusCode, 200)
+	assert.Equal(t, got.Data.Health, "OK")
+	assert.Equal(t, got.Data.Status, "healthy")
+	assert.Equal(t, got.Data.DeadCount, 0)
+	assert.Equal(t, got.Data.InFlight, int64(1))
+	assert.Equal(t, len(got.Data.Hosts), 2)
+	hosts := map[string]int{}
+	for i, h := range got.Data.Hosts {
+		hosts[h.Host] = i
+	}
+	b := got.Data.Hosts[hosts["b"]]
+	assert.Equal(t, b.RequestCount, int64(3))
+	assert.Equal(t, b.FailureCount, int64(1))
+	// revived by the batch
+	assert.Equal(t, b.Dead, false)
+	assert.Equal(t, b.NextRetry, int64(0))
+}
+
+// expvarRuns numbers TestPublishExpvar's prefixes, since expvar names can't be
+// published twice and go test -count runs tests more than once
+var expvarRuns int32
+
+func TestPublishExpvar(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+	p.Get().Mark(nil)
+	prefix := fmt.Sprintf("%s_%d", t.Name(), atomic.AddInt32(&expvarRuns, 1))
+	PublishExpvar(p, prefix)
+
+	var pool struct {
+		HostCount int   `json:"host_count"`
+		InFlight  int64 `json:"in_flight"`
+	}
+	assert.Equal(t, json.Unmarshal([]byte(expvar.Get(prefix+".pool").String()), &pool), nil)
+	assert.Equal(t, pool.HostCount, 2)
+	p.Get()
+	var hosts map[string]struct {
+		InFlight     int64 `json:"in_flight"`
+		SuccessCount int64 `json:"success_count"`
+	}
+	assert.Equal(t, json.Unmarshal([]byte(expvar.Get(prefix+".hosts").String()), &hosts), nil)
+	assert.Equal(t, hosts["a"].SuccessCount, int64(1))
+	assert.Equal(t, hosts["b"].InFlight, int64(1))
+}
+
+func TestEventSink(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{})
+	events := make(chan Event, 10)
+	p.SetEventSink(EventSinkFunc(func(e Event) { events <- e }), 0)
+	p.AddHost("b")
+	p.RemoveHost("b")
+	r := p.Get()
+	time.Sleep(time.Millisecond)
+	r.Mark(errors.New("down"))
+	p.MarkHostSuccess("a")
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		e := <-events
+		got = append(got, e.Kind.String()+" "+e.Host)
+		if e.Kind == EventMarked {
+			assert.Equal(t, e.Err.Error(), "down")
+			assert.Equal(t, e.Class, HostError)
+			assert.True(t, e.Duration >= time.Millisecond)
+		}
+	}
+	assert.Equal(t, got, []string{"added b", "removed b", "selected a", "marked a", "dead a", "alive a"})
+	waitUntil(t, func() bool { return p.EventSinkStatistics().Delivered == 6 })
+
+	// a sink that falls behind loses events rather than holding up the pool
+	block := make(chan struct{})
+	p.SetEventSink(EventSinkFunc(func(e Event) { events <- e; <-block }), 1)
+	assert.Equal(t, p.EventSinkStatistics(), EventSinkStats{})
+	p.MarkBatch("a", []Outcome{{}})
+	<-events
+	p.MarkBatch("a", []Outcome{{}, {}})
+	assert.Equal(t, p.EventSinkStatistics().Dropped, int64(1))
+	close(block)
+	p.Close()
+	p.MarkBatch("a", []Outcome{{}})
+	assert.Equal(t, p.EventSinkStatistics(), EventSinkStats{})
+}
+
+func TestTrace(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{})
+	defer p.Close()
+	events := make(chan Event, 10)
+	p.SetEventSink(EventSinkFunc(func(e Event) { events <- e }), 0)
+
+	ctx := WithTrace(context.Background(), Trace{TraceID: "t1", SpanID: "s1"})
+	r, err := p.GetContext(ctx, RequestFeatures{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Trace().String(), "t1/s1")
+	r.Mark(nil)
+	assert.Equal(t, (<-events).Trace, r.Trace())
+	assert.Equal(t, (<-events).Trace, r.Trace())
+
+	// features take precedence over the context
+	r, _ = p.GetContext(ctx, RequestFeatures{Trace: Trace{TraceID: "t2"}})
+	assert.Equal(t, r.Trace().String(), "t2")
+	assert.Equal(t, p.Get().Trace(), Trace{})
+}
+
+func TestTransitionLog(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{})
+	defer p.Close()
+	p.MarkHostFailure("a", errors.New("before the log"))
+	p.MarkHostSuccess("a")
+	assert.Equal(t, len(p.Transitions()), 0)
+
+	p.SetTransitionLog(4)
+	r, _ := p.GetContext(context.Background(), RequestFeatures{})
+	time.Sleep(time.Millisecond)
+	r.Mark(errors.New("connection refused"))
+	got := p.Transitions()
+	assert.Equal(t, len(got), 1)
+	assert.Equal(t, got[0].Host, r.Host())
+	assert.Equal(t, got[0].Dead, true)
+	assert.Equal(t, got[0].Cause, "request")
+	assert.Equal(t, got[0].Err, "connection refused")
+	assert.True(t, got[0].Latency >= time.Millisecond)
+
+	other := "a"
+	if r.Host() == "a" {
+		other = "b"
+	}
+	p.MarkBatch(other, []Outcome{{}, {Err: errors.New("timeout"), Duration: time.Second}})
+	p.ResetAll()
+	p.MarkHostFailure("a", errors.New("health check"))
+	got = p.Transitions()
+	// only the last 4 are kept, oldest first
+	assert.Equal(t, len(got), 4)
+	assert.Equal(t, got[0].Cause, "batch")
+	assert.Equal(t, got[0].Err, "timeout")
+	assert.Equal(t, got[0].Latency, time.Second)
+	assert.Equal(t, got[1].Cause, "reset")
+	assert.Equal(t, got[2].Cause, "reset")
+	assert.Equal(t, got[2].Dead, false)
+	assert.Equal(t, got[3], Transition{Host: "a", Time: got[3].Time, Dead: true, Cause: "external", Err: "health check", MarkedAt: got[3].MarkedAt})
+
+	w := httptest.NewRecorder()
+	TransitionsHandler(p).ServeHTTP(w, httptest.NewRequest("GET", "/transitions", nil))
+	var dumped []Transition
+	assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &dumped), nil)
+	assert.Equal(t, len(dumped), 4)
+	assert.Equal(t, dumped[3].Err, "health check")
+}
+
+func TestLimits(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{})
+	defer p.Close()
+	var saturation []bool
+	p.AddHooks(HostHooks{OnSaturation: func(saturated bool) { saturation = append(saturation, saturated) }})
+	p.SetLimits(Limits{MaxInFlight: 1})
+	ctx := context.Background()
+	r1, err := p.GetContext(ctx, RequestFeatures{})
+	assert.Equal(t, err, nil)
+	r2, _ := p.GetContext(ctx, RequestFeatures{})
+	assert.NotEqual(t, r1.Host(), r2.Host())
+	_, err = p.GetContext(ctx, RequestFeatures{})
+	assert.Equal(t, err, ErrSaturated)
+	assert.Equal(t, saturation, []bool{true})
+
+	// waiting Gets go on as requests finish
+	p.SetLimits(Limits{MaxInFlight: 1, Wait: true})
+	got := make(chan HostPoolResponse)
+	go func() {
+		r, _ := p.GetContext(ctx, RequestFeatures{})
+		got <- r
+	}()
+	waitUntil(t, func() bool { return p.SaturationStatistics().Waiting == 1 })
+	r1.Mark(nil)
+	r3 := <-got
+	assert.Equal(t, r3.Host(), r1.Host())
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = p.GetContext(timeout, RequestFeatures{})
+	assert.Equal(t, err, context.DeadlineExceeded)
+	assert.Equal(t, p.SaturationStatistics(), SaturationStats{Saturated: true, Waited: 1, Rejected: 2})
+
+	r2.Mark(nil)
+	p.Get()
+	assert.Equal(t, p.SaturationStatistics().Saturated, false)
+	assert.Equal(t, saturation, []bool{true, false})
+}
+
+func TestAdaptiveLimits(t *testing.T) {
+	aimd := AIMDLimit(AIMD{Initial: 10, Max: 12, Timeout: time.Second})
+	aimd.Observe(time.Millisecond, 2, false)
+	assert.Equal(t, aimd.Limit(), 10)
+	for i := 0; i < 5; i++ {
+		aimd.Observe(time.Millisecond, 8, false)
+	}
+	assert.Equal(t, aimd.Limit(), 12)
+	aimd.Observe(2*time.Second, 8, false)
+	assert.Equal(t, aimd.Limit(), 10)
+
+	gradient := GradientLimit(Gradient{Initial: 50, Smoothing: 1, LongWindow: 1000})
+	for i := 0; i < 100; i++ {
+		gradient.Observe(10*time.Millisecond, 50, false)
+	}
+	steady := gradient.Limit()
+	assert.True(t, steady > 50)
+	for i := 0; i < 10; i++ {
+		gradient.Observe(100*time.Millisecond, steady, false)
+	}
+	assert.True(t, gradient.Limit() < steady/2)
+
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{})
+	defer p.Close()
+	p.SetLimits(Limits{AdaptiveLimit: func() LimitAlgorithm { return AIMDLimit(AIMD{Initial: 2}) }})
+	r1 := p.Get()
+	p.Get()
+	_, err := p.GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, ErrSaturated)
+	s, _ := p.HostStatistics("a")
+	assert.Equal(t, s.ConcurrencyLimit, 2)
+	r1.Mark(nil)
+	s, _ = p.HostStatistics("a")
+	assert.Equal(t, s.ConcurrencyLimit, 3)
+	p.AddHost("b")
+	s, _ = p.HostStatistics("b")
+	assert.Equal(t, s.ConcurrencyLimit, 2)
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestDecisionLogging(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b", "c"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	l := &testLogger{}
+	p.SetLogger(l)
+	p.SetEpsilon(0)
+	p.MarkHostSuccess("d")
+	assert.Equal(t, len(l.lines), 1)
+	assert.Contains(t, l.lines[0], "host d not in HostPool")
+
+	p.MarkBatch("a", []Outcome{{Duration: 10 * time.Millisecond}})
+	p.MarkBatch("b", []Outcome{{Duration: 30 * time.Millisecond}})
+	p.MarkHostFailure("c", errors.New("down"))
+	p.Get().Mark(nil)
+	assert.Equal(t, len(l.lines), 1)
+
+	p.SetDecisionLogging(1)
+	p.Get().Mark(nil)
+	assert.Equal(t, len(l.lines), 2)
+	line := l.lines[1]
+	assert.Contains(t, line, "(by score): a share ")
+	assert.Contains(t, line, ", b share ")
+	assert.Contains(t, line, ", c dead until")
+}
+
+func TestHostCost(t *testing.T) {
+	p := NewEpsilonGreedy(nil, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetEpsilon(0)
+	p.SetEndpoints([]Host{{Name: "a"}, {Name: "b", Cost: 3}})
+	share := func() float64 {
+		hits := 0
+		for i := 0; i < 4000; i++ {
+			r := p.Get()
+			if r.Host() == "a" {
+				hits++
+			}
+			r.MarkScore(nil, 10)
+		}
+		return float64(hits) / 4000
+	}
+	p.MarkBatch("a", []Outcome{{Duration: 10 * time.Millisecond}})
+	p.MarkBatch("b", []Outcome{{Duration: 10 * time.Millisecond}})
+	assert.InDelta(t, share(), 0.75, 0.05)
+	p.SetCostSensitivity(0)
+	assert.InDelta(t, share(), 0.5, 0.05)
+}
+
+func TestThroughput(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &ThroughputEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.timer = &mockTimer{t: 10}
+	bytes := map[string]int64{"a": 1 << 20, "b": 1 << 18}
+	p.SetEpsilon(1)
+	for i := 0; i < 10; i++ {
+		r := p.Get()
+		r.MarkBytes(nil, bytes[r.Host()])
+	}
+	p.SetEpsilon(0)
+	hits := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		r := p.Get()
+		hits[r.Host()]++
+		r.MarkBytes(nil, bytes[r.Host()])
+	}
+	// the same response times, but a moves four times as many bytes
+	assert.InDelta(t, float64(hits["a"])/4000, 0.8, 0.05)
+	s, _ := p.HostStatistics("a")
+	assert.InDelta(t, s.Throughput, float64(100<<20), 1)
+}
+
+func TestPartialSuccess(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.timer = &mockTimer{t: 10}
+	p.SetErrorPenalty(PartialSuccess, 30*time.Millisecond)
+	stale := WithErrorClass(errors.New("served stale"), PartialSuccess)
+	mark := func(r HostPoolResponse) {
+		if r.Host() == "b" {
+			r.Mark(stale)
+		} else {
+			r.Mark(nil)
+		}
+	}
+	p.SetEpsilon(1)
+	for i := 0; i < 10; i++ {
+		mark(p.Get())
+	}
+	p.SetEpsilon(0)
+	hits := 0
+	for i := 0; i < 4000; i++ {
+		r := p.Get()
+		if r.Host() == "a" {
+			hits++
+		}
+		mark(r)
+	}
+	// b scores (10ms + 30ms) / 2, half as well as a
+	assert.InDelta(t, float64(hits)/4000, 2.0/3, 0.05)
+	s, _ := p.HostStatistics("b")
+	assert.Equal(t, s.Dead, false)
+	assert.Equal(t, s.Failures, int64(0))
+	assert.InDelta(t, s.Score, 20, 0.01)
+}
+
+func TestRotateCredentials(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+	var mu sync.Mutex
+	var refreshed []string
+	var fail bool
+	release := make(chan struct{})
+	p.SetCredentialRefresher(func(ctx context.Context, host Host) error {
+		mu.Lock()
+		refreshed = append(refreshed, host.Name)
+		mu.Unlock()
+		<-release
+		if fail {
+			return errors.New("token endpoint down")
+		}
+		return nil
+	})
+
+	// hosts that haven't rotated aren't refreshed
+	close(release)
+	for i := 0; i < 4; i++ {
+		p.Get().Mark(nil)
+	}
+	assert.Equal(t, len(refreshed), 0)
+
+	// one refresh, before the next use of each rotated host
+	p.RotateCredentials("a")
+	for i := 0; i < 4; i++ {
+		p.Get().Mark(nil)
+	}
+	assert.Equal(t, refreshed, []string{"a"})
+
+	// Gets that pick a host being refreshed wait for it
+	release = make(chan struct{})
+	refreshed = nil
+	p.RotateCredentials()
+	type result struct {
+		host string
+		err  error
+	}
+	results := make(chan result, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			r, err := p.GetContext(context.Background(), RequestFeatures{})
+			if err == nil {
+				results <- result{r.Host(), nil}
+				r.Mark(nil)
+				return
+			}
+			results <- result{err: err}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, len(results), 0)
+	close(release)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, (<-results).err, nil)
+	}
+	assert.Equal(t, len(refreshed), 2)
+
+	// a failed refresh kills the host, and Get moves on
+	refreshed = nil
+	fail = true
+	p.RotateCredentials("b")
+	for i := 0; i < 4; i++ {
+		r := p.Get()
+		assert.Equal(t, r.Host(), "a")
+		r.Mark(nil)
+	}
+	assert.Equal(t, refreshed, []string{"b"})
+	s, _ := p.HostStatistics("b")
+	assert.Equal(t, s.Dead, true)
+	assert.Equal(t, s.InFlight, int64(0))
+
+	// and with every host failing, the refresh error comes back
+	p.RotateCredentials("a")
+	_, err := p.GetContext(context.Background(), RequestFeatures{})
+	assert.NotEqual(t, err, nil)
+	assert.Contains(t, err.Error(), "token endpoint down")
+}
+
+func TestReplicaSets(t *testing.T) {
+	sets := NewReplicaSets(
+		ReplicaSet{Name: "shard1", Pool: New([]string{"a1", "a2"})},
+		ReplicaSet{Name: "shard2", Pool: New([]string{"b1", "b2"}), Weight: 3},
+	)
+	defer sets.Close()
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		r, set, err := sets.Get(context.Background(), RequestFeatures{})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, set, map[byte]string{'a': "shard1", 'b': "shard2"}[r.Host()[0]])
+		counts[set]++
+		r.Mark(nil)
+	}
+	assert.InDelta(t, float64(counts["shard2"])/4000, 0.75, 0.05)
+
+	// a set with a host down gets less, and one with none up gets nothing
+	shard2, _ := sets.Set("shard2")
+	shard2.MarkHostFailure("b1", errors.New("down"))
+	sets.updated = time.Time{}
+	stats := sets.Statistics()
+	assert.Equal(t, stats[1], ReplicaSetStats{Name: "shard2", Live: 1, Total: 2, Share: 0.6})
+	shard2.MarkHostFailure("b2", errors.New("down"))
+	sets.updated = time.Time{}
+	for i := 0; i < 100; i++ {
+		r, set, _ := sets.Get(context.Background(), RequestFeatures{})
+		assert.Equal(t, set, "shard1")
+		r.Mark(nil)
+	}
+
+	// but can still be asked for directly
+	r, err := sets.GetFromSet(context.Background(), "shard2", RequestFeatures{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Host()[0], byte('b'))
+	r.Mark(nil)
+	_, err = sets.GetFromSet(context.Background(), "shard3", RequestFeatures{})
+	assert.Equal(t, err, ErrNoHosts)
+}
+
+func TestViews(t *testing.T) {
+	p := NewEpsilonGreedy(nil, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.timer = &mockTimer{t: 10}
+	zone := func(z string) map[string]string { return map[string]string{"zone": z} }
+	p.SetEndpoints([]Host{
+		{Name: "a1", Meta: zone("a")},
+		{Name: "a2", Meta: zone("a")},
+		{Name: "b1", Meta: zone("b")},
+	})
+	zoneA := NewView(p, HasMeta("zone", "a"))
+	zoneB := NewView(p, HasMeta("zone", "b"))
+	assert.ElementsMatch(t, zoneA.Hosts(), []string{"a1", "a2"})
+
+	for i := 0; i < 100; i++ {
+		r := zoneA.Get()
+		assert.Equal(t, r.Host()[0], byte('a'))
+		r.Mark(nil)
+	}
+	// what the view learned is the pool's
+	s1, _ := p.HostStatistics("a1")
+	s2, _ := p.HostStatistics("a2")
+	assert.Equal(t, s1.Successes+s2.Successes, int64(100))
+	assert.Equal(t, len(zoneA.Statistics()), 2)
+
+	// narrowed, and merged back
+	onlyA2 := zoneA.Filter(func(h Host) bool { return h.Name == "a2" })
+	assert.Equal(t, onlyA2.Get().Host(), "a2")
+	both := zoneA.Union(zoneB)
+	assert.Equal(t, len(both.parts), 1)
+	hits := map[string]int{}
+	for i := 0; i < 300; i++ {
+		r := both.Get()
+		hits[r.Host()]++
+		r.Mark(nil)
+	}
+	assert.Equal(t, len(hits), 3)
+
+	// with every allowed host down only those come back
+	p.MarkHostFailure("a1", errors.New("down"))
+	p.MarkHostFailure("a2", errors.New("down"))
+	p.MarkHostFailure("b1", errors.New("down"))
+	zoneB.Get().Mark(nil)
+	a1, _ := p.HostStatistics("a1")
+	b1, _ := p.HostStatistics("b1")
+	assert.Equal(t, a1.Dead, true)
+	assert.Equal(t, b1.Dead, false)
+
+	_, err := NewView(p, HasMeta("zone", "c")).GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, ErrNoHosts)
+
+	// unions of different pools pick a pool by its live hosts
+	other := New([]string{"x"})
+	defer other.Close()
+	mixed := zoneB.Union(NewView(other, nil))
+	hits = map[string]int{}
+	for i := 0; i < 100; i++ {
+		r := mixed.Get()
+		hits[r.Host()]++
+		r.Mark(nil)
+	}
+	assert.Equal(t, len(hits), 2)
+}
+
+func TestSubPools(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+	all := NewView(p, nil)
+	batch := NewSubPool("batch", all, Quota{MaxInFlight: 2})
+	api := NewSubPool("api", all, Quota{Rate: 1000, Burst: 2})
+
+	// batch's requests in flight don't count against api's quota
+	r1, r2 := batch.Get(), batch.Get()
+	_, err := batch.GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, ErrQuotaExceeded)
+	r, err := api.GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, nil)
+	r.Mark(nil)
+	assert.Equal(t, batch.Statistics(), SubPoolStats{Name: "batch", InFlight: 2, Granted: 2, Rejected: 1})
+
+	// marking gives the quota back, once
+	r1.Mark(nil)
+	r1.Mark(nil)
+	assert.Equal(t, batch.Statistics().InFlight, 1)
+	r2.Mark(nil)
+
+	// but they share what's learned about the hosts
+	r = api.Get()
+	r.Mark(errors.New("down"))
+	s, _ := p.HostStatistics(r.Host())
+	assert.Equal(t, s.Dead, true)
+	assert.NotEqual(t, batch.Get().Host(), r.Host())
+
+	// the rate limit runs out after the burst, and waiting refills it
+	api.refilled = time.Now()
+	api.tokens = 0
+	_, err = api.GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, ErrQuotaExceeded)
+	waiting := NewSubPool("waiting", all, Quota{Rate: 100, Wait: true})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		waiting.Get().Mark(nil)
+	}
+	assert.True(t, time.Since(start) >= 15*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = waiting.GetContext(ctx, RequestFeatures{})
+	assert.Equal(t, err, context.Canceled)
+}
+
+func TestLeakDetection(t *testing.T) {
+	for _, p := range []HostPool{New([]string{"a"}), NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{})} {
+		p.SetLogger(log.New(ioutil.Discard, "", 0))
+		p.SetLeakDetection(true)
+		p.Get().Mark(nil)
+		for i := 0; i < 3; i++ {
+			p.Get()
+		}
+		waitUntil(t, func() bool {
+			runtime.GC()
+			s, _ := p.HostStatistics("a")
+			return s.InFlight == 0
+		})
+		s, _ := p.HostStatistics("a")
+		assert.Equal(t, s.Dropped, int64(3))
+		assert.Equal(t, s.Ignored, int64(3))
+		assert.Equal(t, s.Dead, false)
+		assert.Equal(t, s.Successes, int64(1))
+		p.Close()
+	}
+}
+
+func TestConnectionBalancer(t *testing.T) {
+	p := NewConnectionBalancer([]string{"a", "b"})
+	defer p.Close()
+	var conns []HostPoolResponse
+	for i := 0; i < 6; i++ {
+		conns = append(conns, p.Get())
+	}
+	assert.Equal(t, p.Connections(), map[string]int{"a": 3, "b": 3})
+
+	// closing connections makes room on their host
+	for _, r := range conns[:4] {
+		if r.Host() == "a" {
+			r.Mark(nil)
+		}
+	}
+	assert.Equal(t, p.Connections()["b"], 3)
+	assert.Equal(t, p.Get().Host(), "a")
+	assert.Equal(t, len(p.Rebalance()), 0)
+
+	// a new host gets the next connections, and some of the old ones
+	p.AddHost("c")
+	assert.Equal(t, p.Get().Host(), "c")
+	counts := p.Connections()
+	moves := p.Rebalance()
+	assert.Equal(t, len(moves), 1)
+	assert.Equal(t, moves[0].Host(), "b")
+	for _, r := range moves {
+		r.Mark(nil)
+		assert.Equal(t, p.Get().Host(), "c")
+	}
+	assert.Equal(t, p.Connections()["c"], counts["c"]+1)
+
+	// connections to dead hosts all move
+	conns = nil
+	for i := 0; i < 3; i++ {
+		conns = append(conns, p.Get())
+	}
+	p.MarkHostFailure("b", errors.New("down"))
+	for _, r := range p.Rebalance() {
+		assert.Equal(t, r.Host(), "b")
+	}
+	assert.Equal(t, len(p.Rebalance()), p.Connections()["b"])
+}
+
+func TestByteBalancer(t *testing.T) {
+	p := NewByteBalancer([]string{"a", "b", "c"})
+	defer p.Close()
+	upload := p.GetWithFeatures(RequestFeatures{PayloadSize: 1 << 20})
+	small := p.GetWithFeatures(RequestFeatures{PayloadSize: 1 << 10})
+	assert.NotEqual(t, upload.Host(), small.Host())
+
+	// bytes count, not requests
+	AddOutstanding(small, 1<<20-1<<10)
+	third := p.Get()
+	assert.Equal(t, p.OutstandingBytes()[third.Host()], int64(0))
+	next := p.Get()
+	assert.Equal(t, next.Host(), third.Host())
+	next.Mark(nil)
+	AddOutstanding(third, 1<<20)
+
+	// the upload progresses, and its host gets the next request
+	AddOutstanding(upload, -(1<<20 - 10))
+	r := p.Get()
+	assert.Equal(t, r.Host(), upload.Host())
+	r.Mark(nil)
+
+	// marking drops what's left, once
+	upload.Mark(nil)
+	AddOutstanding(upload, 100)
+	upload.Mark(nil)
+	assert.Equal(t, p.OutstandingBytes()[upload.Host()], int64(0))
+	small.Mark(nil)
+	third.Mark(nil)
+	assert.Equal(t, p.OutstandingBytes(), map[string]int64{"a": 0, "b": 0, "c": 0})
+
+	// other pools' responses are left alone
+	AddOutstanding(New([]string{"a"}).Get(), 10)
+}
+
+func TestHostRegistry(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	r := NewHostRegistry()
+	p1 := New([]string{"gw", "a"})
+	p2 := New([]string{"gw", "b"})
+	p3 := New([]string{"gw", "c"})
+	for _, p := range []HostPool{p1, p2, p3} {
+		defer p.Close()
+		r.Join(p)
+	}
+	deaths := 0
+	p3.AddHooks(HostHooks{OnHostDead: func(string) { deaths++ }})
+
+	p1.MarkHostFailure("gw", errors.New("down"))
+	for _, p := range []HostPool{p2, p3} {
+		s, _ := p.HostStatistics("gw")
+		assert.Equal(t, s.Dead, true)
+		assert.False(t, s.NextRetry.After(time.Now()))
+	}
+	assert.Equal(t, deaths, 0)
+
+	// the next request to a suspect is a probe, the rest go elsewhere
+	var probe HostPoolResponse
+	for i := 0; i < 4; i++ {
+		r := p2.Get()
+		if r.Host() == "gw" {
+			assert.Equal(t, probe, nil)
+			probe = r
+			continue
+		}
+		r.Mark(nil)
+	}
+	assert.NotEqual(t, probe, nil)
+	probe.Mark(nil)
+	s, _ := p2.HostStatistics("gw")
+	assert.Equal(t, s.Dead, false)
+
+	// and one that fails keeps it dead
+	for r := p3.Get(); ; r = p3.Get() {
+		if r.Host() == "gw" {
+			r.Mark(errors.New("still down"))
+			break
+		}
+		r.Mark(nil)
+	}
+	s, _ = p3.HostStatistics("gw")
+	assert.Equal(t, s.Dead, true)
+	assert.True(t, s.NextRetry.After(time.Now()))
+}
+
+func TestPacing(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+
+	// the burst goes straight away, and Gets over it are turned away if
+	// they can't be delayed
+	p.SetPacing(Pacing{Rate: 1, Burst: 2})
+	for i := 0; i < 2; i++ {
+		r, err := p.GetContext(context.Background(), RequestFeatures{})
+		assert.Equal(t, err, nil)
+		r.Mark(nil)
+	}
+	_, err := p.GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, ErrPaced)
+	// Get can't fail, so it waits for the rate instead of handing out an
+	// empty host
+	p.SetPacing(Pacing{Rate: 100})
+	p.Get().Mark(nil)
+	start := time.Now()
+	r := p.Get()
+	assert.True(t, r.Host() != "")
+	assert.True(t, time.Since(start) >= 5*time.Millisecond)
+	r.Mark(nil)
+	p.SetPacing(Pacing{Rate: 1, Burst: 2})
+	for i := 0; i < 2; i++ {
+		p.Get().Mark(nil)
+	}
+	_, err = p.GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, ErrPaced)
+
+	// or wait for the rate if they can
+	p.SetPacing(Pacing{Rate: 100, MaxDelay: time.Second})
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		r, err := p.GetContext(context.Background(), RequestFeatures{})
+		assert.Equal(t, err, nil)
+		r.Mark(nil)
+	}
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	stats := p.PacingStatistics()
+	assert.Equal(t, stats.Delayed, int64(3))
+	assert.Equal(t, stats.Rejected, int64(2))
+	assert.True(t, stats.Delay > 0)
+
+	p.SetPacing(Pacing{})
+	for i := 0; i < 10; i++ {
+		_, err = p.GetContext(context.Background(), RequestFeatures{})
+		assert.Equal(t, err, nil)
+	}
+}
+
+func TestWeightSchedule(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	now := time.Now().UTC()
+	sinceMidnight := now.Sub(now.Truncate(24 * time.Hour))
+	backups := WeightProfile{
+		Name:   "backups",
+		Hosts:  func(h Host) bool { return h.Name == "a" },
+		Start:  sinceMidnight - time.Minute,
+		End:    sinceMidnight + time.Minute,
+		Weight: 0.1,
+	}
+	assert.True(t, backups.activeAt(now))
+	assert.False(t, backups.activeAt(now.Add(time.Hour)))
+	overnight := WeightProfile{Start: 23 * time.Hour, End: time.Hour}
+	assert.True(t, overnight.activeAt(now.Truncate(24*time.Hour).Add(30*time.Minute)))
+	assert.False(t, overnight.activeAt(now.Truncate(24*time.Hour).Add(12*time.Hour)))
+
+	p := NewConnectionBalancer([]string{"a", "b"})
+	defer p.Close()
+	events := make(chan Event, 10)
+	p.SetEventSink(EventSinkFunc(func(e Event) {
+		if e.Profile != "" {
+			events <- e
+		}
+	}), 0)
+	p.SetWeightSchedule(backups)
+	assert.Equal(t, p.ActiveWeightProfiles(), []string{"backups"})
+	e := <-events
+	assert.Equal(t, e.Kind, EventProfileStarted)
+	assert.Equal(t, e.Profile, "backups")
+
+	// a is a tenth of b while its backups run
+	for i := 0; i < 11; i++ {
+		p.Get()
+	}
+	assert.Equal(t, p.Connections(), map[string]int{"a": 1, "b": 10})
+
+	p.SetWeightSchedule()
+	assert.Equal(t, len(p.ActiveWeightProfiles()), 0)
+	e = <-events
+	assert.Equal(t, e.Kind, EventProfileEnded)
+}
+
+func TestWeightedRandom(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	picks := func(p HostPool, n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			r := p.Get()
+			counts[r.Host()]++
+			r.Mark(nil)
+		}
+		return counts
+	}
+	p := NewWeightedRandom(nil, 1)
+	defer p.Close()
+	p.SetEndpoints([]Host{{Name: "a"}, {Name: "b", Weight: 3}})
+	counts := picks(p, 4000)
+	assert.InDelta(t, float64(counts["b"])/4000, 0.75, 0.05)
+
+	// the same seed makes the same picks
+	q := NewWeightedRandom(nil, 1)
+	defer q.Close()
+	q.SetEndpoints([]Host{{Name: "a"}, {Name: "b", Weight: 3}})
+	assert.Equal(t, picks(q, 4000), counts)
+
+	p.MarkHostFailure("b", errors.New("down"))
+	assert.Equal(t, picks(p, 10), map[string]int{"a": 10})
+}
+
+func TestRandom(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	p := NewRandom([]string{"a", "b", "c", "d"})
+	defer p.Close()
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		r := p.Get()
+		counts[r.Host()]++
+		r.Mark(nil)
+	}
+	for _, host := range p.Hosts() {
+		assert.InDelta(t, float64(counts[host])/4000, 0.25, 0.05)
+	}
+
+	// dead hosts are passed over, even when random picks keep landing on them
+	for _, host := range []string{"a", "b", "c"} {
+		p.MarkHostFailure(host, errors.New("down"))
+	}
+	for i := 0; i < 20; i++ {
+		r := p.Get()
+		assert.Equal(t, r.Host(), "d")
+		r.Mark(nil)
+	}
+}
+
+func TestStaggerRoundRobin(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	hosts := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	first := func(instance string) string {
+		p := New(hosts)
+		defer p.Close()
+		p.StaggerRoundRobin(instance)
+		return p.Get().Host()
+	}
+	// the same instance always starts in the same place, and a fleet of
+	// them doesn't all start in one
+	assert.Equal(t, first("web-1"), first("web-1"))
+	starts := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		starts[first(fmt.Sprintf("web-%d", i))] = true
+	}
+	assert.True(t, len(starts) > 1)
+	assert.NotEqual(t, first(""), "")
+
+	// and so do they all come back from an outage
+	p := New(hosts)
+	defer p.Close()
+	p.StaggerRoundRobin("web-1")
+	start := p.Get().Host()
+	for _, host := range hosts {
+		p.MarkHostFailure(host, errors.New("down"))
+	}
+	assert.Equal(t, p.Get().Host(), start)
+}
+
+func TestRange(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a", "b", "c"}, 0, &LinearEpsilonValueCalculator{})
+	defer p.Close()
+	p.MarkHostFailure("b", errors.New("down"))
+
+	var hosts []string
+	p.Range(func(host Host, s HostStats) bool {
+		hosts = append(hosts, host.Name)
+		assert.Equal(t, s.Host, host.String())
+		assert.Equal(t, s.Dead, host.Name == "b")
+		// the pool isn't locked while f runs
+		r := p.Get()
+		r.Mark(nil)
+		return host.Name != "b"
+	})
+	assert.Equal(t, hosts, []string{"a", "b"})
+}
+
+func TestHostOrder(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	p := New(nil)
+	defer p.Close()
+	order := func() []string {
+		var hosts []string
+		for _, s := range p.Statistics() {
+			hosts = append(hosts, s.Host)
+		}
+		return hosts
+	}
+	p.SetEndpoints([]Host{{Name: "a"}, {Name: "b", Weight: 2}, {Name: "c"}, {Name: "d", Weight: 3}})
+	p.SetHostOrder(WeightOrder)
+	assert.Equal(t, order(), []string{"d", "b", "a", "c"})
+	assert.Equal(t, p.Get().Host(), "d")
+
+	// hosts added later are put in order too
+	p.AddHost("e")
+	assert.Equal(t, order(), []string{"d", "b", "a", "c", "e"})
+	p.SetHostOrder(ProvidedOrder)
+	assert.Equal(t, order(), []string{"a", "b", "c", "d", "e"})
+
+	// shuffling keeps every host, and shuffles again after an outage
+	hosts := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	p.SetHosts(hosts)
+	p.SetHostOrder(ShuffledOrder)
+	orders := make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		shuffled := order()
+		assert.Equal(t, len(shuffled), len(hosts))
+		orders[fmt.Sprint(shuffled)] = true
+		for _, host := range hosts {
+			p.MarkHostFailure(host, errors.New("down"))
+		}
+		p.Get()
+	}
+	assert.True(t, len(orders) > 1)
+}
+
+func TestRetryStagger(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	hosts := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	p := New(hosts)
+	defer p.Close()
+	p.SetRetryStagger(time.Minute)
+	start := time.Now()
+	retries := make(map[time.Time]bool)
+	for _, host := range hosts {
+		p.MarkHostFailure(host, errors.New("partitioned"))
+		at, _ := p.NextRetryAt(host)
+		assert.True(t, !at.Before(start.Add(30*time.Second)))
+		assert.True(t, at.Before(time.Now().Add(90*time.Second)))
+		retries[at] = true
+	}
+	// hosts that went down together come back one by one
+	assert.True(t, len(retries) > 1)
+
+	p.SetRetryStagger(0)
+	p.ResetAll()
+	p.MarkHostFailure("a", errors.New("down"))
+	at, _ := p.NextRetryAt("a")
+	assert.WithinDuration(t, at, time.Now().Add(30*time.Second), time.Second)
+}
+
+func TestMaxTiming(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetMaxTiming(time.Minute)
+	mark := func(ms int) {
+		p.timer = &mockTimer{t: ms}
+		p.Get().Mark(nil)
+	}
+	mark(100)
+	// a clock set back, and a response marked hours late
+	mark(-5000)
+	mark(3 * 3600 * 1000)
+	s, _ := p.HostStatistics("a")
+	assert.Equal(t, s.TimingAnomalies, int64(2))
+	assert.Equal(t, s.Successes, int64(3))
+	assert.Equal(t, s.SuccessLatency, 100*time.Millisecond)
+
+	// failures and batches are guarded too
+	p.timer = &mockTimer{t: -1}
+	p.Get().Mark(errors.New("Dummy Error"))
+	p.MarkBatch("a", []Outcome{{Duration: 2 * time.Minute}, {Duration: 100 * time.Millisecond}})
+	s, _ = p.HostStatistics("a")
+	assert.Equal(t, s.TimingAnomalies, int64(4))
+	assert.Equal(t, s.SuccessLatency, 100*time.Millisecond)
+}
+
+func TestScoreConfidence(t *testing.T) {
+	p := NewEpsilonGreedy([]string{"a"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	s, _ := p.HostStatistics("a")
+	assert.Equal(t, s.Confidence, 0.0)
+
+	p.timer = &mockTimer{t: 100}
+	for i := 0; i < 50; i++ {
+		p.Get().Mark(nil)
+	}
+	s, _ = p.HostStatistics("a")
+	assert.InDelta(t, s.SampledScore, 100, 0.001)
+	assert.True(t, s.Confidence > 0.8)
+	before := s.Confidence
+
+	// a host that stops getting traffic keeps its score, but less and less
+	// can be made of it
+	for i := 0; i < epsilonBuckets/2; i++ {
+		p.performEpsilonGreedyDecay()
+	}
+	s, _ = p.HostStatistics("a")
+	assert.InDelta(t, s.SampledScore, 100, 0.001)
+	assert.True(t, s.Confidence < before)
+}
+
+func TestNewHostRamp(t *testing.T) {
+	p := New([]string{"a", "b"})
+	defer p.Close()
+	p.SetNewHostRamp(time.Hour)
+	p.AddHost("c")
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		r := p.Get()
+		counts[r.Host()]++
+		r.Mark(nil)
+	}
+	// c starts on a twentieth of its share: it's up for 1000 of the Gets,
+	// taking each with a chance of minRampShare, and round robin passes the
+	// rest on to the other hosts. Within five standard deviations, so this
+	// fails about once in a million runs.
+	assert.InDelta(t, float64(counts["c"])/1000, minRampShare, 5*math.Sqrt(minRampShare*(1-minRampShare)/1000))
+	assert.Equal(t, counts["a"]+counts["b"]+counts["c"], 3000)
+	assert.InDelta(t, counts["a"], counts["b"], 1)
+
+	// and it's all it gets when it's the only host up
+	p.MarkHostFailure("a", errors.New("down"))
+	p.MarkHostFailure("b", errors.New("down"))
+	assert.Equal(t, p.Get().Host(), "c")
+
+	// hosts a pool starts with don't ramp, nor do any once it's turned off
+	p.SetNewHostRamp(0)
+	p.ResetAll()
+	counts = make(map[string]int)
+	for i := 0; i < 300; i++ {
+		r := p.Get()
+		counts[r.Host()]++
+		r.Mark(nil)
+	}
+	assert.Equal(t, counts, map[string]int{"a": 100, "b": 100, "c": 100})
+
+	w := NewWeightedRandom([]string{"a"}, 1)
+	defer w.Close()
+	w.SetNewHostRamp(time.Hour)
+	w.AddHost("b")
+	counts = make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		r := w.Get()
+		counts[r.Host()]++
+		r.Mark(nil)
+	}
+	// the pool's rand is seeded, so this is the same every run
+	share := minRampShare / (1 + minRampShare)
+	assert.InDelta(t, float64(counts["b"])/2000, share, 5*math.Sqrt(share*(1-share)/2000))
+}
+
+func TestPressure(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	p := NewEpsilonGreedy([]string{"a", "b", "c", "d"}, 0, &LinearEpsilonValueCalculator{})
+	defer p.Close()
+	p.SetLimits(Limits{MaxInFlight: 2})
+	p.MarkBatch("a", []Outcome{{Duration: 10 * time.Millisecond}})
+	p.MarkBatch("b", []Outcome{{Duration: 30 * time.Millisecond}})
+	p.MarkHostFailure("d", errors.New("down"))
+	r := p.Get()
+	defer r.Mark(nil)
+
+	pr := PressureOf(p)
+	assert.Equal(t, pr.HealthyFraction, 0.75)
+	assert.Equal(t, pr.InFlight, int64(1))
+	assert.InDelta(t, pr.Utilization, 1.0/6, 0.001)
+	assert.Equal(t, pr.Latency, 20*time.Millisecond)
+	assert.Equal(t, pr.MaxLatency, 30*time.Millisecond)
+	assert.Equal(t, pr.LatencyTrend, 1.0)
+
+	m := &PressureMonitor{pool: p}
+	assert.Equal(t, m.report().LatencyTrend, 1.0)
+	p.MarkBatch("a", []Outcome{{Duration: 200 * time.Millisecond}})
+	assert.True(t, m.report().LatencyTrend > 1)
+
+	reports := make(chan Pressure, 10)
+	m = MonitorPressure(p, time.Millisecond, PressureSinkFunc(func(pr Pressure) {
+		select {
+		case reports <- pr:
+		default:
+		}
+	}))
+	pr = <-reports
+	m.Close()
+	assert.Equal(t, pr.HealthyFraction, 0.75)
+}
+
+func TestApplyHostsDryRun(t *testing.T) {
+	p := New(nil)
+	defer p.Close()
+	p.SetEndpoints([]Host{{Name: "a"}, {Name: "b", Weight: 2}, {Name: "c"}})
+	c := p.ApplyEndpointsDryRun([]Host{{Name: "b", Weight: 3}, {Name: "c"}, {Name: "d"}})
+	assert.Equal(t, c.Added, []string{"d"})
+	assert.Equal(t, c.Removed, []string{"a"})
+	assert.Equal(t, c.Reweighted, []WeightChange{{Host: "b", From: 2, To: 3}})
+	assert.Equal(t, len(c.Shares), 0)
+	// nothing changed
+	assert.Equal(t, len(p.Hosts()), 3)
+
+	k := NewConsistentHash([]string{"a", "b"}, 0)
+	defer k.Close()
+	c = k.ApplyHostsDryRun([]string{"a", "b", "c"})
+	assert.Equal(t, c.Added, []string{"c"})
+	var before, after float64
+	for _, s := range c.Shares {
+		before += s.Before
+		after += s.After
+	}
+	assert.InDelta(t, before, 1, 1e-9)
+	assert.InDelta(t, after, 1, 1e-9)
+	assert.Equal(t, c.Shares["c"].Before, 0.0)
+	assert.InDelta(t, c.Shares["c"].After, 1.0/3, 0.1)
+	assert.True(t, c.Shares["a"].After < c.Shares["a"].Before)
+}
+
+func TestKeysMoved(t *testing.T) {
+	k := NewConsistentHash([]string{"a", "b"}, 0)
+	defer k.Close()
+	assert.Equal(t, k.KeysMoved([]string{"b", "a"}), 0.0)
+	assert.Equal(t, k.KeysMoved(nil), 1.0)
+
+	// adding a host only moves keys to it
+	c := k.ApplyHostsDryRun([]string{"a", "b", "c"})
+	assert.InDelta(t, c.KeysMoved, c.Shares["c"].After, 1e-9)
+	assert.InDelta(t, k.KeysMoved([]string{"a", "b", "c"}), c.KeysMoved, 1e-9)
+
+	// and it matches what happens to keys on a pool with the new hosts
+	after := NewConsistentHash([]string{"a", "b", "c"}, 0)
+	defer after.Close()
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprint(i)
+		if k.HostForKey(key) != after.HostForKey(key) {
+			moved++
+		}
+	}
+	assert.InDelta(t, float64(moved)/10000, c.KeysMoved, 0.02)
+}
+
+func TestConsistentHashFuncs(t *testing.T) {
+	points := map[string]uint32{"a-0": 100, "b-0": 200, "k1": 150, "k2": 250}
+	k := NewConsistentHash([]string{"a", "b"}, 1)
+	defer k.Close()
+	k.SetHash(func(data []byte) uint32 { return points[string(data)] })
+	assert.Equal(t, k.HostForKey("k1"), "b")
+	assert.Equal(t, k.HostForKey("k2"), "a")
+
+	// Get goes by key once there's a key func
+	k.SetKeyFunc(func(ctx context.Context, f RequestFeatures) string { return f.Method })
+	for i := 0; i < 3; i++ {
+		r := k.GetWithFeatures(RequestFeatures{Method: "k1"})
+		assert.Equal(t, r.Host(), "b")
+		r.Mark(nil)
+	}
+	// and round robin without one
+	hosts := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		r := k.Get()
+		hosts[r.Host()] = true
+		r.Mark(nil)
+	}
+	assert.Equal(t, len(hosts), 2)
+
+	assert.Equal(t, FNV1a32([]byte("a")), uint32(0xe40c292c))
+	assert.Equal(t, CRC32([]byte("a")), uint32(0xe8b7be43))
+}
+
+func TestKetama(t *testing.T) {
+	// worked out with libmemcached's ketama
+	keys := []string{"apple", "banana", "cherry", "date", "elderberry", "fig", "grape", "honeydew"}
+	k := NewKetama([]string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11212"})
+	defer k.Close()
+	var hosts []string
+	for _, key := range keys {
+		hosts = append(hosts, k.HostForKey(key))
+	}
+	assert.Equal(t, hosts, []string{"10.0.1.1:11211", "10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11212",
+		"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.1:11211", "10.0.1.3:11212"})
+
+	k.SetEndpoints([]Host{
+		{Name: "10.0.1.1", Port: 11211},
+		{Name: "10.0.1.2", Port: 11211, Weight: 2},
+		{Name: "10.0.1.3", Port: 11212},
+	})
+	assert.Equal(t, k.HostForKey("apple"), "10.0.1.2:11211")
+	c := k.ApplyHostsDryRun([]string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11212"})
+	assert.InDelta(t, c.Shares["10.0.1.2:11211"].Before, 0.5, 0.1)
+	assert.InDelta(t, c.Shares["10.0.1.2:11211"].After, 1.0/3, 0.1)
+}
+
+func TestPriorityPolicy(t *testing.T) {
+	p := New([]string{"a", "b", "c"})
+	defer p.Close()
+	p.SetPriorityPolicy(1, PriorityPolicy{AvoidThrottled: time.Minute})
+	p.MarkHostSuccess("a")
+	for {
+		r := p.Get()
+		if r.Host() == "a" {
+			r.Mark(WithErrorClass(errors.New("429"), Throttled))
+			break
+		}
+		r.Mark(nil)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 6; i++ {
+		r := p.GetWithFeatures(RequestFeatures{Priority: 1})
+		seen[r.Host()] = true
+		r.Mark(nil)
+	}
+	assert.Equal(t, seen, map[string]bool{"b": true, "c": true})
+	// other priorities absorb the throttling
+	seen = map[string]bool{}
+	for i := 0; i < 3; i++ {
+		r := p.Get()
+		seen[r.Host()] = true
+		r.Mark(nil)
+	}
+	assert.Equal(t, seen["a"], true)
+
+	// with nowhere else to go the throttled host is used
+	one := New([]string{"a"})
+	defer one.Close()
+	one.SetPriorityPolicy(1, PriorityPolicy{AvoidThrottled: time.Minute})
+	one.Get().Mark(WithErrorClass(errors.New("429"), Throttled))
+	r := one.GetWithFeatures(RequestFeatures{Priority: 1})
+	assert.Equal(t, r.Host(), "a")
+	r.Mark(nil)
+
+	e := NewEpsilonGreedy([]string{"a", "b", "c", "d"}, 0, &LinearEpsilonValueCalculator{}).(EpsilonGreedyHostPool)
+	defer e.Close()
+	e.SeedScore("a", time.Millisecond, 100)
+	for _, host := range []string{"b", "c", "d"} {
+		e.SeedScore(host, 10*time.Millisecond, 100)
+	}
+	e.SetPriorityPolicy(-1, PriorityPolicy{AvoidFastest: 0.25})
+	for i := 0; i < 50; i++ {
+		r := e.GetWithFeatures(RequestFeatures{Priority: -1})
+		assert.True(t, r.Host() != "a")
+		r.Mark(nil)
+	}
+
+	// hedged by the policy
+	h := New([]string{"x", "y"})
+	defer h.Close()
+	h.SetPriorityPolicy(2, PriorityPolicy{HedgeDelay: time.Millisecond})
+	var calls int32
+	err := DoPriority(context.Background(), h, 2, func(ctx context.Context, host string) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, h.HedgeStatistics().Hedged, int64(1))
+}
+
+func TestLoadShedding(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	p := New([]string{"a", "b", "c", "d"})
+	defer p.Close()
+	p.SetLoadShedding(LoadShedding{BelowPriority: 1, MinHealthyFraction: 0.5})
+	r, err := p.GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, nil)
+	r.Mark(nil)
+
+	p.MarkHostFailure("a", errors.New("down"))
+	p.MarkHostFailure("b", errors.New("down"))
+	p.MarkHostFailure("c", errors.New("down"))
+	p.SetLoadShedding(LoadShedding{BelowPriority: 1, MinHealthyFraction: 0.5})
+	_, err = p.GetContext(context.Background(), RequestFeatures{})
+	shed, ok := err.(*ShedError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, shed.HealthyFraction, 0.25)
+	// high priority Gets go through
+	r, err = p.GetContext(context.Background(), RequestFeatures{Priority: 1})
+	assert.Equal(t, err, nil)
+	r.Mark(nil)
+	s := p.LoadSheddingStatistics()
+	assert.Equal(t, s.Shedding, true)
+	assert.Equal(t, s.Shed, int64(1))
+	// nor are Gets that can't return an error, which would only get an
+	// empty host
+	for i := 0; i < 3; i++ {
+		r = p.Get()
+		assert.Equal(t, r.Host(), "d")
+		r.Mark(nil)
+	}
+	r = NewView(p, nil).Get()
+	assert.Equal(t, r.Host(), "d")
+	r.Mark(nil)
+	assert.Equal(t, p.LoadSheddingStatistics().Shed, int64(1))
+
+	// and only some are shed with a fraction
+	p.SetLoadShedding(LoadShedding{BelowPriority: 1, MinHealthyFraction: 0.5, Fraction: 0.5})
+	for i := 0; i < 200; i++ {
+		if r, err := p.GetContext(context.Background(), RequestFeatures{}); err == nil {
+			r.Mark(nil)
+		}
+	}
+	assert.InDelta(t, float64(p.LoadSheddingStatistics().Shed-1), 100, 40)
+
+	// shedding on latency
+	e := NewEpsilonGreedy([]string{"a", "b"}, 0, &LinearEpsilonValueCalculator{})
+	defer e.Close()
+	e.SetLoadShedding(LoadShedding{BelowPriority: 1, MaxLatency: 100 * time.Millisecond})
+	e.MarkBatch("a", []Outcome{{Duration: 50 * time.Millisecond}})
+	e.MarkBatch("b", []Outcome{{Duration: 100 * time.Millisecond}})
+	r, err = e.GetContext(context.Background(), RequestFeatures{})
+	assert.Equal(t, err, nil)
+	r.Mark(nil)
+	e.MarkBatch("a", []Outcome{{Duration: 500 * time.Millisecond}})
+	e.SetLoadShedding(LoadShedding{BelowPriority: 1, MaxLatency: 100 * time.Millisecond})
+	_, err = e.GetContext(context.Background(), RequestFeatures{})
+	_, ok = err.(*ShedError)
+	assert.Equal(t, ok, true)
+}
+
+func TestDraining(t *testing.T) {
+	pools := []HostPool{
+		New(nil),
+		NewEpsilonGreedy(nil, 0, &LinearEpsilonValueCalculator{}),
+		NewConsistentHash(nil, 0),
+	}
+	for _, p := range pools {
+		defer p.Close()
+		p.SetEndpoints([]Host{{Name: "a"}, {Name: "b", Draining: true}})
+		for i := 0; i < 20; i++ {
+			r := p.Get()
+			assert.Equal(t, r.Host(), "a")
+			r.Mark(nil)
+		}
+	}
+	k := pools[2].(KeyedHostPool)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, k.HostForKey(fmt.Sprint(i)), "a")
+	}
+	// with every host draining they're used anyway
+	k.SetEndpoints([]Host{{Name: "a", Draining: true}})
+	r := k.GetForKey("x")
+	assert.Equal(t, r.Host(), "a")
+	r.Mark(nil)
+}
+
+func TestSetIdentity(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	p := New([]string{"a:80", "a:8080", "b:80"})
+	defer p.Close()
+	p.SetIdentity(func(host string) string { return ParseHost(host).Name })
+
+	p.MarkHostFailure("a:80", errors.New("down"))
+	s, _ := p.HostStatistics("a:8080")
+	assert.Equal(t, s.Dead, true)
+	for i := 0; i < 4; i++ {
+		r := p.Get()
+		assert.Equal(t, r.Host(), "b:80")
+		r.Mark(nil)
+	}
+
+	// only one of a's hosts is retried
+	p.ForceRetryNow("a:80")
+	p.ForceRetryNow("a:8080")
+	var probes []string
+	for i := 0; i < 4; i++ {
+		r := p.Get()
+		if r.Host() != "b:80" {
+			probes = append(probes, r.Host())
+			defer r.Mark(nil)
+			continue
+		}
+		r.Mark(nil)
+	}
+	assert.Equal(t, len(probes), 1)
+	p.MarkHostSuccess(probes[0])
+	s, _ = p.HostStatistics("a:80")
+	assert.Equal(t, s.Dead, false)
+	s, _ = p.HostStatistics("a:8080")
+	assert.Equal(t, s.Dead, false)
+
+	// hosts of other servers are left alone
+	p.MarkHostFailure("b:80", errors.New("down"))
+	s, _ = p.HostStatistics("a:80")
+	assert.Equal(t, s.Dead, false)
+}
+
+func TestAliasTable(t *testing.T) {
+	table := newAliasTable([]float64{0.5, 0.3, 0.2})
+	r := rand.New(rand.NewSource(0))
+	hits := make([]int, 3)
+	for i := 0; i < 100000; i++ {
+		hits[table.pick(r)]++
+	}
+	assert.InDelta(t, float64(hits[0])/100000, 0.5, 0.01)
+	assert.InDelta(t, float64(hits[1])/100000, 0.3, 0.01)
+	assert.InDelta(t, float64(hits[2])/100000, 0.2, 0.01)
+}
+
+func TestPerformanceMode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewEpsilonGreedy([]string{"a", "b", "c"}, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	p.SetEpsilon(0)
+	p.MarkBatch("a", []Outcome{{Duration: 100 * time.Millisecond}})
+	p.MarkBatch("b", []Outcome{{Duration: 300 * time.Millisecond}})
+	p.MarkBatch("c", []Outcome{{Duration: 300 * time.Millisecond}})
+	p.SetPerformanceMode(true)
+
+	hits := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		r := p.Get()
+		hits[r.Host()]++
+		r.Mark(nil)
+	}
+	assert.InDelta(t, float64(hits["a"])/10000, 0.6, 0.03)
+
+	// dead hosts drop out of the snapshot straight away
+	(&epsilonHostPoolResponse{standardHostPoolResponse: standardHostPoolResponse{host: "a", pool: p}}).Mark(errors.New("Dummy Error"))
+	for i := 0; i < 100; i++ {
+		assert.NotEqual(t, p.Get().Host(), "a")
+	}
+
+	// and come back when their retry is due
+	p.Lock()
+	p.hosts["a"].nextRetry = time.Now().Add(-time.Second)
+	p.rebuildSnapshot()
+	p.Unlock()
+	assert.Equal(t, p.Get().Host(), "a")
+	assert.NotEqual(t, p.Get().Host(), "a")
+}
+
+func BenchmarkPerformanceMode(b *testing.B) {
+	hosts := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	p := NewEpsilonGreedy(hosts, 0, &LinearEpsilonValueCalculator{}).(*epsilonGreedyHostPool)
+	defer p.Close()
+	for i, host := range hosts {
+		p.MarkBatch(host, []Outcome{{Duration: time.Duration(i+1) * time.Millisecond}})
+	}
+	p.SetPerformanceMode(true)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.Get().Mark(nil)
+		}
+	})
+}
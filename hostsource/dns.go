@@ -0,0 +1,176 @@
+package hostsource
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// DNSConfig configures a DNS
+type DNSConfig struct {
+	// Port is added to each address to make the hosts, eg. "80" gives
+	// 10.0.0.1:80. Empty leaves the bare addresses.
+	Port string
+	// MinTTL and MaxTTL bound how long answers are used for before the name
+	// is looked up again, whatever their TTL (0 uses defaults of 5 seconds
+	// and 5 minutes). Failed lookups are retried after MinTTL.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Drain is how long an address stays in the pool, draining, after it is
+	// gone from the answers (0 uses a default of a minute), see DNS
+	Drain time.Duration
+	// Resolver looks the name up, nil uses a NameserverResolver with the
+	// system's nameservers
+	Resolver Resolver
+	// OnError is called with failed lookups, which leave the pool as it was.
+	// nil ignores them.
+	OnError func(error)
+}
+
+const (
+	defaultMinTTL = 5 * time.Second
+	defaultMaxTTL = 5 * time.Minute
+	defaultDrain  = time.Minute
+)
+
+// DNS keeps the hosts of a pool set to every A and AAAA record of a name,
+// so that each address behind a DNS name is balanced and tracked on its own.
+// The name is looked up again when its records' TTL runs out.
+//
+// Addresses that drop out of the answers aren't removed straight away, but
+// left in the pool as Draining for the Drain period: they get no new
+// requests, but those already sent to them are still marked against a host
+// the pool knows, and a record missing from one answer (as with round robin
+// DNS that only returns some records) doesn't lose what the pool has learned
+// about it. They are removed by the first lookup after they have been gone
+// for the whole period, and stop draining if they're back before then.
+type DNS struct {
+	pool   hostpool.HostPool
+	name   string
+	config DNSConfig
+
+	sync.Mutex
+	seen map[string]time.Time // when each host was last in an answer
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// WatchDNS sets the hosts of pool from name and keeps them up to date. The
+// first lookup must succeed.
+func WatchDNS(pool hostpool.HostPool, name string, c DNSConfig) (*DNS, error) {
+	if c.MinTTL <= 0 {
+		c.MinTTL = defaultMinTTL
+	}
+	if c.MaxTTL < c.MinTTL {
+		c.MaxTTL = defaultMaxTTL
+		if c.MaxTTL < c.MinTTL {
+			c.MaxTTL = c.MinTTL
+		}
+	}
+	if c.Drain <= 0 {
+		c.Drain = defaultDrain
+	}
+	if c.Resolver == nil {
+		c.Resolver = &NameserverResolver{}
+	}
+	d := &DNS{
+		pool:    pool,
+		name:    name,
+		config:  c,
+		seen:    make(map[string]time.Time),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	ttl, err := d.Refresh(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	go d.watch(ttl)
+	return d, nil
+}
+
+// Refresh looks the name up and updates the pool, returning how long until
+// it should be looked up again
+func (d *DNS) Refresh(ctx context.Context) (time.Duration, error) {
+	records, err := d.config.Resolver.Resolve(ctx, d.name)
+	if err == nil && len(records) == 0 {
+		err = ErrNoHosts
+	}
+	if err != nil {
+		return d.config.MinTTL, err
+	}
+
+	ttl := d.config.MaxTTL
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	for _, r := range records {
+		if r.TTL < ttl {
+			ttl = r.TTL
+		}
+		host := r.IP.String()
+		if d.config.Port != "" {
+			host = net.JoinHostPort(host, d.config.Port)
+		}
+		d.seen[host] = now
+	}
+	if ttl < d.config.MinTTL {
+		ttl = d.config.MinTTL
+	}
+
+	hosts := make([]string, 0, len(d.seen))
+	for host, seen := range d.seen {
+		if now.Sub(seen) >= d.config.Drain {
+			delete(d.seen, host)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	endpoints := make([]hostpool.Host, len(hosts))
+	for i, host := range hosts {
+		endpoints[i] = hostpool.ParseHost(host)
+		endpoints[i].Draining = d.seen[host] != now
+	}
+	d.pool.SetEndpoints(endpoints)
+	return ttl, nil
+}
+
+func (d *DNS) watch(ttl time.Duration) {
+	defer close(d.stopped)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	timer := time.NewTimer(ttl)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-d.done:
+			return
+		}
+		next, err := d.Refresh(ctx)
+		if err != nil && d.config.OnError != nil && ctx.Err() == nil {
+			d.config.OnError(err)
+		}
+		timer.Reset(next)
+	}
+}
+
+// Close stops refreshing the pool
+func (d *DNS) Close() {
+	d.closeOnce.Do(func() { close(d.done) })
+	<-d.stopped
+}
@@ -0,0 +1,240 @@
+package hostsource
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Record is an address a name resolved to, with how long it may be cached
+type Record struct {
+	IP  net.IP
+	TTL time.Duration
+}
+
+// Resolver looks up the A and AAAA records of a name
+type Resolver interface {
+	Resolve(ctx context.Context, name string) ([]Record, error)
+}
+
+// NameserverResolver queries nameservers directly, since the standard
+// library's resolver doesn't give out TTLs. Names are looked up as given,
+// without the search domains of resolv.conf.
+type NameserverResolver struct {
+	// Servers are host:port nameserver addresses, tried in order. nil uses
+	// the nameservers in /etc/resolv.conf.
+	Servers []string
+}
+
+const dnsTimeout = 2 * time.Second
+
+func (r *NameserverResolver) Resolve(ctx context.Context, name string) ([]Record, error) {
+	servers := r.Servers
+	if servers == nil {
+		servers = systemNameservers()
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	var err error
+	for _, server := range servers {
+		var records, v6 []Record
+		if records, err = query(ctx, server, name, dnsTypeA); err != nil {
+			continue
+		}
+		if v6, err = query(ctx, server, name, dnsTypeAAAA); err != nil {
+			continue
+		}
+		return append(records, v6...), nil
+	}
+	return nil, err
+}
+
+func systemNameservers() []string {
+	var servers []string
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// DNS wire format, see RFC 1035 and RFC 3596
+const (
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsClassIN   = 1
+	dnsHeaderLen = 12
+
+	dnsFlagTC        = 1 << 9
+	dnsRcodeNXDomain = 3
+)
+
+var errDNSFormat = errors.New("hostsource: malformed dns response")
+
+// query asks server for the records of qtype for name, over UDP and then TCP
+// if the answer was truncated
+func query(ctx context.Context, server, name string, qtype uint16) ([]Record, error) {
+	msg, err := buildQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	resp, err := exchange(ctx, "udp", server, msg)
+	if err == nil && binary.BigEndian.Uint16(resp[2:])&dnsFlagTC != 0 {
+		resp, err = exchange(ctx, "tcp", server, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(resp, msg[:2], qtype)
+}
+
+func buildQuery(name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen, 512)
+	// unguessable ids make spoofed answers harder
+	if _, err := rand.Read(msg[:2]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(msg[2:], 1<<8) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)    // one question
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("hostsource: bad dns name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return msg, nil
+}
+
+func exchange(ctx context.Context, network, server string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network == "udp" {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// skip stray answers to earlier queries
+			if n >= dnsHeaderLen && buf[0] == msg[0] && buf[1] == msg[1] {
+				return buf[:n], nil
+			}
+		}
+	}
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < dnsHeaderLen {
+		return nil, errDNSFormat
+	}
+	return resp, nil
+}
+
+func parseResponse(msg, id []byte, qtype uint16) ([]Record, error) {
+	if len(msg) < dnsHeaderLen || msg[0] != id[0] || msg[1] != id[1] {
+		return nil, errDNSFormat
+	}
+	switch rcode := binary.BigEndian.Uint16(msg[2:]) & 0xf; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		return nil, errors.New("hostsource: no such host")
+	default:
+		return nil, fmt.Errorf("hostsource: dns error code %d", rcode)
+	}
+	questions := binary.BigEndian.Uint16(msg[4:])
+	answers := binary.BigEndian.Uint16(msg[6:])
+	off := dnsHeaderLen
+	var err error
+	for i := 0; i < int(questions); i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4 // type and class
+	}
+	var records []Record
+	for i := 0; i < int(answers); i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errDNSFormat
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		size := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+size > len(msg) {
+			return nil, errDNSFormat
+		}
+		// CNAMEs on the way are skipped, the addresses they lead to follow
+		if rtype == qtype && class == dnsClassIN && (size == net.IPv4len || size == net.IPv6len) {
+			ip := make(net.IP, size)
+			copy(ip, msg[off:off+size])
+			records = append(records, Record{IP: ip, TTL: time.Duration(ttl) * time.Second})
+		}
+		off += size
+	}
+	return records, nil
+}
+
+// skipName returns the offset just past the name at off
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSFormat
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			// a pointer ends the name
+			return off + 2, nil
+		}
+		off += 1 + n
+	}
+}
@@ -0,0 +1,162 @@
+// Package hostsource keeps the hosts of a hostpool up to date from somewhere
+// else: a file shipped by config management, DNS, or nsqlookupd.
+package hostsource
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// FileConfig configures a File
+type FileConfig struct {
+	// Interval is how often the file is checked for changes, by its size and
+	// modification time (0 uses a default of 5 seconds)
+	Interval time.Duration
+	// NoSignal stops SIGHUP from reloading the file
+	NoSignal bool
+	// OnError is called with errors reloading the file, which leave the pool
+	// as it was. nil ignores them.
+	OnError func(error)
+}
+
+const defaultFileInterval = 5 * time.Second
+
+// File loads the hosts of a pool from a file, and reloads it when it changes
+// or the process gets SIGHUP. The file holds either a JSON array of hosts, or
+// one host per line, with blank lines and lines starting with # skipped.
+// Hosts are applied with SetHosts, so hosts that stay keep their health.
+type File struct {
+	pool   hostpool.HostPool
+	path   string
+	config FileConfig
+
+	sync.Mutex
+	loaded os.FileInfo // what was last loaded
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// WatchFile loads the hosts in path into pool, and keeps watching it. The
+// first load must succeed.
+func WatchFile(pool hostpool.HostPool, path string, c FileConfig) (*File, error) {
+	if c.Interval <= 0 {
+		c.Interval = defaultFileInterval
+	}
+	f := &File{pool: pool, path: path, config: c, done: make(chan struct{}), stopped: make(chan struct{})}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	hup := make(chan os.Signal, 1)
+	if !c.NoSignal {
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+	go f.watch(hup)
+	return f, nil
+}
+
+// Reload loads the file again, changed or not
+func (f *File) Reload() error {
+	f.Lock()
+	defer f.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	hosts, err := ParseHosts(data)
+	if err != nil {
+		return fmt.Errorf("hostsource: %s: %w", f.path, err)
+	}
+	f.loaded = info
+	f.pool.SetHosts(hosts)
+	return nil
+}
+
+// changed reports whether the file looks different from when it was loaded
+func (f *File) changed() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		// report it when reloading
+		return true
+	}
+	f.Lock()
+	defer f.Unlock()
+	return info.Size() != f.loaded.Size() || !info.ModTime().Equal(f.loaded.ModTime())
+}
+
+func (f *File) watch(hup chan os.Signal) {
+	defer close(f.stopped)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(f.config.Interval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		select {
+		case <-ticker.C:
+			if !f.changed() {
+				continue
+			}
+		case <-hup:
+		case <-f.done:
+			return
+		}
+		err := f.Reload()
+		// a broken file is reported once, not on every tick until it's fixed
+		if err != nil && f.config.OnError != nil && (lastErr == nil || err.Error() != lastErr.Error()) {
+			f.config.OnError(err)
+		}
+		lastErr = err
+	}
+}
+
+// Close stops watching the file
+func (f *File) Close() {
+	f.closeOnce.Do(func() { close(f.done) })
+	<-f.stopped
+}
+
+// ErrNoHosts is returned for a host list without any hosts, which is taken
+// as a mistake rather than a reason to empty the pool
+var ErrNoHosts = errors.New("no hosts")
+
+// ParseHosts reads a host list in the format of a File
+func ParseHosts(data []byte) ([]string, error) {
+	var hosts []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &hosts); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				hosts = append(hosts, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, ErrNoHosts
+	}
+	return hosts, nil
+}
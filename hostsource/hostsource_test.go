@@ -0,0 +1,253 @@
+package hostsource
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func sortedHosts(p hostpool.HostPool) []string {
+	hosts := p.Hosts()
+	sort.Strings(hosts)
+	return hosts
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met after 1s")
+		}
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	hosts, err := ParseHosts([]byte("# backends\na:80\n\n  b:80  \n"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hosts, []string{"a:80", "b:80"})
+	hosts, err = ParseHosts([]byte(` ["a:80", "c:80"]`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hosts, []string{"a:80", "c:80"})
+	_, err = ParseHosts([]byte("# nothing yet\n"))
+	assert.Equal(t, err, ErrNoHosts)
+	_, err = ParseHosts([]byte(`["a:80"`))
+	assert.NotEqual(t, err, nil)
+}
+
+// replaceFile writes data elsewhere and moves it in place, so that it's never
+// seen half written
+func replaceFile(t *testing.T, path, data string) {
+	assert.Equal(t, ioutil.WriteFile(path+".new", []byte(data), 0644), nil)
+	assert.Equal(t, os.Rename(path+".new", path), nil)
+}
+
+func TestWatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostsource")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+
+	p := hostpool.New(nil)
+	defer p.Close()
+	_, err = WatchFile(p, path, FileConfig{})
+	assert.NotEqual(t, err, nil)
+
+	assert.Equal(t, ioutil.WriteFile(path, []byte("a\nb\n"), 0644), nil)
+	var mu sync.Mutex
+	var errs []error
+	f, err := WatchFile(p, path, FileConfig{Interval: time.Millisecond, OnError: func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}})
+	assert.Equal(t, err, nil)
+	defer f.Close()
+	assert.Equal(t, sortedHosts(p), []string{"a", "b"})
+
+	replaceFile(t, path, `["b", "c", "d"]`)
+	waitUntil(t, func() bool { return len(p.Hosts()) == 3 })
+	assert.Equal(t, sortedHosts(p), []string{"b", "c", "d"})
+
+	// a broken file is reported once and changes nothing
+	replaceFile(t, path, `["b", "c"`)
+	waitUntil(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) > 0
+	})
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, len(errs), 1)
+	mu.Unlock()
+	assert.Equal(t, sortedHosts(p), []string{"b", "c", "d"})
+}
+
+type testResolver struct {
+	sync.Mutex
+	records []Record
+	err     error
+}
+
+func (r *testResolver) Resolve(ctx context.Context, name string) ([]Record, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.records, r.err
+}
+
+func (r *testResolver) set(records []Record, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.records, r.err = records, err
+}
+
+func TestWatchDNS(t *testing.T) {
+	r := &testResolver{}
+	p := hostpool.New(nil)
+	defer p.Close()
+	r.set(nil, errors.New("Dummy Error"))
+	_, err := WatchDNS(p, "svc.local", DNSConfig{Resolver: r})
+	assert.NotEqual(t, err, nil)
+
+	r.set([]Record{{IP: net.ParseIP("10.0.0.1"), TTL: time.Hour}, {IP: net.ParseIP("fd00::1"), TTL: time.Hour}}, nil)
+	d, err := WatchDNS(p, "svc.local", DNSConfig{Resolver: r, Port: "80", MinTTL: time.Millisecond, MaxTTL: time.Hour, Drain: 50 * time.Millisecond})
+	assert.Equal(t, err, nil)
+	defer d.Close()
+	assert.Equal(t, sortedHosts(p), []string{"10.0.0.1:80", "[fd00::1]:80"})
+
+	// the TTL is honored
+	inFlight := p.Get()
+	r.set([]Record{{IP: net.ParseIP("10.0.0.2"), TTL: time.Millisecond}}, nil)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, len(p.Hosts()), 2)
+	ttl, err := d.Refresh(context.Background())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ttl, time.Millisecond)
+
+	// vanished addresses are drained before they're removed: they get no new
+	// requests, but those in flight are still marked against them
+	assert.Equal(t, sortedHosts(p), []string{"10.0.0.1:80", "10.0.0.2:80", "[fd00::1]:80"})
+	for i := 0; i < 6; i++ {
+		r := p.Get()
+		assert.Equal(t, r.Host(), "10.0.0.2:80")
+		r.Mark(nil)
+	}
+	draining := inFlight.Host()
+	inFlight.Mark(nil)
+	s, ok := p.HostStatistics(draining)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, s.InFlight, int64(0))
+	assert.Equal(t, s.Successes, int64(1))
+	waitUntil(t, func() bool {
+		d.Refresh(context.Background())
+		return len(p.Hosts()) == 1
+	})
+	assert.Equal(t, p.Hosts(), []string{"10.0.0.2:80"})
+}
+
+// serveDNS answers A queries for any name with ip, and AAAA queries with
+// nothing
+func serveDNS(t *testing.T, ip net.IP, ttl uint32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+			resp := append([]byte{}, q...)
+			resp[2] |= 0x80 // a response
+			qtype := binary.BigEndian.Uint16(q[n-4:])
+			if qtype == dnsTypeA {
+				resp[7] = 1
+				resp = append(resp, 0xc0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassIN)
+				resp = append(resp, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl), 0, 4)
+				resp = append(resp, ip.To4()...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNameserverResolver(t *testing.T) {
+	server := serveDNS(t, net.ParseIP("10.1.2.3"), 30)
+	r := &NameserverResolver{Servers: []string{server}}
+	records, err := r.Resolve(context.Background(), "svc.example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(records), 1)
+	assert.Equal(t, records[0].IP.String(), "10.1.2.3")
+	assert.Equal(t, records[0].TTL, 30*time.Second)
+
+	_, err = parseResponse([]byte{1, 2, 0x81, 0x83, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{1, 2}, dnsTypeA)
+	assert.NotEqual(t, err, nil)
+	_, err = parseResponse([]byte{1, 2, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0, 5}, []byte{1, 2}, dnsTypeA)
+	assert.Equal(t, err, errDNSFormat)
+}
+
+func TestWatchNSQLookupd(t *testing.T) {
+	var mu sync.Mutex
+	producers := `{"channels":[],"producers":[{"broadcast_address":"nsqd1","tcp_port":4150,"http_port":4151}]}`
+	modern := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/lookup")
+		assert.Equal(t, r.URL.Query().Get("topic"), "events")
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, producers)
+	}))
+	defer modern.Close()
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status_code":200,"status_txt":"OK","data":{"producers":[`+
+			`{"broadcast_address":"nsqd1","tcp_port":4150},{"broadcast_address":"nsqd2","tcp_port":4150}]}}`)
+	}))
+	defer legacy.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	p := hostpool.New(nil)
+	defer p.Close()
+	_, err := WatchNSQLookupd(p, "events", []string{missing.URL}, NSQLookupdConfig{})
+	assert.Equal(t, err, ErrNoHosts)
+
+	var errs []error
+	l, err := WatchNSQLookupd(p, "events", []string{modern.URL, strings.TrimPrefix(legacy.URL, "http://"), "127.0.0.1:1"},
+		NSQLookupdConfig{Interval: time.Millisecond, OnError: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		}})
+	assert.Equal(t, err, nil)
+	defer l.Close()
+	assert.Equal(t, sortedHosts(p), []string{"nsqd1:4150", "nsqd2:4150"})
+	mu.Lock()
+	assert.NotEqual(t, len(errs), 0)
+	producers = `{"producers":[{"broadcast_address":"nsqd3","tcp_port":4150,"http_port":4151}]}`
+	mu.Unlock()
+	waitUntil(t, func() bool { return len(p.Hosts()) == 3 })
+	assert.Equal(t, sortedHosts(p), []string{"nsqd1:4150", "nsqd2:4150", "nsqd3:4150"})
+
+	// or the HTTP addresses, for publishing
+	h := hostpool.New(nil)
+	defer h.Close()
+	l2, err := WatchNSQLookupd(h, "events", []string{modern.URL}, NSQLookupdConfig{HTTPPort: true})
+	assert.Equal(t, err, nil)
+	defer l2.Close()
+	assert.Equal(t, h.Hosts(), []string{"nsqd3:4151"})
+}
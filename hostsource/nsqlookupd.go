@@ -0,0 +1,200 @@
+package hostsource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// NSQLookupdConfig configures an NSQLookupd
+type NSQLookupdConfig struct {
+	// Interval is how often the lookupds are polled (0 uses a default of a
+	// minute, as nsq's own clients do)
+	Interval time.Duration
+	// HTTPPort makes the hosts the producers' HTTP addresses, for publishing
+	// over HTTP, rather than their TCP ones
+	HTTPPort bool
+	// Client makes the requests, nil uses a client with a 5 second timeout
+	Client *http.Client
+	// OnError is called with failed polls, which leave the pool as it was,
+	// and with the errors of single lookupds when others answered. nil
+	// ignores them.
+	OnError func(error)
+}
+
+const (
+	defaultLookupdInterval = time.Minute
+	lookupdTimeout         = 5 * time.Second
+)
+
+// NSQLookupd keeps the hosts of a pool set to the nsqd producers of a topic,
+// as registered with one or more nsqlookupd (the union of what they all
+// know, as nsq's clients do). Hosts are applied with SetHosts, so nsqd hosts
+// that stay keep their health; mark the connection errors and failed
+// publishes against them as with any pool, and the pool routes around the
+// broken ones until they recover.
+type NSQLookupd struct {
+	pool     hostpool.HostPool
+	topic    string
+	lookupds []string
+	config   NSQLookupdConfig
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// WatchNSQLookupd sets the hosts of pool from the producers of topic, as
+// found in lookupds (host:port of their HTTP address, or a URL), and keeps
+// them up to date. The first poll must succeed.
+func WatchNSQLookupd(pool hostpool.HostPool, topic string, lookupds []string, c NSQLookupdConfig) (*NSQLookupd, error) {
+	if c.Interval <= 0 {
+		c.Interval = defaultLookupdInterval
+	}
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: lookupdTimeout}
+	}
+	l := &NSQLookupd{
+		pool:     pool,
+		topic:    topic,
+		lookupds: lookupds,
+		config:   c,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if err := l.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	go l.watch()
+	return l, nil
+}
+
+// Refresh polls the lookupds and updates the pool. It fails if none of them
+// answer, or none know of any producers.
+func (l *NSQLookupd) Refresh(ctx context.Context) error {
+	seen := make(map[string]bool)
+	var hosts []string
+	var err error
+	answered := false
+	for _, lookupd := range l.lookupds {
+		producers, lookupErr := l.lookup(ctx, lookupd)
+		if lookupErr != nil {
+			err = lookupErr
+			continue
+		}
+		answered = true
+		for _, p := range producers {
+			port := p.TCPPort
+			if l.config.HTTPPort {
+				port = p.HTTPPort
+			}
+			host := net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(port))
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	if !answered {
+		if err == nil {
+			err = ErrNoHosts
+		}
+		return err
+	}
+	if err != nil && l.config.OnError != nil {
+		l.config.OnError(err)
+	}
+	if len(hosts) == 0 {
+		return ErrNoHosts
+	}
+	sort.Strings(hosts)
+	l.pool.SetHosts(hosts)
+	return nil
+}
+
+type nsqProducer struct {
+	BroadcastAddress string `json:"broadcast_address"`
+	TCPPort          int    `json:"tcp_port"`
+	HTTPPort         int    `json:"http_port"`
+}
+
+type lookupResponse struct {
+	Producers []nsqProducer `json:"producers"`
+	// nsqlookupd before 1.0 wraps the response in an envelope
+	Data *lookupResponse `json:"data"`
+}
+
+func (l *NSQLookupd) lookup(ctx context.Context, lookupd string) ([]nsqProducer, error) {
+	u, err := url.Parse(lookupd)
+	if err != nil || u.Host == "" {
+		u = &url.URL{Scheme: "http", Host: lookupd}
+	}
+	u.Path = "/lookup"
+	u.RawQuery = url.Values{"topic": {l.topic}}.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// nsqlookupd before 1.0 only leaves out the envelope when asked to
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	resp, err := l.config.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// the topic isn't registered anywhere yet
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hostsource: %s returned %s", u, resp.Status)
+	}
+	var r lookupResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("hostsource: decoding %s: %w", u, err)
+	}
+	if r.Data != nil {
+		return r.Data.Producers, nil
+	}
+	return r.Producers, nil
+}
+
+func (l *NSQLookupd) watch() {
+	defer close(l.stopped)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ticker := time.NewTicker(l.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return
+		}
+		if err := l.Refresh(ctx); err != nil && l.config.OnError != nil && ctx.Err() == nil {
+			l.config.OnError(err)
+		}
+	}
+}
+
+// Close stops refreshing the pool
+func (l *NSQLookupd) Close() {
+	l.closeOnce.Do(func() { close(l.done) })
+	<-l.stopped
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package hostsource
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchFileSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostsource")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	assert.Equal(t, ioutil.WriteFile(path, []byte("a\n"), 0644), nil)
+
+	p := hostpool.New(nil)
+	defer p.Close()
+	f, err := WatchFile(p, path, FileConfig{Interval: time.Hour})
+	assert.Equal(t, err, nil)
+	defer f.Close()
+
+	assert.Equal(t, ioutil.WriteFile(path, []byte("a\nb\n"), 0644), nil)
+	assert.Equal(t, syscall.Kill(os.Getpid(), syscall.SIGHUP), nil)
+	waitUntil(t, func() bool { return len(p.Hosts()) == 2 })
+}
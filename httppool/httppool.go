@@ -0,0 +1,95 @@
+// Package httppool provides an http.RoundTripper that sends each request to a
+// host picked from a hostpool, and marks the host with how it answered.
+package httppool
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// Transport sends requests to hosts from Pool. The host of each request's URL
+// is replaced with the picked host (a host or host:port), as is the scheme if
+// the host has one (see hostpool.Host), and everything else about the request
+// is left alone.
+type Transport struct {
+	Pool hostpool.HostPool
+	// KeepHost sends requests with the Host header they were built with,
+	// rather than the picked host, eg. for hosts behind a virtual host
+	KeepHost bool
+	// Base sends the requests, nil uses http.DefaultTransport
+	Base http.RoundTripper
+	// Classify decides what a response means for the host that sent it, nil
+	// uses ClassifyStatus. Transport errors are classified by the pool.
+	Classify func(*http.Response) hostpool.ErrorClass
+}
+
+// StatusError is what Transport marks a host with for a response classified
+// as anything but a success. It is not returned to the caller, who gets the
+// response as usual.
+type StatusError struct {
+	StatusCode int
+	Class      hostpool.ErrorClass
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("httppool: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *StatusError) ErrorClass() hostpool.ErrorClass {
+	return e.Class
+}
+
+// ClassifyStatus is the default classification: 5xx responses are host
+// errors, 429 Too Many Requests is throttling, and everything else shows a
+// working host
+func ClassifyStatus(resp *http.Response) hostpool.ErrorClass {
+	switch {
+	case resp.StatusCode >= 500:
+		return hostpool.HostError
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return hostpool.Throttled
+	}
+	return hostpool.RequestError
+}
+
+// RoundTrip picks a host, sends req to it and marks it once the response
+// headers are in. With no hosts in the pool it returns hostpool.ErrNoHosts,
+// or waits for one if the pool's EmptyPoolPolicy says to.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, err := t.Pool.GetContext(req.Context(), hostpool.RequestFeatures{Method: req.Method})
+	if err != nil {
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	u := r.Endpoint().URL()
+	if u.Scheme != "" {
+		out.URL.Scheme = u.Scheme
+	}
+	out.URL.Host = u.Host
+	if !t.KeepHost {
+		out.Host = ""
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(out)
+	if err != nil {
+		r.Mark(err)
+		return nil, err
+	}
+
+	classify := t.Classify
+	if classify == nil {
+		classify = ClassifyStatus
+	}
+	if c := classify(resp); c == hostpool.RequestError {
+		r.Mark(nil)
+	} else {
+		r.Mark(&StatusError{StatusCode: resp.StatusCode, Class: c})
+	}
+	return resp, nil
+}
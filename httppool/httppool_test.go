@@ -0,0 +1,56 @@
+package httppool
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bitly/go-hostpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	p := hostpool.New([]string{u.Host})
+	defer p.Close()
+	client := &http.Client{Transport: &Transport{Pool: p}}
+	dead := func() bool { return p.Statistics()[0].Dead }
+
+	for _, c := range []struct {
+		status int
+		dead   bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotFound, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusBadGateway, true},
+		{http.StatusOK, false},
+	} {
+		status = c.status
+		resp, err := client.Get("http://service/path")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, resp.StatusCode, c.status)
+		resp.Body.Close()
+		assert.Equal(t, dead(), c.dead, "after a %d", c.status)
+		assert.Equal(t, p.Statistics()[0].InFlight, int64(0))
+	}
+
+	// classification can be overridden
+	client.Transport.(*Transport).Classify = func(resp *http.Response) hostpool.ErrorClass {
+		if resp.StatusCode == http.StatusNotFound {
+			return hostpool.HostError
+		}
+		return ClassifyStatus(resp)
+	}
+	status = http.StatusNotFound
+	resp, _ := client.Get("http://service/path")
+	resp.Body.Close()
+	assert.Equal(t, dead(), true)
+}
@@ -0,0 +1,52 @@
+package hostpool
+
+// Host identity
+//
+// The same server can be in a pool more than once: on several ports, under
+// DNS aliases, or by name and by IP. An identity function maps each host to
+// the server it's on, and hosts on the same server share their health: when
+// one goes in the dead pool they all do, only one of them is retried at a
+// time, and when it comes back they all do. Each host is still picked and
+// handed out as itself, and keeps its own response times and scores.
+
+// SetIdentity makes the hosts that identity maps to the same value share
+// their health. nil goes back to every host being its own.
+func (p *standardHostPool) SetIdentity(identity func(host string) string) {
+	p.Lock()
+	defer p.Unlock()
+	p.identity = identity
+	p.groupIdentities()
+}
+
+// groupIdentities should only be called when the lock has already been
+// acquired
+func (p *standardHostPool) groupIdentities() {
+	p.byIdentity = nil
+	if p.identity == nil {
+		return
+	}
+	p.byIdentity = make(map[string][]*hostEntry, len(p.hostList))
+	for _, h := range p.hostList {
+		id := p.identity(h.host)
+		p.byIdentity[id] = append(p.byIdentity[id], h)
+	}
+}
+
+// siblings returns the other hosts on the same server as h, and should only
+// be called when the lock (or read lock) has already been acquired
+func (p *standardHostPool) siblings(h *hostEntry) []*hostEntry {
+	if p.byIdentity == nil {
+		return nil
+	}
+	all := p.byIdentity[p.identity(h.host)]
+	if len(all) < 2 {
+		return nil
+	}
+	others := make([]*hostEntry, 0, len(all)-1)
+	for _, s := range all {
+		if s != h {
+			others = append(others, s)
+		}
+	}
+	return others
+}
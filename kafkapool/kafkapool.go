@@ -0,0 +1,227 @@
+// Package kafkapool keeps a hostpool in step with the brokers of a Kafka
+// cluster, from the metadata a client fetches, and turns the errors of
+// produce and fetch requests into marks, so custom Kafka clients can use
+// hostpool's health tracking. It doesn't depend on any client library: feed
+// Update from the client's metadata responses, and Mark with the errors it
+// returns.
+package kafkapool
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// ErrUnknownBroker is returned for a broker id that isn't in the metadata
+var ErrUnknownBroker = errors.New("kafkapool: broker not in cluster metadata")
+
+// Broker is a broker as listed in metadata
+type Broker struct {
+	ID   int32
+	Addr string // host:port
+	Rack string
+}
+
+// Metadata is the part of a metadata response the pool keeps track of
+type Metadata struct {
+	Brokers      []Broker
+	ControllerID int32
+}
+
+// Pool hands out brokers from a hostpool with a host per broker
+type Pool struct {
+	pool    hostpool.HostPool
+	onStale func()
+
+	sync.RWMutex
+	brokers    map[int32]Broker
+	controller int32
+}
+
+// Pick is a broker handed out by the pool. Mark it with the result of the
+// request sent to it.
+type Pick struct {
+	Broker Broker
+	resp   hostpool.HostPoolResponse
+	pool   *Pool
+}
+
+// New builds a Pool with no brokers, until the first Update. onStale, if set,
+// is called when a broker says the client's metadata is out of date (it isn't
+// the leader or controller any more), to fetch it again. newPool builds the
+// underlying hostpool, nil uses hostpool.New.
+func New(onStale func(), newPool func(hosts []string) hostpool.HostPool) *Pool {
+	if newPool == nil {
+		newPool = hostpool.New
+	}
+	return &Pool{
+		pool:       newPool(nil),
+		onStale:    onStale,
+		brokers:    make(map[int32]Broker),
+		controller: -1,
+	}
+}
+
+// HostPool returns the pool brokers are picked from. Hosts are the brokers'
+// addresses, with their id and rack in the "broker_id" and "rack" Meta of
+// their Endpoint.
+func (p *Pool) HostPool() hostpool.HostPool {
+	return p.pool
+}
+
+// Update replaces the brokers with those in md, adding and removing hosts to
+// match. Brokers that stay keep their health.
+func (p *Pool) Update(md Metadata) {
+	brokers := make(map[int32]Broker, len(md.Brokers))
+	endpoints := make([]hostpool.Host, 0, len(md.Brokers))
+	for _, b := range md.Brokers {
+		brokers[b.ID] = b
+		h := hostpool.ParseHost(b.Addr)
+		h.Meta = map[string]string{"broker_id": strconv.Itoa(int(b.ID)), "rack": b.Rack}
+		endpoints = append(endpoints, h)
+	}
+	p.Lock()
+	p.brokers = brokers
+	p.controller = md.ControllerID
+	p.Unlock()
+	p.pool.SetEndpoints(endpoints)
+}
+
+// Get picks any broker, eg. to fetch metadata from
+func (p *Pool) Get(ctx context.Context) (*Pick, error) {
+	return p.get(ctx, hostpool.RequestFeatures{})
+}
+
+// GetBroker returns the broker with id, eg. the leader of the partition a
+// request is for. It is handed out even if it's dead, since no other broker
+// can take the request, but the Mark is still counted.
+func (p *Pool) GetBroker(ctx context.Context, id int32) (*Pick, error) {
+	p.RLock()
+	b, ok := p.brokers[id]
+	p.RUnlock()
+	if !ok {
+		return nil, ErrUnknownBroker
+	}
+	addr := hostpool.ParseHost(b.Addr).String()
+	return p.get(ctx, hostpool.RequestFeatures{Filter: func(h hostpool.Host) bool {
+		return h.String() == addr
+	}})
+}
+
+// Controller returns the controller broker, for admin requests
+func (p *Pool) Controller(ctx context.Context) (*Pick, error) {
+	p.RLock()
+	id := p.controller
+	p.RUnlock()
+	return p.GetBroker(ctx, id)
+}
+
+func (p *Pool) get(ctx context.Context, f hostpool.RequestFeatures) (*Pick, error) {
+	resp, err := p.pool.GetContext(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	p.RLock()
+	defer p.RUnlock()
+	pick := &Pick{resp: resp, pool: p}
+	for _, b := range p.brokers {
+		if hostpool.ParseHost(b.Addr).String() == resp.Host() {
+			pick.Broker = b
+			break
+		}
+	}
+	return pick, nil
+}
+
+// Close closes the hostpool
+func (p *Pool) Close() {
+	p.pool.Close()
+}
+
+// Mark reports the result of a request, classified with Classify. Errors
+// about the request itself count as successes, and a broker that is busy is
+// marked Throttled; stale metadata calls the pool's onStale.
+func (p *Pick) Mark(err error) {
+	switch Classify(err) {
+	case Stale:
+		if p.pool.onStale != nil {
+			p.pool.onStale()
+		}
+		err = nil
+	case Busy:
+		err = hostpool.WithErrorClass(err, hostpool.Throttled)
+	case RequestError:
+		err = nil
+	}
+	p.resp.Mark(err)
+}
+
+// Class is what an error from a Kafka request says about the broker
+type Class int
+
+const (
+	// Success is a nil error, or error code 0
+	Success Class = iota
+	// Stale is an error saying the client's metadata is out of date, like
+	// NOT_LEADER_OR_FOLLOWER: the broker is fine, but the request belongs
+	// elsewhere
+	Stale
+	// Busy is a broker that is up but can't serve the request yet, like
+	// COORDINATOR_LOAD_IN_PROGRESS, or is throttling the client
+	Busy
+	// RequestError is any other error code, which is about the request (an
+	// unknown topic, an offset out of range, a message too large...)
+	RequestError
+	// Failure is a broker that is down or failing: network errors, timeouts,
+	// and error codes like BROKER_NOT_AVAILABLE and KAFKA_STORAGE_ERROR
+	Failure
+)
+
+// codeClasses are the error codes of the Kafka protocol that aren't
+// RequestErrors
+var codeClasses = map[int]Class{
+	0:  Success,
+	3:  Stale,   // UNKNOWN_TOPIC_OR_PARTITION, often a new partition
+	5:  Stale,   // LEADER_NOT_AVAILABLE
+	6:  Stale,   // NOT_LEADER_OR_FOLLOWER
+	7:  Failure, // REQUEST_TIMED_OUT
+	8:  Failure, // BROKER_NOT_AVAILABLE
+	13: Failure, // NETWORK_EXCEPTION
+	14: Busy,    // COORDINATOR_LOAD_IN_PROGRESS
+	15: Stale,   // COORDINATOR_NOT_AVAILABLE
+	16: Stale,   // NOT_COORDINATOR
+	41: Stale,   // NOT_CONTROLLER
+	56: Failure, // KAFKA_STORAGE_ERROR
+	74: Stale,   // FENCED_LEADER_EPOCH
+	75: Stale,   // UNKNOWN_LEADER_EPOCH
+	89: Busy,    // THROTTLING_QUOTA_EXCEEDED
+}
+
+// ClassifyCode works out what a Kafka error code says about the broker
+func ClassifyCode(code int) Class {
+	if c, ok := codeClasses[code]; ok {
+		return c
+	}
+	return RequestError
+}
+
+// Classify works out what err says about the broker that returned it. Client
+// libraries return error codes as errors of an integer type (sarama's KError,
+// kafka-go's Error), which are classified with ClassifyCode, looking through
+// any wrapping; any other error is a Failure.
+func Classify(err error) Class {
+	if err == nil {
+		return Success
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		switch v := reflect.ValueOf(e); v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return ClassifyCode(int(v.Int()))
+		}
+	}
+	return Failure
+}
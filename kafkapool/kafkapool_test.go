@@ -0,0 +1,80 @@
+package kafkapool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bitly/go-hostpool"
+	"github.com/stretchr/testify/assert"
+)
+
+// kError is an error code the way client libraries return them
+type kError int16
+
+func (e kError) Error() string {
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+func TestPool(t *testing.T) {
+	stale := 0
+	p := New(func() { stale++ }, nil)
+	defer p.Close()
+	_, err := p.Get(context.Background())
+	assert.Equal(t, err, hostpool.ErrNoHosts)
+
+	p.Update(Metadata{
+		Brokers: []Broker{
+			{ID: 1, Addr: "k1:9092", Rack: "a"},
+			{ID: 2, Addr: "k2:9092", Rack: "b"},
+		},
+		ControllerID: 2,
+	})
+	assert.ElementsMatch(t, p.HostPool().Hosts(), []string{"k1:9092", "k2:9092"})
+	e, _ := p.HostPool().Endpoint("k1:9092")
+	assert.Equal(t, e.Meta, map[string]string{"broker_id": "1", "rack": "a"})
+
+	c, err := p.Controller(context.Background())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, c.Broker, Broker{ID: 2, Addr: "k2:9092", Rack: "b"})
+	c.Mark(kError(41))
+	assert.Equal(t, stale, 1)
+
+	// request errors and throttling don't count against the broker, failures do
+	b, _ := p.GetBroker(context.Background(), 1)
+	b.Mark(fmt.Errorf("producing: %w", kError(10)))
+	b, _ = p.GetBroker(context.Background(), 1)
+	b.Mark(kError(89))
+	s, _ := p.HostPool().HostStatistics("k1:9092")
+	assert.Equal(t, s.Dead, false)
+	assert.Equal(t, s.Ignored, int64(1))
+	b, _ = p.GetBroker(context.Background(), 1)
+	b.Mark(errors.New("dial tcp k1:9092: connection refused"))
+	s, _ = p.HostPool().HostStatistics("k1:9092")
+	assert.Equal(t, s.Dead, true)
+	for i := 0; i < 4; i++ {
+		pick, _ := p.Get(context.Background())
+		assert.Equal(t, pick.Broker.ID, int32(2))
+		pick.Mark(nil)
+	}
+
+	_, err = p.GetBroker(context.Background(), 3)
+	assert.Equal(t, err, ErrUnknownBroker)
+
+	// brokers that leave are removed, those that stay keep their health
+	p.Update(Metadata{Brokers: []Broker{{ID: 1, Addr: "k1:9092"}}, ControllerID: 1})
+	assert.Equal(t, p.HostPool().Hosts(), []string{"k1:9092"})
+	s, _ = p.HostPool().HostStatistics("k1:9092")
+	assert.Equal(t, s.Dead, true)
+}
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, Classify(nil), Success)
+	assert.Equal(t, Classify(kError(0)), Success)
+	assert.Equal(t, Classify(kError(6)), Stale)
+	assert.Equal(t, Classify(kError(14)), Busy)
+	assert.Equal(t, Classify(kError(1)), RequestError)
+	assert.Equal(t, Classify(kError(56)), Failure)
+	assert.Equal(t, Classify(errors.New("i/o timeout")), Failure)
+}
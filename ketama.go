@@ -0,0 +1,69 @@
+package hostpool
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Ketama
+//
+// Memcached clients in other languages mostly share keys out with ketama, as
+// libmemcached does it (MEMCACHED_BEHAVIOR_KETAMA_WEIGHTED). A ketama pool
+// places hosts and keys exactly as they do, so a Go client can share a cluster
+// with them without keys moving between hosts:
+//
+// - each host gets 160 points at the mean weight, in proportion to its
+// Weight otherwise, rounded down to a multiple of 4
+// - the points come 4 at a time from the MD5 of "host-i", the host as given
+// without the default port, :11211
+// - keys go to the first point at or after the MD5 of the key
+//
+// Hosts have to be given the way the other clients are, eg. as IP addresses
+// if that's how they're configured.
+
+const (
+	ketamaPointsPerHost = 160
+	ketamaPointsPerHash = 4
+	memcachedPort       = ":11211"
+)
+
+// NewKetama builds a KeyedHostPool with a ketama ring, compatible with
+// libmemcached's. SetHash only changes how keys are hashed; the hosts' points
+// always come from MD5.
+func NewKetama(hosts []string) KeyedHostPool {
+	p := &consistentHashPool{
+		standardHostPool: New(hosts).(*standardHostPool),
+		replicas:         ketamaPointsPerHost,
+		hash:             MD5,
+		ketama:           true,
+	}
+	p.buildRing()
+	p.onHostsChange = p.buildRing
+	return p
+}
+
+// MD5 is the first 32 bits of the MD5 of data, little endian, as libmemcached
+// hashes keys for ketama
+func MD5(data []byte) uint32 {
+	digest := md5.Sum(data)
+	return binary.LittleEndian.Uint32(digest[:])
+}
+
+// ketamaPoints are host's points on a ketama ring, for a host with share
+// times the mean weight
+func ketamaPoints(host string, share float64) []uint32 {
+	host = strings.TrimSuffix(host, memcachedPort)
+	// the tiny nudge is libmemcached's, against rounding down a whole number
+	hashes := int(math.Floor(share*ketamaPointsPerHost/ketamaPointsPerHash + 0.0000000001))
+	points := make([]uint32, 0, hashes*ketamaPointsPerHash)
+	for i := 0; i < hashes; i++ {
+		digest := md5.Sum([]byte(host + "-" + strconv.Itoa(i)))
+		for j := 0; j < ketamaPointsPerHash; j++ {
+			points = append(points, binary.LittleEndian.Uint32(digest[j*4:]))
+		}
+	}
+	return points
+}
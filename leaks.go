@@ -0,0 +1,68 @@
+package hostpool
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Leak detection
+//
+// A response that is dropped without being marked stays in flight against
+// its host for good, which goes unnoticed until Limits or least loaded picks
+// start passing the host over. With leak detection on, the pool sets a
+// finalizer on each response it hands out: one the garbage collector finds
+// unmarked is marked with ErrDropped, which says nothing about the host,
+// counted in HostStats.Dropped and logged. Finalizers only run once a
+// response is collected, so this is a safety net, not a timeout, and costs a
+// little on every Get.
+
+// ErrDropped is what a response is marked with when leak detection finds it
+// was dropped without being marked. It is Canceled, and wraps
+// context.Canceled for classifiers that don't look for a class.
+var ErrDropped = WithErrorClass(fmt.Errorf("hostpool: response dropped without being marked: %w", context.Canceled), Canceled)
+
+func (p *standardHostPool) SetLeakDetection(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&p.leakDetection, v)
+}
+
+// watchLeaks sets the finalizer on a response Get is handing out, if leak
+// detection is on
+func (p *standardHostPool) watchLeaks(r HostPoolResponse) {
+	if atomic.LoadInt32(&p.leakDetection) == 0 {
+		return
+	}
+	switch r := r.(type) {
+	case *standardHostPoolResponse:
+		runtime.SetFinalizer(r, func(r *standardHostPoolResponse) {
+			r.Do(func() {
+				r.err = ErrDropped
+				p.dropped(r)
+			})
+		})
+	case *epsilonHostPoolResponse:
+		runtime.SetFinalizer(r, func(r *epsilonHostPoolResponse) {
+			r.Do(func() {
+				r.ended = time.Now()
+				r.err = ErrDropped
+				p.dropped(r)
+			})
+		})
+	}
+}
+
+func (p *standardHostPool) dropped(r HostPoolResponse) {
+	p.RLock()
+	if h, ok := p.hosts[r.Host()]; ok {
+		atomic.AddInt64(&h.dropped, 1)
+	}
+	p.RUnlock()
+	p.logf("hostpool: response for %s was dropped without being marked", r.Host())
+	doMark(ErrDropped, r)
+}
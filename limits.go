@@ -0,0 +1,379 @@
+package hostpool
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrency limits
+//
+// A host that is sent more requests than it can work through at once only
+// gets slower, so a pool can cap the requests in flight to each host: Get
+// passes over hosts at the cap, and when every host that could take a
+// request is at it the pool is saturated, and Get either waits for a request
+// to finish or fails with ErrSaturated. Saturation is the signal to shed load
+// further up, and is reported through SaturationStatistics and the
+// OnSaturation hook. Consistent hash pools don't apply the limits, since
+// moving keys to other hosts would defeat their purpose; nor do picks made by
+// performance mode's lock free path, which is switched off while a limit is
+// set.
+//
+// Rather than a fixed cap, which has to be guessed and goes stale as hosts
+// change, each host's limit can be learned from its requests by a
+// LimitAlgorithm, the way Netflix's concurrency-limits library does: AIMDLimit
+// backs off when requests fail or time out, and GradientLimit shrinks the
+// limit as response times climb above their long term average, which is
+// where queueing starts.
+
+// ErrSaturated is returned by GetContext when every host is at its
+// concurrency limit and the pool's Limits say not to wait
+var ErrSaturated = errors.New("every host in HostPool is at its concurrency limit")
+
+// Limits configures the concurrency limits of a pool, see SetLimits
+type Limits struct {
+	// MaxInFlight is how many requests each host may have in flight, 0 for
+	// no limit
+	MaxInFlight int
+	// AdaptiveLimit, if set, builds the LimitAlgorithm that learns each
+	// host's limit, which is used instead of MaxInFlight
+	AdaptiveLimit func() LimitAlgorithm
+	// Wait makes GetContext wait for a request to finish when the pool is
+	// saturated, until its context is done, rather than return ErrSaturated
+	// straight away. Get waits for as long as it takes.
+	Wait bool
+	// SaturatedAfter is how long a Get may wait before the pool counts as
+	// saturated; 0 counts any wait. Failing to get a host always counts. The
+	// pool stops being saturated with the first Get that doesn't wait that
+	// long.
+	SaturatedAfter time.Duration
+}
+
+// SaturationStats is the saturation state of a pool, see Limits
+type SaturationStats struct {
+	Saturated bool
+	// Waiting is the number of Gets waiting for a host right now
+	Waiting int64
+	// Waited and Rejected count the Gets that waited past SaturatedAfter,
+	// and those that failed, since the pool was built
+	Waited   int64
+	Rejected int64
+}
+
+type saturationState struct {
+	saturated bool
+	waited    int64
+	rejected  int64
+}
+
+func (p *standardHostPool) SetLimits(l Limits) {
+	p.Lock()
+	defer p.Unlock()
+	p.limits = l
+	limited := int32(0)
+	if p.limited() {
+		limited = 1
+	}
+	atomic.StoreInt32(&p.limitsSet, limited)
+	for _, h := range p.hostList {
+		h.limiter = nil
+		if l.AdaptiveLimit != nil {
+			h.limiter = l.AdaptiveLimit()
+		}
+	}
+	// a higher limit may let waiting Gets go on
+	p.wakeCapacityWaiters()
+}
+
+func (p *standardHostPool) SaturationStatistics() SaturationStats {
+	p.RLock()
+	defer p.RUnlock()
+	return SaturationStats{
+		Saturated: p.saturation.saturated,
+		Waiting:   atomic.LoadInt64(&p.capacityWaiting),
+		Waited:    p.saturation.waited,
+		Rejected:  p.saturation.rejected,
+	}
+}
+
+// limited reports whether any limit is set, and should only be called when
+// the lock has already been acquired
+func (p *standardHostPool) limited() bool {
+	return p.limits.MaxInFlight > 0 || p.limits.AdaptiveLimit != nil
+}
+
+// atLimit reports whether h can't take another request, and should only be
+// called when the lock has already been acquired
+func (p *standardHostPool) atLimit(h *hostEntry) bool {
+	if h.limiter != nil {
+		return atomic.LoadInt64(&h.inFlight) >= int64(h.limiter.Limit())
+	}
+	return p.limits.MaxInFlight > 0 && atomic.LoadInt64(&h.inFlight) >= int64(p.limits.MaxInFlight)
+}
+
+// saturated reports whether every host that could be picked is at its limit.
+// With every host dead and none at its limit the pool isn't saturated, and Get
+// brings the hosts back as usual. It should only be called when the lock has
+// already been acquired
+func (p *standardHostPool) saturated(now time.Time) bool {
+	anyAtLimit := false
+	for _, h := range p.hostList {
+		if !p.atLimit(h) {
+			if h.canTryHost(now) {
+				return false
+			}
+		} else {
+			anyAtLimit = true
+		}
+	}
+	return anyAtLimit
+}
+
+// waitForCapacity follows the pool's Limits until a host can take a request,
+// and is called by Get after waitForHosts. It should only be called when the
+// lock has already been acquired, and may unlock while it waits
+func (p *standardHostPool) waitForCapacity(ctx context.Context) error {
+	if !p.limited() {
+		return nil
+	}
+	var start time.Time
+	for p.saturated(p.now()) {
+		if !p.limits.Wait {
+			p.saturation.rejected++
+			p.setSaturated(true)
+			return ErrSaturated
+		}
+		if start.IsZero() {
+			start = time.Now()
+		}
+		p.capacityLock.Lock()
+		if p.capacityFreed == nil {
+			p.capacityFreed = make(chan struct{})
+		}
+		freed := p.capacityFreed
+		p.capacityLock.Unlock()
+		atomic.AddInt64(&p.capacityWaiting, 1)
+		p.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+		}
+		p.Lock()
+		atomic.AddInt64(&p.capacityWaiting, -1)
+		if ctx.Err() != nil {
+			p.saturation.rejected++
+			p.setSaturated(true)
+			return ctx.Err()
+		}
+		if err := p.waitForHosts(ctx); err != nil {
+			return err
+		}
+	}
+	waited := !start.IsZero() && time.Since(start) > p.limits.SaturatedAfter
+	if waited {
+		p.saturation.waited++
+	}
+	p.setSaturated(waited)
+	return nil
+}
+
+// setSaturated should only be called when the lock has already been acquired
+func (p *standardHostPool) setSaturated(saturated bool) {
+	if p.saturation.saturated == saturated {
+		return
+	}
+	p.saturation.saturated = saturated
+	if len(p.hooks) > 0 {
+		p.events = append(p.events, hostEvent{kind: hostSaturation, saturated: saturated})
+	}
+}
+
+// wakeCapacityWaiters lets Gets waiting for a host under its limit check
+// again. It may be called with the lock or the read lock.
+func (p *standardHostPool) wakeCapacityWaiters() {
+	if atomic.LoadInt64(&p.capacityWaiting) == 0 {
+		return
+	}
+	p.capacityLock.Lock()
+	if p.capacityFreed != nil {
+		close(p.capacityFreed)
+		p.capacityFreed = nil
+	}
+	p.capacityLock.Unlock()
+}
+
+// observeLimit hands a finished request to its host's LimitAlgorithm, with
+// the number of requests that were in flight along with it. Requests canceled
+// by the caller say nothing about the host's limit, a host throttling
+// requests is over it. It may be called with the lock or the read lock.
+func (p *standardHostPool) observeLimit(h *hostEntry, hostR HostPoolResponse, inFlight int64) {
+	var err error
+	if r, ok := hostR.(interface{ markedErr() error }); ok {
+		err = r.markedErr()
+	}
+	c := p.errorClass(err)
+	if c == Canceled {
+		return
+	}
+	var rtt time.Duration
+	if r, ok := hostR.(interface{ elapsed() (time.Duration, bool) }); ok {
+		rtt, _ = r.elapsed()
+	}
+	h.limiter.Observe(rtt, int(inFlight), c.hostFailed() || c == Throttled)
+}
+
+// LimitAlgorithm learns the concurrency limit of a single host, see Limits.
+// It is called from many goroutines at once.
+type LimitAlgorithm interface {
+	// Limit is how many requests the host may have in flight
+	Limit() int
+	// Observe is told about each request to the host as it's marked: its
+	// response time (0 if the pool doesn't time requests, as plain pools
+	// don't), how many requests were in flight when it finished, itself
+	// included, and whether it failed or was throttled
+	Observe(rtt time.Duration, inFlight int, failed bool)
+}
+
+// AIMD configures an AIMDLimit. Zero values use the defaults.
+type AIMD struct {
+	// Initial, Min and Max bound the limit, by default 20, 1 and 200
+	Initial int
+	Min     int
+	Max     int
+	// Backoff is what the limit is multiplied by when a request fails, by
+	// default 0.9
+	Backoff float64
+	// Timeout, if set, counts requests that take longer as failed
+	Timeout time.Duration
+}
+
+type aimdLimit struct {
+	AIMD
+	mu    sync.Mutex
+	limit float64
+}
+
+// AIMDLimit raises the limit by one for each request that succeeds while
+// the host is using at least half of it, and cuts it by Backoff for each one
+// that fails
+func AIMDLimit(c AIMD) LimitAlgorithm {
+	c.Min, c.Max, c.Initial = limitBounds(c.Min, c.Max, c.Initial)
+	if !(c.Backoff > 0 && c.Backoff < 1) {
+		c.Backoff = 0.9
+	}
+	return &aimdLimit{AIMD: c, limit: float64(c.Initial)}
+}
+
+func (l *aimdLimit) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+func (l *aimdLimit) Observe(rtt time.Duration, inFlight int, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if failed || (l.Timeout > 0 && rtt > l.Timeout) {
+		l.limit *= l.Backoff
+	} else if float64(2*inFlight) >= l.limit {
+		// only grow a limit that's being used, or a quiet spell would let it
+		// climb without bound
+		l.limit++
+	}
+	l.limit = clampLimit(l.limit, l.Min, l.Max)
+}
+
+// Gradient configures a GradientLimit. Zero values use the defaults.
+type Gradient struct {
+	// Initial, Min and Max bound the limit, by default 20, 1 and 200
+	Initial int
+	Min     int
+	Max     int
+	// Tolerance is how many times slower than their long term average
+	// requests may get before the limit shrinks, by default 1.5
+	Tolerance float64
+	// Smoothing is how much of the limit each request moves, by default 0.2
+	Smoothing float64
+	// LongWindow is roughly how many requests the long term average response
+	// time is taken over, by default 600
+	LongWindow int
+}
+
+type gradientLimit struct {
+	Gradient
+	mu      sync.Mutex
+	limit   float64
+	longRTT float64 // moving average, in nanoseconds
+}
+
+// GradientLimit moves the limit by the ratio of the host's long term average
+// response time to the latest one: as requests start to queue on the host
+// they slow down, and the limit comes down with them. Failures are left to
+// the pool's health tracking, and requests without a response time are
+// skipped.
+func GradientLimit(c Gradient) LimitAlgorithm {
+	c.Min, c.Max, c.Initial = limitBounds(c.Min, c.Max, c.Initial)
+	if c.Tolerance < 1 {
+		c.Tolerance = 1.5
+	}
+	if !(c.Smoothing > 0 && c.Smoothing <= 1) {
+		c.Smoothing = 0.2
+	}
+	if c.LongWindow <= 0 {
+		c.LongWindow = 600
+	}
+	return &gradientLimit{Gradient: c, limit: float64(c.Initial)}
+}
+
+func (l *gradientLimit) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+func (l *gradientLimit) Observe(rtt time.Duration, inFlight int, failed bool) {
+	if rtt <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sample := float64(rtt)
+	if l.longRTT == 0 {
+		l.longRTT = sample
+	} else {
+		weight := 2 / float64(l.LongWindow+1)
+		l.longRTT = (1-weight)*l.longRTT + weight*sample
+	}
+	if float64(2*inFlight) < l.limit {
+		// a limit that isn't being used has nothing to learn from
+		return
+	}
+	gradient := math.Max(0.5, math.Min(1, l.Tolerance*l.longRTT/sample))
+	// room for a few requests to queue, so the limit can grow
+	queue := math.Sqrt(l.limit)
+	next := l.limit*gradient + queue
+	l.limit = clampLimit((1-l.Smoothing)*l.limit+l.Smoothing*next, l.Min, l.Max)
+}
+
+func limitBounds(min, max, initial int) (int, int, int) {
+	if min <= 0 {
+		min = 1
+	}
+	if max <= 0 {
+		max = 200
+	}
+	if max < min {
+		max = min
+	}
+	if initial <= 0 {
+		initial = 20
+	}
+	return min, max, int(clampLimit(float64(initial), min, max))
+}
+
+func clampLimit(limit float64, min, max int) float64 {
+	return math.Max(float64(min), math.Min(float64(max), limit))
+}
@@ -0,0 +1,136 @@
+package hostpool
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Logger is what a pool writes its log messages to, see SetLogger. A
+// *log.Logger is one. Printf may be called with the pool locked, so it must
+// not call back into the pool.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// loggerBox lets any Logger go in an atomic.Value, which needs every value
+// stored to be of the same type
+type loggerBox struct {
+	Logger
+}
+
+func (p *standardHostPool) SetLogger(l Logger) {
+	p.logger.Store(loggerBox{l})
+}
+
+// logf writes to the pool's Logger, or the standard logger if none is set
+func (p *standardHostPool) logf(format string, v ...interface{}) {
+	if b, ok := p.logger.Load().(loggerBox); ok && b.Logger != nil {
+		b.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Decision logging
+//
+// Working out from statistics alone why a pool sends a host the traffic it
+// does can be hard, so an epsilon greedy pool can log some of its picks: which
+// host it picked and how (to meet a minimum exploration, exploring, from the
+// selection cache, by score or round robin with nothing scored), the share of
+// traffic each live host gets by score, and why the rest were passed over.
+// Only a sampled fraction of Gets is logged, to keep the cost down for busy
+// pools; picks made by performance mode's lock free path aren't logged.
+
+// pickReason is how getEpsilonGreedy picked a host
+type pickReason int
+
+const (
+	pickedMinExploration pickReason = iota
+	pickedExploring
+	pickedCached
+	pickedWeighted
+	pickedRoundRobin
+)
+
+func (r pickReason) String() string {
+	switch r {
+	case pickedMinExploration:
+		return "minimum exploration"
+	case pickedExploring:
+		return "exploring"
+	case pickedCached:
+		return "cached shares"
+	case pickedWeighted:
+		return "by score"
+	}
+	return "round robin, nothing scored"
+}
+
+// SetDecisionLogging logs a fraction of host picks, chosen at random, to the
+// pool's Logger. 0 turns it off and 1 logs every pick.
+func (p *epsilonGreedyHostPool) SetDecisionLogging(rate float64) {
+	if !(rate > 0) {
+		rate = 0
+	}
+	atomic.StoreUint64(&p.decisionRate, math.Float64bits(rate))
+}
+
+// logDecision logs a pick if it's sampled, and should only be called when the
+// lock has already been acquired
+func (p *epsilonGreedyHostPool) logDecision(host string, how pickReason, f RequestFeatures, t Trace, now time.Time) {
+	rate := math.Float64frombits(atomic.LoadUint64(&p.decisionRate))
+	if rate == 0 || rand.Float64() >= rate {
+		return
+	}
+	// hosts are described in order, once the shares are known
+	skipped := make([]string, len(p.hostList))
+	values := make([]float64, len(p.hostList))
+	var sum float64
+	for i, h := range p.hostList {
+		switch {
+		case h.dead && h.host == host:
+			// picked for a retry, which pushed its next one back
+			skipped[i] = "retried while dead"
+			continue
+		case !h.canTryHost(now):
+			skipped[i] = "dead until " + h.nextRetry.Format(time.RFC3339)
+			continue
+		}
+		var v float64
+		if f.Class != "" {
+			v = h.getWeightedAverageClassResponseTime(f.Class)
+		} else {
+			v = h.getWeightedAverageResponseTime()
+		}
+		if v <= 0 {
+			skipped[i] = "no response times"
+			continue
+		}
+		values[i] = p.calcValue(h, v, f)
+		sum += values[i]
+	}
+	hosts := make([]string, len(p.hostList))
+	for i, h := range p.hostList {
+		switch {
+		case skipped[i] != "":
+			hosts[i] = h.host + " " + skipped[i]
+		case p.cooldownWeight(h) < 1:
+			hosts[i] = fmt.Sprintf("%s share %.1f%% (value %.3g, cooling down until %s)", h.host, 100*values[i]/sum, values[i], h.cooldownUntil.Format(time.RFC3339))
+		default:
+			hosts[i] = fmt.Sprintf("%s share %.1f%% (value %.3g)", h.host, 100*values[i]/sum, values[i])
+		}
+	}
+	request := ""
+	if f.Class != "" {
+		request = fmt.Sprintf(" for class %q", f.Class)
+	}
+	if t != (Trace{}) {
+		request += " in trace " + t.String()
+	}
+	p.logf("hostpool: picked %s (%s)%s: %s", host, how, request, strings.Join(hosts, ", "))
+}
@@ -0,0 +1,245 @@
+// Package mailpool keeps long lived connections to mail relays and backends
+// (SMTP, IMAP) and hands them out from a hostpool. Connections are reused
+// while their host is healthy, and closed when it fails or leaves the pool.
+// Replies are classified by their SMTP reply code or IMAP status, so a
+// rejected message or a greylisted recipient doesn't count against the host,
+// while a 421 or an IMAP BYE does.
+package mailpool
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// Conn is a connection to a mail host, eg. an *smtp.Client
+type Conn interface {
+	Close() error
+}
+
+// Config configures a Pool
+type Config struct {
+	// Dial connects to a host (host:port), including any greeting, TLS and
+	// authentication, so that a host that can't be logged in to is marked
+	// when it's picked
+	Dial func(ctx context.Context, addr string) (Conn, error)
+	// MaxIdle is how many connections are kept per host for reuse (0 uses a
+	// default of 2)
+	MaxIdle int
+	// NewPool builds the underlying hostpool, nil uses hostpool.New
+	NewPool func(hosts []string) hostpool.HostPool
+}
+
+const defaultMaxIdle = 2
+
+// Pool hands out connections to the hosts of a hostpool
+type Pool struct {
+	pool   hostpool.HostPool
+	config Config
+
+	sync.Mutex
+	idle map[string][]Conn
+}
+
+// Session is a connection handed out by Get. Mark it with the result of what
+// was sent over it, which also gives the connection back for reuse.
+type Session struct {
+	Addr string
+	Conn Conn
+	resp hostpool.HostPoolResponse
+	pool *Pool
+}
+
+// New builds a Pool over addrs
+func New(addrs []string, c Config) *Pool {
+	if c.MaxIdle <= 0 {
+		c.MaxIdle = defaultMaxIdle
+	}
+	if c.NewPool == nil {
+		c.NewPool = hostpool.New
+	}
+	p := &Pool{pool: c.NewPool(addrs), config: c, idle: make(map[string][]Conn)}
+	p.pool.AddHooks(hostpool.HostHooks{OnHostDead: p.closeIdle, OnHostRemoved: p.closeIdle})
+	return p
+}
+
+// HostPool returns the pool hosts are picked from
+func (p *Pool) HostPool() hostpool.HostPool {
+	return p.pool
+}
+
+// Get returns a session on an idle connection to the host picked, or a new
+// one. Hosts that can't be dialed are marked as failed and another is tried;
+// the last dial error is returned if none can be, and hostpool.ErrNoHosts if
+// there are no hosts.
+func (p *Pool) Get(ctx context.Context) (*Session, error) {
+	var err error
+	for i := 0; i == 0 || i < len(p.pool.Hosts()); i++ {
+		resp, getErr := p.pool.GetContext(ctx, hostpool.RequestFeatures{})
+		if getErr != nil {
+			return nil, getErr
+		}
+		addr := resp.Host()
+		conn := p.takeIdle(addr)
+		if conn == nil {
+			if conn, err = p.config.Dial(ctx, addr); err != nil {
+				resp.Mark(err)
+				continue
+			}
+		}
+		return &Session{Addr: addr, Conn: conn, resp: resp, pool: p}, nil
+	}
+	return nil, err
+}
+
+func (p *Pool) takeIdle(addr string) Conn {
+	p.Lock()
+	defer p.Unlock()
+	idle := p.idle[addr]
+	if len(idle) == 0 {
+		return nil
+	}
+	conn := idle[len(idle)-1]
+	p.idle[addr] = idle[:len(idle)-1]
+	return conn
+}
+
+// putIdle keeps conn for reuse, or closes it if the host has enough
+func (p *Pool) putIdle(addr string, conn Conn) {
+	p.Lock()
+	if len(p.idle[addr]) < p.config.MaxIdle {
+		p.idle[addr] = append(p.idle[addr], conn)
+		conn = nil
+	}
+	p.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (p *Pool) closeIdle(addr string) {
+	p.Lock()
+	idle := p.idle[addr]
+	delete(p.idle, addr)
+	p.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+// Close closes the hostpool and every idle connection
+func (p *Pool) Close() {
+	p.pool.Close()
+	p.Lock()
+	defer p.Unlock()
+	for addr, idle := range p.idle {
+		for _, conn := range idle {
+			conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
+
+// Mark reports the result of what was sent over the session, classified with
+// Classify, and gives its connection back. Rejected and deferred messages
+// leave the host healthy, though deferrals by a busy host are marked
+// Throttled. Unavailable replies and failures close the connection, and
+// mark the host failed.
+func (s *Session) Mark(err error) {
+	switch Classify(err) {
+	case Success:
+		s.pool.putIdle(s.Addr, s.Conn)
+	case Rejected:
+		s.pool.putIdle(s.Addr, s.Conn)
+		err = nil
+	case Busy:
+		s.pool.putIdle(s.Addr, s.Conn)
+		err = hostpool.WithErrorClass(err, hostpool.Throttled)
+	default:
+		s.Conn.Close()
+	}
+	s.resp.Mark(err)
+}
+
+// Discard ends the session without reusing its connection, eg. after a
+// command left it in an unknown state, and marks the host with err as Mark
+// does
+func (s *Session) Discard(err error) {
+	s.Conn.Close()
+	switch Classify(err) {
+	case Rejected, Success:
+		err = nil
+	case Busy:
+		err = hostpool.WithErrorClass(err, hostpool.Throttled)
+	}
+	s.resp.Mark(err)
+}
+
+// Class is what an error from a mail host says about it
+type Class int
+
+const (
+	// Success is a nil error
+	Success Class = iota
+	// Rejected is a reply about the message or mailbox rather than the
+	// host: SMTP 5xx and 4xx replies like greylisting, IMAP NO and BAD
+	Rejected
+	// Busy is a host that is up but can't take the message now: SMTP 451
+	// (local error) and 452 (insufficient storage)
+	Busy
+	// Unavailable is a host closing the connection: SMTP 421, IMAP BYE
+	Unavailable
+	// Failure is everything else: network errors, timeouts, closed
+	// connections
+	Failure
+)
+
+// Classify works out what err says about the host that returned it. SMTP
+// reply codes are taken from a *textproto.Error, as net/smtp returns, or
+// from the start of the error text; IMAP statuses from its first word, after
+// any tag.
+func Classify(err error) Class {
+	if err == nil {
+		return Success
+	}
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return classifyCode(te.Code)
+	}
+	fields := strings.Fields(err.Error())
+	if len(fields) == 0 {
+		return Failure
+	}
+	if code, convErr := strconv.Atoi(strings.SplitN(fields[0], "-", 2)[0]); convErr == nil && code >= 200 && code < 600 {
+		return classifyCode(code)
+	}
+	if len(fields) > 2 {
+		fields = fields[:2]
+	}
+	for _, f := range fields {
+		switch strings.ToUpper(f) {
+		case "NO", "BAD":
+			return Rejected
+		case "BYE":
+			return Unavailable
+		}
+	}
+	return Failure
+}
+
+func classifyCode(code int) Class {
+	switch {
+	case code < 400:
+		return Success
+	case code == 421:
+		return Unavailable
+	case code == 451 || code == 452:
+		return Busy
+	}
+	return Rejected
+}
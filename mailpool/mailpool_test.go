@@ -0,0 +1,69 @@
+package mailpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeConn struct {
+	addr   string
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPool(t *testing.T) {
+	dials := map[string]int{}
+	p := New([]string{"mx1:25", "mx2:25"}, Config{Dial: func(ctx context.Context, addr string) (Conn, error) {
+		dials[addr]++
+		if addr == "mx2:25" {
+			return nil, errors.New("535 5.7.8 Authentication credentials invalid")
+		}
+		return &fakeConn{addr: addr}, nil
+	}})
+	defer p.Close()
+
+	// connections are reused, and rejected messages don't hurt the host
+	var first Conn
+	for i := 0; i < 4; i++ {
+		s, err := p.Get(context.Background())
+		assert.Equal(t, err, nil)
+		assert.Equal(t, s.Addr, "mx1:25")
+		if first == nil {
+			first = s.Conn
+		}
+		assert.True(t, s.Conn == first)
+		s.Mark(&textproto.Error{Code: 550, Msg: "5.1.1 User unknown"})
+	}
+	assert.Equal(t, dials, map[string]int{"mx1:25": 1, "mx2:25": 1})
+
+	// a 421 closes the connection and takes the host down, along with its
+	// idle connections
+	s1, _ := p.Get(context.Background())
+	s2, _ := p.Get(context.Background())
+	assert.True(t, s1.Conn != s2.Conn)
+	s2.Mark(nil)
+	s1.Mark(fmt.Errorf("sending: %w", &textproto.Error{Code: 421, Msg: "4.7.0 Try again later"}))
+	assert.Equal(t, s1.Conn.(*fakeConn).closed, true)
+	assert.Equal(t, s2.Conn.(*fakeConn).closed, true)
+	st, _ := p.HostPool().HostStatistics("mx1:25")
+	assert.Equal(t, st.Dead, true)
+}
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, Classify(nil), Success)
+	assert.Equal(t, Classify(&textproto.Error{Code: 450, Msg: "greylisted"}), Rejected)
+	assert.Equal(t, Classify(&textproto.Error{Code: 452, Msg: "insufficient storage"}), Busy)
+	assert.Equal(t, Classify(errors.New("421-4.7.0 Too many connections")), Unavailable)
+	assert.Equal(t, Classify(errors.New("a001 NO [AUTHENTICATIONFAILED] Invalid credentials")), Rejected)
+	assert.Equal(t, Classify(errors.New("* BYE server shutting down")), Unavailable)
+	assert.Equal(t, Classify(errors.New("dial tcp 10.0.0.1:25: i/o timeout")), Failure)
+}
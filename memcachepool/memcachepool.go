@@ -0,0 +1,132 @@
+// Package memcachepool spreads memcached keys over a set of servers with a
+// consistent hash hostpool. Selector has the PickServer and Each methods of
+// gomemcache's ServerSelector, so it can be plugged into memcache.NewFromSelector
+// without this package depending on gomemcache.
+package memcachepool
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// ErrNoServers is returned when the selector has no servers to pick from
+var ErrNoServers = errors.New("memcachepool: no servers configured or available")
+
+// Selector picks the server owning each key
+type Selector struct {
+	pool  hostpool.KeyedHostPool
+	addrs map[string]net.Addr
+	names map[string]string // server name by address
+}
+
+// Pick is a server handed out by PickForKey. Mark it with the result of the
+// request sent to it.
+type Pick struct {
+	Addr net.Addr
+	resp hostpool.HostPoolResponse
+}
+
+// New resolves servers (host:port, or a path for a unix socket) and builds a
+// Selector over them, with replicas ring points per server (0 for the
+// default).
+func New(servers []string, replicas int) (*Selector, error) {
+	addrs := make(map[string]net.Addr, len(servers))
+	names := make(map[string]string, len(servers))
+	for _, s := range servers {
+		var addr net.Addr
+		var err error
+		if strings.Contains(s, "/") {
+			addr, err = net.ResolveUnixAddr("unix", s)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", s)
+		}
+		if err != nil {
+			return nil, err
+		}
+		addrs[s] = addr
+		names[addr.String()] = s
+	}
+	return &Selector{pool: hostpool.NewConsistentHash(servers, replicas), addrs: addrs, names: names}, nil
+}
+
+// HostPool returns the pool servers are picked from
+func (s *Selector) HostPool() hostpool.KeyedHostPool {
+	return s.pool
+}
+
+// PickForKey returns the server for key, counting the request as in flight
+// until it's marked
+func (s *Selector) PickForKey(key string) (*Pick, error) {
+	if len(s.addrs) == 0 {
+		return nil, ErrNoServers
+	}
+	resp := s.pool.GetForKey(key)
+	return &Pick{Addr: s.addrs[resp.Host()], resp: resp}, nil
+}
+
+// Mark reports the result of a request. Errors that come back from a server
+// that is up (cache misses, failed stores and compare-and-swap conflicts)
+// count as successes.
+func (p *Pick) Mark(err error) {
+	if !IsServerError(err) {
+		err = nil
+	}
+	p.resp.Mark(err)
+}
+
+// PickServer returns the server for key, skipping dead servers. Unlike
+// PickForKey there's nothing to mark, so report failures with MarkServer.
+func (s *Selector) PickServer(key string) (net.Addr, error) {
+	if len(s.addrs) == 0 {
+		return nil, ErrNoServers
+	}
+	return s.addrs[s.pool.HostForKey(key)], nil
+}
+
+// MarkServer reports the result of a request made to a server returned by
+// PickServer
+func (s *Selector) MarkServer(addr net.Addr, err error) {
+	name, ok := s.names[addr.String()]
+	if !ok {
+		return
+	}
+	if !IsServerError(err) {
+		err = nil
+	}
+	s.pool.MarkBatch(name, []hostpool.Outcome{{Err: err}})
+}
+
+// Each calls f for every server, stopping at the first error
+func (s *Selector) Each(f func(net.Addr) error) error {
+	for _, name := range s.pool.Hosts() {
+		if err := f(s.addrs[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying hostpool
+func (s *Selector) Close() {
+	s.pool.Close()
+}
+
+// replyErrors are the error texts gomemcache uses for replies from a server
+// that is up
+var replyErrors = map[string]bool{
+	"memcache: cache miss":                true,
+	"memcache: item not stored":           true,
+	"memcache: compare-and-swap conflict": true,
+}
+
+// IsServerError reports whether err should count against the server that
+// returned it
+func IsServerError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return !replyErrors[err.Error()]
+}
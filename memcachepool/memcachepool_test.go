@@ -0,0 +1,44 @@
+package memcachepool
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelector(t *testing.T) {
+	s, err := New([]string{"127.0.0.1:11211", "127.0.0.1:11212"}, 0)
+	assert.Equal(t, err, nil)
+	defer s.Close()
+
+	var down net.Addr
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		p, err := s.PickForKey(key)
+		assert.Equal(t, err, nil)
+		addr, _ := s.PickServer(key)
+		assert.Equal(t, addr.String(), p.Addr.String())
+		p.Mark(errors.New("memcache: cache miss"))
+		down = addr
+	}
+
+	s.MarkServer(down, errors.New("connection refused"))
+	for i := 0; i < 100; i++ {
+		addr, _ := s.PickServer(fmt.Sprintf("key%d", i))
+		assert.NotEqual(t, addr.String(), down.String())
+	}
+
+	var n int
+	s.Each(func(net.Addr) error {
+		n++
+		return nil
+	})
+	assert.Equal(t, n, 2)
+
+	empty, _ := New(nil, 0)
+	_, err = empty.PickServer("key")
+	assert.Equal(t, err, ErrNoServers)
+}
@@ -0,0 +1,46 @@
+package hostpool
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// HostOrder is the order a pool keeps its hosts in, see SetHostOrder. Until
+// a pool has learned anything about its hosts the order decides where its
+// first requests go, eg. round robin starts at the first host.
+type HostOrder int
+
+const (
+	// ProvidedOrder keeps the hosts in the order they were given
+	ProvidedOrder HostOrder = iota
+	// ShuffledOrder puts the hosts in a random order, so that clients given
+	// the same list don't all start on the same host
+	ShuffledOrder
+	// WeightOrder puts the hosts with the highest Weight first, and those
+	// with the same weight in the order they were given
+	WeightOrder
+)
+
+// SetHostOrder puts the pool's hosts in order, and keeps them in it as hosts
+// are set, and puts them in it again (shuffling them again, say) when every
+// host has gone down and they're all brought back
+func (p *standardHostPool) SetHostOrder(o HostOrder) {
+	p.Lock()
+	defer p.Unlock()
+	p.hostOrder = o
+	p.orderHosts(p.hostList)
+	p.healthChanged()
+}
+
+// orderHosts should only be called when the lock has already been acquired
+func (p *standardHostPool) orderHosts(list []*hostEntry) {
+	sort.SliceStable(list, func(i, j int) bool { return list[i].given < list[j].given })
+	switch p.hostOrder {
+	case ShuffledOrder:
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		r.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+	case WeightOrder:
+		sort.SliceStable(list, func(i, j int) bool { return list[i].endpoint.weight() > list[j].endpoint.weight() })
+	}
+}
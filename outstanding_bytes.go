@@ -0,0 +1,158 @@
+package hostpool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// ByteBalancer is a HostPool for streaming and upload heavy traffic, where
+// requests differ too much in size for their count to say how loaded a host
+// is. Each response carries the bytes still to be sent or received on it,
+// starting from its RequestFeatures.PayloadSize and kept up to date with
+// AddOutstanding, and each Get picks the live host with the fewest bytes
+// outstanding for its Weight (then the fewest requests in flight). Whatever is
+// left outstanding is dropped when the response is marked.
+type ByteBalancer interface {
+	HostPool
+	// OutstandingBytes returns the bytes outstanding to each host
+	OutstandingBytes() map[string]int64
+}
+
+type bytesPool struct {
+	*standardHostPool
+}
+
+type bytesResponse struct {
+	standardHostPoolResponse
+	bytesLock   sync.Mutex
+	outstanding int64
+	settled     bool // once marked
+}
+
+// NewByteBalancer builds a ByteBalancer over hosts
+func NewByteBalancer(hosts []string) ByteBalancer {
+	return &bytesPool{New(hosts).(*standardHostPool)}
+}
+
+// AddOutstanding changes the bytes outstanding on a response from a
+// ByteBalancer: up as more is queued to be sent on a stream, down as it's
+// sent. It does nothing for responses from other pools.
+func AddOutstanding(r HostPoolResponse, delta int64) {
+	br, ok := r.(*bytesResponse)
+	if !ok {
+		return
+	}
+	p := br.pool.(*bytesPool)
+	p.RLock()
+	defer p.RUnlock()
+	br.bytesLock.Lock()
+	defer br.bytesLock.Unlock()
+	if h, ok := p.hosts[br.host]; ok && !br.settled {
+		br.outstanding += delta
+		atomic.AddInt64(&h.outstanding, delta)
+	}
+}
+
+func (p *bytesPool) Get() HostPoolResponse {
+	return p.GetWithFeatures(RequestFeatures{})
+}
+
+func (p *bytesPool) GetWithFeatures(f RequestFeatures) HostPoolResponse {
+	r, err := p.GetContext(forGet, f)
+	return orNoHost(p, r, err)
+}
+
+func (p *bytesPool) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	return p.getRefreshed(ctx, f, func() (HostPoolResponse, error) { return p.getContext(ctx, f) })
+}
+
+func (p *bytesPool) getContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	if err := p.waitForHosts(ctx); err != nil {
+		return nil, err
+	}
+	if err := p.waitForCapacity(ctx); err != nil {
+		return nil, err
+	}
+	if f.Filter != nil {
+		if !p.useFilter(f.Filter) {
+			return nil, ErrNoHosts
+		}
+		defer func() { p.filter = nil }()
+	}
+	if p.usePriority(f) {
+		defer func() { p.avoid = nil }()
+	}
+	host := p.getLeastLoaded(func(h *hostEntry) float64 {
+		// whole requests in flight break ties between hosts with the same
+		// bytes outstanding
+		return float64(atomic.LoadInt64(&h.outstanding)) + float64(atomic.LoadInt64(&h.inFlight))/1e6
+	})
+	h := p.hosts[host]
+	atomic.AddInt64(&h.inFlight, 1)
+	atomic.AddInt64(&h.outstanding, f.PayloadSize)
+	t := requestTrace(ctx, f)
+	p.emit(Event{Kind: EventSelected, Host: host, Trace: t})
+	return &bytesResponse{
+		standardHostPoolResponse: standardHostPoolResponse{host: host, pool: p, inFlight: true, trace: t},
+		outstanding:              f.PayloadSize,
+	}, nil
+}
+
+func (r *bytesResponse) Mark(err error) {
+	r.Do(func() {
+		r.err = err
+		doMark(err, r)
+	})
+}
+
+func (r *bytesResponse) MarkScore(err error, score float64) {
+	r.Mark(err)
+}
+
+func (r *bytesResponse) MarkBytes(err error, bytes int64) {
+	r.Mark(err)
+}
+
+func (p *bytesPool) markSuccess(r HostPoolResponse) {
+	p.settle(r)
+	p.standardHostPool.markSuccess(r)
+}
+
+func (p *bytesPool) markFailed(r HostPoolResponse) {
+	p.settle(r)
+	p.standardHostPool.markFailed(r)
+}
+
+func (p *bytesPool) markNeutral(r HostPoolResponse) {
+	p.settle(r)
+	p.standardHostPool.markNeutral(r)
+}
+
+// settle drops whatever a marked response still had outstanding
+func (p *bytesPool) settle(r HostPoolResponse) {
+	br, ok := r.(*bytesResponse)
+	if !ok {
+		return
+	}
+	p.RLock()
+	defer p.RUnlock()
+	br.bytesLock.Lock()
+	defer br.bytesLock.Unlock()
+	if h, ok := p.hosts[br.host]; ok && !br.settled {
+		atomic.AddInt64(&h.outstanding, -br.outstanding)
+	}
+	br.settled = true
+}
+
+func (p *bytesPool) OutstandingBytes() map[string]int64 {
+	p.RLock()
+	defer p.RUnlock()
+	bytes := make(map[string]int64, len(p.hostList))
+	for _, h := range p.hostList {
+		bytes[h.host] = atomic.LoadInt64(&h.outstanding)
+	}
+	return bytes
+}
@@ -0,0 +1,121 @@
+package hostpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pacing
+//
+// Bursts of Gets, like those at the top of every minute from cron jobs, can
+// go past what the hosts behind a pool can take between them even when each
+// host is within its own concurrency limit. A pool can be paced to the rate
+// its hosts are declared to handle: Gets may come at once up to a burst, and
+// beyond that are spaced out to the sustained rate, by delaying them or, if
+// they'd have to wait too long, failing them with ErrPaced.
+
+// ErrPaced is returned by GetContext when keeping to the pool's Pacing would
+// delay it longer than the Pacing allows
+var ErrPaced = errors.New("hostpool: Get is over the pool's paced rate")
+
+// Pacing configures the pacing of a pool, see SetPacing
+type Pacing struct {
+	// Rate is how many Gets a second the pool sustains, 0 for no pacing
+	Rate float64
+	// Burst is how many Gets may go at once above the rate (0 counts as 1)
+	Burst int
+	// MaxDelay is how long a GetContext may be delayed to keep to the rate,
+	// 0 for none. Those that would have to wait longer fail with ErrPaced,
+	// and those whose context is done first with its error. Get and
+	// GetWithFeatures can't fail, so they wait as long as it takes.
+	MaxDelay time.Duration
+}
+
+// PacingStats sums up the pacing of a pool's Gets since it was built
+type PacingStats struct {
+	// Delayed counts the Gets that had to wait for the rate, and Rejected
+	// those that failed with ErrPaced or gave up waiting
+	Delayed  int64
+	Rejected int64
+	// Delay is the total time Gets were delayed for
+	Delay time.Duration
+}
+
+type pacer struct {
+	sync.Mutex
+	pacing Pacing
+	tokens float64 // below 0 once Gets are waiting
+	filled time.Time
+	stats  PacingStats
+}
+
+func (p *standardHostPool) SetPacing(pacing Pacing) {
+	if pacing.Burst <= 0 {
+		pacing.Burst = 1
+	}
+	pc := &p.pacer
+	pc.Lock()
+	defer pc.Unlock()
+	pc.pacing = pacing
+	pc.tokens = float64(pacing.Burst)
+	pc.filled = time.Now()
+	paced := int32(0)
+	if pacing.Rate > 0 {
+		paced = 1
+	}
+	atomic.StoreInt32(&p.paced, paced)
+}
+
+func (p *standardHostPool) PacingStatistics() PacingStats {
+	pc := &p.pacer
+	pc.Lock()
+	defer pc.Unlock()
+	return pc.stats
+}
+
+// pace holds up a Get until the pool's pacing lets it through
+func (p *standardHostPool) pace(ctx context.Context) error {
+	if atomic.LoadInt32(&p.paced) == 0 {
+		return nil
+	}
+	pc := &p.pacer
+	pc.Lock()
+	now := time.Now()
+	pc.tokens += now.Sub(pc.filled).Seconds() * pc.pacing.Rate
+	if pc.tokens > float64(pc.pacing.Burst) {
+		pc.tokens = float64(pc.pacing.Burst)
+	}
+	pc.filled = now
+	// take a token now, and wait until it would have been there
+	pc.tokens--
+	if pc.tokens >= 0 {
+		pc.Unlock()
+		return nil
+	}
+	wait := time.Duration(-pc.tokens / pc.pacing.Rate * float64(time.Second))
+	if wait > pc.pacing.MaxDelay && !fromGet(ctx) {
+		pc.tokens++
+		pc.stats.Rejected++
+		pc.Unlock()
+		return ErrPaced
+	}
+	pc.stats.Delayed++
+	pc.stats.Delay += wait
+	pc.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		pc.Lock()
+		pc.tokens++
+		pc.stats.Rejected++
+		pc.Unlock()
+		return ctx.Err()
+	}
+}
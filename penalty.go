@@ -0,0 +1,63 @@
+package hostpool
+
+import (
+	"time"
+)
+
+// Error penalties
+//
+// Out of the box a failure only puts a host in the dead pool: until then, and
+// once it's back, the host is scored on its successful requests alone. With a
+// penalty set for a class of error, every failed request of that class also
+// goes into the host's score as a request that took the penalty, so a host
+// that keeps timing out or throttling loses traffic in proportion to how often
+// it does, rather than all at once. Penalties might be a few seconds for
+// timeouts, less for host errors and less again for throttling.
+//
+// Throttled requests don't otherwise affect a host, so a Throttled penalty is
+// the only way they count against it. The same goes for PartialSuccess, whose
+// requests count as successes with their penalty scored alongside their
+// response time. Canceled and RequestError penalties are never applied.
+
+func (p *epsilonGreedyHostPool) SetErrorPenalty(class ErrorClass, penalty time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if penalty <= 0 {
+		delete(p.penalties, class)
+		return
+	}
+	if p.penalties == nil {
+		p.penalties = make(map[ErrorClass]float64)
+	}
+	p.penalties[class] = penalty.Seconds() * 1000
+}
+
+// markNeutral applies any Throttled penalty
+func (p *epsilonGreedyHostPool) markNeutral(hostR HostPoolResponse) {
+	p.standardHostPool.markNeutral(hostR)
+	eHostR, ok := hostR.(*epsilonHostPoolResponse)
+	if !ok || p.errorClass(eHostR.err) != Throttled || !p.sampled() {
+		return
+	}
+	h := p.lockTimings(eHostR.host)
+	if h == nil {
+		return
+	}
+	defer p.unlockTimings(h)
+	p.recordPenalty(h, Throttled, eHostR.class)
+}
+
+// recordPenalty scores a failed (or partly successful) request with the
+// penalty for its class, if there is one. It should only be called between lockTimings and
+// unlockTimings
+func (p *epsilonGreedyHostPool) recordPenalty(h *hostEntry, c ErrorClass, class string) {
+	penalty, ok := p.penalties[c]
+	if !ok {
+		return
+	}
+	p.recordScore(h, penalty)
+	h.penaltyCounts[h.epsilonIndex]++
+	if class != "" {
+		p.recordClassScore(h, class, penalty)
+	}
+}
@@ -0,0 +1,185 @@
+package hostpool
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Performance mode
+//
+// By default every Get on an epsilon greedy pool takes the pool's lock and
+// works out a weighted average for every host, which is fine for most clients
+// but makes the pool the bottleneck in front of something like an in memory
+// cache. In performance mode the pool instead publishes an immutable snapshot
+// of its live hosts after every decay tick and health change, with the tick's
+// traffic shares loaded into an alias table, and Get only reads that snapshot:
+//
+//   - picking by score is an O(1) alias table sample
+//   - exploring is an atomic round robin over the live hosts
+//   - in flight counts are atomic and marks on healthy hosts take read locks
+//
+// Get only falls back to the locked path to retry a dead host whose retry is
+// due, or when there are no live hosts at all. The trade off is freshness:
+// scores only change once per decay tick, the exploration strategy is read
+// once per tick (and told about exploration once per tick it happened in),
+// and request features, MinExploration and least recently tried exploration
+// are not used. BenchmarkPerformanceMode keeps track of the cost per Get.
+
+type hostSnapshot struct {
+	live    []*hostEntry // alive hosts, for exploring
+	scored  []*hostEntry // alive hosts with a share of traffic
+	alias   aliasTable   // over scored
+	epsilon float32
+	retryAt time.Time // earliest retry of a dead host, zero if none are dead
+}
+
+func (p *epsilonGreedyHostPool) SetPerformanceMode(enabled bool) {
+	p.Lock()
+	defer p.Unlock()
+	if !enabled {
+		atomic.StoreInt32(&p.performance, 0)
+		return
+	}
+	p.startDecay()
+	p.scoreHosts()
+	atomic.StoreInt32(&p.performance, 1)
+	p.rebuildSnapshot()
+}
+
+// rebuildSnapshot should only be called when the lock has already been
+// acquired
+func (p *epsilonGreedyHostPool) rebuildSnapshot() {
+	if atomic.LoadInt32(&p.performance) == 0 {
+		return
+	}
+	snap := &hostSnapshot{epsilon: p.exploration.Epsilon()}
+	var weights []float64
+	for _, h := range p.hostList {
+		if h.endpoint.Draining {
+			continue
+		}
+		if h.dead {
+			if snap.retryAt.IsZero() || h.nextRetry.Before(snap.retryAt) {
+				snap.retryAt = h.nextRetry
+			}
+			continue
+		}
+		snap.live = append(snap.live, h)
+		if h.tickPercentage > 0 {
+			snap.scored = append(snap.scored, h)
+			weights = append(weights, h.tickPercentage)
+		}
+	}
+	snap.alias = newAliasTable(weights)
+	p.snapshot.Store(snap)
+}
+
+var fastRands = sync.Pool{
+	New: func() interface{} {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	},
+}
+
+// getFast returns nil when the locked path needs to pick instead
+func (p *epsilonGreedyHostPool) getFast() *epsilonHostPoolResponse {
+	snap, _ := p.snapshot.Load().(*hostSnapshot)
+	if snap == nil || len(snap.live) == 0 {
+		return nil
+	}
+	now := time.Now()
+	if !snap.retryAt.IsZero() && !now.Before(snap.retryAt) {
+		return p.getDueRetry(now)
+	}
+
+	r := fastRands.Get().(*rand.Rand)
+	var h *hostEntry
+	if len(snap.scored) == 0 || r.Float32() < snap.epsilon {
+		atomic.AddInt64(&p.fastExplored, 1)
+		next := atomic.AddUint64(&p.fastNext, 1)
+		h = snap.live[next%uint64(len(snap.live))]
+	} else {
+		h = snap.scored[snap.alias.pick(r)]
+	}
+	fastRands.Put(r)
+
+	atomic.AddInt64(&h.inFlight, 1)
+	return &epsilonHostPoolResponse{
+		standardHostPoolResponse: standardHostPoolResponse{host: h.host, pool: p, inFlight: true},
+		started:                  now,
+	}
+}
+
+// getDueRetry hands out a dead host whose retry time has passed, so it gets
+// its chance even though the snapshot doesn't include it
+func (p *epsilonGreedyHostPool) getDueRetry(now time.Time) *epsilonHostPoolResponse {
+	p.Lock()
+	defer p.Unlock()
+	for _, h := range p.hostList {
+		if h.dead && !h.endpoint.Draining && h.nextRetry.Before(now) {
+			p.retryHost(h)
+			atomic.AddInt64(&h.inFlight, 1)
+			return &epsilonHostPoolResponse{
+				standardHostPoolResponse: standardHostPoolResponse{host: h.host, pool: p, inFlight: true},
+				started:                  now,
+			}
+		}
+	}
+	// someone else got to it first
+	p.rebuildSnapshot()
+	return nil
+}
+
+// aliasTable samples from a discrete distribution in constant time, using
+// Vose's alias method
+type aliasTable struct {
+	prob  []float64
+	alias []int
+}
+
+func newAliasTable(weights []float64) aliasTable {
+	n := len(weights)
+	t := aliasTable{prob: make([]float64, n), alias: make([]int, n)}
+	if n == 0 {
+		return t
+	}
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	scaled := make([]float64, n)
+	var small, large []int
+	for i, w := range weights {
+		scaled[i] = w * float64(n) / sum
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+	for len(small) > 0 && len(large) > 0 {
+		s, l := small[len(small)-1], large[len(large)-1]
+		small = small[:len(small)-1]
+		t.prob[s] = scaled[s]
+		t.alias[s] = l
+		scaled[l] = scaled[l] + scaled[s] - 1
+		if scaled[l] < 1 {
+			large = large[:len(large)-1]
+			small = append(small, l)
+		}
+	}
+	// whatever is left is 1 up to rounding
+	for _, i := range append(small, large...) {
+		t.prob[i] = 1
+	}
+	return t
+}
+
+func (t aliasTable) pick(r *rand.Rand) int {
+	i := r.Intn(len(t.prob))
+	if r.Float64() < t.prob[i] {
+		return i
+	}
+	return t.alias[i]
+}
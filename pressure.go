@@ -0,0 +1,164 @@
+package hostpool
+
+import (
+	"sync"
+	"time"
+)
+
+// Pressure
+//
+// Autoscalers usually scale a fleet on what its servers report about
+// themselves, which misses what clients see: hosts that are up but too slow,
+// requests queueing for capacity, or hosts the clients have given up on. A
+// pool's pressure sums that up, and MonitorPressure reports it at regular
+// intervals to a PressureSink, eg. one that publishes it as a custom metric
+// for an autoscaler to scale on.
+
+// Pressure is a point in time view of how hard a pool's hosts are pushed, as
+// its client sees them
+type Pressure struct {
+	Time time.Time
+	// HealthyFraction is the fraction of the pool's hosts that are alive, 0
+	// for a pool with no hosts
+	HealthyFraction float64
+	// Saturated and Waiting are from SaturationStatistics
+	Saturated bool
+	Waiting   int64
+	// InFlight is the requests in flight across the pool, and Utilization
+	// the fraction of the live hosts' concurrency limits they take up (0 if
+	// any live host has no limit)
+	InFlight    int64
+	Utilization float64
+	// Latency is the mean of the live hosts' SuccessLatency, and MaxLatency
+	// the slowest of them; both are 0 for pools that don't time requests.
+	// Pools don't keep latency quantiles, so the slowest host stands in for
+	// the tail.
+	Latency    time.Duration
+	MaxLatency time.Duration
+	// LatencyTrend is Latency over its average across the monitor's earlier
+	// reports: above 1 while latency climbs, below 1 while it falls, and 1
+	// until there's anything to compare with (or from PressureOf)
+	LatencyTrend float64
+}
+
+// PressureOf works out a pool's pressure as of now
+func PressureOf(p HostPool) Pressure {
+	sat := p.SaturationStatistics()
+	pr := Pressure{
+		Time:         time.Now(),
+		Saturated:    sat.Saturated,
+		Waiting:      sat.Waiting,
+		LatencyTrend: 1,
+	}
+	var live, timed int
+	var limits int64
+	limited := true
+	var latency time.Duration
+	stats := p.Statistics()
+	for _, s := range stats {
+		pr.InFlight += s.InFlight
+		if s.Dead {
+			continue
+		}
+		live++
+		if s.ConcurrencyLimit > 0 {
+			limits += int64(s.ConcurrencyLimit)
+		} else {
+			limited = false
+		}
+		if s.SuccessLatency > 0 {
+			timed++
+			latency += s.SuccessLatency
+			if s.SuccessLatency > pr.MaxLatency {
+				pr.MaxLatency = s.SuccessLatency
+			}
+		}
+	}
+	if len(stats) > 0 {
+		pr.HealthyFraction = float64(live) / float64(len(stats))
+	}
+	if live > 0 && limited {
+		pr.Utilization = float64(pr.InFlight) / float64(limits)
+	}
+	if timed > 0 {
+		pr.Latency = latency / time.Duration(timed)
+	}
+	return pr
+}
+
+// PressureSink receives a pool's pressure from MonitorPressure
+type PressureSink interface {
+	HandlePressure(Pressure)
+}
+
+// PressureSinkFunc lets an ordinary function be used as a PressureSink
+type PressureSinkFunc func(Pressure)
+
+func (f PressureSinkFunc) HandlePressure(pr Pressure) {
+	f(pr)
+}
+
+// pressureTrendWeight is how much each report counts towards the average
+// latency that LatencyTrend compares with
+const pressureTrendWeight = 0.2
+
+// PressureMonitor reports a pool's pressure at regular intervals, see
+// MonitorPressure
+type PressureMonitor struct {
+	pool    HostPool
+	sink    PressureSink
+	average float64 // of Latency, in nanoseconds, 0 until the first report
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// MonitorPressure hands the pressure of p to sink every interval, from a
+// goroutine of its own, until it's closed
+func MonitorPressure(p HostPool, interval time.Duration, sink PressureSink) *PressureMonitor {
+	m := &PressureMonitor{
+		pool:    p,
+		sink:    sink,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go m.run(interval)
+	return m
+}
+
+func (m *PressureMonitor) run(interval time.Duration) {
+	defer close(m.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+		m.sink.HandlePressure(m.report())
+	}
+}
+
+// report works out the pool's pressure along with its latency trend
+func (m *PressureMonitor) report() Pressure {
+	pr := PressureOf(m.pool)
+	latency := float64(pr.Latency)
+	if latency == 0 {
+		return pr
+	}
+	if m.average > 0 {
+		pr.LatencyTrend = latency / m.average
+		m.average += pressureTrendWeight * (latency - m.average)
+	} else {
+		m.average = latency
+	}
+	return pr
+}
+
+// Close stops the reports
+func (m *PressureMonitor) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+	<-m.stopped
+}
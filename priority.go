@@ -0,0 +1,119 @@
+package hostpool
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Priorities
+//
+// Gets carry a priority (RequestFeatures.Priority), and a pool can treat
+// each priority its own way: requests that matter kept away from hosts that
+// are throttling and hedged to cut their tail latency, while background
+// requests keep off the fastest hosts so there's headroom on them when it's
+// needed. Priorities without a policy are picked as usual, throttled hosts
+// and all, and so absorb the throttling requests that matter pass over.
+
+// PriorityPolicy is how a pool treats Gets of one priority, see
+// SetPriorityPolicy
+type PriorityPolicy struct {
+	// HedgeDelay makes DoPriority hedge requests of the priority after it,
+	// as DoHedged does. 0 doesn't hedge.
+	HedgeDelay time.Duration
+	// AvoidThrottled passes over hosts that throttled a request in the last
+	// AvoidThrottled
+	AvoidThrottled time.Duration
+	// AvoidFastest is the fraction of the scored live hosts to pass over,
+	// fastest first, eg. 0.25 to keep requests off the fastest quarter. Only
+	// pools that score hosts, like epsilon greedy ones, know which they are.
+	AvoidFastest float64
+}
+
+// SetPriorityPolicy sets how Gets of priority are treated. Hosts are only
+// passed over while others can be picked, so a policy never leaves a Get
+// with nothing to pick. A zero PriorityPolicy goes back to picking as usual.
+func (p *standardHostPool) SetPriorityPolicy(priority int, policy PriorityPolicy) {
+	p.Lock()
+	defer p.Unlock()
+	if policy == (PriorityPolicy{}) {
+		delete(p.priorities, priority)
+	} else {
+		if p.priorities == nil {
+			p.priorities = make(map[int]PriorityPolicy)
+		}
+		p.priorities[priority] = policy
+	}
+	set := int32(0)
+	if len(p.priorities) > 0 {
+		set = 1
+	}
+	atomic.StoreInt32(&p.prioritiesSet, set)
+}
+
+func (p *standardHostPool) priorityPolicy(priority int) PriorityPolicy {
+	p.RLock()
+	defer p.RUnlock()
+	return p.priorities[priority]
+}
+
+// usePriority passes over the hosts the policy for f's priority avoids for
+// the Get being picked, unless that would leave no live host to pick, and
+// reports whether it did. It should only be called when the lock has already
+// been acquired, after any filter is in place, and p.avoid cleared before
+// it's released.
+func (p *standardHostPool) usePriority(f RequestFeatures) bool {
+	policy, ok := p.priorities[f.Priority]
+	if !ok {
+		return false
+	}
+	now := p.now()
+	avoid := make(map[*hostEntry]bool)
+	var live []*hostEntry
+	for _, h := range p.hostList {
+		if h.dead || p.excluded(h) {
+			continue
+		}
+		if throttled := atomic.LoadInt64(&h.throttled); policy.AvoidThrottled > 0 && throttled != 0 &&
+			now.Sub(time.Unix(0, throttled)) < policy.AvoidThrottled {
+			avoid[h] = true
+			continue
+		}
+		live = append(live, h)
+	}
+	left := len(live)
+	if left == 0 {
+		return false
+	}
+	if policy.AvoidFastest > 0 && p.hostScore != nil {
+		var scored []*hostEntry
+		scores := make(map[*hostEntry]float64, len(live))
+		for _, h := range live {
+			if s := p.hostScore(h); s > 0 {
+				scored = append(scored, h)
+				scores[h] = s
+			}
+		}
+		sort.Slice(scored, func(i, j int) bool { return scores[scored[i]] < scores[scored[j]] })
+		n := int(policy.AvoidFastest * float64(len(scored)))
+		if n >= left {
+			n = left - 1
+		}
+		for _, h := range scored[:n] {
+			avoid[h] = true
+		}
+	}
+	if len(avoid) == 0 {
+		return false
+	}
+	p.avoid = avoid
+	return true
+}
+
+// noteThrottled records when a host last throttled a request
+func (p *standardHostPool) noteThrottled(h *hostEntry, r HostPoolResponse) {
+	m, ok := r.(interface{ markedErr() error })
+	if ok && p.errorClass(m.markedErr()) == Throttled {
+		atomic.StoreInt64(&h.throttled, time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,81 @@
+package hostpool
+
+import (
+	"time"
+)
+
+// HostPrior is a learned score for a host, as saved by Priors: its weighted
+// average response time in milliseconds (mixed with any MarkScore scores). It
+// encodes to JSON for saving between runs.
+type HostPrior struct {
+	Host  string  `json:"host"`
+	Score float64 `json:"score"`
+}
+
+// a prior counts as this many requests to begin with if SetPriors isn't
+// given a weight
+const defaultPriorWeight = 10
+
+// priors are dropped once they are worth less than this
+const minPriorWeight = 0.01
+
+func (p *epsilonGreedyHostPool) Priors() []HostPrior {
+	p.RLock()
+	defer p.RUnlock()
+	var priors []HostPrior
+	for _, h := range p.hostList {
+		if v := h.getWeightedAverageResponseTime(); v > 0 {
+			priors = append(priors, HostPrior{Host: h.host, Score: v})
+		}
+	}
+	return priors
+}
+
+func (p *epsilonGreedyHostPool) SetPriors(priors []HostPrior, weight float64) {
+	if weight <= 0 {
+		weight = defaultPriorWeight
+	}
+	p.Lock()
+	defer p.Unlock()
+	for _, prior := range priors {
+		h, ok := p.hosts[prior.Host]
+		if !ok || !validScore(prior.Score) {
+			continue
+		}
+		h.priorScore, h.priorWeight = prior.Score, weight
+	}
+	p.hostsChanged()
+}
+
+// SeedScore gives a host, typically one just added, a prior of avgLatency,
+// eg. copied from a peer in the same rack, weighted as for SetPriors. Without
+// one a new host has nothing to be scored on until its first requests come
+// back. It reports whether the host is in the pool.
+func (p *epsilonGreedyHostPool) SeedScore(host string, avgLatency time.Duration, weight float64) bool {
+	p.RLock()
+	_, ok := p.hosts[host]
+	p.RUnlock()
+	if ok {
+		p.SetPriors([]HostPrior{{Host: host, Score: avgLatency.Seconds() * 1000}}, weight)
+	}
+	return ok
+}
+
+// decayPrior halves the weight of the host's prior, once per decay tick, so
+// that it has faded out well before the response times of a decay duration
+// have
+func (h *hostEntry) decayPrior() {
+	h.priorWeight /= 2
+	if h.priorWeight < minPriorWeight {
+		h.priorScore, h.priorWeight = 0, 0
+	}
+}
+
+// withPrior mixes the host's prior into the weighted average response time
+// avg, worked out from count requests
+func (h *hostEntry) withPrior(avg float64, count int64) float64 {
+	if h.priorWeight == 0 {
+		return avg
+	}
+	return (avg*float64(count) + h.priorScore*h.priorWeight) / (float64(count) + h.priorWeight)
+}
@@ -0,0 +1,70 @@
+package hostpool
+
+import (
+	"math/rand"
+	"time"
+)
+
+// New host ramp
+//
+// A host added to a pool that's already serving traffic starts with cold
+// caches, connection pools and JITs, and its full share of requests straight
+// away can be more than it can take. With a ramp set, a host added to a pool
+// that already has hosts gets a share of its traffic that grows in step with
+// the time since it was added, from a twentieth up to all of it once the ramp
+// is over. Round robin gives the rest of the host's turns to the other hosts
+// in turn; pools that pick by weight scale its weight by the share.
+
+// minRampShare is the share of its traffic a host gets as its ramp starts
+const minRampShare = 0.05
+
+// SetNewHostRamp ramps up the traffic to hosts added from then on over ramp.
+// 0 turns it off, and hosts still ramping go straight to their full share.
+func (p *standardHostPool) SetNewHostRamp(ramp time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.newHostRamp = ramp
+}
+
+// rampShare is the share of its traffic h gets, and should only be called
+// when the lock (or read lock) has already been acquired
+func (p *standardHostPool) rampShare(h *hostEntry, now time.Time) float64 {
+	if p.newHostRamp <= 0 || h.added.IsZero() {
+		return 1
+	}
+	share := float64(now.Sub(h.added)) / float64(p.newHostRamp)
+	switch {
+	case share >= 1:
+		return 1
+	case share < minRampShare:
+		return minRampShare
+	}
+	return share
+}
+
+// rampedOut decides whether round robin should pass over h this time, and
+// should only be called when the lock has already been acquired
+func (p *standardHostPool) rampedOut(h *hostEntry, now time.Time) bool {
+	share := p.rampShare(h, now)
+	if share >= 1 {
+		return false
+	}
+	r := fastRands.Get().(*rand.Rand)
+	v := r.Float64()
+	fastRands.Put(r)
+	return v >= share
+}
+
+// standIn is the next live host to take the turn of a ramping host round
+// robin passed over, or nil if there are none that aren't ramping themselves.
+// It should only be called when the lock has already been acquired
+func (p *standardHostPool) standIn(now time.Time) *hostEntry {
+	for range p.hostList {
+		h := p.hostList[p.standInIndex%len(p.hostList)]
+		p.standInIndex++
+		if !h.dead && !p.excluded(h) && p.rampShare(h, now) >= 1 {
+			return h
+		}
+	}
+	return nil
+}
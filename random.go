@@ -0,0 +1,98 @@
+package hostpool
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// randomPool picks a host uniformly at random: a couple of random picks, in
+// case the first is dead, and then a scan from a random start
+type randomPool struct {
+	*standardHostPool
+	rand *rand.Rand // only used under the lock
+}
+
+// randomRetries is how many more random picks are made when the first is a
+// host that can't be tried, before scanning for one
+const randomRetries = 2
+
+// NewRandom is a pool that picks among its live hosts uniformly at random.
+// It's the simplest pool there is, a baseline to compare the others with,
+// and it suits large fleets of clients that start together: each seeds its
+// picks from the time it was built, so they don't march through the hosts in
+// step the way round robin clients can, sending their load in waves.
+func NewRandom(hosts []string) HostPool {
+	return &randomPool{
+		standardHostPool: New(hosts).(*standardHostPool),
+		rand:             rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *randomPool) Get() HostPoolResponse {
+	return p.GetWithFeatures(RequestFeatures{})
+}
+
+func (p *randomPool) GetWithFeatures(f RequestFeatures) HostPoolResponse {
+	r, err := p.GetContext(forGet, f)
+	return orNoHost(p, r, err)
+}
+
+func (p *randomPool) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	return p.getRefreshed(ctx, f, func() (HostPoolResponse, error) { return p.getContext(ctx, f) })
+}
+
+func (p *randomPool) getContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	if err := p.waitForHosts(ctx); err != nil {
+		return nil, err
+	}
+	if err := p.waitForCapacity(ctx); err != nil {
+		return nil, err
+	}
+	if f.Filter != nil {
+		if !p.useFilter(f.Filter) {
+			return nil, ErrNoHosts
+		}
+		defer func() { p.filter = nil }()
+	}
+	if p.usePriority(f) {
+		defer func() { p.avoid = nil }()
+	}
+	host := p.getRandom()
+	atomic.AddInt64(&p.hosts[host].inFlight, 1)
+	t := requestTrace(ctx, f)
+	p.emit(Event{Kind: EventSelected, Host: host, Trace: t})
+	r := &standardHostPoolResponse{host: host, pool: p, inFlight: true, trace: t}
+	p.watchLeaks(r)
+	return r, nil
+}
+
+// getRandom should only be called when the lock has already been acquired
+func (p *randomPool) getRandom() string {
+	now := p.now()
+	n := len(p.hostList)
+	for i := 0; i <= randomRetries; i++ {
+		if h := p.hostList[p.rand.Intn(n)]; h.canTryHost(now) && !p.excluded(h) {
+			return p.picked(h)
+		}
+	}
+	start := p.rand.Intn(n)
+	for i := range p.hostList {
+		if h := p.hostList[(start+i)%n]; h.canTryHost(now) && !p.excluded(h) {
+			return p.picked(h)
+		}
+	}
+	// all hosts are down, let round robin re-add them
+	return p.getRoundRobin()
+}
+
+// picked should only be called when the lock has already been acquired
+func (p *randomPool) picked(h *hostEntry) string {
+	if h.dead {
+		p.retryHost(h)
+	}
+	return h.host
+}
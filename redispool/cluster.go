@@ -0,0 +1,169 @@
+package redispool
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// Slots is the number of hash slots a Redis Cluster splits keys over
+const Slots = 16384
+
+// SlotRange is a range of slots, Start to End inclusive, and the nodes
+// (host:port) serving them, as reported by CLUSTER SLOTS or CLUSTER SHARDS
+type SlotRange struct {
+	Start, End int
+	Master     string
+	Replicas   []string
+}
+
+// Topology fetches the slot ranges of a cluster, eg. by sending CLUSTER SLOTS
+// to any node
+type Topology func(ctx context.Context) ([]SlotRange, error)
+
+// Cluster routes commands to the nodes of a Redis Cluster by the slot of
+// their key. Every node is a host in the pool, so node health is learned from
+// all of the commands sent to it whatever slot they're for, and a node that
+// fails goes in the dead pool as usual. MOVED and ASK replies mean the slots
+// have moved, and refresh the topology in the background.
+type Cluster struct {
+	*Pool
+	topology Topology
+
+	mu         sync.RWMutex
+	ranges     []SlotRange // by Start
+	refreshing int32       // 1 while a background refresh runs
+	wg         sync.WaitGroup
+}
+
+// refreshTimeout bounds background refreshes of the topology
+const refreshTimeout = 5 * time.Second
+
+// NewCluster builds a Cluster with the pool and dial function as New does,
+// over the nodes topology reports. It fails if the topology can't be fetched.
+func NewCluster(topology Topology, dial func(addr string) (Client, error), newPool func(hosts []string) hostpool.HostPool) (*Cluster, error) {
+	c := &Cluster{Pool: New(nil, dial, newPool), topology: topology}
+	if err := c.Refresh(context.Background()); err != nil {
+		c.Pool.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Refresh fetches the topology again and updates the pool's hosts to its
+// nodes
+func (c *Cluster) Refresh(ctx context.Context) error {
+	ranges, err := c.topology(ctx)
+	if err != nil {
+		return err
+	}
+	ranges = append([]SlotRange(nil), ranges...)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, r := range ranges {
+		for _, node := range append([]string{r.Master}, r.Replicas...) {
+			if !seen[node] {
+				seen[node] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	c.mu.Lock()
+	c.ranges = ranges
+	c.mu.Unlock()
+	c.pool.SetHosts(nodes)
+	return nil
+}
+
+// refreshSoon refreshes the topology in the background, unless a refresh is
+// already running
+func (c *Cluster) refreshSoon() {
+	if !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer atomic.StoreInt32(&c.refreshing, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		c.Refresh(ctx)
+	}()
+}
+
+// GetForSlot returns a client for a node serving key's slot: its master, or
+// for reads any of its live nodes, replicas included. Commands sent to a
+// replica need READONLY set on its connection, which is up to the client.
+// It returns hostpool.ErrNoHosts if no node serves the slot.
+func (c *Cluster) GetForSlot(key string, read bool) (*Conn, error) {
+	c.mu.RLock()
+	r, ok := c.lookup(Slot(key))
+	c.mu.RUnlock()
+	if !ok {
+		return nil, hostpool.ErrNoHosts
+	}
+	// compared as the pool has them
+	allowed := map[string]bool{hostpool.ParseHost(r.Master).String(): true}
+	if read {
+		for _, node := range r.Replicas {
+			allowed[hostpool.ParseHost(node).String()] = true
+		}
+	}
+	conn, err := c.get(hostpool.RequestFeatures{Filter: func(h hostpool.Host) bool {
+		return allowed[h.String()]
+	}})
+	if err != nil {
+		return nil, err
+	}
+	conn.redirected = c.refreshSoon
+	return conn, nil
+}
+
+// lookup should only be called when the read lock has already been acquired
+func (c *Cluster) lookup(slot int) (SlotRange, bool) {
+	i := sort.Search(len(c.ranges), func(i int) bool { return c.ranges[i].End >= slot })
+	if i < len(c.ranges) && c.ranges[i].Start <= slot {
+		return c.ranges[i], true
+	}
+	return SlotRange{}, false
+}
+
+// Close waits for any background refresh and closes the pool
+func (c *Cluster) Close() {
+	c.wg.Wait()
+	c.Pool.Close()
+}
+
+// Slot returns the hash slot of key: the CRC16 of the key, or of its hash tag
+// (the part between the first { and the } after it, if not empty), modulo
+// Slots
+func Slot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % Slots
+}
+
+// crc16 is CRC-16/XMODEM, as Redis Cluster uses
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,239 @@
+// Package redispool keeps one client per Redis host and hands them out from a
+// hostpool. It works with any client library: clients are built by a Dial
+// function and only need to be closable, and replies are classified by their
+// error text, which every client passes through from the server. Cluster
+// routes by hash slot over the nodes of a Redis Cluster.
+package redispool
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// Client is a connection (or connection pool) to a single Redis host, eg. a
+// *redis.Client or a redigo *redis.Pool
+type Client interface {
+	Close() error
+}
+
+// Pool hands out one client per host
+type Pool struct {
+	pool hostpool.HostPool
+	dial func(addr string) (Client, error)
+
+	sync.Mutex
+	clients map[string]Client
+	dialing map[string]*pendingDial // one dial at a time per host
+	closed  bool
+}
+
+// pendingDial is a dial in progress, which Gets for the same host wait for
+// rather than dialing again
+type pendingDial struct {
+	done   chan struct{} // closed once client and err are set
+	client Client
+	err    error
+}
+
+// ErrClosed is returned by Get for a dial that finishes after Close
+var ErrClosed = errors.New("redispool: pool is closed")
+
+// Conn is the client for a host handed out by Get. Mark it with the result of
+// the commands sent through it.
+type Conn struct {
+	Addr   string
+	Client Client
+	resp   hostpool.HostPoolResponse
+	pool   *Pool
+	// redirected is told about MOVED and ASK replies, see Cluster
+	redirected func()
+}
+
+// New builds a Pool over addrs. Clients are dialed on first use of each host,
+// and dialed again after a failure. newPool builds the underlying hostpool,
+// nil uses hostpool.New.
+func New(addrs []string, dial func(addr string) (Client, error), newPool func(hosts []string) hostpool.HostPool) *Pool {
+	if newPool == nil {
+		newPool = hostpool.New
+	}
+	return &Pool{
+		pool:    newPool(addrs),
+		dial:    dial,
+		clients: make(map[string]Client, len(addrs)),
+		dialing: make(map[string]*pendingDial),
+	}
+}
+
+// HostPool returns the pool hosts are picked from
+func (p *Pool) HostPool() hostpool.HostPool {
+	return p.pool
+}
+
+// Get returns a ready client. Hosts that can't be dialed are marked as failed
+// and another is tried; the last dial error is returned if none can be, and
+// hostpool.ErrNoHosts if there are no hosts.
+func (p *Pool) Get() (*Conn, error) {
+	return p.get(hostpool.RequestFeatures{})
+}
+
+func (p *Pool) get(f hostpool.RequestFeatures) (*Conn, error) {
+	var err error
+	for i := 0; i == 0 || i < len(p.pool.Hosts()); i++ {
+		resp, getErr := p.pool.GetContext(context.Background(), f)
+		if getErr != nil {
+			return nil, getErr
+		}
+		var c Client
+		if c, err = p.client(resp.Host()); err != nil {
+			resp.Mark(err)
+			continue
+		}
+		return &Conn{Addr: resp.Host(), Client: c, resp: resp, pool: p}, nil
+	}
+	return nil, err
+}
+
+// client returns the client for addr, dialing it without the lock held so
+// that a slow host only holds up the Gets waiting for it
+func (p *Pool) client(addr string) (Client, error) {
+	p.Lock()
+	if c, ok := p.clients[addr]; ok {
+		p.Unlock()
+		return c, nil
+	}
+	if d, ok := p.dialing[addr]; ok {
+		p.Unlock()
+		<-d.done
+		return d.client, d.err
+	}
+	d := &pendingDial{done: make(chan struct{})}
+	p.dialing[addr] = d
+	p.Unlock()
+
+	d.client, d.err = p.dial(addr)
+
+	p.Lock()
+	delete(p.dialing, addr)
+	if d.err == nil {
+		switch c, ok := p.clients[addr]; {
+		case p.closed:
+			d.client.Close()
+			d.client, d.err = nil, ErrClosed
+		case ok:
+			// someone got there first, keep theirs
+			d.client.Close()
+			d.client = c
+		default:
+			p.clients[addr] = d.client
+		}
+	}
+	p.Unlock()
+	close(d.done)
+	return d.client, d.err
+}
+
+// Mark reports the result of a command, classified with Classify. Replies
+// that show the host is up and answering - redirects, nil replies and errors
+// about the command itself - count as successes. Failures close the host's
+// client, so it is dialed again when the host is retried.
+func (c *Conn) Mark(err error) {
+	switch Classify(err) {
+	case Redirect:
+		if c.redirected != nil && !strings.HasPrefix(err.Error(), "TRYAGAIN") {
+			c.redirected()
+		}
+		err = nil
+	case ReplyError:
+		err = nil
+	case ReadOnly, Loading, Failure:
+		c.pool.drop(c.Addr, c.Client)
+	}
+	c.resp.Mark(err)
+}
+
+func (p *Pool) drop(addr string, c Client) {
+	p.Lock()
+	defer p.Unlock()
+	if p.clients[addr] == c {
+		delete(p.clients, addr)
+		c.Close()
+	}
+}
+
+// Close closes the hostpool and every client
+func (p *Pool) Close() {
+	p.pool.Close()
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	for addr, c := range p.clients {
+		c.Close()
+		delete(p.clients, addr)
+	}
+}
+
+// Class is what an error from a Redis command says about the host
+type Class int
+
+const (
+	// Success is a nil error
+	Success Class = iota
+	// Redirect is a MOVED or ASK reply: the host is fine, but the key lives
+	// elsewhere in the cluster
+	Redirect
+	// ReadOnly is a READONLY reply, from a host that was demoted to a replica
+	ReadOnly
+	// Loading is a LOADING or MASTERDOWN reply, from a host that is up but
+	// can't serve yet
+	Loading
+	// ReplyError is any other error reply from the server (ERR, WRONGTYPE,
+	// NOSCRIPT...) or a nil reply, which are about the command, not the host
+	ReplyError
+	// Failure is everything else: network errors, timeouts, closed clients
+	Failure
+)
+
+// nilReplies are the errors client libraries return for a nil reply
+var nilReplies = map[string]bool{
+	"redis: nil":           true, // go-redis
+	"redigo: nil returned": true, // redigo
+}
+
+// replyPrefixes are the error codes Redis uses for errors about a command
+var replyPrefixes = []string{
+	"ERR", "WRONGTYPE", "NOSCRIPT", "NOAUTH", "NOPERM", "WRONGPASS", "EXECABORT",
+	"BUSYGROUP", "NOGROUP", "CROSSSLOT", "UNKILLABLE", "NOTBUSY",
+}
+
+// Classify works out what err says about the host that returned it
+func Classify(err error) Class {
+	if err == nil {
+		return Success
+	}
+	msg := err.Error()
+	if nilReplies[msg] {
+		return ReplyError
+	}
+	code := msg
+	if i := strings.IndexByte(msg, ' '); i >= 0 {
+		code = msg[:i]
+	}
+	switch code {
+	case "MOVED", "ASK", "TRYAGAIN":
+		return Redirect
+	case "READONLY":
+		return ReadOnly
+	case "LOADING", "MASTERDOWN", "CLUSTERDOWN":
+		return Loading
+	}
+	for _, p := range replyPrefixes {
+		if code == p {
+			return ReplyError
+		}
+	}
+	return Failure
+}
@@ -0,0 +1,152 @@
+package redispool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClient struct {
+	addr   string
+	closed bool
+}
+
+func (c *fakeClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPool(t *testing.T) {
+	dials := map[string]int{}
+	p := New([]string{"a:6379", "b:6379"}, func(addr string) (Client, error) {
+		dials[addr]++
+		if addr == "b:6379" {
+			return nil, errors.New("connection refused")
+		}
+		return &fakeClient{addr: addr}, nil
+	}, nil)
+	defer p.Close()
+
+	for i := 0; i < 4; i++ {
+		c, err := p.Get()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, c.Addr, "a:6379")
+		c.Mark(errors.New("MOVED 3999 10.0.0.1:6381"))
+	}
+	assert.Equal(t, dials["a:6379"], 1)
+	assert.Equal(t, dials["b:6379"], 1)
+
+	// failures close the client, and the next Get dials a new one
+	c, _ := p.Get()
+	c.Mark(errors.New("READONLY You can't write against a read only replica."))
+	assert.Equal(t, c.Client.(*fakeClient).closed, true)
+
+	_, err := p.Get()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, dials["a:6379"], 2)
+}
+
+func TestPoolSlowDial(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var slowDials int32
+	p := New([]string{"a:6379", "b:6379"}, func(addr string) (Client, error) {
+		if addr == "b:6379" {
+			if atomic.AddInt32(&slowDials, 1) == 1 {
+				close(started)
+			}
+			<-release
+		}
+		return &fakeClient{addr: addr}, nil
+	}, nil)
+	defer p.Close()
+
+	clients := make(chan Client, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, _ := p.client("b:6379")
+			clients <- c
+		}()
+	}
+	<-started
+	// other hosts don't wait for b's dial
+	done := make(chan struct{})
+	go func() {
+		p.client("a:6379")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dialing a waited for b")
+	}
+
+	// and b is only dialed once, for both Gets
+	close(release)
+	c1, c2 := <-clients, <-clients
+	assert.True(t, c1 != nil && c1 == c2)
+	assert.Equal(t, atomic.LoadInt32(&slowDials), int32(1))
+}
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, Classify(nil), Success)
+	assert.Equal(t, Classify(errors.New("ASK 3999 10.0.0.1:6381")), Redirect)
+	assert.Equal(t, Classify(errors.New("READONLY You can't write against a read only replica.")), ReadOnly)
+	assert.Equal(t, Classify(errors.New("LOADING Redis is loading the dataset in memory")), Loading)
+	assert.Equal(t, Classify(errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")), ReplyError)
+	assert.Equal(t, Classify(errors.New("redis: nil")), ReplyError)
+	assert.Equal(t, Classify(errors.New("dial tcp 10.0.0.1:6379: i/o timeout")), Failure)
+}
+
+func TestCluster(t *testing.T) {
+	var fetches int32
+	topology := func(ctx context.Context) ([]SlotRange, error) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			return []SlotRange{
+				{Start: 8192, End: Slots - 1, Master: "m2:6379"},
+				{Start: 0, End: 8191, Master: "m1:6379", Replicas: []string{"r1:6379"}},
+			}, nil
+		}
+		return []SlotRange{{Start: 0, End: Slots - 1, Master: "m1:6379"}}, nil
+	}
+	c, err := NewCluster(topology, func(addr string) (Client, error) {
+		return &fakeClient{addr: addr}, nil
+	}, nil)
+	assert.Equal(t, err, nil)
+	defer c.Close()
+	assert.ElementsMatch(t, c.HostPool().Hosts(), []string{"m1:6379", "r1:6379", "m2:6379"})
+
+	assert.Equal(t, Slot("foo"), 12182)
+	assert.Equal(t, Slot("{user1000}.following"), Slot("{user1000}.followers"))
+	assert.Equal(t, Slot("{}bar"), int(crc16("{}bar"))%Slots)
+
+	for i := 0; i < 4; i++ {
+		conn, err := c.GetForSlot("foo", false)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, conn.Addr, "m2:6379")
+		conn.Mark(nil)
+	}
+	reads := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		conn, _ := c.GetForSlot("bar", true) // slot 5061
+		reads[conn.Addr] = true
+		conn.Mark(nil)
+	}
+	assert.Equal(t, reads, map[string]bool{"m1:6379": true, "r1:6379": true})
+
+	// a MOVED reply refreshes the topology
+	conn, _ := c.GetForSlot("foo", false)
+	conn.Mark(errors.New("MOVED 12182 m1:6379"))
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&fetches) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.wg.Wait()
+	conn, _ = c.GetForSlot("foo", false)
+	assert.Equal(t, conn.Addr, "m1:6379")
+	conn.Mark(nil)
+	assert.Equal(t, c.HostPool().Hosts(), []string{"m1:6379"})
+}
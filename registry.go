@@ -0,0 +1,77 @@
+package hostpool
+
+import (
+	"sync"
+	"time"
+)
+
+// HostRegistry shares host health between the pools of a process that have
+// hosts in common, eg. clients of different services behind the same
+// gateway. When a host goes in the dead pool of one of its pools it becomes
+// suspect in the others: it's put in their dead pools too, but due a retry
+// straight away, so the next request to it is a probe while the rest go to
+// other hosts. A probe that succeeds brings it back, one that fails keeps it
+// dead and backs off as usual. Suspects don't count as deaths themselves, so
+// they don't spread any further, and SetMinHealthyHosts still holds.
+type HostRegistry struct {
+	sync.Mutex
+	pools []HostPool
+}
+
+// DefaultHostRegistry is a registry for pools to Join when one per process
+// will do
+var DefaultHostRegistry = NewHostRegistry()
+
+// NewHostRegistry builds a registry with no pools
+func NewHostRegistry() *HostRegistry {
+	return &HostRegistry{}
+}
+
+// Join adds p to the registry. Pools can't leave, but a closed pool stays
+// out of the way.
+func (r *HostRegistry) Join(p HostPool) {
+	r.Lock()
+	r.pools = append(r.pools, p)
+	r.Unlock()
+	p.AddHooks(HostHooks{OnHostDead: func(host string) { r.spread(p, host) }})
+}
+
+func (r *HostRegistry) spread(from HostPool, host string) {
+	r.Lock()
+	pools := r.pools
+	r.Unlock()
+	for _, p := range pools {
+		if p != from {
+			p.suspect(host)
+		}
+	}
+}
+
+// suspect puts a live host in the dead pool, due a retry, for a HostRegistry
+func (p *standardHostPool) suspect(host string) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	h, ok := p.hosts[host]
+	if !ok || h.dead {
+		return
+	}
+	if p.minHealthyHosts > 0 {
+		live := 0
+		for _, e := range p.hostList {
+			if !e.dead {
+				live++
+			}
+		}
+		if live-1 < p.minHealthyHosts {
+			return
+		}
+	}
+	p.noteMark(h, "registry", nil, 0)
+	h.dead = true
+	h.retryCount = 0
+	h.retryDelay = p.initialRetryDelay
+	h.nextRetry = time.Now()
+	p.healthChanged()
+	p.emit(Event{Kind: EventHostDead, Host: host})
+	p.logTransition(h, true, false)
+}
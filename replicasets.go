@@ -0,0 +1,206 @@
+package hostpool
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReplicaSet is a group of hosts that can stand in for each other, eg. the
+// members of one shard of a cluster, with the pool that picks among them
+type ReplicaSet struct {
+	Name string
+	Pool HostPool
+	// Weight scales the share of requests the set is given, as Host.Weight
+	// does for hosts. 0 counts as 1.
+	Weight float64
+}
+
+// ReplicaSets picks hosts in two stages: a replica set first, by how its
+// hosts are doing as a whole, and then a member of it, by the set's own pool.
+// Sets are given requests in proportion to their weight times their live
+// hosts, divided by the mean score of those hosts (their response times, for
+// epsilon greedy pools), so a set that is mostly down or slow gets little
+// traffic until it recovers. Sets whose pools don't score hosts count as
+// average. These shares are worked out again at most once a second.
+//
+// Requests that have to go to a particular set, like those for a key owned
+// by one shard, use GetFromSet.
+type ReplicaSets struct {
+	sync.Mutex
+	sets    []ReplicaSet // by name
+	shares  []float64    // cumulative, by set
+	updated time.Time
+}
+
+const replicaSetRefresh = time.Second
+
+// NewReplicaSets picks among the given sets, which should have distinct names
+func NewReplicaSets(sets ...ReplicaSet) *ReplicaSets {
+	s := &ReplicaSets{sets: append([]ReplicaSet(nil), sets...)}
+	sort.Slice(s.sets, func(i, j int) bool { return s.sets[i].Name < s.sets[j].Name })
+	return s
+}
+
+// Get picks a replica set and then a host in it. set is the name of the set
+// the host came from. The error is the set pool's, eg. ErrNoHosts, or
+// ErrNoHosts if there are no sets.
+func (s *ReplicaSets) Get(ctx context.Context, f RequestFeatures) (r HostPoolResponse, set string, err error) {
+	pool, set := s.pick()
+	if pool == nil {
+		return nil, "", ErrNoHosts
+	}
+	r, err = pool.GetContext(ctx, f)
+	return r, set, err
+}
+
+// GetFromSet gets a host from the named set, or returns ErrNoHosts if there
+// isn't one
+func (s *ReplicaSets) GetFromSet(ctx context.Context, set string, f RequestFeatures) (HostPoolResponse, error) {
+	s.Lock()
+	pool := s.lookup(set)
+	s.Unlock()
+	if pool == nil {
+		return nil, ErrNoHosts
+	}
+	return pool.GetContext(ctx, f)
+}
+
+// Set returns the pool of the named set
+func (s *ReplicaSets) Set(name string) (HostPool, bool) {
+	s.Lock()
+	defer s.Unlock()
+	pool := s.lookup(name)
+	return pool, pool != nil
+}
+
+// lookup should only be called when the lock has already been acquired
+func (s *ReplicaSets) lookup(name string) HostPool {
+	i := sort.Search(len(s.sets), func(i int) bool { return s.sets[i].Name >= name })
+	if i < len(s.sets) && s.sets[i].Name == name {
+		return s.sets[i].Pool
+	}
+	return nil
+}
+
+// ReplicaSetStats is a point in time view of a replica set
+type ReplicaSetStats struct {
+	Name string
+	// Live and Total count the set's hosts
+	Live  int
+	Total int
+	// Score is the mean score of the live hosts, 0 if none are scored
+	Score float64
+	// Share is the share of requests Get gives the set
+	Share float64
+}
+
+// Statistics returns a point in time view of each set, by name
+func (s *ReplicaSets) Statistics() []ReplicaSetStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := make([]ReplicaSetStats, len(s.sets))
+	values := s.values(stats)
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	for i := range stats {
+		stats[i].Name = s.sets[i].Name
+		if total > 0 {
+			stats[i].Share = values[i] / total
+		}
+	}
+	return stats
+}
+
+// pick chooses a set from the shares, refreshing them if they're stale
+func (s *ReplicaSets) pick() (HostPool, string) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.sets) == 0 {
+		return nil, ""
+	}
+	if now := time.Now(); now.Sub(s.updated) >= replicaSetRefresh {
+		s.updated = now
+		s.refreshShares()
+	}
+	total := s.shares[len(s.shares)-1]
+	if total <= 0 {
+		// every set is down, give them all an equal chance of recovering
+		set := s.sets[rand.Intn(len(s.sets))]
+		return set.Pool, set.Name
+	}
+	x := rand.Float64() * total
+	i := sort.Search(len(s.shares), func(i int) bool { return s.shares[i] > x })
+	if i == len(s.sets) {
+		i--
+	}
+	return s.sets[i].Pool, s.sets[i].Name
+}
+
+// refreshShares should only be called when the lock has already been acquired
+func (s *ReplicaSets) refreshShares() {
+	values := s.values(make([]ReplicaSetStats, len(s.sets)))
+	s.shares = s.shares[:0]
+	var sum float64
+	for _, v := range values {
+		sum += v
+		s.shares = append(s.shares, sum)
+	}
+}
+
+// values works out what each set is worth to Get, filling in stats along the
+// way, and should only be called when the lock has already been acquired
+func (s *ReplicaSets) values(stats []ReplicaSetStats) []float64 {
+	var scoreSum float64
+	var scored int
+	for i, set := range s.sets {
+		var sum float64
+		var n int
+		for _, h := range set.Pool.Statistics() {
+			stats[i].Total++
+			if h.Dead {
+				continue
+			}
+			stats[i].Live++
+			if h.Score > 0 {
+				sum += h.Score
+				n++
+			}
+		}
+		if n > 0 {
+			stats[i].Score = sum / float64(n)
+			scoreSum += stats[i].Score
+			scored++
+		}
+	}
+	values := make([]float64, len(s.sets))
+	for i, set := range s.sets {
+		score := stats[i].Score
+		if score == 0 {
+			if scored == 0 {
+				score = 1
+			} else {
+				score = scoreSum / float64(scored)
+			}
+		}
+		weight := set.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		values[i] = weight * float64(stats[i].Live) / score
+	}
+	return values
+}
+
+// Close closes every set's pool
+func (s *ReplicaSets) Close() {
+	s.Lock()
+	defer s.Unlock()
+	for _, set := range s.sets {
+		set.Pool.Close()
+	}
+}
@@ -0,0 +1,37 @@
+package hostpool
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Retry staggering
+//
+// Hosts that go down together, in a network partition say, come back
+// together too: they were put in the dead pool at the same moment, so they
+// are retried at the same moment, and every one of them goes from no traffic
+// to its full share at once, just as health checks pile in on them too. With
+// a stagger set, each host put in the dead pool has a random part of the
+// stagger added to its first retry, so hosts that went down together are
+// retried, and come back, spread out over it.
+
+// SetRetryStagger spreads the first retries of dead hosts over up to
+// stagger. 0 turns it off.
+func (p *standardHostPool) SetRetryStagger(stagger time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.retryStagger = stagger
+	if stagger > 0 && p.staggerRand == nil {
+		p.staggerRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+}
+
+// retryJitter is the part of the stagger a host going in the dead pool has
+// added to its first retry, and should only be called when the lock has
+// already been acquired
+func (p *standardHostPool) retryJitter() time.Duration {
+	if p.retryStagger <= 0 {
+		return 0
+	}
+	return time.Duration(p.staggerRand.Int63n(int64(p.retryStagger)))
+}
@@ -0,0 +1,147 @@
+package hostpool
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Weight schedules
+//
+// Some changes to where traffic goes are known in advance and happen every
+// day, like a region's nightly backup window. A weight schedule makes them
+// without anyone having to: each WeightProfile scales the weights of some
+// hosts during a window of the day, and the pool switches profiles in and out
+// as their windows start and end, sending EventProfileStarted and
+// EventProfileEnded to its EventSink. Schedules are checked on Get, at most
+// once a second.
+//
+// Weights only matter where the pool picks by them: epsilon greedy pools,
+// weighted random pools, connection balancers and byte balancers.
+
+// WeightProfile scales the weights of the hosts it applies to during a
+// window of the day
+type WeightProfile struct {
+	Name string
+	// Hosts picks the hosts the profile applies to, eg. HasMeta("region",
+	// "eu"); nil for all of them
+	Hosts func(Host) bool
+	// Start and End are the window, as times of day since midnight in
+	// Location (UTC if nil). A window that ends before it starts runs past
+	// midnight.
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+	// Weight multiplies the hosts' weights while the profile applies, eg.
+	// 0.1 for a tenth of their usual share. It should be above 0; anything
+	// else counts as 1.
+	Weight float64
+}
+
+// activeAt reports whether t is in the profile's window
+func (w *WeightProfile) activeAt(t time.Time) bool {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	y, m, d := t.Date()
+	since := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, loc))
+	if w.End < w.Start {
+		return since >= w.Start || since < w.End
+	}
+	return since >= w.Start && since < w.End
+}
+
+type weightSchedule struct {
+	profiles []WeightProfile
+	active   []bool // by profile
+	checked  int64  // unix nanos, accessed atomically
+}
+
+// scheduleCheck is how often Gets check the weight schedule
+const scheduleCheck = time.Second
+
+func (p *standardHostPool) SetWeightSchedule(profiles ...WeightProfile) {
+	p.Lock()
+	defer p.Unlock()
+	s := &p.schedule
+	// end the old profiles, so their events pair up
+	for i, on := range s.active {
+		if on {
+			p.profileChanged(&s.profiles[i], false)
+		}
+	}
+	s.profiles = append([]WeightProfile(nil), profiles...)
+	s.active = make([]bool, len(profiles))
+	scheduled := int32(0)
+	if len(profiles) > 0 {
+		scheduled = 1
+	}
+	atomic.StoreInt32(&p.scheduled, scheduled)
+	p.updateSchedule(time.Now())
+}
+
+func (p *standardHostPool) ActiveWeightProfiles() []string {
+	p.RLock()
+	defer p.RUnlock()
+	var names []string
+	for i, on := range p.schedule.active {
+		if on {
+			names = append(names, p.schedule.profiles[i].Name)
+		}
+	}
+	return names
+}
+
+// checkSchedule switches profiles in and out, if the schedule hasn't been
+// checked for a while
+func (p *standardHostPool) checkSchedule() {
+	if atomic.LoadInt32(&p.scheduled) == 0 {
+		return
+	}
+	now := time.Now()
+	if now.UnixNano()-atomic.LoadInt64(&p.schedule.checked) < int64(scheduleCheck) {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.updateSchedule(now)
+}
+
+// updateSchedule should only be called when the lock has already been
+// acquired
+func (p *standardHostPool) updateSchedule(now time.Time) {
+	s := &p.schedule
+	atomic.StoreInt64(&s.checked, now.UnixNano())
+	for i := range s.profiles {
+		if on := s.profiles[i].activeAt(now); on != s.active[i] {
+			s.active[i] = on
+			p.profileChanged(&s.profiles[i], on)
+		}
+	}
+}
+
+// profileChanged should only be called when the lock has already been
+// acquired
+func (p *standardHostPool) profileChanged(w *WeightProfile, on bool) {
+	kind, what := EventProfileEnded, "ended"
+	if on {
+		kind, what = EventProfileStarted, "started"
+	}
+	p.emit(Event{Kind: kind, Profile: w.Name})
+	p.logf("weight profile %s %s", w.Name, what)
+}
+
+// weight is h's Weight as scaled by any profiles in effect and its ramp (see
+// SetNewHostRamp), and should only be called when the lock (or read lock) has
+// already been acquired
+func (p *standardHostPool) weight(h *hostEntry) float64 {
+	w := h.endpoint.weight() * p.rampShare(h, time.Now())
+	s := &p.schedule
+	for i, on := range s.active {
+		if prof := &s.profiles[i]; on && validScore(prof.Weight) && (prof.Hosts == nil || prof.Hosts(h.endpoint)) {
+			w *= prof.Weight
+		}
+	}
+	return w
+}
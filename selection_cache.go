@@ -0,0 +1,92 @@
+package hostpool
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Selection caching
+//
+// Picking a host by score works out a weighted average and a calculator value
+// for every live host, on every Get. Under bursty fan out - thousands of Gets
+// within a millisecond - those values barely move between Gets, so with a
+// selection cache the pool keeps the traffic shares it worked out and reuses
+// them for a short window or a number of picks, whichever runs out first.
+// Every Get still makes its own weighted random pick from the cached shares,
+// so reuse doesn't send a burst to a single host. The cache is thrown away
+// whenever a host goes up or down and on every decay tick.
+
+// selectionCache holds the shares worked out for one request class
+type selectionCache struct {
+	hosts   []*hostEntry
+	ceiling []float64 // running total of the hosts' shares
+	expires time.Time
+	uses    int
+}
+
+// SetSelectionCache makes the pool reuse the traffic shares it works out for a
+// Get for up to window, or for up to picks more Gets, whichever comes first. A
+// limit of 0 isn't checked, and both at 0 turns caching off.
+func (p *epsilonGreedyHostPool) SetSelectionCache(window time.Duration, picks int) {
+	p.Lock()
+	defer p.Unlock()
+	p.cacheWindow = window
+	p.cachePicks = picks
+	p.selections = nil
+}
+
+// cachedPick picks a host from the cached shares for f, or returns nil if
+// there's nothing usable cached. It should only be called when the lock has
+// already been acquired
+func (p *epsilonGreedyHostPool) cachedPick(f RequestFeatures, now time.Time) *hostEntry {
+	c, ok := p.selections[f.Class]
+	if !ok || p.filter != nil || p.avoid != nil {
+		return nil
+	}
+	if (p.cacheWindow > 0 && !now.Before(c.expires)) || (p.cachePicks > 0 && c.uses >= p.cachePicks) {
+		delete(p.selections, f.Class)
+		return nil
+	}
+	c.uses++
+	return c.pick(rand.Float64())
+}
+
+// cacheSelection should only be called when the lock has already been acquired
+func (p *epsilonGreedyHostPool) cacheSelection(f RequestFeatures, now time.Time, hosts []*hostEntry) {
+	if (p.cacheWindow <= 0 && p.cachePicks <= 0) || p.filter != nil || p.avoid != nil {
+		return
+	}
+	if p.selections == nil {
+		p.selections = make(map[string]*selectionCache)
+	} else if _, ok := p.selections[f.Class]; !ok && len(p.selections) >= maxClassesPerHost {
+		return
+	}
+	c := &selectionCache{
+		hosts:   hosts,
+		ceiling: make([]float64, len(hosts)),
+		expires: now.Add(p.cacheWindow),
+		uses:    1,
+	}
+	var sum float64
+	for i, h := range hosts {
+		sum += h.epsilonPercentage
+		c.ceiling[i] = sum
+	}
+	p.selections[f.Class] = c
+}
+
+// invalidateSelections should only be called when the lock has already been
+// acquired
+func (p *epsilonGreedyHostPool) invalidateSelections() {
+	p.selections = nil
+}
+
+func (c *selectionCache) pick(pickPercentage float64) *hostEntry {
+	i := sort.SearchFloat64s(c.ceiling, pickPercentage)
+	if i == len(c.hosts) {
+		// rounding left the last ceiling a hair under 1
+		i--
+	}
+	return c.hosts[i]
+}
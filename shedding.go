@@ -0,0 +1,182 @@
+package hostpool
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load shedding
+//
+// Once most of a pool's hosts are down, or those left are slow, sending them
+// everything only makes an overload worse: requests that will time out anyway
+// still take up the capacity the rest need. With LoadShedding set, a pool
+// turns away a share of its low priority Gets (RequestFeatures.Priority) while
+// its health or latency is past a threshold, so that what capacity is left
+// goes to the requests that matter. Shed Gets fail with a *ShedError, before
+// any host is picked or any pacing is waited for. Only GetContext (and what
+// goes through it, like Do and DoPriority) sheds: Get and GetWithFeatures
+// have no way to report it, and would only hand out an empty host, so they
+// are never shed. Health and latency are checked at most every shedCheck.
+
+// LoadShedding configures the shedding of a pool's Gets, see SetLoadShedding
+type LoadShedding struct {
+	// BelowPriority is the priority Gets have to be under to be shed
+	BelowPriority int
+	// MinHealthyFraction sheds while fewer than this fraction of the pool's
+	// hosts are alive, 0 to not shed on health
+	MinHealthyFraction float64
+	// MaxLatency sheds while the mean SuccessLatency of the live hosts is
+	// over it, 0 to not shed on latency. Only pools that time requests, like
+	// epsilon greedy ones, have one.
+	MaxLatency time.Duration
+	// Fraction is the share of the low priority Gets shed while over a
+	// threshold, eg. 0.5 for half of them. 0 counts as all of them.
+	Fraction float64
+}
+
+// ShedError is returned by GetContext for a Get shed by the pool's
+// LoadShedding, with the pool's state as it was shed
+type ShedError struct {
+	Priority        int
+	HealthyFraction float64
+	Latency         time.Duration
+}
+
+func (e *ShedError) Error() string {
+	return fmt.Sprintf("hostpool: shed Get of priority %d with %.0f%% of hosts healthy and %v latency",
+		e.Priority, e.HealthyFraction*100, e.Latency)
+}
+
+// SheddingStats is a point in time view of a pool's load shedding
+type SheddingStats struct {
+	// Shedding is whether the pool is over a threshold, as of its last check
+	Shedding        bool
+	HealthyFraction float64
+	Latency         time.Duration
+	// Shed counts the Gets shed since the pool was built
+	Shed int64
+}
+
+// shedCheck is how often Gets check the pool's health for shedding
+const shedCheck = 100 * time.Millisecond
+
+type shedder struct {
+	sync.Mutex
+	policy   LoadShedding
+	checked  time.Time
+	shedding bool
+	healthy  float64
+	latency  time.Duration
+	shed     int64
+}
+
+// SetLoadShedding sets the load shedding policy of the pool, for Gets made
+// with GetContext. A zero LoadShedding turns it off.
+func (p *standardHostPool) SetLoadShedding(policy LoadShedding) {
+	if policy.Fraction <= 0 || policy.Fraction > 1 {
+		policy.Fraction = 1
+	}
+	s := &p.shedder
+	s.Lock()
+	defer s.Unlock()
+	s.policy = policy
+	s.checked = time.Time{}
+	s.shedding = false
+	on := int32(0)
+	if policy.MinHealthyFraction > 0 || policy.MaxLatency > 0 {
+		on = 1
+	}
+	atomic.StoreInt32(&p.shedding, on)
+}
+
+func (p *standardHostPool) LoadSheddingStatistics() SheddingStats {
+	s := &p.shedder
+	s.Lock()
+	defer s.Unlock()
+	return SheddingStats{Shedding: s.shedding, HealthyFraction: s.healthy, Latency: s.latency, Shed: s.shed}
+}
+
+// shed returns a *ShedError if a Get for f is to be shed
+func (p *standardHostPool) shed(ctx context.Context, f RequestFeatures) error {
+	if atomic.LoadInt32(&p.shedding) == 0 || fromGet(ctx) {
+		return nil
+	}
+	s := &p.shedder
+	s.Lock()
+	if f.Priority >= s.policy.BelowPriority {
+		s.Unlock()
+		return nil
+	}
+	if now := time.Now(); now.Sub(s.checked) >= shedCheck {
+		s.checked = now
+		s.Unlock()
+		healthy, latency := p.shedSignals()
+		s.Lock()
+		p.updateShedding(healthy, latency)
+	}
+	defer s.Unlock()
+	if !s.shedding || rand.Float64() >= s.policy.Fraction {
+		return nil
+	}
+	s.shed++
+	return &ShedError{Priority: f.Priority, HealthyFraction: s.healthy, Latency: s.latency}
+}
+
+// updateShedding should only be called when the shedder's lock has already
+// been acquired
+func (p *standardHostPool) updateShedding(healthy float64, latency time.Duration) {
+	s := &p.shedder
+	s.healthy, s.latency = healthy, latency
+	shedding := (s.policy.MinHealthyFraction > 0 && healthy < s.policy.MinHealthyFraction) ||
+		(s.policy.MaxLatency > 0 && latency > s.policy.MaxLatency)
+	if shedding != s.shedding {
+		if shedding {
+			p.logf("hostpool: shedding Gets below priority %d, %.0f%% of hosts healthy, %v latency",
+				s.policy.BelowPriority, healthy*100, latency)
+		} else {
+			p.logf("hostpool: no longer shedding Gets")
+		}
+	}
+	s.shedding = shedding
+}
+
+// shedSignals returns the fraction of hosts alive (1 for a pool with none, so
+// an empty pool is left to its EmptyPoolPolicy) and the mean latency of the
+// live ones, as Pressure works them out
+func (p *standardHostPool) shedSignals() (healthy float64, latency time.Duration) {
+	p.RLock()
+	defer p.RUnlock()
+	if len(p.hostList) == 0 {
+		return 1, 0
+	}
+	var live, timed int
+	var sum time.Duration
+	for _, h := range p.hostList {
+		if h.dead {
+			continue
+		}
+		live++
+		if p.hostLatency == nil {
+			continue
+		}
+		if l := p.hostLatency(h); l > 0 {
+			timed++
+			sum += l
+		}
+	}
+	if timed > 0 {
+		latency = sum / time.Duration(timed)
+	}
+	return float64(live) / float64(len(p.hostList)), latency
+}
+
+// getLatency is getWeightedAverageLatency taken under the host's timing lock
+func (h *hostEntry) getLatency() time.Duration {
+	h.timingLock.Lock()
+	defer h.timingLock.Unlock()
+	return msToDuration(h.getWeightedAverageLatency())
+}
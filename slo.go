@@ -0,0 +1,165 @@
+package hostpool
+
+import (
+	"sort"
+	"time"
+)
+
+// SLO is a service level objective applied to every host in a pool. Requests
+// that fail, or that succeed but take longer than Latency, are bad; the rate
+// at which each host consumes the error budget (1 - Objective) is tracked over
+// each of the Windows.
+//
+// A burn rate of 1 means the host is consuming its budget exactly as fast as
+// the objective allows, 10 means ten times as fast.
+type SLO struct {
+	// Objective is the fraction of requests that should be good, eg. 0.999
+	Objective float64
+	// Latency, if non zero, counts successful requests slower than this as
+	// bad. Only pools that time requests (epsilon greedy) can apply it.
+	Latency time.Duration
+	// Windows over which burn rates are computed; defaults to 5 minutes and 1
+	// hour. Windows that aren't positive are dropped, and the pool reports
+	// burn rates for the rest from shortest to longest.
+	Windows []time.Duration
+	// EjectBurnRate, if non zero, marks a host as failed once its burn rate
+	// exceeds this in every window and the shortest window has seen at least
+	// EjectMinRequests requests.
+	EjectBurnRate    float64
+	EjectMinRequests int64
+}
+
+var defaultSLOWindows = []time.Duration{5 * time.Minute, time.Hour}
+
+// timedResponse is implemented by responses that know how long the request
+// they were marked for took
+type timedResponse interface {
+	elapsed() (time.Duration, bool)
+}
+
+func (p *standardHostPool) SetSLO(slo SLO) {
+	p.Lock()
+	defer p.Unlock()
+	if slo.Objective <= 0 || slo.Objective >= 1 {
+		p.slo = nil
+		for _, h := range p.hostList {
+			h.burn = nil
+		}
+		return
+	}
+	windows := make([]time.Duration, 0, len(slo.Windows))
+	for _, w := range slo.Windows {
+		if w > 0 {
+			windows = append(windows, w)
+		}
+	}
+	if len(windows) == 0 {
+		windows = append(windows, defaultSLOWindows...)
+	}
+	// keep the shortest window first, it's the one EjectMinRequests applies to
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	slo.Windows = windows
+	p.slo = &slo
+	for _, h := range p.hostList {
+		h.burn = newBurnTracker(slo.Windows)
+	}
+}
+
+// observeResponse records a marked response against the SLO, and should only
+// be called when the lock has already been acquired
+func (p *standardHostPool) observeResponse(h *hostEntry, failed bool, hostR HostPoolResponse) {
+	if p.slo == nil {
+		return
+	}
+	var duration time.Duration
+	timed := false
+	if tr, ok := hostR.(timedResponse); ok {
+		duration, timed = tr.elapsed()
+	}
+	p.observeSLO(h, failed, duration, timed)
+}
+
+// observeSLO should only be called when the lock has already been acquired
+func (p *standardHostPool) observeSLO(h *hostEntry, failed bool, duration time.Duration, timed bool) {
+	if p.slo == nil {
+		return
+	}
+	bad := failed || (timed && p.slo.Latency > 0 && duration > p.slo.Latency)
+	now := time.Now()
+	h.burn.record(now, bad)
+	if !bad || h.dead || p.slo.EjectBurnRate <= 0 {
+		return
+	}
+	total, _ := h.burn.counts(now, p.slo.Windows[0])
+	if total < p.slo.EjectMinRequests {
+		return
+	}
+	for _, rate := range h.burn.burnRates(now, p.slo) {
+		if rate <= p.slo.EjectBurnRate {
+			return
+		}
+	}
+	p.ejectHost(h)
+}
+
+// burnTracker counts good and bad requests in fixed width time slots, enough
+// of them to cover the longest SLO window
+type burnTracker struct {
+	width time.Duration
+	slots []burnSlot
+}
+
+type burnSlot struct {
+	index int64
+	total int64
+	bad   int64
+}
+
+// newBurnTracker expects windows to be positive and sorted
+func newBurnTracker(windows []time.Duration) *burnTracker {
+	shortest, longest := windows[0], windows[len(windows)-1]
+	width := shortest / 10
+	if width < time.Second {
+		width = time.Second
+	}
+	return &burnTracker{
+		width: width,
+		slots: make([]burnSlot, int(longest/width)+1),
+	}
+}
+
+func (t *burnTracker) record(now time.Time, bad bool) {
+	index := now.UnixNano() / int64(t.width)
+	s := &t.slots[index%int64(len(t.slots))]
+	if s.index != index {
+		*s = burnSlot{index: index}
+	}
+	s.total++
+	if bad {
+		s.bad++
+	}
+}
+
+func (t *burnTracker) counts(now time.Time, window time.Duration) (total int64, bad int64) {
+	current := now.UnixNano() / int64(t.width)
+	oldest := current - int64(window/t.width)
+	for _, s := range t.slots {
+		if s.index > oldest && s.index <= current {
+			total += s.total
+			bad += s.bad
+		}
+	}
+	return total, bad
+}
+
+func (t *burnTracker) burnRates(now time.Time, slo *SLO) []float64 {
+	rates := make([]float64, len(slo.Windows))
+	budget := 1 - slo.Objective
+	for i, w := range slo.Windows {
+		total, bad := t.counts(now, w)
+		if total > 0 {
+			rates[i] = float64(bad) / float64(total) / budget
+		}
+	}
+	return rates
+}
@@ -0,0 +1,118 @@
+// Package sqlpool balances reads across database/sql replica handles with a
+// hostpool, skipping replicas that fail until they are due a retry.
+package sqlpool
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/bitly/go-hostpool"
+)
+
+// ReplicaPool hands out replicas from a set of *sql.DB handles
+type ReplicaPool struct {
+	pool hostpool.HostPool
+	dbs  map[string]*sql.DB
+}
+
+// Replica is a replica handed out by Get. Mark it with the result of using it,
+// as with any hostpool response.
+type Replica struct {
+	Name string
+	DB   *sql.DB
+	resp hostpool.HostPoolResponse
+}
+
+// New builds a ReplicaPool over replicas, keyed by a name for each (usually
+// its address). newPool builds the underlying hostpool from the names, eg.
+// to use an epsilon greedy pool; nil uses hostpool.New.
+func New(replicas map[string]*sql.DB, newPool func(hosts []string) hostpool.HostPool) *ReplicaPool {
+	names := make([]string, 0, len(replicas))
+	dbs := make(map[string]*sql.DB, len(replicas))
+	for name, db := range replicas {
+		names = append(names, name)
+		dbs[name] = db
+	}
+	sort.Strings(names)
+	if newPool == nil {
+		newPool = hostpool.New
+	}
+	return &ReplicaPool{pool: newPool(names), dbs: dbs}
+}
+
+// HostPool returns the pool replicas are picked from, for its statistics and
+// tuning
+func (p *ReplicaPool) HostPool() hostpool.HostPool {
+	return p.pool
+}
+
+// Get returns a replica to use. With no replicas, the Replica has a nil DB.
+func (p *ReplicaPool) Get() *Replica {
+	resp := p.pool.Get()
+	return &Replica{Name: resp.Host(), DB: p.dbs[resp.Host()], resp: resp}
+}
+
+// GetContext is Get that returns hostpool.ErrNoHosts if there are no
+// replicas, or waits for one if the pool's EmptyPoolPolicy says to
+func (p *ReplicaPool) GetContext(ctx context.Context) (*Replica, error) {
+	resp, err := p.pool.GetContext(ctx, hostpool.RequestFeatures{})
+	if err != nil {
+		return nil, err
+	}
+	return &Replica{Name: resp.Host(), DB: p.dbs[resp.Host()], resp: resp}, nil
+}
+
+// Mark reports the result of using the replica. sql.ErrNoRows and
+// sql.ErrTxDone count as successes, and context cancellation or deadlines
+// count for nothing either way.
+func (r *Replica) Mark(err error) {
+	if !IsReplicaError(err) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		err = nil
+	}
+	r.resp.Mark(err)
+}
+
+// IsReplicaError reports whether err should count against the replica that
+// returned it
+func IsReplicaError(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, sql.ErrNoRows),
+		errors.Is(err, sql.ErrTxDone),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
+
+// QueryContext runs a query on a replica, marking it with the result. Errors
+// reading the rows are not seen by the pool; use Get to mark those too.
+func (p *ReplicaPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	r, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	r.Mark(err)
+	return rows, err
+}
+
+// ExecContext runs a statement on a replica, marking it with the result
+func (p *ReplicaPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	r, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.DB.ExecContext(ctx, query, args...)
+	r.Mark(err)
+	return res, err
+}
+
+// Close closes the underlying hostpool. The replica handles belong to the
+// caller and are left open.
+func (p *ReplicaPool) Close() {
+	p.pool.Close()
+}
@@ -0,0 +1,84 @@
+package sqlpool
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDriver fails every query on connections opened with the name "down"
+type fakeDriver struct{}
+
+type fakeConn struct{ down bool }
+
+type fakeStmt struct{ down bool }
+
+type fakeRows struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{down: name == "down"}, nil
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{down: c.down}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.down {
+		return nil, errors.New("connection refused")
+	}
+	return driver.RowsAffected(0), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.down {
+		return nil, errors.New("connection refused")
+	}
+	return fakeRows{}, nil
+}
+
+func (fakeRows) Columns() []string              { return nil }
+func (fakeRows) Close() error                   { return nil }
+func (fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("sqlpool-fake", fakeDriver{})
+}
+
+func TestReplicaPool(t *testing.T) {
+	up, _ := sql.Open("sqlpool-fake", "up")
+	down, _ := sql.Open("sqlpool-fake", "down")
+	p := New(map[string]*sql.DB{"up": up, "down": down}, nil)
+	defer p.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		p.ExecContext(ctx, "SELECT 1")
+	}
+	for _, s := range p.HostPool().Statistics() {
+		assert.Equal(t, s.Dead, s.Host == "down")
+	}
+	for i := 0; i < 10; i++ {
+		rows, err := p.QueryContext(ctx, "SELECT 1")
+		assert.Equal(t, err, nil)
+		rows.Close()
+	}
+
+	r := p.Get()
+	assert.Equal(t, r.Name, "up")
+	r.Mark(sql.ErrNoRows)
+	assert.Equal(t, p.Get().Name, "up")
+}
+
+func TestIsReplicaError(t *testing.T) {
+	assert.Equal(t, IsReplicaError(nil), false)
+	assert.Equal(t, IsReplicaError(sql.ErrNoRows), false)
+	assert.Equal(t, IsReplicaError(context.Canceled), false)
+	assert.Equal(t, IsReplicaError(driver.ErrBadConn), true)
+}
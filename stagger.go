@@ -0,0 +1,35 @@
+package hostpool
+
+import (
+	"hash/fnv"
+	"os"
+	"strconv"
+)
+
+// StaggerRoundRobin starts round robin at an offset into the hosts worked out
+// from instance, or from the machine's hostname and the process ID if
+// instance is empty, rather than at the first host. A fleet of clients that
+// all start (or all see every host come back) at once then spread their
+// first requests over the hosts instead of all sending them to the same one.
+// The offset is the same every time for the same instance.
+func (p *standardHostPool) StaggerRoundRobin(instance string) {
+	if instance == "" {
+		hostname, _ := os.Hostname()
+		instance = hostname + "/" + strconv.Itoa(os.Getpid())
+	}
+	h := fnv.New32a()
+	h.Write([]byte(instance))
+	p.Lock()
+	defer p.Unlock()
+	p.startOffset = int(h.Sum32() & 0x7fffffff)
+	p.nextHostIndex = p.startIndex()
+}
+
+// startIndex is where round robin starts, and should only be called when the
+// lock has already been acquired
+func (p *standardHostPool) startIndex() int {
+	if len(p.hostList) == 0 {
+		return 0
+	}
+	return p.startOffset % len(p.hostList)
+}
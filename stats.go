@@ -0,0 +1,137 @@
+package hostpool
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// HostStats is a point in time view of a single host in a HostPool, as
+// returned by Statistics.
+type HostStats struct {
+	Host      string
+	Dead      bool
+	NextRetry time.Time
+	// InFlight is the number of responses handed out by Get that have not
+	// been marked yet
+	InFlight int64
+	// Successes, Failures and Ignored count the responses marked, and
+	// outcomes passed to MarkBatch, since the host joined the pool: by whether
+	// they succeeded (including with a RequestError), failed, or were
+	// Throttled or Canceled
+	Successes int64
+	Failures  int64
+	Ignored   int64
+	// Dropped counts the responses leak detection found dropped without
+	// being marked, which are also counted as Ignored (see SetLeakDetection)
+	Dropped int64
+
+	// Weighted average response times over the decay duration for successful
+	// and failed requests. These are only tracked by epsilon greedy pools, and
+	// leave out requests marked with MarkScore.
+	SuccessLatency time.Duration
+	FailureLatency time.Duration
+	// TimingAnomalies counts the response times left out for being negative
+	// or longer than SetMaxTiming allows, for epsilon greedy pools
+	TimingAnomalies int64
+
+	// Score is the weighted average the host is scored on by epsilon greedy
+	// pools: response times in milliseconds mixed with any MarkScore scores.
+	Score float64
+	// SampledScore is the score averaged over the samples alone, without
+	// filling in the decay ticks that had none with the ones before, and
+	// Confidence how far it can be trusted: near 1 with plenty of recent
+	// samples, falling to 0 as they age or dwindle. Both are for epsilon
+	// greedy pools, and leave out priors.
+	SampledScore float64
+	Confidence   float64
+	// Throughput is the host's throughput in bytes per second, for epsilon
+	// greedy pools marked with MarkBytes
+	Throughput float64
+	// ExplorationPicks counts how often an epsilon greedy pool picked the host
+	// to explore, rather than by score, since the start of the current decay
+	// duration.
+	ExplorationPicks int64
+	// EpsilonValue is the value the calculator gave the host at the last decay
+	// tick, and EpsilonPercentage the share of scored traffic that works out
+	// to. Both are 0 for hosts that were down or had no response times.
+	EpsilonValue      float64
+	EpsilonPercentage float64
+	// CooldownUntil is when the host's current cooldown ends, or zero if it
+	// isn't cooling down (see Cooldown)
+	CooldownUntil time.Time
+	// ConcurrencyLimit is how many requests the host may have in flight, as
+	// set or learned (see Limits), or 0 for no limit
+	ConcurrencyLimit int
+	// CertNotAfter is when the host's certificate expires, if it has been
+	// reported with ReportCertExpiry
+	CertNotAfter time.Time
+
+	// BurnRates holds the error budget burn rate for each of the pool's SLO
+	// windows, or nil if no SLO is set.
+	BurnRates []float64
+}
+
+// Range calls f with each host and its stats, in the pool's order, until f
+// returns false. They are a snapshot taken at once, and the pool isn't locked
+// while f runs, so f can take its time without holding up Gets.
+func (p *standardHostPool) Range(f func(host Host, stats HostStats) bool) {
+	rangeHosts(p.rangeSnapshot(p.hostStats), f)
+}
+
+func (p *epsilonGreedyHostPool) Range(f func(host Host, stats HostStats) bool) {
+	rangeHosts(p.rangeSnapshot(p.epsilonHostStats), f)
+}
+
+type rangedHost struct {
+	host  Host
+	stats HostStats
+}
+
+// rangeSnapshot copies out every host with its stats, as worked out by stats
+func (p *standardHostPool) rangeSnapshot(stats func(h *hostEntry, now time.Time) HostStats) []rangedHost {
+	p.RLock()
+	defer p.RUnlock()
+	snap := make([]rangedHost, len(p.hostList))
+	now := time.Now()
+	for i, h := range p.hostList {
+		snap[i] = rangedHost{host: h.endpoint, stats: stats(h, now)}
+	}
+	return snap
+}
+
+func rangeHosts(snap []rangedHost, f func(host Host, stats HostStats) bool) {
+	for _, s := range snap {
+		if !f(s.host, s.stats) {
+			return
+		}
+	}
+}
+
+// hostStats should only be called when the lock has already been acquired
+func (p *standardHostPool) hostStats(h *hostEntry, now time.Time) HostStats {
+	s := HostStats{
+		Host:      h.host,
+		Dead:      h.dead,
+		NextRetry: h.nextRetry,
+		InFlight:  atomic.LoadInt64(&h.inFlight),
+		Successes: atomic.LoadInt64(&h.marks[markSucceeded]),
+		Failures:  atomic.LoadInt64(&h.marks[markFailed]),
+		Ignored:   atomic.LoadInt64(&h.marks[markIgnored]),
+		Dropped:   atomic.LoadInt64(&h.dropped),
+		// set even for plain pools, since nothing but reports changes it
+		CertNotAfter: h.certNotAfter,
+	}
+	if h.limiter != nil {
+		s.ConcurrencyLimit = h.limiter.Limit()
+	} else {
+		s.ConcurrencyLimit = p.limits.MaxInFlight
+	}
+	if p.slo != nil {
+		s.BurnRates = h.burn.burnRates(now, p.slo)
+	}
+	return s
+}
+
+func msToDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
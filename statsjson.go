@@ -0,0 +1,125 @@
+package hostpool
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WriteStatsJSON writes the state of p in the JSON shape of nsqd's /stats
+// endpoint, so tooling built for it (dashboards, nagios checks) can read it
+// as is:
+//
+//	{"status_code": 200, "status_txt": "OK", "data": {
+//		"health": "OK", "status": "healthy",
+//		"host_count": 2, "live_count": 2, "dead_count": 0, "in_flight": 1,
+//		"hosts": [{"host": "a:4150", "dead": false, "success_count": 10, ...}]
+//	}}
+//
+// health is "OK" as long as the pool is Ready. Times are unix seconds, 0 if
+// unset, and latencies are in milliseconds.
+func WriteStatsJSON(w io.Writer, p HostPool) error {
+	return json.NewEncoder(w).Encode(statsJSON(p))
+}
+
+// StatsHandler serves WriteStatsJSON, eg. on /stats
+func StatsHandler(p HostPool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		WriteStatsJSON(w, p)
+	})
+}
+
+type statsEnvelope struct {
+	StatusCode int       `json:"status_code"`
+	StatusTxt  string    `json:"status_txt"`
+	Data       poolStats `json:"data"`
+}
+
+type poolStats struct {
+	poolGauges
+	Hosts []hostStatsJSON `json:"hosts"`
+}
+
+type poolGauges struct {
+	Health    string `json:"health"`
+	Status    string `json:"status"`
+	HostCount int    `json:"host_count"`
+	LiveCount int    `json:"live_count"`
+	DeadCount int    `json:"dead_count"`
+	InFlight  int64  `json:"in_flight"`
+}
+
+type hostStatsJSON struct {
+	Host             string  `json:"host"`
+	Dead             bool    `json:"dead"`
+	NextRetry        int64   `json:"next_retry"`
+	InFlight         int64   `json:"in_flight"`
+	RequestCount     int64   `json:"request_count"`
+	SuccessCount     int64   `json:"success_count"`
+	FailureCount     int64   `json:"failure_count"`
+	IgnoredCount     int64   `json:"ignored_count"`
+	SuccessLatency   float64 `json:"success_latency_ms"`
+	FailureLatency   float64 `json:"failure_latency_ms"`
+	Score            float64 `json:"score"`
+	ExplorationPicks int64   `json:"exploration_picks"`
+	EpsilonValue     float64 `json:"epsilon_value"`
+	EpsilonPercent   float64 `json:"epsilon_percentage"`
+	CooldownUntil    int64   `json:"cooldown_until"`
+	CertNotAfter     int64   `json:"cert_not_after"`
+}
+
+func statsJSON(p HostPool) statsEnvelope {
+	health := p.Health()
+	data := poolStats{
+		poolGauges: poolGauges{
+			Health:    "OK",
+			Status:    health.Status.String(),
+			HostCount: health.Total,
+			LiveCount: health.Live,
+			DeadCount: health.Total - health.Live,
+		},
+		Hosts: []hostStatsJSON{},
+	}
+	if !health.Ready() {
+		data.Health = "unhealthy"
+	}
+	for _, s := range p.Statistics() {
+		data.InFlight += s.InFlight
+		if !s.Dead {
+			// left over from when it last was
+			s.NextRetry = time.Time{}
+		}
+		data.Hosts = append(data.Hosts, hostStatsJSON{
+			Host:             s.Host,
+			Dead:             s.Dead,
+			NextRetry:        unixOrZero(s.NextRetry),
+			InFlight:         s.InFlight,
+			RequestCount:     s.Successes + s.Failures + s.Ignored,
+			SuccessCount:     s.Successes,
+			FailureCount:     s.Failures,
+			IgnoredCount:     s.Ignored,
+			SuccessLatency:   durationToMs(s.SuccessLatency),
+			FailureLatency:   durationToMs(s.FailureLatency),
+			Score:            s.Score,
+			ExplorationPicks: s.ExplorationPicks,
+			EpsilonValue:     s.EpsilonValue,
+			EpsilonPercent:   s.EpsilonPercentage,
+			CooldownUntil:    unixOrZero(s.CooldownUntil),
+			CertNotAfter:     unixOrZero(s.CertNotAfter),
+		})
+	}
+	return statsEnvelope{StatusCode: 200, StatusTxt: "OK", Data: data}
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func durationToMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
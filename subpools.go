@@ -0,0 +1,214 @@
+package hostpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Sub-pools
+//
+// Callers of different kinds sharing a pool, like a batch job and a latency
+// critical API in the same process, shouldn't be able to use up each other's
+// share of it. A SubPool gives each a quota of its own - requests in flight
+// and Gets per second - over a View, so they still share everything learned
+// about the hosts.
+
+// ErrQuotaExceeded is returned by a SubPool's GetContext when it's at its
+// quota and the Quota says not to wait
+var ErrQuotaExceeded = errors.New("hostpool: sub-pool is at its quota")
+
+// Quota limits what a SubPool may use of its pool
+type Quota struct {
+	// MaxInFlight is how many requests the sub-pool may have in flight
+	// across all its hosts, 0 for no limit
+	MaxInFlight int
+	// Rate is how many Gets a second the sub-pool may make, 0 for no limit,
+	// with up to Burst (0 counts as 1) of them at once
+	Rate  float64
+	Burst int
+	// Wait makes GetContext wait for the quota, until its context is done,
+	// rather than return ErrQuotaExceeded straight away. Get waits for as
+	// long as it takes.
+	Wait bool
+}
+
+// SubPoolStats is a point in time view of a SubPool's quota
+type SubPoolStats struct {
+	Name     string
+	InFlight int
+	// Waiting is the number of Gets waiting for the quota right now
+	Waiting int
+	// Granted and Rejected count the Gets that got the quota and those that
+	// didn't, since the sub-pool was built
+	Granted  int64
+	Rejected int64
+}
+
+// SubPool is a View with a quota of its own, see NewSubPool
+type SubPool struct {
+	name  string
+	view  *View
+	quota Quota
+
+	sync.Mutex
+	inFlight int
+	tokens   float64
+	refilled time.Time
+	waiting  int
+	granted  int64
+	rejected int64
+	freed    chan struct{} // closed when a request in flight is marked
+}
+
+// NewSubPool builds a sub-pool called name, getting hosts from v within q.
+// Use NewView(p, nil) for all of a pool's hosts.
+func NewSubPool(name string, v *View, q Quota) *SubPool {
+	if q.Burst <= 0 {
+		q.Burst = 1
+	}
+	return &SubPool{name: name, view: v, quota: q, tokens: float64(q.Burst), refilled: time.Now()}
+}
+
+// Name returns the name the sub-pool was built with
+func (s *SubPool) Name() string {
+	return s.name
+}
+
+// Get is GetContext without a context or features
+func (s *SubPool) Get() HostPoolResponse {
+	r, err := s.GetContext(forGet, RequestFeatures{})
+	return orNoHost(s.view.parts[0].pool, r, err)
+}
+
+// GetContext gets a host from the sub-pool's view once the quota allows. The
+// response counts against the quota until it's marked.
+func (s *SubPool) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	r, err := s.view.GetContext(ctx, f)
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	return &subPoolResponse{HostPoolResponse: r, sub: s}, nil
+}
+
+// Hosts returns the hosts of the sub-pool's view
+func (s *SubPool) Hosts() []string {
+	return s.view.Hosts()
+}
+
+// Statistics returns the state of the sub-pool's quota
+func (s *SubPool) Statistics() SubPoolStats {
+	s.Lock()
+	defer s.Unlock()
+	return SubPoolStats{
+		Name:     s.name,
+		InFlight: s.inFlight,
+		Waiting:  s.waiting,
+		Granted:  s.granted,
+		Rejected: s.rejected,
+	}
+}
+
+// acquire takes a request in flight and a token from the quota, waiting for
+// them if the quota says to
+func (s *SubPool) acquire(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+	for {
+		now := time.Now()
+		s.refill(now)
+		full := s.quota.MaxInFlight > 0 && s.inFlight >= s.quota.MaxInFlight
+		limited := s.quota.Rate > 0 && s.tokens < 1
+		if !full && !limited {
+			s.inFlight++
+			if s.quota.Rate > 0 {
+				s.tokens--
+			}
+			s.granted++
+			return nil
+		}
+		if !s.quota.Wait {
+			s.rejected++
+			return ErrQuotaExceeded
+		}
+
+		var freed chan struct{}
+		if full {
+			if s.freed == nil {
+				s.freed = make(chan struct{})
+			}
+			freed = s.freed
+		}
+		var timer *time.Timer
+		var next <-chan time.Time
+		if limited {
+			timer = time.NewTimer(time.Duration((1 - s.tokens) / s.quota.Rate * float64(time.Second)))
+			next = timer.C
+		}
+		s.waiting++
+		s.Unlock()
+		select {
+		case <-freed:
+		case <-next:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		s.Lock()
+		s.waiting--
+		if ctx.Err() != nil {
+			s.rejected++
+			return ctx.Err()
+		}
+	}
+}
+
+// refill should only be called when the lock has already been acquired
+func (s *SubPool) refill(now time.Time) {
+	if s.quota.Rate <= 0 {
+		return
+	}
+	s.tokens += now.Sub(s.refilled).Seconds() * s.quota.Rate
+	if s.tokens > float64(s.quota.Burst) {
+		s.tokens = float64(s.quota.Burst)
+	}
+	s.refilled = now
+}
+
+func (s *SubPool) release() {
+	s.Lock()
+	defer s.Unlock()
+	s.inFlight--
+	if s.freed != nil {
+		close(s.freed)
+		s.freed = nil
+	}
+}
+
+// subPoolResponse gives back its sub-pool's quota when it's marked
+type subPoolResponse struct {
+	HostPoolResponse
+	sub  *SubPool
+	once sync.Once
+}
+
+func (r *subPoolResponse) Mark(err error) {
+	r.HostPoolResponse.Mark(err)
+	r.once.Do(r.sub.release)
+}
+
+func (r *subPoolResponse) MarkScore(err error, score float64) {
+	r.HostPoolResponse.MarkScore(err, score)
+	r.once.Do(r.sub.release)
+}
+
+func (r *subPoolResponse) MarkBytes(err error, bytes int64) {
+	r.HostPoolResponse.MarkBytes(err, bytes)
+	r.once.Do(r.sub.release)
+}
@@ -0,0 +1,84 @@
+package hostpool
+
+import (
+	"time"
+)
+
+// Throughput scoring
+//
+// For bulk transfers, like fetching objects from storage, response times
+// mostly say how big the objects were. What matters is how fast each host
+// moves bytes, so responses can be marked with the bytes they transferred
+// with MarkBytes, and the ThroughputEpsilonValueCalculator scores hosts on
+// their throughput over the decay duration instead of their response times.
+
+// throughputTimings holds the bytes moved and the time taken to move them,
+// bucketed like the host's response times. Hosts only get one once they're
+// marked with MarkBytes.
+type throughputTimings struct {
+	bytes []float64
+	ms    []float64
+}
+
+// ThroughputEpsilonValueCalculator scores hosts on their throughput in bytes
+// per second, as marked with MarkBytes. Hosts that haven't had any bytes
+// marked over the decay duration get next to no traffic beyond exploration,
+// so mark every request of a pool using it with MarkBytes.
+type ThroughputEpsilonValueCalculator struct{}
+
+func (c *ThroughputEpsilonValueCalculator) CalcValueFromAvgResponseTime(v float64) float64 {
+	// only called without metrics, which this calculator needs
+	return minEpsilonValue
+}
+
+func (c *ThroughputEpsilonValueCalculator) CalcValueFromMetrics(m HostMetrics) float64 {
+	return m.Throughput
+}
+
+func (r *standardHostPoolResponse) MarkBytes(err error, bytes int64) {
+	// plain pools don't time requests
+	r.Mark(err)
+}
+
+func (r *epsilonHostPoolResponse) MarkBytes(err error, bytes int64) {
+	r.Do(func() {
+		r.ended = time.Now()
+		r.err = err
+		r.bytes = bytes
+		doMark(err, r)
+	})
+}
+
+// recordThroughput should only be called between lockTimings and
+// unlockTimings
+func (p *epsilonGreedyHostPool) recordThroughput(h *hostEntry, bytes int64, duration time.Duration) {
+	t := h.timings()
+	if t.throughput == nil {
+		t.throughput = &throughputTimings{
+			bytes: make([]float64, epsilonBuckets),
+			ms:    make([]float64, epsilonBuckets),
+		}
+	}
+	t.throughput.bytes[h.epsilonIndex] += float64(bytes)
+	t.throughput.ms[h.epsilonIndex] += duration.Seconds() * 1000
+}
+
+// getThroughput is the host's throughput in bytes per second over the decay
+// duration, with later buckets weighted up as for response times, or 0 if it
+// hasn't been marked with any bytes
+func (h *hostEntry) getThroughput() float64 {
+	if h.hostTimings == nil || h.throughput == nil {
+		return 0
+	}
+	var bytes, ms float64
+	for i := 1; i <= epsilonBuckets; i++ {
+		pos := (h.epsilonIndex + i) % epsilonBuckets
+		weight := float64(i) / float64(epsilonBuckets)
+		bytes += weight * h.throughput.bytes[pos]
+		ms += weight * h.throughput.ms[pos]
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return bytes / ms * 1000
+}
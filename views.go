@@ -0,0 +1,222 @@
+package hostpool
+
+import (
+	"context"
+	"math/rand"
+)
+
+// Views
+//
+// A View is the part of a pool that a predicate allows, eg. the hosts in one
+// zone. Gets through it only pick from those hosts, but everything learned
+// from them (health, response times, scores) is the pool's, and shared with
+// every other view of it and with Gets on the pool itself. So call sites can
+// have policies of their own - local zone only, canaries excluded - without
+// each learning about the hosts from scratch.
+//
+// Views pick the way their pool does, limited to the hosts allowed. With
+// every allowed host down they are all brought back, rather than every host
+// in the pool; Limits are still waited for across the whole pool.
+
+// View is a filtered view of one or more pools, see NewView
+type View struct {
+	parts []viewPart
+}
+
+type viewPart struct {
+	pool HostPool
+	keep func(Host) bool
+}
+
+// NewView is a view of the hosts in p that keep returns true for (all of
+// them, if keep is nil)
+func NewView(p HostPool, keep func(Host) bool) *View {
+	return &View{parts: []viewPart{{pool: p, keep: keep}}}
+}
+
+// HasMeta allows the hosts whose Meta has value for key, eg. to make a view
+// of a zone
+func HasMeta(key, value string) func(Host) bool {
+	return func(h Host) bool {
+		v, ok := h.Meta[key]
+		return ok && v == value
+	}
+}
+
+// Filter narrows the view to the hosts that keep also returns true for
+func (v *View) Filter(keep func(Host) bool) *View {
+	parts := make([]viewPart, len(v.parts))
+	for i, part := range v.parts {
+		parts[i] = viewPart{pool: part.pool, keep: both(part.keep, keep)}
+	}
+	return &View{parts: parts}
+}
+
+// Union is a view of the hosts in either view. Views of different pools each
+// keep their pool, and a Get picks one of the pools in proportion to the live
+// hosts the union allows in it, and then a host from it.
+func (v *View) Union(o *View) *View {
+	parts := append([]viewPart(nil), v.parts...)
+	for _, part := range o.parts {
+		merged := false
+		for i := range parts {
+			if parts[i].pool == part.pool {
+				parts[i].keep = either(parts[i].keep, part.keep)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			parts = append(parts, part)
+		}
+	}
+	return &View{parts: parts}
+}
+
+func both(a, b func(Host) bool) func(Host) bool {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	return func(h Host) bool { return a(h) && b(h) }
+}
+
+func either(a, b func(Host) bool) func(Host) bool {
+	if a == nil || b == nil {
+		return nil
+	}
+	return func(h Host) bool { return a(h) || b(h) }
+}
+
+// Get is GetContext without a context or features
+func (v *View) Get() HostPoolResponse {
+	r, err := v.GetContext(forGet, RequestFeatures{})
+	return orNoHost(v.parts[0].pool, r, err)
+}
+
+// GetContext picks a host the view allows, from the pool with the features
+// given; any Filter in them narrows the view further. It returns ErrNoHosts if
+// the view allows no hosts.
+func (v *View) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	part := v.parts[0]
+	if len(v.parts) > 1 {
+		part = v.pickPart()
+	}
+	f.Filter = both(part.keep, f.Filter)
+	return part.pool.GetContext(ctx, f)
+}
+
+// pickPart picks one of a union's pools, weighted by their live hosts
+func (v *View) pickPart() viewPart {
+	live := make([]int, len(v.parts))
+	sum, fallback := 0, -1
+	for i, part := range v.parts {
+		var total int
+		live[i], total = part.pool.countHosts(part.keep)
+		sum += live[i]
+		if total > 0 && fallback < 0 {
+			fallback = i
+		}
+	}
+	if sum == 0 {
+		// nothing allowed is up, let the first pool with any allowed hosts
+		// bring them back
+		if fallback < 0 {
+			fallback = 0
+		}
+		return v.parts[fallback]
+	}
+	n := rand.Intn(sum)
+	for i, l := range live {
+		if n < l {
+			return v.parts[i]
+		}
+		n -= l
+	}
+	return v.parts[len(v.parts)-1]
+}
+
+// Hosts returns the hosts the view allows
+func (v *View) Hosts() []string {
+	var hosts []string
+	for _, part := range v.parts {
+		for _, host := range part.pool.Hosts() {
+			if e, ok := part.pool.Endpoint(host); ok && (part.keep == nil || part.keep(e)) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
+
+// Statistics returns a point in time view of the hosts the view allows
+func (v *View) Statistics() []HostStats {
+	var stats []HostStats
+	for _, part := range v.parts {
+		for _, s := range part.pool.Statistics() {
+			if e, ok := part.pool.Endpoint(s.Host); ok && (part.keep == nil || part.keep(e)) {
+				stats = append(stats, s)
+			}
+		}
+	}
+	return stats
+}
+
+// countHosts returns how many hosts keep allows, and how many of those are
+// alive
+func (p *standardHostPool) countHosts(keep func(Host) bool) (live, total int) {
+	p.RLock()
+	defer p.RUnlock()
+	for _, h := range p.hostList {
+		if keep == nil || keep(h.endpoint) {
+			total++
+			if !h.dead {
+				live++
+			}
+		}
+	}
+	return live, total
+}
+
+// useFilter limits the Get being picked to the hosts filter allows, reporting
+// false if there are none. It should only be called when the lock has already
+// been acquired, and the filter cleared before it's released.
+func (p *standardHostPool) useFilter(filter func(Host) bool) bool {
+	for _, h := range p.hostList {
+		if filter(h.endpoint) {
+			p.filter = filter
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether h can't be picked for the Get being picked, and
+// should only be called when the lock has already been acquired
+func (p *standardHostPool) excluded(h *hostEntry) bool {
+	return h.endpoint.Draining || p.atLimit(h) || (p.filter != nil && !p.filter(h.endpoint)) || p.avoid[h]
+}
+
+// resetFiltered brings back the hosts the filter allows, once they're all
+// down, and returns the first. It should only be called when the lock has
+// already been acquired
+func (p *standardHostPool) resetFiltered() string {
+	var first string
+	for _, h := range p.hostList {
+		if !p.filter(h.endpoint) {
+			continue
+		}
+		if first == "" {
+			first = h.host
+		}
+		if h.dead {
+			h.dead = false
+			p.emit(Event{Kind: EventHostAlive, Host: h.host})
+			p.logTransition(h, false, true)
+		}
+	}
+	p.healthChanged()
+	return first
+}
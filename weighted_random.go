@@ -0,0 +1,98 @@
+package hostpool
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+)
+
+// weightedRandomPool picks live hosts at random in proportion to their
+// Weight, and learns nothing from how requests go beyond which hosts are dead
+type weightedRandomPool struct {
+	*standardHostPool
+	rand *rand.Rand // only used under the lock
+}
+
+// NewWeightedRandom is a pool for hosts whose Weights (see SetEndpoints) can
+// be trusted to say how much traffic each should get. Each Get picks a live
+// host at random in proportion to its weight, keeping away from the dead
+// pool as usual, but with no response times to track or score it costs
+// little, and with the same seed, hosts and marks it makes the same picks
+// every time.
+func NewWeightedRandom(hosts []string, seed int64) HostPool {
+	return &weightedRandomPool{
+		standardHostPool: New(hosts).(*standardHostPool),
+		rand:             rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (p *weightedRandomPool) Get() HostPoolResponse {
+	return p.GetWithFeatures(RequestFeatures{})
+}
+
+func (p *weightedRandomPool) GetWithFeatures(f RequestFeatures) HostPoolResponse {
+	r, err := p.GetContext(forGet, f)
+	return orNoHost(p, r, err)
+}
+
+func (p *weightedRandomPool) GetContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	return p.getRefreshed(ctx, f, func() (HostPoolResponse, error) { return p.getContext(ctx, f) })
+}
+
+func (p *weightedRandomPool) getContext(ctx context.Context, f RequestFeatures) (HostPoolResponse, error) {
+	p.Lock()
+	defer p.unlockAndNotify()
+	if err := p.waitForHosts(ctx); err != nil {
+		return nil, err
+	}
+	if err := p.waitForCapacity(ctx); err != nil {
+		return nil, err
+	}
+	if f.Filter != nil {
+		if !p.useFilter(f.Filter) {
+			return nil, ErrNoHosts
+		}
+		defer func() { p.filter = nil }()
+	}
+	if p.usePriority(f) {
+		defer func() { p.avoid = nil }()
+	}
+	host := p.getWeightedRandom()
+	atomic.AddInt64(&p.hosts[host].inFlight, 1)
+	t := requestTrace(ctx, f)
+	p.emit(Event{Kind: EventSelected, Host: host, Trace: t})
+	r := &standardHostPoolResponse{host: host, pool: p, inFlight: true, trace: t}
+	p.watchLeaks(r)
+	return r, nil
+}
+
+// getWeightedRandom should only be called when the lock has already been
+// acquired
+func (p *weightedRandomPool) getWeightedRandom() string {
+	now := p.now()
+	var sum float64
+	for _, h := range p.hostList {
+		if h.canTryHost(now) && !p.excluded(h) {
+			sum += p.weight(h)
+		}
+	}
+	if sum == 0 {
+		// all hosts are down, let round robin re-add them
+		return p.getRoundRobin()
+	}
+	x := p.rand.Float64() * sum
+	var picked *hostEntry
+	for _, h := range p.hostList {
+		if !h.canTryHost(now) || p.excluded(h) {
+			continue
+		}
+		picked = h
+		if x -= p.weight(h); x < 0 {
+			break
+		}
+	}
+	if picked.dead {
+		p.retryHost(picked)
+	}
+	return picked.host
+}